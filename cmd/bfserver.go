@@ -8,21 +8,55 @@ import (
 	"os"
 	"time"
 
+	"bfserver/machinery"
 	"bfserver/server"
 )
 
 func main() {
 	var cacheDir *string = flag.String("cacheDir", "", "A directory where downloaded content is cached.")
+	var artifactSource *string = flag.String("artifactSource", "evergreen",
+		"Where task data files come from. One of `evergreen`, `dir:<path>` or an http(s) url template with `{task}` and `{execution}` placeholders.")
+	var logSource *string = flag.String("logSource", "",
+		"Where task logs come from. Accepts the same values as `--artifactSource`, or `none`. An http(s) url template names the log file. Defaults to the artifact source, except for http(s) url templates.")
+	var maxExtractBytes *int64 = flag.Int64("maxExtractBytes", machinery.DefaultExtractor.MaxTotalSize,
+		"The most bytes of data files extracted for a single task. 0 means no limit.")
+	var cacheMaxBytes *int64 = flag.Int64("cacheMaxBytes", 0,
+		"Evict the least recently used tasks once the cache directory exceeds this many bytes. 0 means no limit.")
+	var cacheMaxAge *time.Duration = flag.Duration("cacheMaxAge", 0,
+		"Evict tasks that have not been accessed for this long, e.g: `72h`. 0 means no limit.")
+	var toolchainDir *string = flag.String("toolchainDir", "",
+		"A directory of versioned toolchains, e.g: `<dir>/v7.0/bin/{mongod,wt,ksdecode}`. Each task's dbpaths use the toolchain matching the task's revision or WiredTiger version. Defaults to $PATH.")
 	flag.Parse()
 	if *cacheDir == "" {
 		panic("A directory cache not passed in. Use --cacheDir.")
 	}
 
-	artifacts, err := server.LoadArtifacts(*cacheDir)
+	machinery.DefaultExtractor.MaxTotalSize = *maxExtractBytes
+
+	source, err := machinery.ParseArtifactSource(*artifactSource)
 	if err != nil {
 		panic(err)
 	}
-	_ = artifacts
+
+	artifacts, err := server.LoadArtifacts(*cacheDir, source)
+	if err != nil {
+		panic(err)
+	}
+	if *logSource != "" {
+		logs, err := machinery.ParseLogSource(*logSource)
+		if err != nil {
+			panic(err)
+		}
+		artifacts.SetLogSource(logs)
+	}
+	if *toolchainDir != "" {
+		toolchains, err := machinery.LoadToolchains(*toolchainDir)
+		if err != nil {
+			panic(err)
+		}
+		artifacts.SetToolchains(toolchains)
+	}
+	artifacts.EnforceCachePolicy(server.CachePolicy{MaxBytes: *cacheMaxBytes, MaxAge: *cacheMaxAge}, 10*time.Minute)
 	handler := http.NewServeMux()
 	artifacts.AddHandlers(handler)
 
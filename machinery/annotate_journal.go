@@ -2,15 +2,17 @@ package machinery
 
 import (
 	"bufio"
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
-	"os/exec"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
 
+	"github.com/pkg/errors"
 	"go.mongodb.org/mongo-driver/bson"
 )
 
@@ -47,6 +49,8 @@ type IndexInfo struct {
 	Name       string
 	Ident      string
 	Definition string
+	// The spec's `v`. See `IndexKeyStringVersion`.
+	Version int
 
 	Owner *CollectionInfo `json:"-"`
 }
@@ -55,6 +59,8 @@ type CollectionInfo struct {
 	Name            string
 	Ident           string
 	IndexNameToInfo map[string]*IndexInfo
+	// Clustered collections are keyed by their `_id` rather than by a 64 bit RecordId.
+	Clustered bool
 }
 
 type Catalog struct {
@@ -73,8 +79,13 @@ type MdbCatalogFormat struct {
 			Spec struct {
 				Key  bson.D
 				Name string
+				V    int
 			}
 		}
+		Options struct {
+			// `true`, or the spec of the clustered index.
+			ClusteredIndex interface{} `bson:"clusteredIndex"`
+		}
 	} `bson:"md"`
 }
 
@@ -83,6 +94,7 @@ func (catalog *Catalog) AddRow(inp *MdbCatalogFormat) {
 		Name:            inp.Ns,
 		Ident:           inp.Ident,
 		IndexNameToInfo: make(map[string]*IndexInfo),
+		Clustered:       inp.Metadata.Options.ClusteredIndex != nil && inp.Metadata.Options.ClusteredIndex != false,
 	}
 
 	for idxName, idxIdent := range inp.IdxIdent {
@@ -101,7 +113,11 @@ func (catalog *Catalog) AddRow(inp *MdbCatalogFormat) {
 		if err != nil {
 			panic(err)
 		}
-		cinfo.IndexNameToInfo[index.Spec.Name].Definition = string(specStr)
+		// Catalog entries replayed from the journal may be written mid index build.
+		if iinfo, exists := cinfo.IndexNameToInfo[index.Spec.Name]; exists {
+			iinfo.Definition = string(specStr)
+			iinfo.Version = index.Spec.V
+		}
 	}
 
 	catalog.Collections = append(catalog.Collections, cinfo)
@@ -122,12 +138,7 @@ func LoadCatalog(catalogFile io.ReadCloser, annotateWriter io.WriteCloser) *Cata
 		}
 	}
 
-	ret := &Catalog{
-		FileToCollection: make(map[string]*CollectionInfo),
-		FileToIndex:      make(map[string]*IndexInfo),
-		Collections:      make([]*CollectionInfo, 0),
-		Indexes:          make([]*IndexInfo, 0),
-	}
+	ret := newCatalog()
 	for {
 		more := scanner.Scan()
 		if !more {
@@ -157,9 +168,29 @@ func LoadCatalog(catalogFile io.ReadCloser, annotateWriter io.WriteCloser) *Cata
 	return ret
 }
 
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// LoadCatalogFile reads the `_mdb_catalog` dump saved with the diagnostics, see
+// `WTDiagnosticsResults.CatalogFile`, without running `wt`.
+func LoadCatalogFile(catalogFile string) (*Catalog, error) {
+	file, err := os.Open(catalogFile)
+	if err != nil {
+		return nil, err
+	}
+	return LoadCatalog(file, nopWriteCloser{io.Discard}), nil
+}
+
 type WTList struct {
 	TableToFileId map[string]int64
 	FileIdToTable map[int64]string
+	// The metadata of each table, e.g: `allocation_size=4KB,checkpoint=(...),id=5,...`.
+	TableConfig map[string]string
+	// The `system:` entries, e.g: `system:checkpoint` -> `checkpoint_timestamp="..."`.
+	SystemConfig map[string]string
 }
 
 var fileIdRe *regexp.Regexp = regexp.MustCompile(",id=(\\d+),")
@@ -167,11 +198,15 @@ var fileIdRe *regexp.Regexp = regexp.MustCompile(",id=(\\d+),")
 func LoadWTList(listFile io.ReadCloser) *WTList {
 	scanner := bufio.NewScanner(listFile)
 	scanner.Split(bufio.ScanLines)
+	// Checkpoint lists of long running tests make for long lines.
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
 	defer listFile.Close()
 
 	ret := &WTList{
 		TableToFileId: make(map[string]int64),
 		FileIdToTable: make(map[int64]string),
+		TableConfig:   make(map[string]string),
+		SystemConfig:  make(map[string]string),
 	}
 	ret.TableToFileId["WiredTiger"] = 0
 	ret.FileIdToTable[0] = "WiredTiger"
@@ -181,6 +216,11 @@ func LoadWTList(listFile io.ReadCloser) *WTList {
 			break
 		}
 		key := scanner.Text()
+		if strings.HasPrefix(key, "system:") {
+			scanner.Scan()
+			ret.SystemConfig[key] = scanner.Text()
+			continue
+		}
 		if !strings.HasPrefix(key, "file:") {
 			continue
 		}
@@ -197,6 +237,7 @@ func LoadWTList(listFile io.ReadCloser) *WTList {
 
 		ret.TableToFileId[tableName] = int64(fileIdInt)
 		ret.FileIdToTable[int64(fileIdInt)] = tableName
+		ret.TableConfig[tableName] = value
 	}
 
 	return ret
@@ -214,220 +255,230 @@ func IsMdbTable(tableName string) bool {
 	return IsCollection(tableName) || IsIndex(tableName) || tableName == ""
 }
 
-func Feed(stdin io.Writer, stdout io.Reader, keystring string) string {
-	stdin.Write([]byte(keystring + "\n"))
+// RewritePrintlog annotates `wt printlog` output with the collections and indexes written to.
+// Tables created or dropped while the journal was written are named by a first pass over the
+// `_mdb_catalog` writes in it. Documents changed by row_modify ops are rebuilt from earlier writes
+// or, failing that and when not nil, from `checkpoints`. The transactions of the journal, see
+// `ReadTransactions`, are gathered along the way. It stops early when `ctx` is done.
+func RewritePrintlog(ctx context.Context, input io.ReadSeekCloser, output io.WriteCloser, catalog *Catalog, list *WTList, checkpoints *UnrecoveredCheckpoints) ([]*Transaction, error) {
+	defer input.Close()
+	defer output.Close()
 
-	result, err := bufio.NewReader(stdout).ReadString('\n')
+	annotator, err := NewJournalAnnotator(ctx, input, catalog, list, checkpoints)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-
-	return result
+	index := newTransactionIndex()
+	err = annotator.annotate(indexedRecords{contextRecords{ctx, NewPrintlogReader(input)}, annotator, index}, output)
+	return index.transactions, err
 }
 
-type History struct {
-	Lines []string
-	ptr   int
-}
+// NewJournalAnnotator sets up annotating `wt printlog` output with everything known of its
+// dbpath. It replays the `_mdb_catalog` writes of `input` then rewinds it. Both passes follow the
+// documents with the same `DocumentVersions`, such that tables read as of their checkpoint are
+// read once and count against one bound.
+func NewJournalAnnotator(ctx context.Context, input io.ReadSeeker, catalog *Catalog, list *WTList, checkpoints *UnrecoveredCheckpoints) (*PrintlogAnnotator, error) {
+	versions := newDocumentVersions(ctx, list, checkpoints)
+	timeline, err := ReadCatalogTimeline(contextRecords{ctx, NewPrintlogReader(input)}, list, versions)
+	if err != nil {
+		// The tables named until the failure still help.
+		fmt.Printf("Failed to replay the catalog writes of the journal. Err: %v\n", err)
+	}
+	if _, err := input.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	versions.Rewind()
 
-func NewHistory(cap int) *History {
-	return &History{
-		Lines: make([]string, cap, cap),
-		ptr:   0,
+	// Keys that fail to decode are left as hex.
+	decodeKey := func(indexInfo *IndexInfo, key, value []byte) (string, bool) {
+		indexKey, err := DecodeIndexEntry(indexInfo, key, value)
+		return indexKey.Describe(), err == nil
 	}
+
+	return NewPrintlogAnnotator(catalog, list, timeline, decodeKey, versions), nil
 }
 
-func (history *History) Add(lineNum int, line string) {
-	history.Lines[history.ptr] = fmt.Sprintf("%6d: %s", lineNum, line)
-	history.ptr++
+// PrintlogAnnotator describes the ops of journal records by the collections and indexes they
+// write to, and their values as extended JSON. It must see every record in LSN order, written or
+// not, to follow the documents row_modify ops change.
+type PrintlogAnnotator struct {
+	catalog *Catalog
+	list    *WTList
+	// `timeline`, when not nil, names the tables `list` and `catalog` do not know of.
+	timeline *CatalogTimeline
+	// `decodeKey`, when not nil, may describe an index key given its value, if any, e.g:
+	// `{"_id":{"$oid":"6439840a5abe13336b194496"}}`.
+	decodeKey func(indexInfo *IndexInfo, key, value []byte) (string, bool)
+	// `versions`, when not nil, follows the writes to collections such that the documents
+	// row_modify ops result in can be written in full, along with the fields they change.
+	versions *DocumentVersions
+	// The LSN of the record being annotated.
+	lsn LSN
+}
 
-	if history.ptr == len(history.Lines) {
-		history.ptr = 0
+func NewPrintlogAnnotator(catalog *Catalog, list *WTList, timeline *CatalogTimeline,
+	decodeKey func(indexInfo *IndexInfo, key, value []byte) (string, bool), versions *DocumentVersions) *PrintlogAnnotator {
+	return &PrintlogAnnotator{
+		catalog:   catalog,
+		list:      list,
+		timeline:  timeline,
+		decodeKey: decodeKey,
+		versions:  versions,
 	}
 }
 
-func (history *History) Dump() {
-	fmt.Println("History:")
-	for num := 0; num < cap(history.Lines); num++ {
-		idx := (num + history.ptr) % cap(history.Lines)
-		fmt.Println("\t" + history.Lines[idx])
+// annotatedRecords sets the LSN being annotated to that of the record last returned.
+type annotatedRecords struct {
+	records   LogRecordIterator
+	annotator *PrintlogAnnotator
+}
+
+func (iterator annotatedRecords) Next() (*LogRecord, error) {
+	record, err := iterator.records.Next()
+	if err == nil {
+		iterator.annotator.lsn = record.LSN
 	}
+	return record, err
 }
 
-func RewritePrintlog(input io.ReadCloser, output io.WriteCloser, catalog *Catalog, list *WTList) {
-	defer input.Close()
-	defer output.Close()
+// annotate writes every record in the format of `wt printlog -u -x` with its annotations.
+func (annotator *PrintlogAnnotator) annotate(records LogRecordIterator, output io.Writer) error {
+	return writePrintlog(annotatedRecords{records, annotator}, output, annotator.rewriteOp)
+}
 
-	ksdecodeCmd := exec.Command("ksdecode", "-o", "bson", "-a")
-	ksdecodeStdin, err := ksdecodeCmd.StdinPipe()
-	if err != nil {
-		panic(err)
+// TableOf returns the table an op writes to, e.g: `collection-7-123`, and what the catalog makes of
+// it, e.g: `test.coll`. `exists` is false when the file id is unknown.
+func (annotator *PrintlogAnnotator) TableOf(op *Op) (tableName string, exists bool, mdbDisplayName string, indexInfo *IndexInfo) {
+	tableName, exists = annotator.list.FileIdToTable[int64(op.TableFileID())]
+	if !exists && annotator.timeline != nil {
+		tableName, exists = annotator.timeline.FileIdToTable[int64(op.TableFileID())]
 	}
-	ksdecodeStdout, err := ksdecodeCmd.StdoutPipe()
-	if err != nil {
-		panic(err)
+	if !exists {
+		tableName = ""
 	}
 
-	if err := ksdecodeCmd.Start(); err != nil {
-		panic(err)
+	if collInfo, found := annotator.catalog.FileToCollection[tableName]; found {
+		mdbDisplayName = collInfo.Name
+	} else if indexInfo, found = annotator.catalog.FileToIndex[tableName]; found {
+		mdbDisplayName = fmt.Sprintf("NS: %s IndexName: %s Spec: %s",
+			indexInfo.Owner.Name, indexInfo.Name, indexInfo.Definition)
+	} else if naming, droppedAt, found := annotator.timeline.Naming(tableName, annotator.lsn); found {
+		mdbDisplayName, indexInfo = naming.Describe(), naming.Index
+		if droppedAt != nil {
+			mdbDisplayName += fmt.Sprintf(" (dropped at %v)", *droppedAt)
+		}
+	} else if IsMdbTable(tableName) && tableName != "_mdb_catalog" {
+		mdbDisplayName = "Unknown (dropped?) table"
 	}
-	defer func() {
-		ksdecodeStdin.Close()
-		ksdecodeStdout.Close()
-		ksdecodeCmd.Wait()
-	}()
 
-	scanner := bufio.NewScanner(input)
-	scanner.Split(bufio.ScanLines)
+	return tableName, exists, mdbDisplayName, indexInfo
+}
 
-	history := NewHistory(20)
-	lineNum := 0
-	// Track which table a key/value pair are associated with. Customize output for MDB collection and indexes.
-	var lastSeenTableName string
-	isRowPut := false
-	var lastSeenIndexInfo *IndexInfo
-	for scanner.Scan() {
-		lineNum += 1
+// follow tracks the write of an op to a collection. For row_modify ops it returns the document
+// before and after.
+func (annotator *PrintlogAnnotator) follow(op *Op, tableName string) (before []byte, after []byte, err error) {
+	if annotator.versions == nil || IsIndex(tableName) {
+		return nil, nil, nil
+	}
 
-		line := scanner.Text()
-		history.Add(lineNum, line)
+	switch op.Type {
+	case OpRowPut:
+		annotator.versions.Put(op.TableFileID(), op.Key, op.Value)
+	case OpRowRemove:
+		annotator.versions.Remove(op.TableFileID(), op.Key)
+	case OpRowTruncate:
+		annotator.versions.Truncate(op.TableFileID())
+	case OpRowModify:
+		return annotator.versions.Modify(op.TableFileID(), annotator.lsn, op.Key, op.Value)
+	}
+	return nil, nil, nil
+}
 
-		switch {
-		case strings.HasPrefix(line, "      { \"optype\": \"row_put\""):
-			isRowPut = true
-		case strings.HasPrefix(line, "      { \"optype\": \"row_modify\""):
-			isRowPut = false
-		case strings.HasPrefix(line, "        \"key\": "):
-			continue
-		case strings.HasPrefix(line, "        \"value\": "):
-			continue
-		}
+// Follow tracks the writes of a record that is not written.
+func (annotator *PrintlogAnnotator) Follow(record *LogRecord) {
+	annotator.lsn = record.LSN
+	for idx := range record.Ops {
+		op := &record.Ops[idx]
+		tableName, _, _, _ := annotator.TableOf(op)
+		annotator.follow(op, tableName)
+	}
+}
 
-		// `"fileid" :` (note the space before the colon) is part of a sync record.
-		// `"fileid":` (note the lack of space) is part of a txn's row_put/row_remove record.
-		if strings.HasPrefix(line, "        \"fileid\":") {
-			idHexRe := regexp.MustCompile(" 0x([a-f0-9]+),")
-			// fmt.Printf("FileidLine: `%v`\n", line)
-			fileHex := idHexRe.FindStringSubmatch(line)[1]
-
-			// WT's "debug" log records will write no-op entries for tables that are not logged for recovery. These no-ops are significant by setting a leading bit (e.g: the `8 in hex).
-			// Searching for `8`, strictly speaking, is incorrect. A `9` should* be replaced by a `1`. A problem for a later person
-			if fileHex[0] == '8' {
-				// e.g: `0x(80000003)`. Note this is 8 hex characters.
-				fileHex = strings.Replace(fileHex, "8", "0", 1)
-			} else if len(fileHex) == 8 && (fileHex[0] == '9' || (fileHex[0] >= 'a' && fileHex[0] <= 'f')) {
-				panic("Smarter stripping of the leading bit is not implemented.")
-			}
-			// fmt.Printf("0 == 8? %v\n", fileHex[0] == '8')
+// modifyFields describes the document a row_modify results in and how it differs from the version
+// before.
+func modifyFields(before, after []byte) ([]printlogField, error) {
+	var beforeDoc, afterDoc bson.D
+	if err := bson.Unmarshal(before, &beforeDoc); err != nil {
+		return nil, errors.Wrap(err, "The earlier version is not BSON")
+	}
+	if err := bson.Unmarshal(after, &afterDoc); err != nil {
+		return nil, errors.Wrap(err, "The modified version is not BSON")
+	}
+	document, err := bson.MarshalExtJSONIndent(afterDoc, false, false, "        ", "  ")
+	if err != nil {
+		return nil, err
+	}
+	diff, err := bson.MarshalExtJSON(DiffDocuments(beforeDoc, afterDoc), false, false)
+	if err != nil {
+		return nil, err
+	}
 
-			fileInt, err := strconv.ParseInt(fileHex, 16, 64)
-			if err != nil {
-				panic(err)
-			}
+	return []printlogField{{Name: "value-bson", Value: string(document)}, {Name: "value-diff", Value: string(diff)}}, nil
+}
 
-			output.Write([]byte(line))
-
-			var exists bool
-			lastSeenTableName, exists = list.FileIdToTable[fileInt]
-
-			var mdbDisplayName string
-			if collInfo, exists := catalog.FileToCollection[lastSeenTableName]; exists {
-				mdbDisplayName = collInfo.Name
-				lastSeenIndexInfo = nil
-			} else if indexInfo, exists := catalog.FileToIndex[lastSeenTableName]; exists {
-				mdbDisplayName = fmt.Sprintf("NS: %s IndexName: %s Spec: %s",
-					indexInfo.Owner.Name, indexInfo.Name, indexInfo.Definition)
-				lastSeenIndexInfo = indexInfo
-			} else if IsMdbTable(lastSeenTableName) && lastSeenTableName != "_mdb_catalog" {
-				// We could do better here. It's possible the printlog output for the `_mdb_catalog`
-				// has an insert for this table name/ident.
-				mdbDisplayName = "Unknown (dropped?) table"
-				lastSeenIndexInfo = nil
-			}
+func (annotator *PrintlogAnnotator) rewriteOp(op *Op, fields []printlogField) []printlogField {
+	tableName, exists, mdbDisplayName, indexInfo := annotator.TableOf(op)
+
+	var modified []printlogField
+	before, after, modifyErr := annotator.follow(op, tableName)
+	if op.Type == OpRowModify && modifyErr == nil && annotator.versions != nil && !IsIndex(tableName) {
+		modified, modifyErr = modifyFields(before, after)
+	}
 
+	ret := make([]printlogField, 0, len(fields))
+	for _, field := range fields {
+		switch field.Name {
+		case "key", "value":
+			// The hex forms are exact. The escaped strings are noise.
+			continue
+		case "fileid":
 			// Reconstitute the ".wt" suffix. I assume it's easier for people to digest that
 			// `WiredTiger.wt` is the actual metadata table rather than an ambiguous looking
 			// `WiredTiger`.
 			if exists {
-				output.Write([]byte(fmt.Sprintf(" %s.wt %s\n", lastSeenTableName, mdbDisplayName)))
-			} else {
-				output.Write([]byte("\n"))
+				field.Comment = fmt.Sprintf("%s.wt %s", tableName, mdbDisplayName)
 			}
-		} else if strings.HasPrefix(line, "        \"value-hex\": \"") && IsMdbTable(lastSeenTableName) {
-			valueHexStr := line[22 : len(line)-1]
-
-			switch {
-			case !isRowPut:
-				// Always output row-modify as raw bytes
-				output.Write([]byte(line))
-			case lastSeenTableName == "":
-				valueBinary, err := hex.DecodeString(valueHexStr)
-				if err != nil {
-					panic(err)
-				}
-
-				// Table is unknown because it was no longer in wt list/_mdb_catalog. Try to turn the bytes into bson.
-				byt, err := MayMarshal(valueBinary, "        ")
-				if err == nil {
-					output.Write([]byte("        \"value-bson\": "))
-					output.Write(byt)
-				} else {
-					output.Write([]byte(line))
-				}
-			case IsCollection(lastSeenTableName):
-				valueBinary, err := hex.DecodeString(valueHexStr)
-				if err != nil {
-					panic(err)
+		case "value-hex":
+			// Always output row_modify and index values as raw bytes. A table that is unknown
+			// because it was no longer in wt list/_mdb_catalog may still hold bson. The
+			// document a row_modify results in, when known, follows its raw bytes.
+			if op.Type == OpRowPut && (IsCollection(tableName) || tableName == "") {
+				if byt, err := MayMarshal(op.Value, "        "); err == nil {
+					field = printlogField{Name: "value-bson", Value: string(byt)}
 				}
-
-				output.Write([]byte("        \"value-bson\": "))
-				PPrintExt(output, valueBinary, "        ")
-			case IsIndex(lastSeenTableName):
-				output.Write([]byte(line))
-			default:
-				history.Dump()
-				panic("Unknown? " + lastSeenTableName)
-			}
-
-			output.Write([]byte("\n"))
-		} else if strings.HasPrefix(line, "        \"key-hex\": \"") && IsIndex(lastSeenTableName) {
-			// We can use `ksdecode` to transform:
-			//   "key-hex": "646439840a5abe13336b19449604" ->
-			//   "Keystring": { : ObjectId('6439840a5abe13336b194496') }
-			//
-			// `ksdecode` can accept multiple blobs as input for the same process lifetime,
-			// separated by newlines. However, only one index spec can be used for the entire
-			// process lifetime. So, for now, we only do it for the _id index.
-			if lastSeenIndexInfo == nil || lastSeenIndexInfo.Name != "_id_" {
-				output.Write([]byte(line + "\n"))
-				continue
+			} else if op.Type == OpRowModify && modifyErr != nil {
+				field.Comment = modifyErr.Error()
 			}
+		}
+		ret = append(ret, field)
+		if field.Name == "value-hex" {
+			ret = append(ret, modified...)
+		}
 
-			var keyHexStr string
-			if strings.HasSuffix(line, "\",") {
-				keyHexStr = line[20 : len(line)-2]
-			} else {
-				// `row_remove` operations do not have a value. The `key-hex` field is the last
-				// element in the item.
-				keyHexStr = line[20 : len(line)-1]
+		if field.Name == "key-hex" && indexInfo != nil && annotator.decodeKey != nil {
+			if keystring, decoded := annotator.decodeKey(indexInfo, op.Key, op.Value); decoded {
+				ret = append(ret, printlogField{Name: "Keystring", Value: keystring})
 			}
-
-			// fmt.Println("KeyHex:", keyHexStr)
-			keystring := Feed(ksdecodeStdin, ksdecodeStdout, keyHexStr)
-			// fmt.Println("KS:", keystring)
-			output.Write([]byte(line + "\n"))
-			// Note that the keystring output comes with a tailing newline.
-			output.Write([]byte(fmt.Sprintf("        \"Keystring\": %s", FormatKS(keystring))))
-		} else {
-			output.Write([]byte(line))
-			output.Write([]byte("\n"))
 		}
 	}
+
+	return ret
 }
 
-func FormatKS(keystring string) string {
-	// Inp: 5a1004c72cd25367034a5c98067698e8d95e0f04 { : UUID("c72cd253-6703-4a5c-9806-7698e8d95e0f") }
-	// Out: { : UUID("c72cd253-6703-4a5c-9806-7698e8d95e0f") }
-	_, formatted, _ := strings.Cut(keystring, " ")
-	return formatted
+// AnnotatePrintlog writes records in the format of `wt printlog -u -x` with the collection or
+// index of each operation. See `PrintlogAnnotator` for the optional `timeline`, `decodeKey` and
+// `versions`.
+func AnnotatePrintlog(records LogRecordIterator, output io.Writer, catalog *Catalog, list *WTList, timeline *CatalogTimeline,
+	decodeKey func(indexInfo *IndexInfo, key, value []byte) (string, bool), versions *DocumentVersions) error {
+	return NewPrintlogAnnotator(catalog, list, timeline, decodeKey, versions).annotate(records, output)
 }
@@ -0,0 +1,228 @@
+package machinery
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/ulikunitz/xz"
+)
+
+type ArchiveFormat string
+
+const (
+	FormatGzip    ArchiveFormat = "gzip"
+	FormatZstd    ArchiveFormat = "zstd"
+	FormatXz      ArchiveFormat = "xz"
+	FormatBzip2   ArchiveFormat = "bzip2"
+	FormatZip     ArchiveFormat = "zip"
+	FormatTar     ArchiveFormat = "tar"
+	FormatUnknown ArchiveFormat = "unknown"
+)
+
+// The longest prefix `DetectArchiveFormat` looks at. A tar header is one 512 byte block.
+const formatPeekSize = 512
+
+// DetectArchiveFormat identifies an archive or compression format from the first bytes of a file.
+// Pass at least `formatPeekSize` bytes when available; tar is only recognizable by its header
+// block.
+func DetectArchiveFormat(header []byte) ArchiveFormat {
+	switch {
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		return FormatGzip
+	case bytes.HasPrefix(header, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return FormatZstd
+	case bytes.HasPrefix(header, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return FormatXz
+	case bytes.HasPrefix(header, []byte("BZh")):
+		return FormatBzip2
+	// The second signature is an empty zip file.
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")), bytes.HasPrefix(header, []byte("PK\x05\x06")):
+		return FormatZip
+	case isTarHeader(header):
+		return FormatTar
+	}
+
+	return FormatUnknown
+}
+
+// isTarHeader recognizes POSIX and GNU tar by the `ustar` magic. Pre-POSIX tar files have no magic
+// and are recognized by their header checksum instead.
+func isTarHeader(header []byte) bool {
+	if len(header) < formatPeekSize {
+		return false
+	}
+	if bytes.HasPrefix(header[257:], []byte("ustar")) {
+		return true
+	}
+
+	// The checksum field is an octal number. It is computed with the field itself treated as
+	// spaces.
+	checksumField := strings.Trim(string(header[148:156]), " \x00")
+	expected, err := strconv.ParseInt(checksumField, 8, 64)
+	if err != nil {
+		return false
+	}
+
+	var sum int64
+	for idx, byt := range header[:formatPeekSize] {
+		if idx >= 148 && idx < 156 {
+			byt = ' '
+		}
+		sum += int64(byt)
+	}
+	return sum == expected
+}
+
+// decompress wraps `reader` in a decompressor for `format`. The returned closer must be called
+// once done reading.
+func decompress(format ArchiveFormat, reader io.Reader) (io.Reader, func(), error) {
+	switch format {
+	case FormatGzip:
+		// Concatenated gzip members are read as one stream.
+		gzReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		return gzReader, func() { gzReader.Close() }, nil
+	case FormatZstd:
+		zstdReader, err := zstd.NewReader(reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zstdReader, zstdReader.Close, nil
+	case FormatXz:
+		xzReader, err := xz.NewReader(reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		return xzReader, func() {}, nil
+	case FormatBzip2:
+		return bzip2.NewReader(reader), func() {}, nil
+	}
+
+	return nil, nil, fmt.Errorf("Not a compression format: %v", format)
+}
+
+// compressedName strips a compression suffix from a file name, e.g: `dump.json.zst` ->
+// `dump.json`. `.tgz` style names become `.tar`.
+func compressedName(name string) string {
+	for _, ext := range []string{".tgz", ".tbz2", ".txz", ".tzst"} {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext) + ".tar"
+		}
+	}
+	for _, ext := range []string{".gz", ".zst", ".zstd", ".xz", ".bz2"} {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext)
+		}
+	}
+
+	return name + ".out"
+}
+
+// ExtractArchive detects the format of the file at `archivePath` and extracts it into `target`.
+// Tarballs may be uncompressed or compressed with gzip, zstd, xz or bzip2. Zip files are
+// supported too. A compressed file that is not a tarball is decompressed into `target` as a single
+// file. `onRead`, when not nil, is called with the running count of archive bytes read.
+func (extractor Extractor) ExtractArchive(archivePath string, target string, onRead func(int64)) (ExtractResult, error) {
+	archive, err := os.Open(archivePath)
+	if err != nil {
+		return ExtractResult{}, err
+	}
+	defer archive.Close()
+
+	info, err := archive.Stat()
+	if err != nil {
+		return ExtractResult{}, err
+	}
+	if onRead == nil {
+		onRead = func(int64) {}
+	}
+
+	counter := &readCounter{onRead: onRead}
+	peeker := bufio.NewReader(&countingReader{archive, counter})
+	header, _ := peeker.Peek(formatPeekSize)
+
+	format := DetectArchiveFormat(header)
+	switch format {
+	case FormatZip:
+		return extractor.ExtractZip(&countingReaderAt{archive, counter}, info.Size(), target)
+	case FormatTar:
+		return extractor.ExtractTar(peeker, target)
+	case FormatUnknown:
+		return ExtractResult{}, fmt.Errorf("Unrecognized archive format. Archive: %v", archivePath)
+	}
+
+	decompressed, closer, err := decompress(format, peeker)
+	if err != nil {
+		return ExtractResult{}, errors.Wrap(err, fmt.Sprintf("Failed to read %v archive", format))
+	}
+	defer closer()
+
+	innerPeeker := bufio.NewReader(decompressed)
+	innerHeader, _ := innerPeeker.Peek(formatPeekSize)
+	if isTarHeader(innerHeader) {
+		return extractor.ExtractTar(innerPeeker, target)
+	}
+
+	// A lone compressed file. Gzip may carry the original name.
+	name := compressedName(filepath.Base(archivePath))
+	if gzReader, ok := decompressed.(*gzip.Reader); ok && gzReader.Name != "" {
+		name = filepath.Base(gzReader.Name)
+	}
+
+	ext, err := extractor.newExtraction(target)
+	if err != nil {
+		return ExtractResult{}, err
+	}
+	if err := ext.file(name, 0644, innerPeeker, 0, info.ModTime()); err != nil {
+		return ext.result, err
+	}
+	if len(ext.result.Skipped) > 0 {
+		return ext.result, ext.result.Skipped[0]
+	}
+
+	return ext.finish(), nil
+}
+
+type readCounter struct {
+	read   int64
+	onRead func(int64)
+}
+
+func (counter *readCounter) add(read int) {
+	counter.read += int64(read)
+	counter.onRead(counter.read)
+}
+
+type countingReader struct {
+	io.Reader
+	counter *readCounter
+}
+
+func (reader *countingReader) Read(buf []byte) (int, error) {
+	read, err := reader.Reader.Read(buf)
+	reader.counter.add(read)
+	return read, err
+}
+
+type countingReaderAt struct {
+	io.ReaderAt
+	counter *readCounter
+}
+
+func (reader *countingReaderAt) ReadAt(buf []byte, offset int64) (int, error) {
+	read, err := reader.ReaderAt.ReadAt(buf, offset)
+	reader.counter.add(read)
+	return read, err
+}
@@ -0,0 +1,198 @@
+package machinery
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// TableNaming is what the `_mdb_catalog` made of a table from a point in the journal on.
+type TableNaming struct {
+	LSN        LSN
+	Collection *CollectionInfo
+	// Nil for collections.
+	Index *IndexInfo
+	// The catalog entry was removed, or no longer lists the index.
+	Dropped bool
+}
+
+func (naming TableNaming) Describe() string {
+	if naming.Index != nil {
+		return fmt.Sprintf("NS: %s IndexName: %s Spec: %s", naming.Collection.Name, naming.Index.Name, naming.Index.Definition)
+	}
+	return naming.Collection.Name
+}
+
+// CatalogTimeline replays the writes to the `_mdb_catalog` and to WiredTiger's metadata in the
+// journal. It names the tables that were created or dropped while the journal was written, which
+// `wt list` and the `_mdb_catalog` as of the end of the journal know nothing of.
+type CatalogTimeline struct {
+	// The tables created in WiredTiger's metadata, by file id.
+	FileIdToTable map[int64]string
+	// By table, in LSN order.
+	Namings map[string][]TableNaming
+	// The latest version of each `_mdb_catalog` entry, by key.
+	entries map[string]*Catalog
+}
+
+func newCatalog() *Catalog {
+	return &Catalog{
+		FileToCollection: make(map[string]*CollectionInfo),
+		FileToIndex:      make(map[string]*IndexInfo),
+		Collections:      make([]*CollectionInfo, 0),
+		Indexes:          make([]*IndexInfo, 0),
+	}
+}
+
+// name adds a naming when it differs from the latest one of the table.
+func (timeline *CatalogTimeline) name(table string, naming TableNaming) {
+	namings := timeline.Namings[table]
+	if len(namings) > 0 {
+		latest := namings[len(namings)-1]
+		if latest.Dropped == naming.Dropped && latest.Describe() == naming.Describe() {
+			return
+		}
+	}
+	timeline.Namings[table] = append(namings, naming)
+}
+
+// setEntry records a new version of a `_mdb_catalog` entry at `lsn`. Nil removes the entry.
+func (timeline *CatalogTimeline) setEntry(key string, lsn LSN, entry *Catalog) {
+	if previous, exists := timeline.entries[key]; exists {
+		for _, collection := range previous.Collections {
+			if entry == nil || entry.FileToCollection[collection.Ident] == nil {
+				timeline.name(collection.Ident, TableNaming{LSN: lsn, Collection: collection, Dropped: true})
+			}
+		}
+		for _, index := range previous.Indexes {
+			if entry == nil || entry.FileToIndex[index.Ident] == nil {
+				timeline.name(index.Ident, TableNaming{LSN: lsn, Collection: index.Owner, Index: index, Dropped: true})
+			}
+		}
+	}
+
+	if entry == nil {
+		delete(timeline.entries, key)
+		return
+	}
+	timeline.entries[key] = entry
+	for _, collection := range entry.Collections {
+		timeline.name(collection.Ident, TableNaming{LSN: lsn, Collection: collection})
+	}
+	for _, index := range entry.Indexes {
+		timeline.name(index.Ident, TableNaming{LSN: lsn, Collection: index.Owner, Index: index})
+	}
+}
+
+// parseCatalogEntry returns the collection and indexes of a `_mdb_catalog` entry. Nil for entries
+// that are not collections.
+func parseCatalogEntry(value []byte) *Catalog {
+	var parsedFormat MdbCatalogFormat
+	if err := bson.Unmarshal(value, &parsedFormat); err != nil || parsedFormat.Ident == "" {
+		return nil
+	}
+	ret := newCatalog()
+	ret.AddRow(&parsedFormat)
+	return ret
+}
+
+// ReadCatalogTimeline replays the journal's writes to the `_mdb_catalog` and WiredTiger's
+// metadata. `versions` rebuilds the catalog entries changed by row_modify ops.
+func ReadCatalogTimeline(records LogRecordIterator, list *WTList, versions *DocumentVersions) (*CatalogTimeline, error) {
+	ret := &CatalogTimeline{
+		FileIdToTable: make(map[int64]string),
+		Namings:       make(map[string][]TableNaming),
+		entries:       make(map[string]*Catalog),
+	}
+	catalogFileId, catalogExists := list.TableToFileId["_mdb_catalog"]
+
+	for {
+		record, err := records.Next()
+		if err == io.EOF {
+			return ret, nil
+		} else if err != nil {
+			return ret, err
+		}
+
+		for idx := range record.Ops {
+			op := &record.Ops[idx]
+			switch {
+			case op.TableFileID() == 0 && op.Type == OpRowPut:
+				// Metadata keys and values are nul terminated strings, e.g:
+				// `file:collection-7-123.wt` -> `allocation_size=4KB,...,id=12,...`.
+				key := strings.TrimRight(string(op.Key), "\x00")
+				if !strings.HasPrefix(key, "file:") || !strings.HasSuffix(key, ".wt") {
+					continue
+				}
+				if match := fileIdRe.FindStringSubmatch(string(op.Value)); match != nil {
+					if fileId, err := strconv.ParseInt(match[1], 10, 64); err == nil {
+						ret.FileIdToTable[fileId] = key[5 : len(key)-3]
+					}
+				}
+			case catalogExists && int64(op.TableFileID()) == catalogFileId:
+				var value []byte
+				switch op.Type {
+				case OpRowPut:
+					versions.Put(op.TableFileID(), op.Key, op.Value)
+					value = op.Value
+				case OpRowModify:
+					if _, value, err = versions.Modify(op.TableFileID(), record.LSN, op.Key, op.Value); err != nil {
+						continue
+					}
+				case OpRowRemove:
+					// An entry not written since the last checkpoint names the dropped tables
+					// as of the checkpoint.
+					if _, exists := ret.entries[string(op.Key)]; !exists {
+						if value, exists := versions.checkpointValue(op.TableFileID(), record.LSN, op.Key); exists {
+							if entry := parseCatalogEntry(value); entry != nil {
+								ret.setEntry(string(op.Key), record.LSN, entry)
+							}
+						}
+					}
+					versions.Remove(op.TableFileID(), op.Key)
+					ret.setEntry(string(op.Key), record.LSN, nil)
+					continue
+				default:
+					continue
+				}
+
+				if entry := parseCatalogEntry(value); entry != nil {
+					ret.setEntry(string(op.Key), record.LSN, entry)
+				}
+			}
+		}
+	}
+}
+
+// Naming returns what the `_mdb_catalog` made of a table as of `lsn`, and where the catalog
+// dropped it, if it did. The first naming applies to writes before it, the table having been
+// created before the journal starts.
+func (timeline *CatalogTimeline) Naming(table string, lsn LSN) (naming TableNaming, droppedAt *LSN, found bool) {
+	if timeline == nil || len(timeline.Namings[table]) == 0 {
+		return TableNaming{}, nil, false
+	}
+
+	namings := timeline.Namings[table]
+	current := 0
+	for idx, candidate := range namings {
+		if lsn.Less(candidate.LSN) {
+			break
+		}
+		current = idx
+	}
+	// A dropped table is described by the last name it had.
+	for current > 0 && namings[current].Dropped {
+		current--
+	}
+	for _, later := range namings[current+1:] {
+		if later.Dropped {
+			dropLSN := later.LSN
+			droppedAt = &dropLSN
+			break
+		}
+	}
+	return namings[current], droppedAt, true
+}
@@ -0,0 +1,191 @@
+package machinery
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Timestamp is a WiredTiger timestamp as MongoDB uses them: seconds since the epoch in the high
+// 32 bits and an increment in the low 32 bits.
+type Timestamp uint64
+
+// WiredTiger writes "no stop timestamp" as the largest timestamp.
+const maxTimestamp = Timestamp(math.MaxUint64)
+
+func (ts Timestamp) Seconds() uint32 {
+	return uint32(ts >> 32)
+}
+
+func (ts Timestamp) Increment() uint32 {
+	return uint32(ts)
+}
+
+// WallClock is the time of day the timestamp's seconds refer to.
+func (ts Timestamp) WallClock() time.Time {
+	return time.Unix(int64(ts.Seconds()), 0).UTC()
+}
+
+// String formats the timestamp the way the MongoDB shell does, e.g: `Timestamp(1681737738, 5)`.
+func (ts Timestamp) String() string {
+	switch ts {
+	case 0:
+		return "none"
+	case maxTimestamp:
+		return "max"
+	}
+	return fmt.Sprintf("Timestamp(%d, %d)", ts.Seconds(), ts.Increment())
+}
+
+// Describe adds the wall clock time to `String`.
+func (ts Timestamp) Describe() string {
+	if ts == 0 || ts == maxTimestamp {
+		return ts.String()
+	}
+	return fmt.Sprintf("%v %v", ts, ts.WallClock().Format(time.RFC3339))
+}
+
+// parseTimestamp reads a timestamp of a checkpoint's config. They are written in decimal, and
+// signed when they are the largest timestamp, i.e: -1.
+func parseTimestamp(value string) Timestamp {
+	if ret, err := strconv.ParseUint(value, 10, 64); err == nil {
+		return Timestamp(ret)
+	}
+	if ret, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return Timestamp(ret)
+	}
+	return 0
+}
+
+// parseHexTimestamp reads a timestamp of the `system:` metadata, which are written in hex.
+func parseHexTimestamp(value string) Timestamp {
+	ret, err := strconv.ParseUint(value, 16, 64)
+	if err != nil {
+		return 0
+	}
+	return Timestamp(ret)
+}
+
+// Checkpoint is one entry of a table's `checkpoint=(...)` metadata.
+type Checkpoint struct {
+	Name  string
+	Order int64
+	// When the checkpoint was taken.
+	Time     time.Time
+	Size     int64
+	WriteGen int64
+	// The time window of the data in the checkpoint.
+	NewestStartDurableTs Timestamp
+	OldestStartTs        Timestamp
+	NewestStopDurableTs  Timestamp
+	NewestStopTs         Timestamp
+}
+
+// TableCheckpoints is the checkpoints of one table, oldest first.
+type TableCheckpoints struct {
+	Table       string
+	FileId      int64
+	Checkpoints []Checkpoint
+}
+
+// CheckpointInfo is what the WiredTiger metadata records about checkpoints.
+type CheckpointInfo struct {
+	// The stable timestamp when the last checkpoint was taken. Recovery rolls back to it.
+	CheckpointTimestamp Timestamp
+	OldestTimestamp     Timestamp
+	// The metadata's own checkpoints, from `WiredTiger.turtle`.
+	Metadata TableCheckpoints
+	// In file id order.
+	Tables []TableCheckpoints
+}
+
+func parseInt(value string) int64 {
+	ret, _ := strconv.ParseInt(value, 10, 64)
+	return ret
+}
+
+// parseCheckpoints reads the `checkpoint` setting of a file's config, e.g:
+// `(WiredTigerCheckpoint.5=(addr="...",order=5,time=1681737740,size=8192,write_gen=7,...))`.
+func parseCheckpoints(config map[string]string) []Checkpoint {
+	checkpoints, exists := config["checkpoint"]
+	if !exists {
+		return nil
+	}
+
+	ret := make([]Checkpoint, 0)
+	for name, value := range wtConfigGroup(checkpoints) {
+		settings := wtConfigGroup(value)
+		ret = append(ret, Checkpoint{
+			Name:                 name,
+			Order:                parseInt(settings["order"]),
+			Time:                 time.Unix(parseInt(settings["time"]), 0).UTC(),
+			Size:                 parseInt(settings["size"]),
+			WriteGen:             parseInt(settings["write_gen"]),
+			NewestStartDurableTs: parseTimestamp(settings["newest_start_durable_ts"]),
+			OldestStartTs:        parseTimestamp(settings["oldest_start_ts"]),
+			NewestStopDurableTs:  parseTimestamp(settings["newest_stop_durable_ts"]),
+			NewestStopTs:         parseTimestamp(settings["newest_stop_ts"]),
+		})
+	}
+	sort.Slice(ret, func(left, right int) bool {
+		return ret[left].Order < ret[right].Order
+	})
+
+	return ret
+}
+
+// ReadCheckpoints gathers the checkpoints of every table in `wt list -v` output and of the
+// metadata in the dbpath's `WiredTiger.turtle`.
+func ReadCheckpoints(list *WTList, dbpath string) *CheckpointInfo {
+	ret := &CheckpointInfo{
+		CheckpointTimestamp: parseHexTimestamp(parseWTConfigString(list.SystemConfig["system:checkpoint"])["checkpoint_timestamp"]),
+		OldestTimestamp:     parseHexTimestamp(parseWTConfigString(list.SystemConfig["system:oldest"])["oldest_timestamp"]),
+		Metadata:            TableCheckpoints{Table: "WiredTiger", FileId: 0},
+	}
+
+	for table, config := range list.TableConfig {
+		ret.Tables = append(ret.Tables, TableCheckpoints{
+			Table:       table,
+			FileId:      list.TableToFileId[table],
+			Checkpoints: parseCheckpoints(parseWTConfigString(config)),
+		})
+	}
+	sort.Slice(ret.Tables, func(left, right int) bool {
+		return ret.Tables[left].FileId < ret.Tables[right].FileId
+	})
+
+	if contents, err := os.ReadFile(filepath.Join(dbpath, "WiredTiger.turtle")); err == nil {
+		lines := strings.Split(string(contents), "\n")
+		for idx := 0; idx+1 < len(lines); idx++ {
+			if lines[idx] == "file:WiredTiger.wt" {
+				ret.Metadata.Checkpoints = parseCheckpoints(parseWTConfigString(lines[idx+1]))
+			}
+		}
+	}
+
+	return ret
+}
+
+// Names are the checkpoints `wt dump -c` can read: `WiredTigerCheckpoint`, the most recent, and
+// any checkpoints the application named. `WiredTigerCheckpoint.N` is not a name `wt` accepts.
+func (info *CheckpointInfo) Names() []string {
+	ret := []string{"WiredTigerCheckpoint"}
+	seen := map[string]bool{"WiredTigerCheckpoint": true}
+	for _, table := range info.Tables {
+		for _, checkpoint := range table.Checkpoints {
+			if strings.HasPrefix(checkpoint.Name, "WiredTigerCheckpoint") || seen[checkpoint.Name] {
+				continue
+			}
+			seen[checkpoint.Name] = true
+			ret = append(ret, checkpoint.Name)
+		}
+	}
+	sort.Strings(ret[1:])
+
+	return ret
+}
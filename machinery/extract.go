@@ -0,0 +1,426 @@
+package machinery
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Extractor unpacks archives of untrusted CI output. Entries are never written outside of the
+// target directory.
+type Extractor struct {
+	// Extraction fails once the regular files written exceed this many bytes. 0 means no limit.
+	MaxTotalSize int64
+}
+
+// DefaultExtractor is used for task data archives.
+var DefaultExtractor = Extractor{MaxTotalSize: 20 << 30}
+
+// EntryError describes an archive entry that was skipped.
+type EntryError struct {
+	Name string
+	Err  error
+}
+
+func (entryErr EntryError) Error() string {
+	return fmt.Sprintf("%s: %v", entryErr.Name, entryErr.Err)
+}
+
+type ExtractResult struct {
+	Files int
+	// The bytes of regular file content written.
+	Bytes   int64
+	Skipped []EntryError
+}
+
+func (result *ExtractResult) skip(name string, err error) {
+	result.Skipped = append(result.Skipped, EntryError{name, err})
+}
+
+// safeJoin returns where an archive entry named `name` belongs under `root`. Like `tar`, leading
+// slashes are stripped. Names that climb out of `root` are rejected.
+func safeJoin(root, name string) (string, error) {
+	name = strings.TrimLeft(filepath.ToSlash(name), "/")
+	for _, component := range strings.Split(name, "/") {
+		if component == ".." {
+			return "", fmt.Errorf("Path traversal in entry name")
+		}
+	}
+
+	return filepath.Join(root, filepath.FromSlash(name)), nil
+}
+
+// within returns whether `path` is `root` or inside of it. Both must be clean.
+func within(root, path string) bool {
+	return path == root || strings.HasPrefix(path, root+string(filepath.Separator))
+}
+
+// ensureParents creates the parent directories of `path`. An existing symlink anywhere between
+// `root` and `path` is an error: writes must never be redirected by links from the archive.
+func ensureParents(root, path string) error {
+	parent := filepath.Dir(path)
+	relative, err := filepath.Rel(root, parent)
+	if err != nil {
+		return err
+	}
+
+	current := root
+	for _, component := range strings.Split(relative, string(filepath.Separator)) {
+		if component == "." {
+			continue
+		}
+
+		current = filepath.Join(current, component)
+		info, err := os.Lstat(current)
+		switch {
+		case os.IsNotExist(err):
+			if err := os.Mkdir(current, 0755); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case info.Mode()&os.ModeSymlink != 0:
+			return fmt.Errorf("Parent directory is a symlink. Path: %v", current)
+		case !info.IsDir():
+			return fmt.Errorf("Parent is not a directory. Path: %v", current)
+		}
+	}
+
+	return nil
+}
+
+// removeNonDir clears the way for a new entry at `path`. Archives may legitimately repeat an
+// entry, but an existing symlink must not be written through.
+func removeNonDir(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		return fmt.Errorf("A directory already exists. Path: %v", path)
+	}
+	return os.Remove(path)
+}
+
+// extraction holds the state of unpacking one archive into `root`. Every archive format funnels
+// its entries through these methods so they share the same safety checks.
+type extraction struct {
+	extractor Extractor
+	root      string
+	symlinks  []string
+	result    ExtractResult
+}
+
+func (extractor Extractor) newExtraction(target string) (*extraction, error) {
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return nil, err
+	}
+	// Resolve the root physically so symlinks can be compared against it.
+	root, err := filepath.Abs(target)
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &extraction{extractor: extractor, root: root, symlinks: make([]string, 0)}, nil
+}
+
+// path returns where the entry belongs, or "" if the entry must be skipped.
+func (ext *extraction) path(name string) string {
+	path, err := safeJoin(ext.root, name)
+	if err != nil {
+		ext.result.skip(name, err)
+		return ""
+	}
+	if path == ext.root {
+		return ""
+	}
+
+	return path
+}
+
+func (ext *extraction) dir(name string, mode os.FileMode) {
+	path := ext.path(name)
+	if path == "" {
+		return
+	}
+
+	err := ensureParents(ext.root, path)
+	if err == nil {
+		var info os.FileInfo
+		info, err = os.Lstat(path)
+		if os.IsNotExist(err) {
+			err = os.Mkdir(path, 0755)
+		} else if err == nil && !info.IsDir() {
+			err = fmt.Errorf("A non-directory already exists")
+		}
+	}
+	if err == nil {
+		err = os.Chmod(path, mode.Perm()|0700)
+	}
+	if err != nil {
+		ext.result.skip(name, err)
+	}
+}
+
+// file writes a regular file. Only exceeding the size limit is returned as an error.
+func (ext *extraction) file(name string, mode os.FileMode, contents io.Reader, size int64, modTime time.Time) error {
+	path := ext.path(name)
+	if path == "" {
+		return nil
+	}
+
+	maxSize := ext.extractor.MaxTotalSize
+	if maxSize > 0 && ext.result.Bytes+size > maxSize {
+		return fmt.Errorf("Archive exceeds the extraction limit of %d bytes. Entry: %v", maxSize, name)
+	}
+	if maxSize > 0 {
+		// Do not trust the declared size.
+		contents = io.LimitReader(contents, maxSize-ext.result.Bytes+1)
+	}
+
+	written, err := writeEntryFile(ext.root, path, mode.Perm(), contents, modTime)
+	ext.result.Bytes += written
+	if maxSize > 0 && ext.result.Bytes > maxSize {
+		return fmt.Errorf("Archive exceeds the extraction limit of %d bytes. Entry: %v", maxSize, name)
+	}
+	if err != nil {
+		ext.result.skip(name, err)
+		return nil
+	}
+
+	ext.result.Files++
+	return nil
+}
+
+func (ext *extraction) symlink(name string, linkname string) {
+	path := ext.path(name)
+	if path == "" {
+		return
+	}
+
+	if err := createSymlink(ext.root, path, linkname); err != nil {
+		ext.result.skip(name, err)
+		return
+	}
+	ext.symlinks = append(ext.symlinks, path)
+}
+
+func (ext *extraction) hardlink(name string, linkname string) {
+	path := ext.path(name)
+	if path == "" {
+		return
+	}
+
+	if err := createHardlink(ext.root, path, linkname); err != nil {
+		ext.result.skip(name, err)
+		return
+	}
+	ext.result.Files++
+}
+
+func (ext *extraction) finish() ExtractResult {
+	// Each symlink was checked on its own when created. A chain of links can still resolve
+	// outside of the root once every link exists.
+	for _, link := range ext.symlinks {
+		resolved, err := filepath.EvalSymlinks(link)
+		if err != nil {
+			// Dangling links are harmless.
+			continue
+		}
+		if !within(ext.root, resolved) {
+			os.Remove(link)
+			relative, _ := filepath.Rel(ext.root, link)
+			ext.result.skip(relative, fmt.Errorf("Symlink resolves outside of the target directory"))
+		}
+	}
+
+	return ext.result
+}
+
+// ExtractTar unpacks a tar stream into `target`. Entries that cannot be extracted safely are
+// skipped and listed in the result. An error is only returned when the stream itself is
+// unreadable or the size limit is exceeded.
+//
+// Regular files and directories keep their permission bits, minus setuid, setgid and sticky.
+// Directories are always writable by the owner so the extracted tree can be cleaned up. Device
+// nodes and fifos are skipped.
+func (extractor Extractor) ExtractTar(reader io.Reader, target string) (ExtractResult, error) {
+	ext, err := extractor.newExtraction(target)
+	if err != nil {
+		return ExtractResult{}, err
+	}
+
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return ext.result, errors.Wrap(err, "Failed to read the archive")
+		}
+
+		mode := os.FileMode(header.Mode)
+		switch header.Typeflag {
+		case tar.TypeDir:
+			ext.dir(header.Name, mode)
+		case tar.TypeReg, tar.TypeCont, tar.TypeGNUSparse:
+			if err := ext.file(header.Name, mode, tarReader, header.Size, header.ModTime); err != nil {
+				return ext.result, err
+			}
+		case tar.TypeSymlink:
+			ext.symlink(header.Name, header.Linkname)
+		case tar.TypeLink:
+			ext.hardlink(header.Name, header.Linkname)
+		default:
+			ext.result.skip(header.Name, fmt.Errorf("Unsupported entry type: %q", header.Typeflag))
+		}
+	}
+
+	return ext.finish(), nil
+}
+
+// ExtractZip unpacks a zip archive into `target` with the same guarantees as `ExtractTar`.
+func (extractor Extractor) ExtractZip(reader io.ReaderAt, size int64, target string) (ExtractResult, error) {
+	zipReader, err := zip.NewReader(reader, size)
+	if err != nil {
+		return ExtractResult{}, errors.Wrap(err, "Failed to read the archive")
+	}
+
+	ext, err := extractor.newExtraction(target)
+	if err != nil {
+		return ExtractResult{}, err
+	}
+
+	for _, zipFile := range zipReader.File {
+		mode := zipFile.Mode()
+		switch {
+		case mode.IsDir():
+			ext.dir(zipFile.Name, mode)
+		case mode&os.ModeSymlink != 0:
+			// A zip symlink stores its target as the file contents.
+			linkname, err := readZipEntry(zipFile, 4096)
+			if err != nil {
+				ext.result.skip(zipFile.Name, err)
+				continue
+			}
+			ext.symlink(zipFile.Name, string(linkname))
+		case mode.IsRegular():
+			contents, err := zipFile.Open()
+			if err != nil {
+				ext.result.skip(zipFile.Name, err)
+				continue
+			}
+			err = ext.file(zipFile.Name, mode, contents, int64(zipFile.UncompressedSize64), zipFile.Modified)
+			contents.Close()
+			if err != nil {
+				return ext.result, err
+			}
+		default:
+			ext.result.skip(zipFile.Name, fmt.Errorf("Unsupported entry mode: %v", mode))
+		}
+	}
+
+	return ext.finish(), nil
+}
+
+func readZipEntry(zipFile *zip.File, maxSize int64) ([]byte, error) {
+	contents, err := zipFile.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer contents.Close()
+
+	return io.ReadAll(io.LimitReader(contents, maxSize))
+}
+
+func writeEntryFile(root, path string, mode os.FileMode, contents io.Reader, modTime time.Time) (int64, error) {
+	if err := ensureParents(root, path); err != nil {
+		return 0, err
+	}
+	if err := removeNonDir(path); err != nil {
+		return 0, err
+	}
+
+	// `O_EXCL` guarantees a symlink created in the meantime is not followed.
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+
+	written, err := io.Copy(file, contents)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return written, err
+	}
+
+	if err := os.Chmod(path, mode); err != nil {
+		return written, err
+	}
+	if !modTime.IsZero() {
+		os.Chtimes(path, modTime, modTime)
+	}
+
+	return written, nil
+}
+
+func createSymlink(root, path, linkname string) error {
+	if filepath.IsAbs(linkname) {
+		return fmt.Errorf("Absolute symlink target: %v", linkname)
+	}
+	if !within(root, filepath.Join(filepath.Dir(path), linkname)) {
+		return fmt.Errorf("Symlink target is outside of the target directory: %v", linkname)
+	}
+
+	if err := ensureParents(root, path); err != nil {
+		return err
+	}
+	if err := removeNonDir(path); err != nil {
+		return err
+	}
+	return os.Symlink(linkname, path)
+}
+
+// Hardlink targets are named relative to the archive root.
+func createHardlink(root, path, linkname string) error {
+	linkTarget, err := safeJoin(root, linkname)
+	if err != nil {
+		return err
+	}
+
+	// Linking to a symlink would link to the symlink itself, which may point anywhere
+	// once moved. Only link regular files.
+	info, err := os.Lstat(linkTarget)
+	if err != nil {
+		return errors.Wrap(err, "Hardlink target must be extracted before the link")
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("Hardlink target is not a regular file: %v", linkname)
+	}
+	// Nor may the target be reached through a symlinked directory.
+	if err := ensureParents(root, linkTarget); err != nil {
+		return err
+	}
+
+	if err := ensureParents(root, path); err != nil {
+		return err
+	}
+	if err := removeNonDir(path); err != nil {
+		return err
+	}
+	return os.Link(linkTarget, path)
+}
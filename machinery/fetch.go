@@ -1,92 +1,197 @@
 package machinery
 
 import (
-	"archive/tar"
-	"compress/gzip"
+	"fmt"
 	"io"
 	"io/fs"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+
+	"github.com/pkg/errors"
 )
 
-// TODO: Make the execution parsing robust to the paramter not existing.
-var taskFromUrlRe *regexp.Regexp = regexp.MustCompile("com/task/(.*?)/.*?(?:execution=(\\d+))")
+// TaskRef identifies a single execution of an evergreen task. Restarting a task keeps the task
+// id and bumps the execution number, so the id alone is not enough to name a set of artifacts.
+type TaskRef struct {
+	ID        string
+	Execution int
+}
+
+// LatestExecution stands for whichever execution of a task is the latest. It is resolved to a
+// number before the task is fetched. See `LatestExecutionSource`.
+const LatestExecution = -1
+
+func (task TaskRef) String() string {
+	if task.Execution == LatestExecution {
+		return fmt.Sprintf("%s (latest execution)", task.ID)
+	}
+	return fmt.Sprintf("%s (execution %d)", task.ID, task.Execution)
+}
+
+// ParseTaskRef builds a TaskRef from user input. An empty execution refers to the latest
+// execution, as it does in Spruce.
+func ParseTaskRef(taskId string, execution string) (TaskRef, error) {
+	ret := TaskRef{ID: taskId}
+	if execution == "" {
+		ret.Execution = LatestExecution
+		return ret, nil
+	}
+
+	var err error
+	if ret.Execution, err = strconv.Atoi(execution); err != nil || ret.Execution < 0 {
+		return TaskRef{}, fmt.Errorf("Invalid execution. Execution: %q", execution)
+	}
+
+	return ret, nil
+}
+
+// Spruce puts the execution in the query string while the legacy UI appends it to the path. Like a
+// bare task id, a url without an execution refers to the latest one. See `ParseTaskRef`.
+var taskFromUrlRe *regexp.Regexp = regexp.MustCompile("com/task/([^/?#]+)(?:/(\\d+))?")
+var executionFromUrlRe *regexp.Regexp = regexp.MustCompile("[?&]execution=(\\d+)")
 
-func GetTaskFromUrl(url string) string {
+func GetTaskFromUrl(url string) (TaskRef, error) {
 	// Inp: https://spruce.mongodb.com/task/mongodb_mongo_master_enterprise_rhel_80_64_bit_dynamic_all_feature_flags_required_concurrency_simultaneous_4_linux_enterprise_patch_9c65140283c3f72330a94e58bd9ac2c5bd090ced_63e54b7e9ccd4e19c98bf4c6_23_02_10_19_28_57/files?execution=0&sortBy=STATUS&sortDir=ASC
 	//
-	// Out: mongodb_mongo_master_enterprise_rhel_80_64_bit_dynamic_all_feature_flags_required_concurrency_simultaneous_4_linux_enterprise_patch_9c65140283c3f72330a94e58bd9ac2c5bd090ced_63e54b7e9ccd4e19c98bf4c6_23_02_10_19_28_57
+	// Out: {mongodb_mongo_master_enterprise_rhel_80_64_bit_dynamic_all_feature_flags_required_concurrency_simultaneous_4_linux_enterprise_patch_9c65140283c3f72330a94e58bd9ac2c5bd090ced_63e54b7e9ccd4e19c98bf4c6_23_02_10_19_28_57 0}
+	taskMatch := taskFromUrlRe.FindStringSubmatch(url)
+	if taskMatch == nil {
+		return TaskRef{}, fmt.Errorf("Unable to find a task id in the url. Url: %v", url)
+	}
+
+	execution := taskMatch[2]
+	if executionMatch := executionFromUrlRe.FindStringSubmatch(url); executionMatch != nil {
+		execution = executionMatch[1]
+	}
+	return ParseTaskRef(taskMatch[1], execution)
+}
+
+// FetchPhase describes what a fetch is currently doing.
+type FetchPhase string
+
+const (
+	FetchDownloading FetchPhase = "downloading"
+	FetchExtracting  FetchPhase = "extracting"
+)
+
+// FetchProgress receives updates while a task is fetched. `done` and `total` are byte counts for
+// the current phase. A `total` of 0 means the size is not known.
+type FetchProgress interface {
+	Update(phase FetchPhase, done, total int64)
+}
+
+type noProgress struct{}
+
+func (noProgress) Update(phase FetchPhase, done, total int64) {}
 
-	// TODO: Build a model that supports the execution number.
-	return taskFromUrlRe.FindStringSubmatch(url)[1]
+// progressReader reports the bytes read through it, offset by `base`, as progress of `phase`.
+type progressReader struct {
+	io.Reader
+	progress FetchProgress
+	phase    FetchPhase
+	base     int64
+	read     int64
+	total    int64
 }
 
+func (reader *progressReader) Read(buf []byte) (int, error) {
+	read, err := reader.Reader.Read(buf)
+	reader.read += int64(read)
+	reader.progress.Update(reader.phase, reader.base+reader.read, reader.total)
+	return read, err
+}
+
+// Untar extracts a tarball into `target`. Any entry that could not be extracted safely fails the
+// whole call.
 func Untar(tarball, target string) error {
 	reader, err := os.Open(tarball)
 	if err != nil {
 		return err
 	}
 	defer reader.Close()
-	tarReader := tar.NewReader(reader)
-
-	for {
-		header, err := tarReader.Next()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return err
-		}
-
-		path := filepath.Join(target, header.Name)
-		info := header.FileInfo()
-		if info.IsDir() {
-			if err = os.MkdirAll(path, info.Mode()); err != nil {
-				return err
-			}
-			continue
-		}
 
-		file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
-		if err != nil {
-			return err
-		}
-		defer file.Close()
-		_, err = io.Copy(file, tarReader)
-		if err != nil {
-			return err
-		}
+	result, err := Extractor{}.ExtractTar(reader, target)
+	if err != nil {
+		return err
 	}
+	if len(result.Skipped) > 0 {
+		return fmt.Errorf("Failed to extract %d entries. First: %v", len(result.Skipped), result.Skipped[0])
+	}
+
 	return nil
 }
 
+// UnGzip decompresses `source` into the `target` directory. Any format understood by
+// `ExtractArchive` is accepted, including multi-member gzip files.
 func UnGzip(source, target string) error {
-	reader, err := os.Open(source)
+	result, err := Extractor{}.ExtractArchive(source, target, nil)
 	if err != nil {
 		return err
 	}
-	defer reader.Close()
-
-	archive, err := gzip.NewReader(reader)
-	if err != nil {
-		return err
+	if len(result.Skipped) > 0 {
+		return result.Skipped[0]
 	}
-	defer archive.Close()
 
-	target = filepath.Join(target, archive.Name)
-	writer, err := os.Create(target)
-	if err != nil {
-		return err
+	return nil
+}
+
+// ArchivedDBPath is a dbpath found in one of a task's data archives. `DBPath` is relative to the
+// directory the task was downloaded into and `Archive` is the file name of the archive.
+type ArchivedDBPath struct {
+	DBPath  string
+	Archive string
+}
+
+// archiveSubdir names the directory an archive is extracted into, e.g:
+// `mongo-data-job0.tgz` -> `mongo-data-job0`.
+func archiveSubdir(archive string) string {
+	name := filepath.Base(archive)
+	for _, ext := range []string{
+		".tar.gz", ".tgz", ".tar.zst", ".tzst", ".tar.xz", ".txz", ".tar.bz2", ".tbz2",
+		".tar", ".zip", ".gz", ".zst", ".xz", ".bz2",
+	} {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext)
+		}
 	}
-	defer writer.Close()
 
-	_, err = io.Copy(writer, archive)
-	return err
+	return name
+}
+
+// FindDBPaths returns every directory under `dir` that contains a `WiredTiger` file. The paths
+// are relative to `dir`.
+func FindDBPaths(dir string) []string {
+	dbpaths := make([]string, 0)
+	fs.WalkDir(os.DirFS(dir), ".", func(path string, dir fs.DirEntry, err error) error {
+		if err != nil {
+			panic(err)
+		}
+
+		if dir.Name() == "WiredTiger" {
+			dbpaths = append(dbpaths, filepath.Dir(path))
+		}
+		return nil
+	})
+
+	return dbpaths
+}
+
+// SkippedEntry is an entry of a data archive that was not extracted.
+type SkippedEntry struct {
+	Archive string
+	EntryError
+}
+
+func (entry SkippedEntry) Describe() string {
+	return fmt.Sprintf("%s: %v", entry.Archive, entry.EntryError)
 }
 
-func FetchArtifactsForTask(task string, target string) []string {
+// FetchArtifactsForTask extracts every data archive of the task into its own directory under
+// `target + "dbpath/"`. `progress` may be nil.
+func FetchArtifactsForTask(source ArtifactSource, task TaskRef, target string, progress FetchProgress) ([]ArchivedDBPath, []SkippedEntry) {
 	if !strings.HasSuffix(target, "/") {
 		panic("needs trailing /")
 	}
@@ -99,68 +204,86 @@ func FetchArtifactsForTask(task string, target string) []string {
 		panic(err)
 	}
 
-	evg := exec.Command("evergreen", "fetch", "--task", task, "--artifacts", "--shallow", "--dir", target)
-	if err := evg.Run(); err != nil {
-		panic(err)
+	if progress == nil {
+		progress = noProgress{}
 	}
 
-	dir := os.DirFS(target)
-	matches, err := fs.Glob(dir, "artifacts-*/mongo-data-*")
+	archives, err := source.FetchDataArchives(task, target, progress)
 	if err != nil {
 		panic(err)
 	}
-
-	dataTgz, err := os.Open(target + matches[0])
-	if err != nil {
-		panic(err)
+	if len(archives) == 0 {
+		panic(fmt.Sprintf("No data archives for task. Task: %v", task))
 	}
 
-	gzReader, err := gzip.NewReader(dataTgz)
-	if err != nil {
-		panic(err)
-	}
-
-	tarReader := tar.NewReader(gzReader)
-	for {
-		header, tarErr := tarReader.Next()
-		if tarErr == io.EOF {
-			break
-		}
+	return ExtractDataArchives(archives, target, progress)
+}
 
-		path := filepath.Join(target+"dbpath", header.Name)
-		info := header.FileInfo()
-		if info.IsDir() {
-			if err = os.MkdirAll(path, 0755); err != nil {
-				panic(err)
-			}
-			continue
-		}
+// ExtractDataArchives extracts each archive into its own directory under `target + "dbpath/"` and
+// returns the dbpaths found, and the entries that could not be extracted safely. `progress` may be
+// nil.
+func ExtractDataArchives(archives []string, target string, progress FetchProgress) ([]ArchivedDBPath, []SkippedEntry) {
+	if progress == nil {
+		progress = noProgress{}
+	}
 
-		out, err := os.Create(path)
+	var extractTotal int64
+	for _, archive := range archives {
+		info, err := os.Stat(archive)
 		if err != nil {
 			panic(err)
 		}
+		extractTotal += info.Size()
+	}
+	progress.Update(FetchExtracting, 0, extractTotal)
+	// `extracted` counts archive bytes read for progress. `extractedBytes` counts the file
+	// contents written.
+	var extracted, extractedBytes int64
+
+	ret := make([]ArchivedDBPath, 0)
+	skipped := make([]SkippedEntry, 0)
+	usedSubdirs := make(map[string]bool)
+	for _, archive := range archives {
+		// Archives from different artifact directories may share a name.
+		subdir := archiveSubdir(archive)
+		for suffix := 1; usedSubdirs[subdir]; suffix++ {
+			subdir = fmt.Sprintf("%s_%d", archiveSubdir(archive), suffix)
+		}
+		usedSubdirs[subdir] = true
 
-		written, err := io.Copy(out, tarReader)
-		if err != nil {
+		extractDir := target + "dbpath/" + subdir
+		if err := os.MkdirAll(extractDir, 0755); err != nil {
 			panic(err)
 		}
-		if written != header.Size {
-			panic("bad size")
+		// The size limit applies to the task as a whole.
+		extractor := DefaultExtractor
+		if extractor.MaxTotalSize > 0 {
+			extractor.MaxTotalSize -= extractedBytes
+			if extractor.MaxTotalSize <= 0 {
+				panic(fmt.Sprintf("Task exceeds the extraction limit of %d bytes", DefaultExtractor.MaxTotalSize))
+			}
 		}
-	}
-
-	dbpaths := make([]string, 0)
-	fs.WalkDir(os.DirFS(target+"dbpath/"), ".", func(path string, dir fs.DirEntry, err error) error {
+		var archiveRead int64
+		result, err := extractor.ExtractArchive(archive, extractDir, func(read int64) {
+			archiveRead = read
+			progress.Update(FetchExtracting, extracted+read, extractTotal)
+		})
 		if err != nil {
-			panic(err)
+			panic(errors.Wrap(err, fmt.Sprintf("Failed to extract archive. Archive: %v", archive)))
+		}
+		extracted += archiveRead
+		extractedBytes += result.Bytes
+		for _, entryErr := range result.Skipped {
+			skipped = append(skipped, SkippedEntry{filepath.Base(archive), entryErr})
 		}
 
-		if dir.Name() == "WiredTiger" {
-			dbpaths = append(dbpaths, "dbpath/"+filepath.Dir(path))
+		for _, dbpath := range FindDBPaths(extractDir) {
+			ret = append(ret, ArchivedDBPath{
+				DBPath:  "dbpath/" + subdir + "/" + dbpath,
+				Archive: filepath.Base(archive),
+			})
 		}
-		return nil
-	})
+	}
 
-	return dbpaths
+	return ret, skipped
 }
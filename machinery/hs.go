@@ -0,0 +1,206 @@
+package machinery
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// The history store keeps the older versions of records that checkpoints and readers at earlier
+// timestamps may still need. It is a single WiredTiger file for every table.
+const historyStoreTable = "WiredTigerHS"
+
+// HSUpdateType is how a history store value relates to the version before it.
+type HSUpdateType uint64
+
+const (
+	// The value is a list of modifications to the next newer version.
+	HSUpdateModify HSUpdateType = 1
+	// The value is the whole record.
+	HSUpdateStandard HSUpdateType = 3
+)
+
+func (updateType HSUpdateType) String() string {
+	switch updateType {
+	case HSUpdateModify:
+		return "modify"
+	case HSUpdateStandard:
+		return "standard"
+	}
+	return fmt.Sprintf("unknown(%d)", uint64(updateType))
+}
+
+// HSRecord is one history store record. The key has the format `IuQQ` and the value `QQQu`.
+type HSRecord struct {
+	// The `id=` of the file the version belongs to. See `WTList.FileIdToTable`.
+	BtreeId uint32
+	Key     []byte
+	StartTs Timestamp
+	// Orders versions of the same key with the same start timestamp.
+	Counter       uint64
+	StopDurableTs Timestamp
+	DurableTs     Timestamp
+	UpdateType    HSUpdateType
+	Value         []byte
+}
+
+// ParseHSRecord unpacks a record of `wt dump -x file:WiredTigerHS.wt`.
+func ParseHSRecord(entry DumpEntry) (HSRecord, error) {
+	var ret HSRecord
+	keyUnpacker := &wtUnpacker{buf: entry.Key}
+	ret.BtreeId, ret.Key = uint32(keyUnpacker.Uint()), keyUnpacker.Item()
+	ret.StartTs, ret.Counter = Timestamp(keyUnpacker.Uint()), keyUnpacker.Uint()
+	if keyUnpacker.err != nil {
+		return ret, errors.Wrap(keyUnpacker.err, "Failed to unpack a history store key")
+	}
+
+	valueUnpacker := &wtUnpacker{buf: entry.Value}
+	ret.StopDurableTs, ret.DurableTs = Timestamp(valueUnpacker.Uint()), Timestamp(valueUnpacker.Uint())
+	ret.UpdateType, ret.Value = HSUpdateType(valueUnpacker.Uint()), valueUnpacker.Rest()
+	if valueUnpacker.err != nil {
+		return ret, errors.Wrap(valueUnpacker.err, "Failed to unpack a history store value")
+	}
+
+	return ret, nil
+}
+
+// HSVersion is a history store record named by the catalog and decoded for display.
+type HSVersion struct {
+	Table     string
+	Namespace string
+	Index     string
+	// Empty when the key is not a RecordId.
+	RecordId      string
+	KeyHex        string
+	StartTs       Timestamp
+	Counter       uint64
+	StopDurableTs Timestamp
+	DurableTs     Timestamp
+	UpdateType    string
+	// Extended JSON of whole collection records. Otherwise the value is hex.
+	Document string
+	ValueHex string
+}
+
+func newHSVersion(record HSRecord, catalog *Catalog, list *WTList) HSVersion {
+	ret := HSVersion{
+		Table:         list.FileIdToTable[int64(record.BtreeId)],
+		KeyHex:        hex.EncodeToString(record.Key),
+		StartTs:       record.StartTs,
+		Counter:       record.Counter,
+		StopDurableTs: record.StopDurableTs,
+		DurableTs:     record.DurableTs,
+		UpdateType:    record.UpdateType.String(),
+	}
+	if ret.Table == "" {
+		ret.Table = fmt.Sprintf("unknown(id=%d)", record.BtreeId)
+	}
+	ret.Namespace, ret.Index = catalog.TableOwner(ret.Table)
+
+	switch {
+	case IsCollection(ret.Table):
+		if recordId, ok := CollectionRecordId(record.Key); ok {
+			ret.RecordId = strconv.FormatInt(recordId, 10)
+		}
+	case IsIndex(ret.Table):
+		if _, recordId, ok := SplitKeyStringRecordId(record.Key); ok {
+			ret.RecordId = strconv.FormatInt(recordId, 10)
+		}
+	}
+
+	if IsCollection(ret.Table) && record.UpdateType == HSUpdateStandard {
+		if document, err := MayMarshal(record.Value, ""); err == nil {
+			ret.Document = string(document)
+		}
+	}
+	if ret.Document == "" {
+		ret.ValueHex = hex.EncodeToString(record.Value)
+	}
+
+	return ret
+}
+
+// WriteHistoryStore decodes every history store record into `outputFile`, one JSON object per
+// line. Dbpaths from before the history store existed get an empty file. The file is only created
+// once every record was decoded.
+func WriteHistoryStore(ctx context.Context, home WTHome, catalog *Catalog, list *WTList, outputFile string) (err error) {
+	output, err := os.Create(outputFile + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		output.Close()
+		if err == nil {
+			err = os.Rename(outputFile+".tmp", outputFile)
+		}
+		if err != nil {
+			os.Remove(outputFile + ".tmp")
+		}
+	}()
+
+	if _, exists := list.TableToFileId[historyStoreTable]; !exists {
+		return nil
+	}
+
+	reader, err := home.OpenDump(ctx, "file:"+historyStoreTable+".wt")
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	writer := bufio.NewWriter(output)
+	encoder := json.NewEncoder(writer)
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		record, err := ParseHSRecord(entry)
+		if err != nil {
+			return err
+		}
+		if err := encoder.Encode(newHSVersion(record, catalog, list)); err != nil {
+			return err
+		}
+	}
+
+	return writer.Flush()
+}
+
+// ReadHistoryStore returns up to `limit` versions written by WriteHistoryStore that `filter`
+// accepts. `more` is true when others were accepted too.
+func ReadHistoryStore(historyFile string, filter func(*HSVersion) bool, limit int) (versions []HSVersion, more bool, err error) {
+	input, err := os.Open(historyFile)
+	if err != nil {
+		return nil, false, err
+	}
+	defer input.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(input))
+	for {
+		var version HSVersion
+		if err := decoder.Decode(&version); err == io.EOF {
+			return versions, false, nil
+		} else if err != nil {
+			return nil, false, errors.Wrap(err, fmt.Sprintf("Malformed history store file. File: %v", historyFile))
+		}
+
+		if !filter(&version) {
+			continue
+		}
+		if len(versions) == limit {
+			return versions, true, nil
+		}
+		versions = append(versions, version)
+	}
+}
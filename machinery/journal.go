@@ -0,0 +1,547 @@
+package machinery
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// Every journal record starts with a 16 byte header:
+//
+//	00-03 length of the record, including the header and padding
+//	04-07 CRC32C checksum of the record, computed with the checksum field zeroed
+//	08-09 flags
+//	10-11 unused
+//	12-15 length of the uncompressed record, if compressed
+//
+// Records are padded to a multiple of 128 bytes. The first record of a file holds the log file
+// description. A zero length marks the end of the file's records.
+const (
+	logRecordHeaderSize = 16
+	logMagic            = 0x101064
+
+	logRecordCompressed = 0x01
+	logRecordEncrypted  = 0x02
+
+	// Operations on tables that are not logged for recovery, written with `debug_mode`, have this
+	// bit set on their file id.
+	logOpIgnoreFileID = 0x80000000
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+type LogRecordType uint32
+
+const (
+	LogRecordCheckpoint LogRecordType = 0
+	LogRecordCommit     LogRecordType = 1
+	LogRecordFileSync   LogRecordType = 2
+	LogRecordMessage    LogRecordType = 3
+	LogRecordSystem     LogRecordType = 4
+)
+
+var logRecordTypeNames = map[LogRecordType]string{
+	LogRecordCheckpoint: "checkpoint",
+	LogRecordCommit:     "commit",
+	LogRecordFileSync:   "file_sync",
+	LogRecordMessage:    "message",
+	LogRecordSystem:     "system",
+}
+
+func (recordType LogRecordType) String() string {
+	if name, exists := logRecordTypeNames[recordType]; exists {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", uint32(recordType))
+}
+
+type OpType uint32
+
+// The numbering is WiredTiger's. Operations added later were given the next free number.
+const (
+	OpColPut          OpType = 1
+	OpColRemove       OpType = 2
+	OpColTruncate     OpType = 3
+	OpRowPut          OpType = 4
+	OpRowRemove       OpType = 5
+	OpRowTruncate     OpType = 6
+	OpCheckpointStart OpType = 7
+	OpPrevLSN         OpType = 8
+	OpColModify       OpType = 9
+	OpRowModify       OpType = 10
+	OpTxnTimestamp    OpType = 11
+	OpBackupID        OpType = 12
+)
+
+var opTypeNames = map[OpType]string{
+	OpColPut:          "col_put",
+	OpColRemove:       "col_remove",
+	OpColTruncate:     "col_truncate",
+	OpRowPut:          "row_put",
+	OpRowRemove:       "row_remove",
+	OpRowTruncate:     "row_truncate",
+	OpCheckpointStart: "checkpoint_start",
+	OpPrevLSN:         "prev_lsn",
+	OpColModify:       "col_modify",
+	OpRowModify:       "row_modify",
+	OpTxnTimestamp:    "txn_timestamp",
+	OpBackupID:        "backup_id",
+}
+
+func (opType OpType) String() string {
+	if name, exists := opTypeNames[opType]; exists {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", uint32(opType))
+}
+
+// LSN is the position of a record in the journal: the log file number and the byte offset.
+type LSN struct {
+	File   uint32
+	Offset uint32
+}
+
+func (lsn LSN) String() string {
+	return fmt.Sprintf("[%d,%d]", lsn.File, lsn.Offset)
+}
+
+func (lsn LSN) Less(other LSN) bool {
+	return lsn.File < other.File || (lsn.File == other.File && lsn.Offset < other.Offset)
+}
+
+// Op is one operation of a commit or system record. Only the fields of the operation's type are
+// set.
+type Op struct {
+	Type OpType
+	// As written, including the `logOpIgnoreFileID` bit. See `TableFileID`.
+	FileID uint32
+	// row_put, row_modify and row_remove. A row_modify value is a list of modifications rather
+	// than a whole value.
+	Key   []byte
+	Value []byte
+	// col_put, col_modify and col_remove.
+	Recno uint64
+	// row_truncate. Empty keys truncate from the start or to the end of the table.
+	Start []byte
+	Stop  []byte
+	Mode  uint32
+	// col_truncate.
+	StartRecno uint64
+	StopRecno  uint64
+	// prev_lsn. The last record of the previous log file.
+	PrevLSN LSN
+	// txn_timestamp.
+	TimeSec       uint64
+	TimeNsec      uint64
+	CommitTS      uint64
+	DurableTS     uint64
+	FirstCommitTS uint64
+	PrepareTS     uint64
+	ReadTS        uint64
+	// backup_id.
+	Index       uint32
+	Granularity uint64
+	ID          string
+}
+
+// TableFileID is the id of the table written to, i.e: the `id` in the table's `wt list -v`
+// metadata.
+func (op *Op) TableFileID() uint32 {
+	return op.FileID &^ logOpIgnoreFileID
+}
+
+// IsIgnored is true for writes to tables that are not logged for recovery. They are only in the
+// journal for debugging.
+func (op *Op) IsIgnored() bool {
+	return op.FileID&logOpIgnoreFileID != 0
+}
+
+// LogRecord is one record of the journal. Only the fields of the record's type are set.
+type LogRecord struct {
+	LSN        LSN
+	Compressed bool
+	// The on disk length, including padding, and the uncompressed length.
+	RecLen uint32
+	MemLen uint32
+	Type   LogRecordType
+	// commit.
+	TxnID uint64
+	// commit and system.
+	Ops []Op
+	// checkpoint.
+	CheckpointLSN LSN
+	// file_sync.
+	FileID uint32
+	Start  int64
+	// message.
+	Message string
+}
+
+// JournalFiles returns the `WiredTigerLog.*` files of a journal directory in LSN order.
+func JournalFiles(journalDir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(journalDir, "WiredTigerLog.*"))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(paths, func(left, right int) bool {
+		leftNum, _ := journalFileNumber(paths[left])
+		rightNum, _ := journalFileNumber(paths[right])
+		return leftNum < rightNum
+	})
+	return paths, nil
+}
+
+// journalFileNumber parses e.g: `WiredTigerLog.0000000003` as 3.
+func journalFileNumber(path string) (uint32, error) {
+	_, suffix, _ := strings.Cut(filepath.Base(path), ".")
+	ret, err := strconv.ParseUint(suffix, 10, 32)
+	return uint32(ret), err
+}
+
+// JournalReader iterates over the records of a dbpath's journal without running `wt`.
+type JournalReader struct {
+	// One of `snappy`, `zstd` or `zlib`. When empty, the compressor of each compressed record is
+	// detected from its contents.
+	Compressor string
+	// Set when the last log file ends with a partially written record. Recovery stops at the same
+	// point, so this is not an error.
+	TornTail error
+
+	files    []string
+	fileIdx  int
+	file     *os.File
+	fileNum  uint32
+	fileSize int64
+	offset   int64
+	zstd     *zstd.Decoder
+	err      error
+}
+
+// OpenJournal reads the journal in `journalDir`, typically `<dbpath>/journal`.
+func OpenJournal(journalDir string) (*JournalReader, error) {
+	files, err := JournalFiles(journalDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("No journal files found. Dir: %v", journalDir)
+	}
+
+	return &JournalReader{files: files}, nil
+}
+
+func (reader *JournalReader) Close() error {
+	if reader.zstd != nil {
+		reader.zstd.Close()
+		reader.zstd = nil
+	}
+	return reader.closeFile()
+}
+
+func (reader *JournalReader) closeFile() error {
+	if reader.file == nil {
+		return nil
+	}
+
+	err := reader.file.Close()
+	reader.file = nil
+	return err
+}
+
+// Next returns the next record, or `io.EOF` after the last one.
+func (reader *JournalReader) Next() (*LogRecord, error) {
+	for reader.err == nil {
+		if reader.file == nil {
+			if reader.fileIdx == len(reader.files) {
+				reader.err = io.EOF
+				break
+			}
+			if err := reader.openFile(reader.files[reader.fileIdx]); err != nil {
+				reader.err = err
+				break
+			}
+		}
+
+		record, err := reader.readRecord()
+		if err == io.EOF {
+			reader.closeFile()
+			reader.fileIdx++
+			continue
+		}
+		if errors.Cause(err) == errTornRecord {
+			// Only the end of the journal may be torn. Otherwise records recovery would replay
+			// are missing.
+			if reader.fileIdx == len(reader.files)-1 {
+				reader.TornTail = err
+				reader.closeFile()
+				reader.fileIdx++
+				continue
+			}
+		}
+		if err != nil {
+			reader.err = err
+			break
+		}
+
+		return record, nil
+	}
+
+	return nil, reader.err
+}
+
+func (reader *JournalReader) openFile(path string) error {
+	fileNum, err := journalFileNumber(path)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("Unexpected journal file name. Path: %v", path))
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	reader.file, reader.fileNum, reader.fileSize, reader.offset = file, fileNum, info.Size(), 0
+
+	// The first record describes the file rather than holding data.
+	header, err := reader.readRaw()
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("Failed to read the log file description. Path: %v", path))
+	}
+	if len(header) < logRecordHeaderSize+16 || binary.LittleEndian.Uint32(header[logRecordHeaderSize:]) != logMagic {
+		return fmt.Errorf("Not a WiredTiger log file. Path: %v", path)
+	}
+	reader.offset += int64(len(header))
+
+	return nil
+}
+
+var errTornRecord = errors.New("Partially written log record")
+
+// readRaw reads the record at the current offset, including its header, and verifies its
+// checksum. Returns `io.EOF` at the end of the file's records.
+func (reader *JournalReader) readRaw() ([]byte, error) {
+	lsn := LSN{reader.fileNum, uint32(reader.offset)}
+	if reader.offset+logRecordHeaderSize > reader.fileSize {
+		return nil, io.EOF
+	}
+
+	header := make([]byte, logRecordHeaderSize)
+	if _, err := reader.file.ReadAt(header, reader.offset); err != nil {
+		return nil, err
+	}
+	length := binary.LittleEndian.Uint32(header[0:])
+	if length == 0 {
+		return nil, io.EOF
+	}
+	if length < logRecordHeaderSize || reader.offset+int64(length) > reader.fileSize {
+		return nil, errors.Wrap(errTornRecord, fmt.Sprintf("Bad record length. LSN: %v Length: %v", lsn, length))
+	}
+
+	ret := make([]byte, length)
+	if _, err := reader.file.ReadAt(ret, reader.offset); err != nil {
+		return nil, err
+	}
+	checksum := binary.LittleEndian.Uint32(ret[4:])
+	binary.LittleEndian.PutUint32(ret[4:], 0)
+	if crc32.Checksum(ret, castagnoliTable) != checksum {
+		return nil, errors.Wrap(errTornRecord, fmt.Sprintf("Checksum mismatch. LSN: %v", lsn))
+	}
+	binary.LittleEndian.PutUint32(ret[4:], checksum)
+
+	return ret, nil
+}
+
+func (reader *JournalReader) readRecord() (*LogRecord, error) {
+	lsn := LSN{reader.fileNum, uint32(reader.offset)}
+	raw, err := reader.readRaw()
+	if err != nil {
+		return nil, err
+	}
+	reader.offset += int64(len(raw))
+
+	flags := binary.LittleEndian.Uint16(raw[8:])
+	ret := &LogRecord{
+		LSN:        lsn,
+		Compressed: flags&logRecordCompressed != 0,
+		RecLen:     uint32(len(raw)),
+		MemLen:     uint32(len(raw)),
+	}
+	if flags&logRecordEncrypted != 0 {
+		return nil, fmt.Errorf("Encrypted log records are not supported. LSN: %v", lsn)
+	}
+
+	body := raw[logRecordHeaderSize:]
+	if ret.Compressed {
+		ret.MemLen = binary.LittleEndian.Uint32(raw[12:])
+		if ret.MemLen < logRecordHeaderSize {
+			return nil, fmt.Errorf("Bad uncompressed record length. LSN: %v Length: %v", lsn, ret.MemLen)
+		}
+		if body, err = reader.decompress(body, int(ret.MemLen-logRecordHeaderSize)); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("Failed to decompress log record. LSN: %v", lsn))
+		}
+	}
+
+	if err := parseLogRecord(ret, body); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Failed to parse log record. LSN: %v", lsn))
+	}
+	return ret, nil
+}
+
+// decompress undoes the journal compressor. WiredTiger's snappy and zstd compressors prefix the
+// compressed bytes with their 8 byte length. The zlib compressor writes a plain zlib stream.
+func (reader *JournalReader) decompress(compressed []byte, memLen int) ([]byte, error) {
+	compressor := reader.Compressor
+	if compressor == "" {
+		compressor = detectLogCompressor(compressed)
+	}
+
+	var ret []byte
+	var err error
+	switch compressor {
+	case "snappy", "zstd":
+		if len(compressed) < 8 {
+			return nil, fmt.Errorf("Compressed record is too short")
+		}
+		length := binary.LittleEndian.Uint64(compressed)
+		if length > uint64(len(compressed)-8) {
+			return nil, fmt.Errorf("Bad compressed length. Length: %v", length)
+		}
+		compressed = compressed[8 : 8+length]
+		if compressor == "snappy" {
+			ret, err = snappy.Decode(nil, compressed)
+			break
+		}
+		if reader.zstd == nil {
+			if reader.zstd, err = zstd.NewReader(nil); err != nil {
+				return nil, err
+			}
+		}
+		ret, err = reader.zstd.DecodeAll(compressed, nil)
+	case "zlib":
+		var zlibReader io.ReadCloser
+		if zlibReader, err = zlib.NewReader(bytes.NewReader(compressed)); err == nil {
+			ret, err = io.ReadAll(io.LimitReader(zlibReader, int64(memLen)+1))
+			zlibReader.Close()
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported compressor. Compressor: %q", compressor)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, compressor)
+	}
+	if len(ret) != memLen {
+		return nil, fmt.Errorf("Unexpected uncompressed length. Compressor: %v Expected: %v Actual: %v", compressor, memLen, len(ret))
+	}
+
+	return ret, nil
+}
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+func detectLogCompressor(compressed []byte) string {
+	if len(compressed) >= 12 && bytes.Equal(compressed[8:12], zstdMagic) {
+		return "zstd"
+	}
+	// A zlib header is a compression method of 8 and a check value making it a multiple of 31.
+	if len(compressed) >= 2 && compressed[0]&0x0f == 8 && (uint16(compressed[0])<<8|uint16(compressed[1]))%31 == 0 {
+		if length := binary.LittleEndian.Uint64(compressed); length > uint64(len(compressed)-8) {
+			return "zlib"
+		}
+	}
+	// MongoDB's default.
+	return "snappy"
+}
+
+func parseLogRecord(record *LogRecord, body []byte) error {
+	unpacker := &wtUnpacker{buf: body}
+	record.Type = LogRecordType(unpacker.Uint())
+	switch record.Type {
+	case LogRecordCheckpoint:
+		record.CheckpointLSN = LSN{uint32(unpacker.Uint()), uint32(unpacker.Uint())}
+	case LogRecordCommit:
+		record.TxnID = unpacker.Uint()
+		record.Ops = parseLogOps(unpacker)
+	case LogRecordFileSync:
+		record.FileID = uint32(unpacker.Uint())
+		record.Start = unpacker.Int()
+	case LogRecordMessage:
+		record.Message = unpacker.String()
+	case LogRecordSystem:
+		record.Ops = parseLogOps(unpacker)
+	default:
+		return fmt.Errorf("Unknown log record type. Type: %d", uint32(record.Type))
+	}
+
+	return unpacker.err
+}
+
+// parseLogOps reads operations until the end of the record. Records are zero padded and no
+// operation starts with a zero byte.
+func parseLogOps(unpacker *wtUnpacker) []Op {
+	ret := make([]Op, 0)
+	for !unpacker.done() && unpacker.buf[unpacker.pos] != 0 {
+		start := unpacker.pos
+		opType := OpType(unpacker.Uint())
+		// The size includes the type and size fields.
+		size := unpacker.Uint()
+		if unpacker.err != nil {
+			break
+		}
+		if size > uint64(len(unpacker.buf)-start) {
+			unpacker.fail("Bad operation size. Size: %v", size)
+			break
+		}
+
+		// The last item of each operation has no length. It ends where the operation ends.
+		opUnpacker := &wtUnpacker{buf: unpacker.buf[:start+int(size)], pos: unpacker.pos}
+		op := Op{Type: opType}
+		switch opType {
+		case OpColPut, OpColModify:
+			op.FileID, op.Recno, op.Value = uint32(opUnpacker.Uint()), opUnpacker.Uint(), opUnpacker.Rest()
+		case OpColRemove:
+			op.FileID, op.Recno = uint32(opUnpacker.Uint()), opUnpacker.Uint()
+		case OpColTruncate:
+			op.FileID, op.StartRecno, op.StopRecno = uint32(opUnpacker.Uint()), opUnpacker.Uint(), opUnpacker.Uint()
+		case OpRowPut, OpRowModify:
+			op.FileID, op.Key, op.Value = uint32(opUnpacker.Uint()), opUnpacker.Item(), opUnpacker.Rest()
+		case OpRowRemove:
+			op.FileID, op.Key = uint32(opUnpacker.Uint()), opUnpacker.Rest()
+		case OpRowTruncate:
+			op.FileID, op.Start, op.Stop, op.Mode = uint32(opUnpacker.Uint()), opUnpacker.Item(), opUnpacker.Item(), uint32(opUnpacker.Uint())
+		case OpCheckpointStart:
+		case OpPrevLSN:
+			op.PrevLSN = LSN{uint32(opUnpacker.Uint()), uint32(opUnpacker.Uint())}
+		case OpTxnTimestamp:
+			op.TimeSec, op.TimeNsec = opUnpacker.Uint(), opUnpacker.Uint()
+			op.CommitTS, op.DurableTS, op.FirstCommitTS = opUnpacker.Uint(), opUnpacker.Uint(), opUnpacker.Uint()
+			op.PrepareTS, op.ReadTS = opUnpacker.Uint(), opUnpacker.Uint()
+		case OpBackupID:
+			op.Index, op.Granularity, op.ID = uint32(opUnpacker.Uint()), opUnpacker.Uint(), opUnpacker.String()
+		}
+		if opUnpacker.err != nil {
+			unpacker.fail("Failed to parse %v operation. Err: %v", opType, opUnpacker.err)
+			break
+		}
+
+		ret = append(ret, op)
+		unpacker.pos = start + int(size)
+	}
+
+	return ret
+}
@@ -0,0 +1,174 @@
+package machinery
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// A KeyString ends its values with this byte. An index key's RecordId follows it.
+const keyStringEnd = 0x04
+
+// decodeRecordIdLong reads a RecordId as MongoDB appends it to a KeyString. The number of bytes
+// between the first and last byte, N, is in the high 3 bits of the first byte and the low 3 bits
+// of the last byte, such that it can be read from either end:
+//
+//	[NNN vvvvv] [N bytes of v] [vvvvv NNN]
+//
+// The value is big endian.
+func decodeRecordIdLong(encoded []byte) int64 {
+	var ret uint64 = uint64(encoded[0] & 0x1f)
+	for _, byt := range encoded[1 : len(encoded)-1] {
+		ret = ret<<8 | uint64(byt)
+	}
+	return int64(ret<<5 | uint64(encoded[len(encoded)-1]>>3))
+}
+
+// SplitKeyStringRecordId separates an index key into its KeyString and the RecordId appended to
+// it. `ok` is false for keys without a RecordId, e.g: unique indexes, which keep the RecordId in
+// the value. See `ValueRecordId`.
+func SplitKeyStringRecordId(key []byte) (keyString []byte, recordId int64, ok bool) {
+	if len(key) < 3 {
+		return key, 0, false
+	}
+
+	extraBytes := int(key[len(key)-1] & 0x07)
+	start := len(key) - extraBytes - 2
+	if start < 1 || int(key[start]>>5) != extraBytes || key[start-1] != keyStringEnd {
+		return key, 0, false
+	}
+
+	return key[:start], decodeRecordIdLong(key[start:]), true
+}
+
+// ValueRecordId reads the RecordId at the start of a unique index's value. The rest of the value
+// is the key's TypeBits.
+func ValueRecordId(value []byte) (recordId int64, typeBits []byte, ok bool) {
+	if len(value) < 2 {
+		return 0, value, false
+	}
+
+	length := int(value[0]>>5) + 2
+	if length > len(value) || int(value[length-1]&0x07) != length-2 {
+		return 0, value, false
+	}
+
+	return decodeRecordIdLong(value[:length]), value[length:], true
+}
+
+// SplitKeyStringRecordIdStr separates an index key of a clustered collection into its KeyString and
+// the string RecordId appended to it. The RecordId's length follows it, 7 bits per byte, and is
+// read from the end. Every byte but the last one read has its top bit set.
+func SplitKeyStringRecordIdStr(key []byte) (keyString []byte, recordId []byte, ok bool) {
+	length, end := 0, len(key)
+	for idx := 0; ; idx++ {
+		if end == 0 || idx == 4 {
+			return key, nil, false
+		}
+		end--
+		length |= int(key[end]&0x7f) << (7 * idx)
+		if key[end]&0x80 == 0 {
+			break
+		}
+	}
+
+	start := end - length
+	if start < 1 || key[start-1] != keyStringEnd {
+		return key, nil, false
+	}
+	return key[:start], key[start:end], true
+}
+
+// DecodeClusteredRecordId describes the RecordId of a clustered collection, which is the KeyString
+// of the record's `_id`, e.g: `{"_id":{"$oid":"6439840a5abe13336b194496"}}`. Its TypeBits are not
+// kept, numbers decode as ints and longs.
+func DecodeClusteredRecordId(recordId []byte) (string, error) {
+	key, err := DecodeKeyString(recordId, nil, bson.D{{Key: "_id", Value: int32(1)}}, KeyStringV1)
+	if err != nil {
+		return "", err
+	}
+	return IndexKey{Key: key}.Describe(), nil
+}
+
+// CollectionRecordId reads the key of a collection table. Collections are keyed by a packed
+// 64 bit integer, except clustered collections, whose RecordIds are KeyStrings.
+func CollectionRecordId(key []byte) (int64, bool) {
+	unpacker := &wtUnpacker{buf: key}
+	ret := unpacker.Int()
+	if unpacker.err != nil || unpacker.pos != len(key) {
+		return 0, false
+	}
+	return ret, true
+}
+
+// IndexKeyPattern parses an index's `Definition`, e.g: `{"a":1,"b":-1}`.
+func IndexKeyPattern(indexInfo *IndexInfo) (bson.D, error) {
+	var ret bson.D
+	if err := bson.UnmarshalExtJSON([]byte(indexInfo.Definition), false, &ret); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Failed to parse the index key pattern. Index: %v Spec: %v",
+			indexInfo.Name, indexInfo.Definition))
+	}
+	return ret, nil
+}
+
+// HasDescendingField is true when any field of the key pattern sorts in descending order. The
+// bytes of those fields are inverted in the index's KeyStrings.
+func HasDescendingField(keyPattern bson.D) bool {
+	for _, elem := range keyPattern {
+		if isDescending(elem.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// IndexKey is an index entry decoded into its key, RecordId and TypeBits.
+type IndexKey struct {
+	Key bson.D
+	// Empty when the entry's RecordId could not be read.
+	RecordId string
+	TypeBits []byte
+}
+
+// Describe writes the key as extended JSON, e.g: `{"a":1,"b":"x"}`.
+func (key IndexKey) Describe() string {
+	ret, err := bson.MarshalExtJSON(key.Key, false, false)
+	if err != nil {
+		return fmt.Sprintf("%v", key.Key)
+	}
+	return string(ret)
+}
+
+// DecodeIndexEntry splits an entry of the index's table into its KeyString, RecordId and TypeBits
+// and decodes the KeyString. `value` may be nil when only the key is known, e.g: a removed key.
+// Numbers then decode as ints and longs. The RecordIds of unique indexes in clustered collections
+// are not read, nor are their TypeBits.
+func DecodeIndexEntry(indexInfo *IndexInfo, key, value []byte) (IndexKey, error) {
+	var ret IndexKey
+	keyString, typeBits := key, value
+	if indexInfo.Owner != nil && indexInfo.Owner.Clustered {
+		if splitKey, recordId, ok := SplitKeyStringRecordIdStr(key); ok {
+			keyString = splitKey
+			if ret.RecordId, _ = DecodeClusteredRecordId(recordId); ret.RecordId == "" {
+				ret.RecordId = hex.EncodeToString(recordId)
+			}
+		} else {
+			typeBits = nil
+		}
+	} else if splitKey, recordId, ok := SplitKeyStringRecordId(key); ok {
+		keyString, ret.RecordId = splitKey, strconv.FormatInt(recordId, 10)
+	} else if recordId, rest, ok := ValueRecordId(value); ok {
+		ret.RecordId, typeBits = strconv.FormatInt(recordId, 10), rest
+	}
+	ret.TypeBits = typeBits
+
+	keyPattern, err := IndexKeyPattern(indexInfo)
+	if err != nil {
+		return ret, err
+	}
+	ret.Key, err = DecodeKeyString(keyString, typeBits, keyPattern, IndexKeyStringVersion(indexInfo.Version))
+	return ret, err
+}
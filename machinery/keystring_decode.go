@@ -0,0 +1,647 @@
+package machinery
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/big"
+	"math/bits"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// KeyStringVersion is the encoding of an index's keys. Indexes with `v: 2` use V1, which sorts
+// Decimal128 values among the other numbers. Older indexes use V0.
+type KeyStringVersion int
+
+const (
+	KeyStringV0 KeyStringVersion = 0
+	KeyStringV1 KeyStringVersion = 1
+)
+
+// IndexKeyStringVersion is the KeyString version of an index with the catalog's `v`.
+func IndexKeyStringVersion(indexVersion int) KeyStringVersion {
+	if indexVersion >= 2 {
+		return KeyStringV1
+	}
+	return KeyStringV0
+}
+
+// The type byte that starts each value of a KeyString. Values of different types sort in this
+// order. Numbers of every BSON type share the numeric range, which encodes the magnitude.
+const (
+	ksMinKey                        = 10
+	ksUndefined                     = 15
+	ksNullish                       = 20
+	ksNumericNaN                    = 30
+	ksNumericNegativeLargeMagnitude = 31
+	ksNumericNegative8ByteInt       = 32
+	ksNumericNegative1ByteInt       = 39
+	ksNumericNegativeSmallMagnitude = 40
+	ksNumericZero                   = 41
+	ksNumericPositiveSmallMagnitude = 42
+	ksNumericPositive1ByteInt       = 43
+	ksNumericPositive8ByteInt       = 50
+	ksNumericPositiveLargeMagnitude = 51
+	ksStringLike                    = 60
+	ksObject                        = 70
+	ksArray                         = 80
+	ksBinData                       = 90
+	ksOID                           = 100
+	ksBoolFalse                     = 110
+	ksBoolTrue                      = 111
+	ksDate                          = 120
+	ksTimestamp                     = 130
+	ksRegEx                         = 140
+	ksDBRef                         = 150
+	ksCode                          = 160
+	ksCodeWithScope                 = 170
+	ksMaxKey                        = 240
+
+	// Discriminators only appear in keys built for queries, in place of `keyStringEnd`.
+	ksLess    = 1
+	ksGreater = 254
+)
+
+// The type of a number, as kept in the TypeBits.
+const (
+	ksTypeInt     = 0
+	ksTypeDouble  = 1
+	ksTypeLong    = 2
+	ksTypeDecimal = 3
+)
+
+// A zero's TypeBits are its numeric type, where 3 is a negative double zero. V1 follows the 3 with
+// 3 more bits: 0 for a negative double zero, or from 2 on the sign and top bits of the exponent of
+// a Decimal128 zero.
+const (
+	ksZeroV1NegativeDouble = 0
+	ksZeroV1DecimalFirst   = 2
+)
+
+// Decimal128 exponents are biased such that they are never negative. The largest biased exponent
+// is 12287.
+const (
+	decimalExponentBias    = 6176
+	decimalBiasedExponents = 12288
+	decimalMaxDigits       = 34
+)
+
+// The low bits of a Decimal128's biased exponent kept in the TypeBits. The rest of the exponent
+// follows from the value.
+const ksDecimalExponentBits = 6
+
+// ksTypeBits reads the TypeBits of a key. They tell apart values a KeyString encodes the same,
+// e.g: `1`, `NumberLong(1)` and `1.0`. Bits fill each byte from its lowest bit, values of more
+// than one bit are written high bit first. Reading past the end reads zeros, like an index whose
+// TypeBits are all zeros and therefore stored as nothing.
+type ksTypeBits struct {
+	buf []byte
+	bit int
+}
+
+// newKSTypeBits parses stored TypeBits. They are either empty, a single byte below 0x80, or a
+// size byte of 0x80 | size followed by that many bytes. A size byte of 0x80 is followed by a 4 byte
+// little endian size instead.
+func newKSTypeBits(stored []byte) (*ksTypeBits, error) {
+	switch {
+	case len(stored) == 0:
+		return &ksTypeBits{}, nil
+	case stored[0]&0x80 == 0:
+		return &ksTypeBits{buf: stored[:1]}, nil
+	}
+
+	size, start := int(stored[0]&0x7f), 1
+	if size == 0 {
+		if len(stored) < 5 {
+			return nil, fmt.Errorf("TypeBits are too short. Length: %v", len(stored))
+		}
+		size, start = int(binary.LittleEndian.Uint32(stored[1:5])), 5
+	}
+	if start+size > len(stored) {
+		return nil, fmt.Errorf("TypeBits are too short. Size: %v Length: %v", size, len(stored))
+	}
+	return &ksTypeBits{buf: stored[start : start+size]}, nil
+}
+
+func (typeBits *ksTypeBits) readBit() uint8 {
+	idx := typeBits.bit / 8
+	if idx >= len(typeBits.buf) {
+		typeBits.bit++
+		return 0
+	}
+	ret := typeBits.buf[idx] >> (typeBits.bit % 8) & 1
+	typeBits.bit++
+	return ret
+}
+
+// readBits reads `count` bits, the first being the most significant.
+func (typeBits *ksTypeBits) readBits(count int) uint32 {
+	var ret uint32
+	for idx := 0; idx < count; idx++ {
+		ret = ret<<1 | uint32(typeBits.readBit())
+	}
+	return ret
+}
+
+// readNumeric reads the type of a number. MongoDB writes its high bit first.
+func (typeBits *ksTypeBits) readNumeric() uint8 {
+	return uint8(typeBits.readBits(2))
+}
+
+// ksReader reads the bytes of a KeyString. The bytes of values in descending fields are inverted
+// such that they sort in reverse. The first error is kept and every later read returns zeros.
+type ksReader struct {
+	buf []byte
+	pos int
+	err error
+}
+
+func (reader *ksReader) fail(format string, args ...interface{}) {
+	if reader.err == nil {
+		reader.err = fmt.Errorf(format+" Offset: %v", append(args, reader.pos)...)
+	}
+}
+
+func (reader *ksReader) remaining() bool {
+	return reader.err == nil && reader.pos < len(reader.buf)
+}
+
+// bytes returns a copy of the next `length` bytes, inverted when `invert` is true.
+func (reader *ksReader) bytes(length int, invert bool) []byte {
+	if length < 0 || reader.pos+length > len(reader.buf) {
+		reader.fail("KeyString is too short. Length: %v", length)
+		reader.pos = len(reader.buf)
+		return nil
+	}
+
+	ret := make([]byte, length)
+	copy(ret, reader.buf[reader.pos:reader.pos+length])
+	reader.pos += length
+	if invert {
+		for idx := range ret {
+			ret[idx] = ^ret[idx]
+		}
+	}
+	return ret
+}
+
+func (reader *ksReader) byte(invert bool) byte {
+	if byt := reader.bytes(1, invert); len(byt) == 1 {
+		return byt[0]
+	}
+	return 0
+}
+
+// bigEndian reads `length` bytes as a big endian number.
+func (reader *ksReader) bigEndian(length int, invert bool) uint64 {
+	var ret uint64
+	for _, byt := range reader.bytes(length, invert) {
+		ret = ret<<8 | uint64(byt)
+	}
+	return ret
+}
+
+// cString reads bytes up to a terminating 0x00.
+func (reader *ksReader) cString(invert bool) []byte {
+	var ret []byte
+	for reader.remaining() {
+		byt := reader.byte(invert)
+		if byt == 0x00 {
+			return ret
+		}
+		ret = append(ret, byt)
+	}
+	reader.fail("Unterminated string.")
+	return ret
+}
+
+// stringWithNuls reads a string whose embedded 0x00 bytes are escaped as 0x00 0xff.
+func (reader *ksReader) stringWithNuls(invert bool) string {
+	var ret []byte
+	for {
+		ret = append(ret, reader.cString(invert)...)
+		if !reader.remaining() || reader.buf[reader.pos] != byteIfInverted(0xff, invert) {
+			return string(ret)
+		}
+		reader.pos++
+		ret = append(ret, 0x00)
+	}
+}
+
+func byteIfInverted(byt byte, invert bool) byte {
+	if invert {
+		return ^byt
+	}
+	return byt
+}
+
+// ksDecoder decodes the values of a KeyString along with its TypeBits.
+type ksDecoder struct {
+	reader   *ksReader
+	typeBits *ksTypeBits
+	version  KeyStringVersion
+}
+
+// isDescending is true for key pattern values that sort a field in descending order, e.g: `-1`.
+func isDescending(direction interface{}) bool {
+	switch value := direction.(type) {
+	case int32:
+		return value < 0
+	case int64:
+		return value < 0
+	case float64:
+		return value < 0
+	}
+	return false
+}
+
+// DecodeKeyString decodes the values of an index key without its RecordId. The values are named by
+// the index's key pattern, or are unnamed beyond it, e.g: `{a: 1, b: "x"}`. Without the key's
+// `typeBits` every number decodes as an int, or a long when it does not fit, and every string-like
+// value as a string.
+func DecodeKeyString(keyString, typeBits []byte, keyPattern bson.D, version KeyStringVersion) (bson.D, error) {
+	parsedTypeBits, err := newKSTypeBits(typeBits)
+	if err != nil {
+		return nil, err
+	}
+	decoder := &ksDecoder{reader: &ksReader{buf: keyString}, typeBits: parsedTypeBits, version: version}
+
+	ret := bson.D{}
+	for idx := 0; decoder.reader.remaining(); idx++ {
+		var name string
+		var invert bool
+		if idx < len(keyPattern) {
+			name, invert = keyPattern[idx].Key, isDescending(keyPattern[idx].Value)
+		}
+
+		ctype := decoder.reader.byte(invert)
+		if ctype == ksLess || ctype == ksGreater {
+			ctype = decoder.reader.byte(invert)
+		}
+		if ctype == keyStringEnd {
+			break
+		}
+		value, err := decoder.value(ctype, invert)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, bson.E{Key: name, Value: value})
+	}
+
+	if decoder.reader.err != nil {
+		return nil, errors.Wrap(decoder.reader.err, "Malformed KeyString")
+	}
+	return ret, nil
+}
+
+// value decodes a value of the type `ctype`, whose byte was already read.
+func (decoder *ksDecoder) value(ctype byte, invert bool) (interface{}, error) {
+	reader := decoder.reader
+	switch ctype {
+	case ksMinKey:
+		return primitive.MinKey{}, nil
+	case ksMaxKey:
+		return primitive.MaxKey{}, nil
+	case ksUndefined:
+		return primitive.Undefined{}, nil
+	case ksNullish:
+		return primitive.Null{}, nil
+	case ksBoolFalse:
+		return false, nil
+	case ksBoolTrue:
+		return true, nil
+	case ksDate:
+		// The sign bit is flipped such that earlier dates sort first.
+		return primitive.DateTime(int64(reader.bigEndian(8, invert) ^ 1<<63)), nil
+	case ksTimestamp:
+		timestamp := reader.bigEndian(8, invert)
+		return primitive.Timestamp{T: uint32(timestamp >> 32), I: uint32(timestamp)}, nil
+	case ksOID:
+		var ret primitive.ObjectID
+		copy(ret[:], reader.bytes(len(ret), invert))
+		return ret, nil
+	case ksStringLike:
+		str := reader.stringWithNuls(invert)
+		if decoder.typeBits.readBit() == 1 {
+			return primitive.Symbol(str), nil
+		}
+		return str, nil
+	case ksCode:
+		return primitive.JavaScript(reader.stringWithNuls(invert)), nil
+	case ksCodeWithScope:
+		code := reader.stringWithNuls(invert)
+		scope, err := decoder.object(invert)
+		return primitive.CodeWithScope{Code: primitive.JavaScript(code), Scope: scope}, err
+	case ksRegEx:
+		pattern := string(reader.cString(invert))
+		return primitive.Regex{Pattern: pattern, Options: string(reader.cString(invert))}, nil
+	case ksDBRef:
+		ns := reader.bytes(int(reader.bigEndian(4, invert)), invert)
+		var oid primitive.ObjectID
+		copy(oid[:], reader.bytes(len(oid), invert))
+		return primitive.DBPointer{DB: string(ns), Pointer: oid}, nil
+	case ksBinData:
+		// Lengths of 0xff and more are marked by a 0xff byte followed by a 4 byte length.
+		length := int(reader.byte(invert))
+		if length == 0xff {
+			length = int(reader.bigEndian(4, invert))
+		}
+		subtype := reader.byte(invert)
+		return primitive.Binary{Subtype: subtype, Data: reader.bytes(length, invert)}, nil
+	case ksObject:
+		return decoder.object(invert)
+	case ksArray:
+		ret := bson.A{}
+		for reader.remaining() {
+			ctype := reader.byte(invert)
+			if ctype == 0 {
+				return ret, nil
+			}
+			elem, err := decoder.value(ctype, invert)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, elem)
+		}
+		reader.fail("Unterminated array.")
+		return ret, nil
+	}
+
+	if ctype >= ksNumericNaN && ctype <= ksNumericPositiveLargeMagnitude {
+		return decoder.number(ctype, invert)
+	}
+	return nil, fmt.Errorf("Unknown KeyString type. Type: %v Offset: %v", ctype, reader.pos-1)
+}
+
+// object decodes the elements of an embedded document. Each element is its type, its name and its
+// value, which repeats the type. A 0x00 ends the document.
+func (decoder *ksDecoder) object(invert bool) (bson.D, error) {
+	reader := decoder.reader
+	ret := bson.D{}
+	for reader.remaining() {
+		if reader.byte(invert) == 0 {
+			return ret, nil
+		}
+		name := string(reader.cString(invert))
+		elem, err := decoder.value(reader.byte(invert), invert)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, bson.E{Key: name, Value: elem})
+	}
+	reader.fail("Unterminated object.")
+	return ret, nil
+}
+
+// errUnsupportedDecimal is returned for Decimal128 values outside the precision or range of a
+// double. Their digits beyond a double are not decoded.
+var errUnsupportedDecimal = errors.New("Decimal128 values beyond the precision or range of a double are not supported")
+
+// number decodes a value in the numeric range. Negative numbers have their bytes inverted such
+// that larger magnitudes sort first.
+func (decoder *ksDecoder) number(ctype byte, invert bool) (interface{}, error) {
+	reader := decoder.reader
+	switch ctype {
+	case ksNumericZero:
+		return decoder.zero()
+	case ksNumericNaN:
+		if decoder.typeBits.readNumeric() == ksTypeDecimal {
+			return primitive.NewDecimal128(0x7c00000000000000, 0), nil
+		}
+		return math.NaN(), nil
+	}
+
+	negative := ctype < ksNumericZero
+	if negative {
+		invert = !invert
+	}
+	numericType := decoder.typeBits.readNumeric()
+
+	var magnitude float64
+	// Only set for the integer range, where it is exact beyond 2**53.
+	var integer uint64
+	isInteger := false
+	// Decimal128 values without more digits than a double are the double rounded to 15 digits,
+	// unless they are known to be exactly the double.
+	exactDecimal := false
+	switch {
+	case ctype == ksNumericNegativeLargeMagnitude || ctype == ksNumericPositiveLargeMagnitude:
+		// A magnitude of at least 2**63, including infinity.
+		encoded := reader.bigEndian(8, invert)
+		switch {
+		case decoder.version == KeyStringV0:
+			magnitude = math.Float64frombits(encoded &^ (1 << 63))
+		case encoded == math.MaxUint64:
+			magnitude = math.Inf(1)
+		case encoded&(1<<63) == 0:
+			// The low bit marks a decimal continuation. The exponent's top bit is always set and
+			// not stored.
+			if encoded&1 == 1 {
+				return nil, errUnsupportedDecimal
+			}
+			magnitude = math.Float64frombits(encoded>>1 | 1<<62)
+		default:
+			return nil, errUnsupportedDecimal
+		}
+	case ctype == ksNumericNegativeSmallMagnitude || ctype == ksNumericPositiveSmallMagnitude:
+		// A magnitude below 1.
+		encoded := reader.bigEndian(8, invert)
+		if decoder.version == KeyStringV0 {
+			magnitude = math.Float64frombits(encoded &^ (1 << 63))
+			break
+		}
+
+		// The top 2 bits tell apart decimals smaller than any double, doubles below 2**-255 and
+		// doubles from 2**-255. The low bit marks a decimal continuation.
+		if encoded>>62 == 0 || encoded&1 == 1 {
+			return nil, errUnsupportedDecimal
+		}
+		if encoded>>62 == 3 {
+			magnitude = math.Float64frombits(encoded >> 1 &^ (1 << 62))
+		} else {
+			// Scaled up by 2**256 to leave room for the smaller decimals.
+			magnitude = math.Ldexp(math.Float64frombits((encoded-1<<62)>>1), -256)
+		}
+	default:
+		// An integer part of 1 to 8 bytes whose low bit is set when a fraction follows.
+		length := int(ctype-ksNumericPositive1ByteInt) + 1
+		if negative {
+			length = int(ksNumericNegative1ByteInt-ctype) + 1
+		}
+		encoded := reader.bigEndian(length, invert)
+		integer = encoded >> 1
+		if encoded&1 == 0 {
+			isInteger, exactDecimal = true, true
+			magnitude = float64(integer)
+			break
+		}
+
+		// The fraction is the mantissa's bits below the integer part. V1 follows them with 2 bits
+		// comparing a decimal with the double: equal, equal once rounded to 15 digits, or more
+		// digits that follow in 8 more bytes.
+		fractionBits := 53 - bits.Len64(integer)
+		if fractionBits < 0 {
+			return nil, errUnsupportedDecimal
+		}
+		markerBits := 0
+		if decoder.version == KeyStringV1 {
+			markerBits = 2
+		}
+		encodedFraction := reader.bigEndian((fractionBits+markerBits+7)/8, invert)
+		switch marker := encodedFraction & 3; {
+		case markerBits == 0:
+			exactDecimal = true
+		case marker == 0:
+			exactDecimal = true
+		case marker == 1 || marker == 3:
+			return nil, errUnsupportedDecimal
+		}
+		fraction := encodedFraction >> markerBits
+		magnitude = float64(integer) + math.Ldexp(float64(fraction), -fractionBits)
+	}
+	if reader.err != nil {
+		return nil, nil
+	}
+
+	switch numericType {
+	case ksTypeInt:
+		if negative {
+			return -int32(integer), nil
+		}
+		return int32(integer), nil
+	case ksTypeLong:
+		if !isInteger {
+			// Only -2**63 is out of the integer range.
+			return int64(math.MinInt64), nil
+		}
+		if negative {
+			return -int64(integer), nil
+		}
+		return int64(integer), nil
+	case ksTypeDouble:
+		if negative {
+			return -magnitude, nil
+		}
+		return magnitude, nil
+	}
+
+	if math.IsInf(magnitude, 0) {
+		if negative {
+			return primitive.NewDecimal128(0xf800000000000000, 0), nil
+		}
+		return primitive.NewDecimal128(0x7800000000000000, 0), nil
+	}
+	var coefficient *big.Int
+	var exponent int
+	switch {
+	case isInteger:
+		coefficient, exponent = new(big.Int).SetUint64(integer), 0
+	case exactDecimal:
+		coefficient, exponent = exactDecimalDigits(magnitude)
+	default:
+		coefficient, exponent = roundedDecimalDigits(magnitude)
+	}
+	return decimalWithExponent(coefficient, exponent, negative, decoder.typeBits.readBits(ksDecimalExponentBits))
+}
+
+// zero decodes a zero, whose type and sign are only kept in the TypeBits.
+func (decoder *ksDecoder) zero() (interface{}, error) {
+	zeroType := decoder.typeBits.readNumeric()
+	switch zeroType {
+	case ksTypeInt:
+		return int32(0), nil
+	case ksTypeLong:
+		return int64(0), nil
+	case ksTypeDouble:
+		return 0.0, nil
+	}
+	if decoder.version == KeyStringV0 {
+		return math.Copysign(0, -1), nil
+	}
+
+	// Decimal zeros are followed by 12 more bits of the exponent. The exponents of negative zeros
+	// are offset by the number of exponents.
+	special := uint8(decoder.typeBits.readBits(3))
+	switch {
+	case special == ksZeroV1NegativeDouble:
+		return math.Copysign(0, -1), nil
+	case special < ksZeroV1DecimalFirst:
+		return nil, fmt.Errorf("Unknown KeyString zero type. Type: %v", special)
+	}
+	whichZero := int(special-ksZeroV1DecimalFirst)<<12 | int(decoder.typeBits.readBits(12))
+	negative := whichZero >= decimalBiasedExponents
+	if negative {
+		whichZero -= decimalBiasedExponents
+	}
+	return decimalWithExponent(new(big.Int), whichZero-decimalExponentBias, negative, uint32(whichZero)&(1<<ksDecimalExponentBits-1))
+}
+
+// exactDecimalDigits is the decimal coefficient and exponent of a double, without trailing zeros.
+func exactDecimalDigits(value float64) (*big.Int, int) {
+	mantissa, binaryExponent := math.Frexp(value)
+	coefficient := new(big.Int).SetUint64(uint64(math.Ldexp(mantissa, 53)))
+	binaryExponent -= 53
+	exponent := 0
+	if binaryExponent >= 0 {
+		coefficient.Lsh(coefficient, uint(binaryExponent))
+	} else {
+		// x * 2**-n == x * 5**n * 10**-n
+		coefficient.Mul(coefficient, new(big.Int).Exp(big.NewInt(5), big.NewInt(int64(-binaryExponent)), nil))
+		exponent = binaryExponent
+	}
+	return trimDecimalZeros(coefficient, exponent)
+}
+
+// roundedDecimalDigits is the decimal coefficient and exponent of a double rounded to 15 digits,
+// without trailing zeros.
+func roundedDecimalDigits(value float64) (*big.Int, int) {
+	// E.g: `1.23450000000000e-01`.
+	formatted := strconv.FormatFloat(value, 'e', 14, 64)
+	digits, exponentStr, _ := strings.Cut(formatted, "e")
+	exponent, _ := strconv.Atoi(exponentStr)
+	coefficient, _ := new(big.Int).SetString(strings.Replace(digits, ".", "", 1), 10)
+	return trimDecimalZeros(coefficient, exponent-14)
+}
+
+func trimDecimalZeros(coefficient *big.Int, exponent int) (*big.Int, int) {
+	ten, remainder := big.NewInt(10), new(big.Int)
+	for coefficient.Sign() != 0 {
+		quotient, _ := new(big.Int).QuoRem(coefficient, ten, remainder)
+		if remainder.Sign() != 0 {
+			break
+		}
+		coefficient, exponent = quotient, exponent+1
+	}
+	return coefficient, exponent
+}
+
+// decimalWithExponent builds the Decimal128 whose biased exponent ends with the stored bits. A
+// Decimal128 keeps its trailing zeros, e.g: `1.50` is not `1.5`, so the coefficient is given
+// trailing zeros until the exponent matches.
+func decimalWithExponent(coefficient *big.Int, exponent int, negative bool, storedExponent uint32) (primitive.Decimal128, error) {
+	coefficient = new(big.Int).Set(coefficient)
+	ten := big.NewInt(10)
+	for zeros := 0; zeros < 1<<ksDecimalExponentBits; zeros++ {
+		if uint32(exponent+decimalExponentBias)&(1<<ksDecimalExponentBits-1) == storedExponent {
+			if negative {
+				coefficient.Neg(coefficient)
+			}
+			ret, ok := primitive.ParseDecimal128FromBigInt(coefficient, exponent)
+			if !ok {
+				return primitive.Decimal128{}, errUnsupportedDecimal
+			}
+			return ret, nil
+		}
+		if coefficient.Sign() != 0 && len(coefficient.String()) >= decimalMaxDigits {
+			break
+		}
+		coefficient.Mul(coefficient, ten)
+		exponent--
+	}
+	return primitive.Decimal128{}, fmt.Errorf("No Decimal128 exponent matches the TypeBits. Stored: %v", storedExponent)
+}
@@ -0,0 +1,443 @@
+package machinery
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A resmoke task log line looks like:
+//
+//	[2023/02/10 19:35:12.345] [j0:n1] {"t":{"$date":"2023-02-10T19:35:12.340+00:00"},"s":"I","c":"REPL",...}
+//
+// The first timestamp is added by evergreen. The bracketed logger names who wrote the line:
+//   - `j0:n1`, `j0:s0:n1`, `j0:c:n0`: a server of the job's fixture.
+//   - `js_test:foo`: the output of the test `foo`. Servers started by the test itself prefix their
+//     lines with `d<port>| `, `s<port>| ` or `c<port>| `.
+//   - `executor:js_test:job0`: the job starting and finishing tests.
+var evergreenTimeRe *regexp.Regexp = regexp.MustCompile(`^\[(\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}\.\d{3})\] `)
+var loggerRe *regexp.Regexp = regexp.MustCompile(`^\[([^\] ]+)\] `)
+var fixtureLoggerRe *regexp.Regexp = regexp.MustCompile(`^(j\d+):`)
+var testLoggerRe *regexp.Regexp = regexp.MustCompile(`^[a-z_]+_test:(.+)$`)
+var executorRunningRe *regexp.Regexp = regexp.MustCompile(`^executor:[a-z_]+:(job\d+)$`)
+var runningTestRe *regexp.Regexp = regexp.MustCompile(`Running (\S+)\.\.\.`)
+var shellServerRe *regexp.Regexp = regexp.MustCompile(`^([dsc])(\d{4,5})\| `)
+var logTimeRe *regexp.Regexp = regexp.MustCompile(`"t":\{"\$date":"([^"]+)"\}`)
+var logComponentRe *regexp.Regexp = regexp.MustCompile(`"c":"([A-Z_]+)"`)
+
+// The `Waiting for connections` log line carries the port a server listens on.
+var listeningRe *regexp.Regexp = regexp.MustCompile(`"id":23016,.*"port":(\d+)`)
+
+const evergreenTimeLayout = "2006/01/02 15:04:05.000"
+
+// LogLine is one parsed line of a log file.
+type LogLine struct {
+	Offset int64
+	Time   time.Time
+	// The fixture logger, e.g: `j0:n1`, or the prefix of a server started by a test, e.g: `d20021`.
+	Node string
+	Port int
+	// The test that was running when the line was written.
+	Test      string
+	Component string
+	Text      string
+}
+
+// logParser tracks the state that spans lines: which test each job is running and which port
+// each fixture node listens on.
+type logParser struct {
+	runningTests map[string]string
+	nodePorts    map[string]int
+}
+
+func newLogParser() *logParser {
+	return &logParser{runningTests: make(map[string]string), nodePorts: make(map[string]int)}
+}
+
+// testName strips directories and extensions, e.g: `jstests/core/foo.js` -> `foo`.
+func testName(test string) string {
+	name, _, _ := strings.Cut(filepath.Base(test), ".")
+	return name
+}
+
+func (parser *logParser) parse(offset int64, text string) LogLine {
+	ret := LogLine{Offset: offset, Text: text}
+	rest := text
+
+	if match := evergreenTimeRe.FindStringSubmatch(rest); match != nil {
+		ret.Time, _ = time.Parse(evergreenTimeLayout, match[1])
+		rest = rest[len(match[0]):]
+	}
+
+	if match := loggerRe.FindStringSubmatch(rest); match != nil {
+		logger := match[1]
+		rest = rest[len(match[0]):]
+
+		switch {
+		case executorRunningRe.MatchString(logger):
+			job := "j" + strings.TrimPrefix(executorRunningRe.FindStringSubmatch(logger)[1], "job")
+			if running := runningTestRe.FindStringSubmatch(rest); running != nil {
+				parser.runningTests[job] = testName(running[1])
+			}
+			ret.Test = parser.runningTests[job]
+		case fixtureLoggerRe.MatchString(logger):
+			ret.Node = logger
+			ret.Test = parser.runningTests[fixtureLoggerRe.FindStringSubmatch(logger)[1]]
+		case testLoggerRe.MatchString(logger):
+			ret.Test = testLoggerRe.FindStringSubmatch(logger)[1]
+			if server := shellServerRe.FindStringSubmatch(rest); server != nil {
+				ret.Node = server[1] + server[2]
+				ret.Port, _ = strconv.Atoi(server[2])
+				rest = rest[len(server[0]):]
+			}
+		}
+	}
+
+	if strings.HasPrefix(rest, "{") {
+		if match := logTimeRe.FindStringSubmatch(rest); match != nil {
+			if parsed, err := time.Parse(time.RFC3339Nano, match[1]); err == nil {
+				ret.Time = parsed
+			} else if parsed, err := time.Parse("2006-01-02T15:04:05.000-0700", match[1]); err == nil {
+				ret.Time = parsed
+			}
+		}
+		if match := logComponentRe.FindStringSubmatch(rest); match != nil {
+			ret.Component = match[1]
+		}
+		if match := listeningRe.FindStringSubmatch(rest); match != nil && ret.Node != "" {
+			parser.nodePorts[ret.Node], _ = strconv.Atoi(match[1])
+		}
+	}
+
+	if ret.Port == 0 {
+		ret.Port = parser.nodePorts[ret.Node]
+	}
+	return ret
+}
+
+type LogNodeSummary struct {
+	Name  string
+	Port  int
+	Lines int
+	First time.Time
+	Last  time.Time
+}
+
+type LogTestSummary struct {
+	Name  string
+	Lines int
+	First time.Time
+	Last  time.Time
+	// The byte range of the file containing the test's lines.
+	StartOffset int64
+	EndOffset   int64
+}
+
+type LogComponentSummary struct {
+	Name  string
+	Lines int
+}
+
+// LogCheckpoint allows a scan to start in the middle of a file.
+type LogCheckpoint struct {
+	Offset       int64
+	Time         time.Time
+	RunningTests map[string]string
+	NodePorts    map[string]int
+}
+
+// LogIndex summarizes a log file by node, test and component.
+type LogIndex struct {
+	File       string
+	Lines      int
+	Nodes      []LogNodeSummary
+	Tests      []LogTestSummary
+	Components []LogComponentSummary
+	// One checkpoint every `logCheckpointInterval` lines, in file order.
+	Checkpoints []LogCheckpoint
+}
+
+const logCheckpointInterval = 10000
+
+// Log lines may embed whole documents.
+const maxLogLineSize = 16 * 1024 * 1024
+
+func (parser *logParser) checkpoint(offset int64, at time.Time) LogCheckpoint {
+	ret := LogCheckpoint{
+		Offset:       offset,
+		Time:         at,
+		RunningTests: make(map[string]string, len(parser.runningTests)),
+		NodePorts:    make(map[string]int, len(parser.nodePorts)),
+	}
+	for job, test := range parser.runningTests {
+		ret.RunningTests[job] = test
+	}
+	for node, port := range parser.nodePorts {
+		ret.NodePorts[node] = port
+	}
+	return ret
+}
+
+func (parser *logParser) restore(checkpoint LogCheckpoint) {
+	parser.runningTests = make(map[string]string, len(checkpoint.RunningTests))
+	for job, test := range checkpoint.RunningTests {
+		parser.runningTests[job] = test
+	}
+	parser.nodePorts = make(map[string]int, len(checkpoint.NodePorts))
+	for node, port := range checkpoint.NodePorts {
+		parser.nodePorts[node] = port
+	}
+}
+
+func widen(first, last *time.Time, at time.Time) {
+	if at.IsZero() {
+		return
+	}
+	if first.IsZero() || at.Before(*first) {
+		*first = at
+	}
+	if at.After(*last) {
+		*last = at
+	}
+}
+
+// readLines calls `visit` with each line of `reader` and the offset it starts at, relative to
+// `offset`. A false return stops reading.
+func readLines(reader io.Reader, offset int64, visit func(offset int64, line string) bool) error {
+	bufReader := bufio.NewReaderSize(reader, 64*1024)
+	for {
+		line, err := bufReader.ReadString('\n')
+		if len(line) > 0 {
+			lineLen := int64(len(line))
+			if len(line) > maxLogLineSize {
+				line = line[:maxLogLineSize]
+			}
+			if !visit(offset, strings.TrimRight(line, "\r\n")) {
+				return nil
+			}
+			offset += lineLen
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// IndexLog reads the whole log file once to build its index.
+func IndexLog(logPath string) (*LogIndex, error) {
+	logFile, err := os.Open(logPath)
+	if err != nil {
+		return nil, err
+	}
+	defer logFile.Close()
+
+	ret := &LogIndex{File: filepath.Base(logPath)}
+	nodes := make(map[string]*LogNodeSummary)
+	tests := make(map[string]*LogTestSummary)
+	components := make(map[string]*LogComponentSummary)
+	parser := newLogParser()
+	var lastTime time.Time
+
+	err = readLines(logFile, 0, func(offset int64, text string) bool {
+		if ret.Lines%logCheckpointInterval == 0 {
+			ret.Checkpoints = append(ret.Checkpoints, parser.checkpoint(offset, lastTime))
+		}
+		ret.Lines++
+
+		line := parser.parse(offset, text)
+		if !line.Time.IsZero() {
+			lastTime = line.Time
+		}
+		if line.Node != "" {
+			node, exists := nodes[line.Node]
+			if !exists {
+				node = &LogNodeSummary{Name: line.Node}
+				nodes[line.Node] = node
+			}
+			node.Lines++
+			node.Port = line.Port
+			widen(&node.First, &node.Last, line.Time)
+		}
+		if line.Test != "" {
+			test, exists := tests[line.Test]
+			if !exists {
+				test = &LogTestSummary{Name: line.Test, StartOffset: offset}
+				tests[line.Test] = test
+			}
+			test.Lines++
+			test.EndOffset = offset + int64(len(text)) + 1
+			widen(&test.First, &test.Last, line.Time)
+		}
+		if line.Component != "" {
+			component, exists := components[line.Component]
+			if !exists {
+				component = &LogComponentSummary{Name: line.Component}
+				components[line.Component] = component
+			}
+			component.Lines++
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read the log")
+	}
+
+	// A node's port may only be learned after its first lines.
+	for name, node := range nodes {
+		if port, exists := parser.nodePorts[name]; exists {
+			node.Port = port
+		}
+		ret.Nodes = append(ret.Nodes, *node)
+	}
+	sort.Slice(ret.Nodes, func(left, right int) bool { return ret.Nodes[left].Name < ret.Nodes[right].Name })
+	for _, test := range tests {
+		ret.Tests = append(ret.Tests, *test)
+	}
+	sort.Slice(ret.Tests, func(left, right int) bool { return ret.Tests[left].StartOffset < ret.Tests[right].StartOffset })
+	for _, component := range components {
+		ret.Components = append(ret.Components, *component)
+	}
+	sort.Slice(ret.Components, func(left, right int) bool { return ret.Components[left].Name < ret.Components[right].Name })
+
+	return ret, nil
+}
+
+// SaveLogIndex writes the index next to the log, as `<log>.index.json`.
+func SaveLogIndex(logPath string, index *LogIndex) error {
+	contents, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	// Write to the side first such that a crash does not leave a truncated index behind.
+	tmpPath := LogIndexPath(logPath) + ".tmp"
+	if err := os.WriteFile(tmpPath, contents, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, LogIndexPath(logPath))
+}
+
+func LogIndexPath(logPath string) string {
+	return logPath + ".index.json"
+}
+
+func LoadLogIndex(logPath string) (*LogIndex, error) {
+	contents, err := os.ReadFile(LogIndexPath(logPath))
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &LogIndex{}
+	if err := json.Unmarshal(contents, ret); err != nil {
+		return nil, errors.Wrap(err, "Failed to parse the log index")
+	}
+	return ret, nil
+}
+
+// LogFilter selects log lines. Zero values match everything.
+type LogFilter struct {
+	Test      string
+	Component string
+	// A node name, e.g: `j0:n1`, or a port.
+	Node string
+	From time.Time
+	To   time.Time
+	// Only lines starting at or after this offset are returned. Used to page through results.
+	After int64
+}
+
+func (filter LogFilter) matches(line LogLine, nodes map[string]bool) bool {
+	switch {
+	case filter.Test != "" && line.Test != filter.Test:
+		return false
+	case filter.Component != "" && line.Component != filter.Component:
+		return false
+	case len(nodes) > 0 && !nodes[line.Node]:
+		return false
+	case !filter.From.IsZero() && (line.Time.IsZero() || line.Time.Before(filter.From)):
+		return false
+	case !filter.To.IsZero() && (line.Time.IsZero() || line.Time.After(filter.To)):
+		return false
+	}
+	return true
+}
+
+// ScanLog returns up to `limit` lines matching the filter. The index bounds how much of the file
+// is read. When more lines may match, `next` is the offset to continue from. Otherwise it is -1.
+func ScanLog(logPath string, index *LogIndex, filter LogFilter, limit int) (lines []LogLine, next int64, err error) {
+	// A port selects every node that listened on it.
+	nodes := make(map[string]bool)
+	if filter.Node != "" {
+		nodes[filter.Node] = true
+		for _, node := range index.Nodes {
+			if strconv.Itoa(node.Port) == filter.Node {
+				nodes[node.Name] = true
+			}
+		}
+	}
+
+	start, end := filter.After, int64(-1)
+	if filter.Test != "" {
+		for _, test := range index.Tests {
+			if test.Name == filter.Test {
+				if test.StartOffset > start {
+					start = test.StartOffset
+				}
+				end = test.EndOffset
+			}
+		}
+	}
+
+	// Resume from the last checkpoint before the start such that the parser knows which tests
+	// are running.
+	parser := newLogParser()
+	seek := int64(0)
+	for _, checkpoint := range index.Checkpoints {
+		// Lines are not strictly ordered by time. A checkpoint's time is only a hint.
+		if checkpoint.Offset > start || (!filter.From.IsZero() && checkpoint.Time.After(filter.From)) {
+			break
+		}
+		seek = checkpoint.Offset
+		parser.restore(checkpoint)
+	}
+
+	logFile, err := os.Open(logPath)
+	if err != nil {
+		return nil, -1, err
+	}
+	defer logFile.Close()
+	if _, err := logFile.Seek(seek, io.SeekStart); err != nil {
+		return nil, -1, err
+	}
+
+	lines = make([]LogLine, 0)
+	next = -1
+	err = readLines(logFile, seek, func(offset int64, text string) bool {
+		if end != -1 && offset >= end {
+			return false
+		}
+
+		line := parser.parse(offset, text)
+		if offset < start || !filter.matches(line, nodes) {
+			return true
+		}
+		if len(lines) == limit {
+			next = offset
+			return false
+		}
+		lines = append(lines, line)
+		return true
+	})
+
+	return lines, next, err
+}
@@ -1,16 +1,35 @@
 package machinery
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/ulikunitz/xz"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 func TestStartServer(tst *testing.T) {
 	tst.SkipNow()
 
-	server := NewServer(27116, "./testfiles/", "mongod.log")
+	server := NewServer(nil, 27116, "./testfiles/", "mongod.log")
 	if err := server.StartAndWaitForListening(5 * time.Second); err != nil {
 		panic(err)
 	}
@@ -31,16 +50,17 @@ func TestFetchArtifacts(tst *testing.T) {
 	tst.SkipNow()
 
 	taskName := "mongodb_mongo_master_enterprise_rhel_80_64_bit_dynamic_required_noPassthrough_2_enterprise_f98b3361fbab4e02683325cc0e6ebaa69d6af1df_22_07_22_11_24_37"
-	FetchArtifactsForTask(taskName, "./tmp/")
+	FetchArtifactsForTask(EvergreenSource{}, TaskRef{ID: taskName}, "./tmp/", nil)
 }
 
 func TestFetchArtifactsWithTerminalShell(tst *testing.T) {
 	tst.SkipNow()
 
 	taskName := "mongodb_mongo_master_enterprise_rhel_80_64_bit_dynamic_required_noPassthrough_2_enterprise_f98b3361fbab4e02683325cc0e6ebaa69d6af1df_22_07_22_11_24_37"
-	dbpath := FetchArtifactsForTask(taskName, "./tmp/")[2]
+	dbpaths, _ := FetchArtifactsForTask(EvergreenSource{}, TaskRef{ID: taskName}, "./tmp/", nil)
+	dbpath := dbpaths[2].DBPath
 
-	server := NewServer(27116, dbpath, "tmp/mongod.log")
+	server := NewServer(nil, 27116, dbpath, "tmp/mongod.log")
 	if err := server.StartAndWaitForListening(5 * time.Second); err != nil {
 		panic(err)
 	}
@@ -66,7 +86,43 @@ func TestGetTaskFromUrl(tst *testing.T) {
 	task := "mongodb_mongo_master_enterprise_rhel_80_64_bit_dynamic_all_feature_flags_required_concurrency_simultaneous_4_linux_enterprise_patch_9c65140283c3f72330a94e58bd9ac2c5bd090ced_63e54b7e9ccd4e19c98bf4c6_23_02_10_19_28_57"
 	url := "https://spruce.mongodb.com/task/mongodb_mongo_master_enterprise_rhel_80_64_bit_dynamic_all_feature_flags_required_concurrency_simultaneous_4_linux_enterprise_patch_9c65140283c3f72330a94e58bd9ac2c5bd090ced_63e54b7e9ccd4e19c98bf4c6_23_02_10_19_28_57/files?execution=0&sortBy=STATUS&sortDir=ASC"
 
-	assertEquals(tst, task, GetTaskFromUrl(url))
+	taskRef, err := GetTaskFromUrl(url)
+	if err != nil {
+		tst.Fatalf("Failed to parse url. Err: %v", err)
+	}
+	assertEquals(tst, TaskRef{task, 0}, taskRef)
+
+	// A restarted task's url.
+	taskRef, err = GetTaskFromUrl("https://spruce.mongodb.com/task/" + task + "/logs?execution=2")
+	if err != nil {
+		tst.Fatalf("Failed to parse url. Err: %v", err)
+	}
+	assertEquals(tst, TaskRef{task, 2}, taskRef)
+
+	// The legacy UI puts the execution in the path.
+	taskRef, err = GetTaskFromUrl("https://evergreen.mongodb.com/task/" + task + "/1")
+	if err != nil {
+		tst.Fatalf("Failed to parse url. Err: %v", err)
+	}
+	assertEquals(tst, TaskRef{task, 1}, taskRef)
+
+	// A url without an execution refers to the latest one.
+	taskRef, err = GetTaskFromUrl("https://spruce.mongodb.com/task/" + task)
+	if err != nil {
+		tst.Fatalf("Failed to parse url. Err: %v", err)
+	}
+	assertEquals(tst, TaskRef{task, LatestExecution}, taskRef)
+
+	// So does a bare task id.
+	taskRef, err = ParseTaskRef(task, "")
+	if err != nil {
+		tst.Fatalf("Failed to parse task. Err: %v", err)
+	}
+	assertEquals(tst, TaskRef{task, LatestExecution}, taskRef)
+
+	if _, err = GetTaskFromUrl("https://spruce.mongodb.com/version/abc"); err == nil {
+		tst.Fatalf("Expected an error for a url without a task")
+	}
 }
 
 func TestWT(tst *testing.T) {
@@ -79,7 +135,7 @@ func TestWT(tst *testing.T) {
 	dbpath := "dbpath/data/db/job4/rs0/node0"
 
 	wtDiag := NewWTDiagnostics("./testfiles/"+dbpath, "./testfiles/wtDiag-rs0-n0")
-	wtDiagResults, err := wtDiag.Run()
+	wtDiagResults, err := wtDiag.Run(context.Background())
 	if err != nil {
 		tst.Fatalf("Failed to get diagnostics. Err: %v", err)
 	}
@@ -129,5 +185,1475 @@ func TestAnnotate(tst *testing.T) {
 		panic(err)
 	}
 
-	RewritePrintlog(printlogFile, annotatedPrintlogFile, catalog, wtList)
+	if _, err := RewritePrintlog(context.Background(), printlogFile, annotatedPrintlogFile, catalog, wtList, nil); err != nil {
+		panic(err)
+	}
+}
+
+func TestHTTPSource(tst *testing.T) {
+	if err := os.RemoveAll("./testfiles/http"); err != nil {
+		panic(err)
+	}
+	if err := os.MkdirAll("./testfiles/http", 0755); err != nil {
+		panic(err)
+	}
+
+	requested := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		requested = append(requested, req.URL.EscapedPath())
+		resp.Write([]byte("0123456789"))
+	}))
+	defer server.Close()
+	source := HTTPSource{URLTemplate: server.URL + "/{task}/{execution}/data.tgz"}
+	// Logs are only fetched from their own url.
+	if LogSourceOf(source) != nil {
+		tst.Fatalf("Expected no log source without a log url template")
+	}
+	source.LogURLTemplate = server.URL + "/{task}/{execution}/task.log"
+
+	archives, err := source.FetchDataArchives(TaskRef{"task_1.a-b", 2}, "./testfiles/http", noProgress{})
+	if err != nil {
+		tst.Fatalf("Failed to download. Err: %v", err)
+	}
+	assertEquals(tst, "mongo-data-data.tgz", filepath.Base(archives[0]))
+	assertEquals(tst, "/task_1.a-b/2/data.tgz", requested[0])
+
+	// Task ids are never sent as paths of their own.
+	for _, taskId := range []string{"..", "a/b", "a?b", ""} {
+		if _, err := source.FetchDataArchives(TaskRef{taskId, 0}, "./testfiles/http", noProgress{}); err == nil {
+			tst.Fatalf("Expected an error for an invalid task id. Task: %q", taskId)
+		}
+	}
+	assertEquals(tst, 1, len(requested))
+
+	logs, err := LogSourceOf(source).FetchLogs(TaskRef{"task", 0}, "./testfiles/http")
+	if err != nil {
+		tst.Fatalf("Failed to download. Err: %v", err)
+	}
+	assertEquals(tst, "task.log", filepath.Base(logs[0]))
+	assertEquals(tst, "/task/0/task.log", requested[1])
+
+	defer func(maxSize int64) { MaxDownloadSize = maxSize }(MaxDownloadSize)
+	MaxDownloadSize = 9
+	if _, err := source.FetchLogs(TaskRef{"task", 0}, "./testfiles/http"); err == nil {
+		tst.Fatalf("Expected an error for a download over the limit")
+	}
+}
+
+func TestExtractTarRejectsUnsafeEntries(tst *testing.T) {
+	if err := os.RemoveAll("./testfiles/extract"); err != nil {
+		panic(err)
+	}
+	root := "./testfiles/extract/root"
+	// A file next to the root that escaping entries would clobber.
+	if err := os.MkdirAll(root, 0755); err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile("./testfiles/extract/outside", []byte("untouched"), 0644); err != nil {
+		panic(err)
+	}
+
+	archive := &bytes.Buffer{}
+	tarWriter := tar.NewWriter(archive)
+	for _, header := range []struct {
+		tar.Header
+		contents string
+	}{
+		{tar.Header{Name: "data/", Typeflag: tar.TypeDir, Mode: 0750}, ""},
+		{tar.Header{Name: "data/WiredTiger", Typeflag: tar.TypeReg, Mode: 0640}, "WiredTiger"},
+		{tar.Header{Name: "data/run.sh", Typeflag: tar.TypeReg, Mode: 04755}, "#!/bin/sh"},
+		{tar.Header{Name: "/absolute/file", Typeflag: tar.TypeReg, Mode: 0644}, "stripped"},
+		{tar.Header{Name: "../outside", Typeflag: tar.TypeReg, Mode: 0644}, "clobbered"},
+		{tar.Header{Name: "escape", Typeflag: tar.TypeSymlink, Linkname: "../outside"}, ""},
+		{tar.Header{Name: "absolute", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}, ""},
+		{tar.Header{Name: "datalink", Typeflag: tar.TypeSymlink, Linkname: "data"}, ""},
+		{tar.Header{Name: "datalink/through", Typeflag: tar.TypeReg, Mode: 0644}, "through a link"},
+		// Each link is inside the root on its own, but `chain` resolves to the root's parent.
+		{tar.Header{Name: "up", Typeflag: tar.TypeSymlink, Linkname: "data/.."}, ""},
+		{tar.Header{Name: "chain", Typeflag: tar.TypeSymlink, Linkname: "up/.."}, ""},
+		{tar.Header{Name: "data/hardlink", Typeflag: tar.TypeLink, Linkname: "data/WiredTiger"}, ""},
+		{tar.Header{Name: "badlink", Typeflag: tar.TypeLink, Linkname: "../outside"}, ""},
+		{tar.Header{Name: "fifo", Typeflag: tar.TypeFifo}, ""},
+	} {
+		header.Size = int64(len(header.contents))
+		if err := tarWriter.WriteHeader(&header.Header); err != nil {
+			panic(err)
+		}
+		if _, err := tarWriter.Write([]byte(header.contents)); err != nil {
+			panic(err)
+		}
+	}
+	tarWriter.Close()
+
+	result, err := Extractor{}.ExtractTar(bytes.NewReader(archive.Bytes()), root)
+	if err != nil {
+		tst.Fatalf("Unexpected extraction error. Err: %v", err)
+	}
+
+	skipped := make([]string, 0)
+	for _, entryErr := range result.Skipped {
+		skipped = append(skipped, entryErr.Name)
+	}
+	assertEquals(tst, "../outside escape absolute datalink/through badlink fifo chain", strings.Join(skipped, " "))
+	assertEquals(tst, 4, result.Files)
+
+	outside, _ := os.ReadFile("./testfiles/extract/outside")
+	assertEquals(tst, "untouched", string(outside))
+
+	contents, _ := os.ReadFile(filepath.Join(root, "data/hardlink"))
+	assertEquals(tst, "WiredTiger", string(contents))
+	contents, _ = os.ReadFile(filepath.Join(root, "absolute/file"))
+	assertEquals(tst, "stripped", string(contents))
+
+	// Modes are kept, without setuid.
+	info, _ := os.Stat(filepath.Join(root, "data/run.sh"))
+	assertEquals(tst, os.FileMode(0755), info.Mode())
+	info, _ = os.Stat(filepath.Join(root, "data"))
+	assertEquals(tst, os.ModeDir|0750, info.Mode())
+
+	// A link within the root is kept.
+	linkTarget, _ := os.Readlink(filepath.Join(root, "datalink"))
+	assertEquals(tst, "data", linkTarget)
+}
+
+func TestExtractTarSizeLimit(tst *testing.T) {
+	if err := os.RemoveAll("./testfiles/extract"); err != nil {
+		panic(err)
+	}
+
+	archive := &bytes.Buffer{}
+	tarWriter := tar.NewWriter(archive)
+	for _, name := range []string{"first", "second"} {
+		tarWriter.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: 8})
+		tarWriter.Write([]byte("01234567"))
+	}
+	tarWriter.Close()
+
+	result, err := Extractor{MaxTotalSize: 12}.ExtractTar(archive, "./testfiles/extract")
+	if err == nil {
+		tst.Fatalf("Expected the extraction limit to be enforced")
+	}
+	assertEquals(tst, 1, result.Files)
+	assertEquals(tst, int64(8), result.Bytes)
+}
+
+func TestExtractArchiveFormats(tst *testing.T) {
+	if err := os.RemoveAll("./testfiles/formats"); err != nil {
+		panic(err)
+	}
+	if err := os.MkdirAll("./testfiles/formats", 0755); err != nil {
+		panic(err)
+	}
+
+	tarball := &bytes.Buffer{}
+	tarWriter := tar.NewWriter(tarball)
+	tarWriter.WriteHeader(&tar.Header{Name: "db/WiredTiger", Typeflag: tar.TypeReg, Mode: 0644, Size: 10})
+	tarWriter.Write([]byte("WiredTiger"))
+	tarWriter.Close()
+
+	compressors := map[string]func(io.Writer) io.WriteCloser{
+		"mongo-data.tgz": func(writer io.Writer) io.WriteCloser { return gzip.NewWriter(writer) },
+		"mongo-data.tar.zst": func(writer io.Writer) io.WriteCloser {
+			zstdWriter, _ := zstd.NewWriter(writer)
+			return zstdWriter
+		},
+		"mongo-data.tar.xz": func(writer io.Writer) io.WriteCloser {
+			xzWriter, _ := xz.NewWriter(writer)
+			return xzWriter
+		},
+	}
+
+	archives := map[string]ArchiveFormat{"mongo-data.tar": FormatTar, "mongo-data.zip": FormatZip}
+	os.WriteFile("./testfiles/formats/mongo-data.tar", tarball.Bytes(), 0644)
+	for name, compressor := range compressors {
+		compressed := &bytes.Buffer{}
+		writer := compressor(compressed)
+		writer.Write(tarball.Bytes())
+		writer.Close()
+		os.WriteFile("./testfiles/formats/"+name, compressed.Bytes(), 0644)
+		archives[name] = DetectArchiveFormat(compressed.Bytes())
+	}
+
+	zipped := &bytes.Buffer{}
+	zipWriter := zip.NewWriter(zipped)
+	fileWriter, _ := zipWriter.Create("db/WiredTiger")
+	fileWriter.Write([]byte("WiredTiger"))
+	zipWriter.Close()
+	os.WriteFile("./testfiles/formats/mongo-data.zip", zipped.Bytes(), 0644)
+
+	assertEquals(tst, FormatGzip, archives["mongo-data.tgz"])
+	assertEquals(tst, FormatZstd, archives["mongo-data.tar.zst"])
+	assertEquals(tst, FormatXz, archives["mongo-data.tar.xz"])
+	assertEquals(tst, FormatBzip2, DetectArchiveFormat([]byte("BZh91AY&SY")))
+	assertEquals(tst, FormatUnknown, DetectArchiveFormat([]byte("not an archive")))
+
+	for name := range archives {
+		target := "./testfiles/formats/" + name + ".out"
+		result, err := Extractor{}.ExtractArchive("./testfiles/formats/"+name, target, nil)
+		if err != nil {
+			tst.Fatalf("Failed to extract. Archive: %v Err: %v", name, err)
+		}
+		assertEquals(tst, 1, result.Files)
+
+		contents, _ := os.ReadFile(target + "/db/WiredTiger")
+		assertEquals(tst, "WiredTiger", string(contents))
+	}
+
+	// A lone gzipped file made of two gzip members.
+	multiMember := &bytes.Buffer{}
+	for _, part := range []string{"first ", "second"} {
+		gzWriter := gzip.NewWriter(multiMember)
+		gzWriter.Name = "mongod.log"
+		gzWriter.Write([]byte(part))
+		gzWriter.Close()
+	}
+	os.WriteFile("./testfiles/formats/log.gz", multiMember.Bytes(), 0644)
+	if err := UnGzip("./testfiles/formats/log.gz", "./testfiles/formats/log"); err != nil {
+		tst.Fatalf("Failed to decompress. Err: %v", err)
+	}
+	contents, _ := os.ReadFile("./testfiles/formats/log/mongod.log")
+	assertEquals(tst, "first second", string(contents))
+}
+
+func TestParseDBPathLayout(tst *testing.T) {
+	for _, testCase := range []struct {
+		dbpath   string
+		expected DBPathLayout
+	}{
+		{"dbpath/mongo-data-job0/data/db/job0/resmoke/node1",
+			DBPathLayout{Cluster: "dbpath/mongo-data-job0/data/db/job0", Node: "node1"}},
+		{"dbpath/mongo-data-job4/data/db/job4/resmoke/shard1/node2",
+			DBPathLayout{Cluster: "dbpath/mongo-data-job4/data/db/job4", ReplicaSet: "shard1", Shard: "shard1", Node: "node2"}},
+		{"dbpath/mongo-data-job4/data/db/job4/resmoke/config/node0",
+			DBPathLayout{Cluster: "dbpath/mongo-data-job4/data/db/job4", ReplicaSet: "config", ConfigServer: true, Node: "node0"}},
+		{"dbpath/mongo-data-job0/data/db/job0/rs0/node0",
+			DBPathLayout{Cluster: "dbpath/mongo-data-job0/data/db/job0", ReplicaSet: "rs0", Node: "node0"}},
+		{"dbpath/repro/db", DBPathLayout{Cluster: "dbpath/repro", Node: "db"}},
+	} {
+		assertEquals(tst, testCase.expected, ParseDBPathLayout(testCase.dbpath))
+	}
+}
+
+func TestBuildTopology(tst *testing.T) {
+	prefix := "dbpath/mongo-data-job0/data/db/job0/resmoke/"
+	shardConfig := &ReplSetConfig{ID: "shard-rs0", Members: []ReplSetMember{
+		{ID: 0, Host: "localhost:20001"}, {ID: 1, Host: "localhost:20002"}, {ID: 2, Host: "localhost:20003", ArbiterOnly: true}}}
+	metadata := map[string]NodeMetadata{
+		// node1 won the most recent election. node0 still remembers voting for itself earlier.
+		prefix + "shard0/node0": {ReplSetConfig: shardConfig, ShardName: "shard-rs0", Port: 20001,
+			HasLastVote: true, LastVoteTerm: 1, CandidateIndex: 0},
+		prefix + "shard0/node1": {ReplSetConfig: shardConfig, ShardName: "shard-rs0", Port: 20002,
+			HasLastVote: true, LastVoteTerm: 2, CandidateIndex: 1},
+		prefix + "shard0/node2": {ReplSetConfig: shardConfig, ShardName: "shard-rs0", Port: 20003},
+		prefix + "config/node0": {ReplSetConfig: &ReplSetConfig{ID: "config-rs", ConfigSvr: true,
+			Members: []ReplSetMember{{ID: 0, Host: "localhost:20000"}}},
+			HasLastVote: true, LastVoteTerm: 1, CandidateIndex: 0},
+	}
+	dbpaths := []string{
+		prefix + "config/node0", prefix + "shard0/node0", prefix + "shard0/node1", prefix + "shard0/node2",
+		"dbpath/other/db",
+	}
+
+	topology := BuildTopology(dbpaths, func(dbpath string) (NodeMetadata, error) {
+		if ret, exists := metadata[dbpath]; exists {
+			return ret, nil
+		}
+		return NodeMetadata{}, fmt.Errorf("wt not found")
+	})
+
+	assertEquals(tst, 2, len(topology.Clusters))
+	cluster := topology.Clusters[0]
+	assertEquals(tst, true, cluster.Sharded)
+	assertEquals(tst, 2, len(cluster.ReplicaSets))
+
+	config := cluster.ReplicaSets[0]
+	assertEquals(tst, "config-rs", config.Name)
+	assertEquals(tst, true, config.ConfigServer)
+	assertEquals(tst, NodePrimary, config.Nodes[0].State)
+
+	shard := cluster.ReplicaSets[1]
+	assertEquals(tst, "shard-rs0", shard.Name)
+	assertEquals(tst, "shard-rs0", shard.Shard)
+	assertEquals(tst, NodeSecondary, shard.Nodes[0].State)
+	assertEquals(tst, NodePrimary, shard.Nodes[1].State)
+	assertEquals(tst, NodeArbiter, shard.Nodes[2].State)
+	assertEquals(tst, "localhost:20002", shard.Nodes[1].Host)
+
+	// Without metadata only the layout is known.
+	other := topology.Clusters[1].ReplicaSets[0].Nodes[0]
+	assertEquals(tst, NodeUnknown, other.State)
+	assertEquals(tst, "wt not found", other.Err)
+}
+
+func TestParseDump(tst *testing.T) {
+	dump := "WiredTiger Dump (WiredTiger Version 11.2.0)\nFormat=hex\nHeader\ntable:_mdb_catalog\n" +
+		"key_format=q,value_format=u\nData\n81\n0500000000\n82\n0600000000\n"
+	entries, err := ParseDump(strings.NewReader(dump))
+	if err != nil {
+		panic(err)
+	}
+	assertEquals(tst, 2, len(entries))
+	assertEquals(tst, "\x82", string(entries[1].Key))
+	assertEquals(tst, "\x06\x00\x00\x00\x00", string(entries[1].Value))
+}
+
+const resmokeLog = `[2023/02/10 19:35:10.000] [resmoke] 2023-02-10T19:35:10.000+0000 Starting the fixture
+[2023/02/10 19:35:11.000] [j0:n0] {"t":{"$date":"2023-02-10T19:35:11.100+00:00"},"s":"I","c":"NETWORK","id":23016,"ctx":"listener","msg":"Waiting for connections","attr":{"port":20000,"ssl":"off"}}
+[2023/02/10 19:35:12.000] [executor:js_test:job0] 2023-02-10T19:35:12.000+0000 Running jstests/core/first.js...
+[2023/02/10 19:35:12.500] [js_test:first] Starting a test
+[2023/02/10 19:35:13.000] [j0:n0] {"t":{"$date":"2023-02-10T19:35:13.100+00:00"},"s":"I","c":"REPL","id":21392,"ctx":"conn1","msg":"New replica set config"}
+[2023/02/10 19:35:14.000] [executor:js_test:job0] 2023-02-10T19:35:14.000+0000 Running jstests/core/second.js...
+[2023/02/10 19:35:15.000] [js_test:second] d20021| {"t":{"$date":"2023-02-10T19:35:15.100+00:00"},"s":"I","c":"STORAGE","id":1,"ctx":"main","msg":"Opening"}
+[2023/02/10 19:35:16.000] [j0:n0] {"t":{"$date":"2023-02-10T19:35:16.100+00:00"},"s":"I","c":"REPL","id":2,"ctx":"conn2","msg":"Stepping down"}
+`
+
+func TestIndexAndScanLog(tst *testing.T) {
+	if err := os.RemoveAll("./testfiles/"); err != nil {
+		panic(err)
+	}
+	if err := os.MkdirAll("./testfiles/", 0755); err != nil {
+		panic(err)
+	}
+	logPath := "./testfiles/task.log"
+	if err := os.WriteFile(logPath, []byte(resmokeLog), 0644); err != nil {
+		panic(err)
+	}
+
+	index, err := IndexLog(logPath)
+	if err != nil {
+		panic(err)
+	}
+	if err := SaveLogIndex(logPath, index); err != nil {
+		panic(err)
+	}
+	if index, err = LoadLogIndex(logPath); err != nil {
+		panic(err)
+	}
+
+	assertEquals(tst, 8, index.Lines)
+	assertEquals(tst, 2, len(index.Nodes))
+	assertEquals(tst, "d20021", index.Nodes[0].Name)
+	assertEquals(tst, 20021, index.Nodes[0].Port)
+	assertEquals(tst, "j0:n0", index.Nodes[1].Name)
+	assertEquals(tst, 20000, index.Nodes[1].Port)
+	assertEquals(tst, 3, index.Nodes[1].Lines)
+	assertEquals(tst, 2, len(index.Tests))
+	assertEquals(tst, "first", index.Tests[0].Name)
+	assertEquals(tst, 3, index.Tests[0].Lines)
+	assertEquals(tst, "second", index.Tests[1].Name)
+	assertEquals(tst, 3, len(index.Components))
+
+	// Fixture node lines belong to the test the job is running.
+	lines, next, err := ScanLog(logPath, index, LogFilter{Test: "second", Component: "REPL"}, 10)
+	if err != nil {
+		panic(err)
+	}
+	assertEquals(tst, int64(-1), next)
+	assertEquals(tst, 1, len(lines))
+	assertEquals(tst, "j0:n0", lines[0].Node)
+	assertEquals(tst, true, strings.Contains(lines[0].Text, "Stepping down"))
+
+	// A port selects the node that listened on it.
+	lines, _, err = ScanLog(logPath, index, LogFilter{Node: "20000"}, 10)
+	if err != nil {
+		panic(err)
+	}
+	assertEquals(tst, 3, len(lines))
+
+	// Time filters use the server's own timestamp when there is one.
+	from, _ := time.Parse(time.RFC3339, "2023-02-10T19:35:13Z")
+	to, _ := time.Parse(time.RFC3339, "2023-02-10T19:35:15.5Z")
+	lines, next, err = ScanLog(logPath, index, LogFilter{From: from, To: to}, 2)
+	if err != nil {
+		panic(err)
+	}
+	assertEquals(tst, 2, len(lines))
+	assertEquals(tst, "2023-02-10T19:35:13.1Z", lines[0].Time.Format(time.RFC3339Nano))
+	lines, next, err = ScanLog(logPath, index, LogFilter{From: from, To: to, After: next}, 2)
+	if err != nil {
+		panic(err)
+	}
+	assertEquals(tst, 1, len(lines))
+	assertEquals(tst, "second", lines[0].Test)
+	assertEquals(tst, int64(-1), next)
+
+	os.RemoveAll("./testfiles/")
+}
+
+func TestResolveToolchain(tst *testing.T) {
+	dir := tst.TempDir()
+	writeToolchain := func(name, metadata string) {
+		if err := os.MkdirAll(filepath.Join(dir, "toolchains", name, "bin"), 0755); err != nil {
+			panic(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "toolchains", name, "bin", "wt"), []byte("#!/bin/sh\n"), 0755); err != nil {
+			panic(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "toolchains", name, "toolchain.json"), []byte(metadata), 0644); err != nil {
+			panic(err)
+		}
+	}
+	writeToolchain("v6.0", `{"revision": "1111111111111111111111111111111111111111", "wtVersion": "10.0.2"}`)
+	writeToolchain("v7.0", `{"revision": "2222222222222222222222222222222222222222", "wtVersion": "11.2.0"}`)
+	writeToolchain("master", `{"wtVersion": "11.3.0"}`)
+
+	registry, err := LoadToolchains(filepath.Join(dir, "toolchains"))
+	if err != nil {
+		panic(err)
+	}
+	assertEquals(tst, 3, len(registry.Toolchains))
+
+	turtle := "WiredTiger version string\nWiredTiger 11.2.0: (December  1, 2022)\nWiredTiger version\nmajor=11,minor=2,patch=0\n"
+	if err := os.WriteFile(filepath.Join(dir, "WiredTiger.turtle"), []byte(turtle), 0644); err != nil {
+		panic(err)
+	}
+	wtVersion, err := ReadTurtleVersion(dir)
+	if err != nil {
+		panic(err)
+	}
+	assertEquals(tst, WTVersion{11, 2, 0}, wtVersion)
+
+	task := TaskRef{ID: "mongodb_mongo_v6.0_jsCore_patch_1111111111111111111111111111111111111111_63e54b7e9ccd4e19c98bf4c6_23_02_10_19_28_57"}
+	assertEquals(tst, "1111111111111111111111111111111111111111", TaskRevision(task))
+	assertEquals(tst, "", TaskRevision(TaskRef{ID: "upload_repro_123"}))
+
+	// The task's revision wins over the data files' version.
+	assertEquals(tst, "v6.0", registry.Resolve(TaskRevision(task), wtVersion).Name)
+	assertEquals(tst, "v6.0", registry.Resolve("1111111", WTVersion{}).Name)
+	// Otherwise the oldest toolchain that can open the data files.
+	assertEquals(tst, "v7.0", registry.Resolve("", wtVersion).Name)
+	assertEquals(tst, "master", registry.Resolve("", WTVersion{11, 2, 1}).Name)
+	assertEquals(tst, SystemToolchainName, registry.Resolve("", WTVersion{12, 0, 0}).Name)
+	assertEquals(tst, SystemToolchainName, registry.Resolve("", WTVersion{}).Name)
+
+	toolchain := registry.Find("v7.0")
+	assertEquals(tst, filepath.Join(registry.Dir, "v7.0", "bin", "wt"), toolchain.Binary("wt"))
+	// Missing binaries and the system toolchain use $PATH.
+	assertEquals(tst, "ksdecode", toolchain.Binary("ksdecode"))
+	assertEquals(tst, "wt", registry.Find(SystemToolchainName).Binary("wt"))
+	assertEquals(tst, "wt", (*Toolchain)(nil).Binary("wt"))
+}
+
+// packWTUint packs a non-negative integer the way WiredTiger does. See wtpack.go.
+func packWTUint(value uint64) []byte {
+	switch {
+	case value <= wtPos1ByteMax:
+		return []byte{wtPos1ByteMarker | byte(value)}
+	case value <= wtPos2ByteMax:
+		value -= wtPos1ByteMax + 1
+		return []byte{wtPos2ByteMarker | byte(value>>8), byte(value)}
+	}
+
+	value -= wtPos2ByteMax + 1
+	var ret []byte
+	for ; value > 0; value >>= 8 {
+		ret = append([]byte{byte(value)}, ret...)
+	}
+	return append([]byte{wtPosMultiMarker | byte(len(ret))}, ret...)
+}
+
+func packWTItem(item []byte) []byte {
+	return append(packWTUint(uint64(len(item))), item...)
+}
+
+// packLogOp prefixes the operation's fields with its type and size. The size includes itself.
+func packLogOp(opType OpType, fields ...[]byte) []byte {
+	body := bytes.Join(fields, nil)
+	size := uint64(len(body)) + 2
+	for uint64(len(packWTUint(uint64(opType)))+len(packWTUint(size))+len(body)) != size {
+		size++
+	}
+	return append(append(packWTUint(uint64(opType)), packWTUint(size)...), body...)
+}
+
+// logRecord frames a record body with a header, padding and checksum. A compressed record holds
+// the body compressed with WiredTiger's snappy compressor.
+func logRecord(body []byte, compressed bool) []byte {
+	memLen := logRecordHeaderSize + len(body)
+	flags := uint16(0)
+	if compressed {
+		encoded := snappy.Encode(nil, body)
+		body = binary.LittleEndian.AppendUint64(nil, uint64(len(encoded)))
+		body = append(body, encoded...)
+		flags = logRecordCompressed
+	}
+
+	length := (logRecordHeaderSize + len(body) + 127) / 128 * 128
+	ret := make([]byte, length)
+	binary.LittleEndian.PutUint32(ret[0:], uint32(length))
+	binary.LittleEndian.PutUint16(ret[8:], flags)
+	binary.LittleEndian.PutUint32(ret[12:], uint32(memLen))
+	copy(ret[logRecordHeaderSize:], body)
+	binary.LittleEndian.PutUint32(ret[4:], crc32.Checksum(ret, castagnoliTable))
+	return ret
+}
+
+func logFileHeader() []byte {
+	desc := make([]byte, 16)
+	binary.LittleEndian.PutUint32(desc, logMagic)
+	binary.LittleEndian.PutUint16(desc[4:], 5)
+	binary.LittleEndian.PutUint64(desc[8:], 100*1024*1024)
+	return logRecord(desc, false)
+}
+
+func TestReadJournal(tst *testing.T) {
+	unpacker := &wtUnpacker{buf: []byte{0x7f, 0xe1, 0x40}}
+	assertEquals(tst, int64(-1), unpacker.Int())
+	assertEquals(tst, uint64(8256+0x40), unpacker.Uint())
+	assertEquals(tst, nil, unpacker.err)
+
+	journalDir := tst.TempDir()
+	doc := []byte("\x0e\x00\x00\x00\x10_id\x00\x01\x00\x00\x00\x00")
+	commit := bytes.Join([][]byte{
+		packWTUint(uint64(LogRecordCommit)), packWTUint(7),
+		packLogOp(OpRowPut, packWTUint(5), packWTItem([]byte{0x81}), doc),
+		packLogOp(OpRowRemove, packWTUint(0x80000003), []byte("key")),
+	}, nil)
+	modify := bytes.Join([][]byte{
+		packWTUint(uint64(LogRecordCommit)), packWTUint(300),
+		packLogOp(OpTxnTimestamp, packWTUint(1), packWTUint(2), packWTUint(3<<32|1), packWTUint(3<<32|1),
+			packWTUint(3<<32|1), packWTUint(0), packWTUint(0)),
+		packLogOp(OpRowModify, packWTUint(6), packWTItem([]byte{0x82}), bytes.Repeat([]byte("modify"), 50)),
+	}, nil)
+
+	firstFile := bytes.Join([][]byte{
+		logFileHeader(),
+		logRecord(bytes.Join([][]byte{packWTUint(uint64(LogRecordSystem)), packLogOp(OpPrevLSN, packWTUint(0), packWTUint(0))}, nil), false),
+		logRecord(commit, false),
+		logRecord(modify, true),
+		logRecord(append(packWTUint(uint64(LogRecordMessage)), "hello\x00"...), false),
+		// Preallocated space is zeroed.
+		make([]byte, 512),
+	}, nil)
+	torn := logRecord(append(packWTUint(uint64(LogRecordMessage)), "torn\x00"...), false)
+	torn[20] ^= 0xff
+	secondFile := bytes.Join([][]byte{
+		logFileHeader(),
+		logRecord(bytes.Join([][]byte{packWTUint(uint64(LogRecordFileSync)), packWTUint(4), packWTUint(1)}, nil), false),
+		torn,
+	}, nil)
+	if err := os.WriteFile(filepath.Join(journalDir, "WiredTigerLog.0000000001"), firstFile, 0644); err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(filepath.Join(journalDir, "WiredTigerLog.0000000002"), secondFile, 0644); err != nil {
+		panic(err)
+	}
+
+	reader, err := OpenJournal(journalDir)
+	if err != nil {
+		panic(err)
+	}
+	defer reader.Close()
+
+	var records []*LogRecord
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			tst.Fatalf("Failed to read the journal. Err: %v", err)
+		}
+		records = append(records, record)
+	}
+	assertEquals(tst, 5, len(records))
+	if reader.TornTail == nil {
+		tst.Fatalf("Expected the torn record at the end of the journal to be noticed")
+	}
+
+	assertEquals(tst, LSN{1, 128}, records[0].LSN)
+	assertEquals(tst, LogRecordSystem, records[0].Type)
+	assertEquals(tst, OpPrevLSN, records[0].Ops[0].Type)
+
+	assertEquals(tst, LSN{1, 256}, records[1].LSN)
+	assertEquals(tst, uint64(7), records[1].TxnID)
+	assertEquals(tst, 2, len(records[1].Ops))
+	assertEquals(tst, OpRowPut, records[1].Ops[0].Type)
+	assertEquals(tst, uint32(5), records[1].Ops[0].FileID)
+	assertEquals(tst, "\x81", string(records[1].Ops[0].Key))
+	assertEquals(tst, string(doc), string(records[1].Ops[0].Value))
+	assertEquals(tst, true, records[1].Ops[1].IsIgnored())
+	assertEquals(tst, uint32(3), records[1].Ops[1].TableFileID())
+	assertEquals(tst, "key", string(records[1].Ops[1].Key))
+
+	assertEquals(tst, true, records[2].Compressed)
+	assertEquals(tst, uint64(300), records[2].TxnID)
+	assertEquals(tst, uint64(3<<32|1), records[2].Ops[0].CommitTS)
+	assertEquals(tst, OpRowModify, records[2].Ops[1].Type)
+	assertEquals(tst, strings.Repeat("modify", 50), string(records[2].Ops[1].Value))
+
+	assertEquals(tst, "hello", records[3].Message)
+	assertEquals(tst, LSN{2, 128}, records[4].LSN)
+	assertEquals(tst, LogRecordFileSync, records[4].Type)
+	assertEquals(tst, int64(1), records[4].Start)
+
+	// The printlog output matches what `wt printlog -u -x` writes and `RewritePrintlog` expects.
+	reader, err = OpenJournal(journalDir)
+	if err != nil {
+		panic(err)
+	}
+	defer reader.Close()
+	printlog := &bytes.Buffer{}
+	if err := WritePrintlog(reader, printlog); err != nil {
+		panic(err)
+	}
+	for _, expected := range []string{
+		"  { \"lsn\" : [1,256],\n    \"hdr_flags\" : \"\",\n    \"rec_len\" : 128,\n",
+		"    \"type\" : \"commit\",\n    \"txnid\" : 7,\n    \"ops\": [\n",
+		"      { \"optype\": \"row_put\",\n        \"fileid\": 5 0x5,\n        \"key\": \"\\u0081\",\n        \"key-hex\": \"81\",\n",
+		"        \"value-hex\": \"" + hex.EncodeToString(doc) + "\"\n      },\n",
+		"        \"fileid\": 2147483651 0x80000003,\n        \"key\": \"key\",\n        \"key-hex\": \"6b6579\"\n      }\n    ]\n  },\n",
+		"        \"prev_lsn\": [0, 0]\n",
+		"    \"fileid\" : 4,\n    \"start\" : 1\n  }\n]\n",
+	} {
+		if !strings.Contains(printlog.String(), expected) {
+			tst.Fatalf("Expected printlog output to contain:\n%s\nOutput:\n%s", expected, printlog.String())
+		}
+	}
+}
+
+func TestPrintlogReader(tst *testing.T) {
+	doc := []byte("\x0e\x00\x00\x00\x10_id\x00\x01\x00\x00\x00\x00")
+	// Whitespace and field order differ from what `WritePrintlog` writes. The second operation has
+	// no `-hex` fields and a `}` inside a string.
+	printlog := "junk before the document\n[{\"type\":\"commit\",\"lsn\":[1,256],\"txnid\":7,\"hdr_flags\":\"\"," +
+		"\"ops\":[{\"key-hex\":\"81\",\"optype\":\"row_put\",\"value-hex\":\"" + hex.EncodeToString(doc) + "\",\"fileid\": 5 0x5}," +
+		"{\"optype\":\"row_remove\",\"fileid\":2147483651 0x80000003,\"key\":\"k}\\u0081\"}]}\n," +
+		"  { \"lsn\" : [2,128],\n    \"type\" : \"file_sync\",\n    \"fileid\" : 4,\n    \"start\" : 1\n  }\n]\n"
+
+	reader := NewPrintlogReader(strings.NewReader(printlog))
+	var records []*LogRecord
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			tst.Fatalf("Failed to parse printlog output. Err: %v", err)
+		}
+		records = append(records, record)
+	}
+	assertEquals(tst, 2, len(records))
+	assertEquals(tst, LSN{1, 256}, records[0].LSN)
+	assertEquals(tst, LogRecordCommit, records[0].Type)
+	assertEquals(tst, uint64(7), records[0].TxnID)
+	assertEquals(tst, 2, len(records[0].Ops))
+	assertEquals(tst, OpRowPut, records[0].Ops[0].Type)
+	assertEquals(tst, uint32(5), records[0].Ops[0].FileID)
+	assertEquals(tst, "\x81", string(records[0].Ops[0].Key))
+	assertEquals(tst, string(doc), string(records[0].Ops[0].Value))
+	assertEquals(tst, uint32(3), records[0].Ops[1].TableFileID())
+	assertEquals(tst, "k}\x81", string(records[0].Ops[1].Key))
+	assertEquals(tst, LogRecordFileSync, records[1].Type)
+	assertEquals(tst, uint32(4), records[1].FileID)
+
+	// Writing the records and parsing them again is lossless.
+	written := &bytes.Buffer{}
+	if err := WritePrintlog(NewPrintlogReader(strings.NewReader(printlog)), written); err != nil {
+		panic(err)
+	}
+	reparsed, err := NewPrintlogReader(bytes.NewReader(written.Bytes())).Next()
+	if err != nil {
+		panic(err)
+	}
+	assertEquals(tst, fmt.Sprintf("%+v", *records[0]), fmt.Sprintf("%+v", *reparsed))
+
+	// Annotation names the table and collection, and decodes collection values.
+	catalog := &Catalog{FileToCollection: make(map[string]*CollectionInfo), FileToIndex: make(map[string]*IndexInfo)}
+	catalog.FileToCollection["collection-2-123"] = &CollectionInfo{Name: "test.coll", Ident: "collection-2-123"}
+	list := &WTList{FileIdToTable: map[int64]string{5: "collection-2-123", 3: "index-4-123"}}
+	annotated := &bytes.Buffer{}
+	if err := AnnotatePrintlog(NewPrintlogReader(strings.NewReader(printlog)), annotated, catalog, list, nil, nil, nil); err != nil {
+		panic(err)
+	}
+	for _, expected := range []string{
+		"        \"fileid\": 5 0x5, collection-2-123.wt test.coll\n        \"key-hex\": \"81\",\n",
+		"        \"value-bson\": {\n",
+		"        \"fileid\": 2147483651 0x80000003, index-4-123.wt Unknown (dropped?) table\n        \"key-hex\": \"6b7d81\"\n      }\n",
+	} {
+		if !strings.Contains(annotated.String(), expected) {
+			tst.Fatalf("Expected annotated output to contain:\n%s\nOutput:\n%s", expected, annotated.String())
+		}
+	}
+	if strings.Contains(annotated.String(), "\"key\":") {
+		tst.Fatalf("Expected the escaped keys to be dropped. Output:\n%s", annotated.String())
+	}
+}
+
+func TestPrintlogEscapesStrings(tst *testing.T) {
+	printlog := "[{\"lsn\":[1,128],\"type\":\"message\",\"message\":\"say \\\"hi\\\"\\nbye\"},\n" +
+		"{\"lsn\":[1,256],\"type\":\"system\",\"ops\":[{\"optype\":\"backup_id\",\"index\":1,\"granularity\":2," +
+		"\"id\":\"id \\\"1\\\"\\n\"}]}]\n"
+	written := &bytes.Buffer{}
+	if err := WritePrintlog(NewPrintlogReader(strings.NewReader(printlog)), written); err != nil {
+		panic(err)
+	}
+	for _, expected := range []string{
+		"    \"message\" : \"say \\\"hi\\\"\\nbye\"\n",
+		"        \"id\": \"id \\\"1\\\"\\n\"\n",
+	} {
+		if !strings.Contains(written.String(), expected) {
+			tst.Fatalf("Expected printlog output to contain:\n%s\nOutput:\n%s", expected, written.String())
+		}
+	}
+
+	// The escaped strings parse back to the same records.
+	reader := NewPrintlogReader(bytes.NewReader(written.Bytes()))
+	message, err := reader.Next()
+	if err != nil {
+		tst.Fatalf("Failed to parse printlog output. Err: %v\nOutput:\n%s", err, written.String())
+	}
+	assertEquals(tst, "say \"hi\"\nbye", message.Message)
+	system, err := reader.Next()
+	if err != nil {
+		tst.Fatalf("Failed to parse printlog output. Err: %v\nOutput:\n%s", err, written.String())
+	}
+	assertEquals(tst, OpBackupID, system.Ops[0].Type)
+	assertEquals(tst, "id \"1\"\n", system.Ops[0].ID)
+}
+
+func TestDetectWTConfig(tst *testing.T) {
+	dbpath := tst.TempDir()
+	config, err := DetectWTConfig(dbpath)
+	if err != nil {
+		panic(err)
+	}
+	assertEquals(tst, "log=(enabled=true,path=journal,compressor=snappy),verbose=()", config.String())
+
+	storage, _ := bson.Marshal(bson.M{"storage": bson.M{"engine": "wiredTiger", "options": bson.M{"directoryPerDB": true}}})
+	files := map[string]string{
+		"WiredTiger.basecfg": "# Do not modify this file.\nconfig_base=false,log=(enabled=true,compressor=zlib,path=\"journal\",file_max=100MB)\n",
+		"WiredTiger.turtle": "WiredTiger version\nmajor=11,minor=2,patch=0\nfile:WiredTiger.wt\n" +
+			"allocation_size=4KB,encryption=(keyid=\"key1\",name=AES256-CBC),id=0\n",
+		"storage.bson": string(storage),
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dbpath, name), []byte(contents), 0644); err != nil {
+			panic(err)
+		}
+	}
+	config, err = DetectWTConfig(dbpath)
+	if err != nil {
+		panic(err)
+	}
+	assertEquals(tst, "zlib", config.LogCompressor)
+	assertEquals(tst, "AES256-CBC", config.EncryptionName)
+	assertEquals(tst, "key1", config.EncryptionKeyID)
+	// `wt` cannot open encrypted dbpaths. Say so up front rather than run it.
+	if err := config.Check(); err == nil {
+		tst.Fatalf("Expected encrypted dbpaths to be rejected")
+	}
+	if _, err := (WTHome{DBPath: dbpath, Config: &config}).DumpTable("_mdb_catalog"); err == nil || !strings.Contains(err.Error(), "encrypted") {
+		tst.Fatalf("Expected the dump to fail early. Err: %v", err)
+	}
+	assertEquals(tst, true, config.DirectoryPerDB)
+
+	// The journal files win over the base config. These are in the dbpath itself and compressed
+	// with zstd.
+	os.Remove(filepath.Join(dbpath, "WiredTiger.turtle"))
+	encoder, _ := zstd.NewWriter(nil)
+	body := bytes.Join([][]byte{
+		packWTUint(uint64(LogRecordMessage)), bytes.Repeat([]byte("m"), 300), {0},
+	}, nil)
+	encoded := encoder.EncodeAll(body, nil)
+	compressed := append(binary.LittleEndian.AppendUint64(nil, uint64(len(encoded))), encoded...)
+	record := logRecord(compressed, false)
+	binary.LittleEndian.PutUint16(record[8:], logRecordCompressed)
+	binary.LittleEndian.PutUint32(record[12:], uint32(logRecordHeaderSize+len(body)))
+	binary.LittleEndian.PutUint32(record[4:], 0)
+	binary.LittleEndian.PutUint32(record[4:], crc32.Checksum(record, castagnoliTable))
+	journal := append(logFileHeader(), record...)
+	if err := os.WriteFile(filepath.Join(dbpath, "WiredTigerLog.0000000001"), journal, 0644); err != nil {
+		panic(err)
+	}
+
+	config, err = DetectWTConfig(dbpath)
+	if err != nil {
+		panic(err)
+	}
+	assertEquals(tst, "log=(enabled=true,path=.,compressor=zstd),verbose=()", config.String())
+
+	storage, _ = bson.Marshal(bson.M{"storage": bson.M{"engine": "inMemory"}})
+	if err := os.WriteFile(filepath.Join(dbpath, "storage.bson"), storage, 0644); err != nil {
+		panic(err)
+	}
+	if _, err := DetectWTConfig(dbpath); err == nil {
+		tst.Fatalf("Expected a dbpath of another storage engine to be rejected")
+	}
+}
+
+func TestWTDiagnosticsCancel(tst *testing.T) {
+	// A `wt` that never finishes.
+	toolchainDir := tst.TempDir()
+	if err := os.MkdirAll(filepath.Join(toolchainDir, "bin"), 0755); err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(filepath.Join(toolchainDir, "bin", "wt"), []byte("#!/bin/sh\nexec sleep 60\n"), 0755); err != nil {
+		panic(err)
+	}
+
+	wtDiag := NewWTDiagnostics(tst.TempDir(), tst.TempDir())
+	wtDiag.Toolchain = &Toolchain{Name: "sleeping", Dir: toolchainDir}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := wtDiag.Run(ctx); errors.Cause(err) != context.DeadlineExceeded {
+		tst.Fatalf("Expected the deadline to stop the diagnostics. Err: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		tst.Fatalf("Expected `wt` to be killed at the deadline. Elapsed: %v", elapsed)
+	}
+}
+
+// WiredTiger allows one process per home. Diagnostics must never run two `wt` at once.
+func TestWTDiagnosticsRunsWTAlone(tst *testing.T) {
+	toolchainDir := tst.TempDir()
+	if err := os.MkdirAll(filepath.Join(toolchainDir, "bin"), 0755); err != nil {
+		panic(err)
+	}
+	script := "#!/bin/sh\n" +
+		"cd " + toolchainDir + "\n" +
+		"mkdir running || echo overlap >> runs\n" +
+		"echo \"$*\" >> runs\n" +
+		"sleep 0.2\n" +
+		"rmdir running\n" +
+		"echo Data\n"
+	if err := os.WriteFile(filepath.Join(toolchainDir, "bin", "wt"), []byte(script), 0755); err != nil {
+		panic(err)
+	}
+
+	// Without journal files `wt printlog` is the fallback.
+	wtDiag := NewWTDiagnostics(tst.TempDir(), tst.TempDir()+"/")
+	wtDiag.Toolchain = &Toolchain{Name: "recording", Dir: toolchainDir}
+	wtDiag.Run(context.Background())
+
+	runs, err := os.ReadFile(filepath.Join(toolchainDir, "runs"))
+	if err != nil {
+		panic(err)
+	}
+	if strings.Contains(string(runs), "overlap") {
+		tst.Fatalf("Expected `wt` to run alone. Runs:\n%s", runs)
+	}
+	if !strings.Contains(string(runs), "printlog") || !strings.Contains(string(runs), "list") || !strings.Contains(string(runs), "_mdb_catalog") {
+		tst.Fatalf("Expected the journal, list and catalog to be read. Runs:\n%s", runs)
+	}
+}
+
+func TestKeyStringRecordIds(tst *testing.T) {
+	// `{: "a"}` followed by RecordId(1).
+	keyString, recordId, ok := SplitKeyStringRecordId([]byte{0x3c, 'a', 0x00, 0x04, 0x00, 0x08})
+	assertEquals(tst, true, ok)
+	assertEquals(tst, int64(1), recordId)
+	assertEquals(tst, "3c610004", hex.EncodeToString(keyString))
+
+	_, recordId, ok = SplitKeyStringRecordId([]byte{0x3c, 'a', 0x00, 0x04, 0x40, 0x80, 0x00, 0x02})
+	assertEquals(tst, true, ok)
+	assertEquals(tst, int64(1<<20), recordId)
+
+	// A unique index key has no RecordId, the value starts with it.
+	_, _, ok = SplitKeyStringRecordId([]byte{0x3c, 'a', 0x00, 0x04})
+	assertEquals(tst, false, ok)
+	recordId, typeBits, ok := ValueRecordId([]byte{0x1f, 0x40, 0xaa})
+	assertEquals(tst, true, ok)
+	assertEquals(tst, int64(1000), recordId)
+	assertEquals(tst, "aa", hex.EncodeToString(typeBits))
+
+	recordId, ok = CollectionRecordId(packWTUint(300))
+	assertEquals(tst, true, ok)
+	assertEquals(tst, int64(300), recordId)
+	// Clustered collections are keyed by KeyStrings.
+	_, ok = CollectionRecordId([]byte{0x3c, 'a', 0x00, 0x04})
+	assertEquals(tst, false, ok)
+
+	keyPattern, err := IndexKeyPattern(&IndexInfo{Name: "a_1", Definition: `{"a":1}`})
+	if err != nil {
+		panic(err)
+	}
+	assertEquals(tst, false, HasDescendingField(keyPattern))
+	keyPattern, err = IndexKeyPattern(&IndexInfo{Name: "a_1_b_-1", Definition: `{"a":1,"b":-1.0}`})
+	if err != nil {
+		panic(err)
+	}
+	assertEquals(tst, true, HasDescendingField(keyPattern))
+}
+
+func TestDumpPage(tst *testing.T) {
+	toolchainDir := tst.TempDir()
+	if err := os.MkdirAll(filepath.Join(toolchainDir, "bin"), 0755); err != nil {
+		panic(err)
+	}
+	wt := "#!/bin/sh\nprintf 'WiredTiger Dump\\nFormat=hex\\nHeader\\ntable:collection-0\\nkey_format=q\\nData\\n'\n" +
+		"for key in 81 82 83 84 85; do printf \"$key\\n05000000$key\\n\"; done\n"
+	if err := os.WriteFile(filepath.Join(toolchainDir, "bin", "wt"), []byte(wt), 0755); err != nil {
+		panic(err)
+	}
+
+	home := WTHome{DBPath: tst.TempDir(), Toolchain: &Toolchain{Name: "dump", Dir: toolchainDir}}
+	entries, more, err := home.DumpPage(context.Background(), "collection-0", 1, 2)
+	if err != nil {
+		panic(err)
+	}
+	assertEquals(tst, true, more)
+	assertEquals(tst, 2, len(entries))
+	assertEquals(tst, "\x82", string(entries[0].Key))
+	assertEquals(tst, "0500000083", hex.EncodeToString(entries[1].Value))
+
+	entries, more, err = home.DumpPage(context.Background(), "collection-0", 4, 2)
+	if err != nil {
+		panic(err)
+	}
+	assertEquals(tst, false, more)
+	assertEquals(tst, 1, len(entries))
+	assertEquals(tst, "\x85", string(entries[0].Key))
+}
+
+func TestVerifyTables(tst *testing.T) {
+	toolchainDir := tst.TempDir()
+	if err := os.MkdirAll(filepath.Join(toolchainDir, "bin"), 0755); err != nil {
+		panic(err)
+	}
+	// The index fails to verify.
+	wt := "#!/bin/sh\nfor arg; do table=$arg; done\n" +
+		"if [ \"$table\" = file:index-2.wt ]; then echo 'read checksum error' >&2; exit 1; fi\n"
+	if err := os.WriteFile(filepath.Join(toolchainDir, "bin", "wt"), []byte(wt), 0755); err != nil {
+		panic(err)
+	}
+
+	collection := &CollectionInfo{Name: "test.foo", Ident: "collection-1", IndexNameToInfo: make(map[string]*IndexInfo)}
+	index := &IndexInfo{Name: "a_1", Ident: "index-2", Owner: collection}
+	catalog := &Catalog{
+		FileToCollection: map[string]*CollectionInfo{"collection-1": collection},
+		FileToIndex:      map[string]*IndexInfo{"index-2": index},
+	}
+	list := &WTList{TableToFileId: map[string]int64{"WiredTiger": 0, "sizeStorer": 3, "collection-1": 5, "index-2": 6}}
+
+	home := WTHome{DBPath: tst.TempDir(), Toolchain: &Toolchain{Name: "verify", Dir: toolchainDir}}
+	results, err := VerifyTables(context.Background(), home, catalog, list)
+	if err != nil {
+		panic(err)
+	}
+	assertEquals(tst, 3, len(results))
+	assertEquals(tst, false, results[0].Passed)
+	assertEquals(tst, "test.foo index a_1", results[0].Describe())
+	assertEquals(tst, true, strings.Contains(results[0].Output, "read checksum error"))
+	assertEquals(tst, "sizeStorer", results[1].Describe())
+	assertEquals(tst, "test.foo", results[2].Describe())
+	assertEquals(tst, true, results[2].Passed)
+
+	verifyFile := filepath.Join(tst.TempDir(), "verify")
+	if err := SaveVerifyResults(results, verifyFile); err != nil {
+		panic(err)
+	}
+	loaded, err := LoadVerifyResults(verifyFile)
+	if err != nil {
+		panic(err)
+	}
+	assertEquals(tst, results[0], loaded[0])
+}
+
+func TestReadCheckpoints(tst *testing.T) {
+	list := "system:checkpoint\ncheckpoint_timestamp=\"643d4b0a00000005\"\n" +
+		"system:oldest\noldest_timestamp=\"643d4b0000000001\"\n" +
+		"file:collection-1.wt\nallocation_size=4KB,checkpoint=(" +
+		"WiredTigerCheckpoint.7=(addr=\"018a81e4\",order=7,time=1681738508,size=12288,newest_start_durable_ts=7223011857924096001," +
+		"oldest_start_ts=0,newest_txn=12,newest_stop_durable_ts=0,newest_stop_ts=-1,newest_stop_txn=-11,prepare=0,write_gen=20,run_write_gen=1)," +
+		"WiredTigerCheckpoint.6=(addr=\"018181e4\",order=6,time=1681738500,size=8192,write_gen=15,run_write_gen=1))," +
+		"checkpoint_backup_info=,id=5,key_format=q\n"
+	wtList := LoadWTList(io.NopCloser(strings.NewReader(list)))
+	assertEquals(tst, int64(5), wtList.TableToFileId["collection-1"])
+
+	dbpath := tst.TempDir()
+	turtle := "WiredTiger version string\nWiredTiger 11.2.0\nfile:WiredTiger.wt\n" +
+		"allocation_size=4KB,checkpoint=(WiredTigerCheckpoint.9=(addr=\"01\",order=9,time=1681738508,size=4096,write_gen=30)),id=0\n"
+	if err := os.WriteFile(filepath.Join(dbpath, "WiredTiger.turtle"), []byte(turtle), 0644); err != nil {
+		panic(err)
+	}
+
+	info := ReadCheckpoints(wtList, dbpath)
+	assertEquals(tst, "Timestamp(1681738506, 5)", info.CheckpointTimestamp.String())
+	assertEquals(tst, "Timestamp(1681738496, 1) 2023-04-17T13:34:56Z", info.OldestTimestamp.Describe())
+	assertEquals(tst, 1, len(info.Metadata.Checkpoints))
+	assertEquals(tst, int64(30), info.Metadata.Checkpoints[0].WriteGen)
+
+	assertEquals(tst, 1, len(info.Tables))
+	checkpoints := info.Tables[0].Checkpoints
+	assertEquals(tst, 2, len(checkpoints))
+	assertEquals(tst, "WiredTigerCheckpoint.6", checkpoints[0].Name)
+	latest := checkpoints[1]
+	assertEquals(tst, int64(12288), latest.Size)
+	assertEquals(tst, int64(20), latest.WriteGen)
+	assertEquals(tst, "2023-04-17T13:35:08Z", latest.Time.Format(time.RFC3339))
+	assertEquals(tst, uint32(1681738500), latest.NewestStartDurableTs.Seconds())
+	assertEquals(tst, uint32(1), latest.NewestStartDurableTs.Increment())
+	assertEquals(tst, "max", latest.NewestStopTs.String())
+	assertEquals(tst, "none", latest.OldestStartTs.String())
+}
+
+func TestDiffTable(tst *testing.T) {
+	toolchainDir := tst.TempDir()
+	if err := os.MkdirAll(filepath.Join(toolchainDir, "bin"), 0755); err != nil {
+		panic(err)
+	}
+	// As of the checkpoint the table has records 1, 2 and 3. Since then 1 was removed, 2 was
+	// updated and 4 was inserted. The checkpoint must be read without recovery, and only one `wt`
+	// may run at a time.
+	wt := "#!/bin/sh\n" +
+		"case \"$*\" in *\" -r \"*\"-c \"*) echo recovered >&2; exit 1;; esac\n" +
+		"mkdir " + toolchainDir + "/running || exit 1\n" +
+		"sleep 0.1\n" +
+		"printf 'WiredTiger Dump\\nFormat=hex\\nHeader\\ntable:collection-0\\nkey_format=q\\nData\\n'\n" +
+		"rmdir " + toolchainDir + "/running\n" +
+		"case \"$*\" in\n" +
+		"*\"-c WiredTigerCheckpoint\"*) printf '81\\n01\\n82\\n02\\n83\\n03\\n';;\n" +
+		"*) printf '82\\n22\\n83\\n03\\n84\\n04\\n';;\n" +
+		"esac\n"
+	if err := os.WriteFile(filepath.Join(toolchainDir, "bin", "wt"), []byte(wt), 0755); err != nil {
+		panic(err)
+	}
+
+	latest := WTHome{DBPath: tst.TempDir(), Toolchain: &Toolchain{Name: "diff", Dir: toolchainDir}}
+	checkpoint := latest.Unrecovered(tst.TempDir()).AtCheckpoint("WiredTigerCheckpoint")
+	diffs, more, err := DiffTable(context.Background(), checkpoint, latest, "collection-0", 10)
+	if err != nil {
+		panic(err)
+	}
+	assertEquals(tst, false, more)
+	assertEquals(tst, 3, len(diffs))
+	assertEquals(tst, "\x81", string(diffs[0].Key))
+	assertEquals(tst, true, diffs[0].After == nil)
+	assertEquals(tst, "\x02", string(diffs[1].Before))
+	assertEquals(tst, "\x22", string(diffs[1].After))
+	assertEquals(tst, "\x84", string(diffs[2].Key))
+	assertEquals(tst, true, diffs[2].Before == nil)
+
+	diffs, more, err = DiffTable(context.Background(), checkpoint, latest, "collection-0", 2)
+	if err != nil {
+		panic(err)
+	}
+	assertEquals(tst, true, more)
+	assertEquals(tst, 2, len(diffs))
+}
+
+func TestHistoryStore(tst *testing.T) {
+	doc, err := bson.Marshal(bson.M{"x": "old"})
+	if err != nil {
+		panic(err)
+	}
+	startTs := uint64(1681738500)<<32 | 2
+	hsKey := func(btreeId uint64, key []byte) []byte {
+		return bytes.Join([][]byte{packWTUint(btreeId), packWTItem(key), packWTUint(startTs), packWTUint(0)}, nil)
+	}
+	hsValue := func(updateType HSUpdateType, value []byte) []byte {
+		return bytes.Join([][]byte{packWTUint(startTs + 1), packWTUint(startTs), packWTUint(uint64(updateType)), value}, nil)
+	}
+	// A whole document of the collection, a modify of it and an index entry.
+	entries := []DumpEntry{
+		{hsKey(5, packWTUint(7)), hsValue(HSUpdateStandard, doc)},
+		{hsKey(5, packWTUint(7)), hsValue(HSUpdateModify, []byte{0x01})},
+		{hsKey(6, []byte{0x2b, 0x02, 0x04, 0x00, 0x38}), hsValue(HSUpdateStandard, nil)},
+	}
+
+	record, err := ParseHSRecord(entries[0])
+	if err != nil {
+		panic(err)
+	}
+	assertEquals(tst, uint32(5), record.BtreeId)
+	assertEquals(tst, "Timestamp(1681738500, 2)", record.StartTs.String())
+	assertEquals(tst, "Timestamp(1681738500, 3)", record.StopDurableTs.String())
+	assertEquals(tst, HSUpdateStandard, record.UpdateType)
+	assertEquals(tst, string(doc), string(record.Value))
+
+	var dump strings.Builder
+	dump.WriteString("WiredTiger Dump\nFormat=hex\nHeader\nfile:WiredTigerHS.wt\nkey_format=IuQQ\nData\n")
+	for _, entry := range entries {
+		dump.WriteString(hex.EncodeToString(entry.Key) + "\n" + hex.EncodeToString(entry.Value) + "\n")
+	}
+	dumpFile := filepath.Join(tst.TempDir(), "hs_dump")
+	if err := os.WriteFile(dumpFile, []byte(dump.String()), 0644); err != nil {
+		panic(err)
+	}
+	toolchainDir := tst.TempDir()
+	if err := os.MkdirAll(filepath.Join(toolchainDir, "bin"), 0755); err != nil {
+		panic(err)
+	}
+	wt := fmt.Sprintf("#!/bin/sh\ncase \"$*\" in *file:WiredTigerHS.wt) cat %s;; *) exit 1;; esac\n", dumpFile)
+	if err := os.WriteFile(filepath.Join(toolchainDir, "bin", "wt"), []byte(wt), 0755); err != nil {
+		panic(err)
+	}
+
+	collection := &CollectionInfo{Name: "test.foo", Ident: "collection-1", IndexNameToInfo: make(map[string]*IndexInfo)}
+	catalog := &Catalog{
+		FileToCollection: map[string]*CollectionInfo{"collection-1": collection},
+		FileToIndex:      map[string]*IndexInfo{"index-2": {Name: "x_1", Ident: "index-2", Owner: collection}},
+	}
+	list := &WTList{
+		TableToFileId: map[string]int64{"WiredTigerHS": 1, "collection-1": 5, "index-2": 6},
+		FileIdToTable: map[int64]string{1: "WiredTigerHS", 5: "collection-1", 6: "index-2"},
+	}
+	home := WTHome{DBPath: tst.TempDir(), Toolchain: &Toolchain{Name: "hs", Dir: toolchainDir}}
+	historyFile := filepath.Join(tst.TempDir(), "history_store")
+	if err := WriteHistoryStore(context.Background(), home, catalog, list, historyFile); err != nil {
+		panic(err)
+	}
+
+	versions, more, err := ReadHistoryStore(historyFile, func(version *HSVersion) bool {
+		return version.Namespace == "test.foo"
+	}, 2)
+	if err != nil {
+		panic(err)
+	}
+	assertEquals(tst, true, more)
+	assertEquals(tst, "collection-1", versions[0].Table)
+	assertEquals(tst, "7", versions[0].RecordId)
+	assertEquals(tst, true, strings.Contains(versions[0].Document, `"old"`))
+	assertEquals(tst, "modify", versions[1].UpdateType)
+	assertEquals(tst, "01", versions[1].ValueHex)
+
+	versions, _, err = ReadHistoryStore(historyFile, func(version *HSVersion) bool {
+		return version.Index != ""
+	}, 10)
+	if err != nil {
+		panic(err)
+	}
+	assertEquals(tst, 1, len(versions))
+	assertEquals(tst, "x_1", versions[0].Index)
+	assertEquals(tst, "7", versions[0].RecordId)
+
+	// A failed dump leaves no file behind.
+	os.Remove(dumpFile)
+	if err := WriteHistoryStore(context.Background(), home, catalog, list, historyFile+"2"); err == nil {
+		tst.Fatalf("Expected the dump to fail")
+	}
+	if _, err := os.Stat(historyFile + "2"); !os.IsNotExist(err) {
+		tst.Fatalf("Expected no history store file. Err: %v", err)
+	}
+}
+
+func TestDecodeKeyString(tst *testing.T) {
+	canonical := func(key bson.D, err error) string {
+		if err != nil {
+			panic(err)
+		}
+		ret, err := bson.MarshalExtJSON(key, true, false)
+		if err != nil {
+			panic(err)
+		}
+		return string(ret)
+	}
+	mustHex := func(str string) []byte {
+		ret, err := hex.DecodeString(strings.ReplaceAll(str, " ", ""))
+		if err != nil {
+			panic(err)
+		}
+		return ret
+	}
+
+	// `{a: "x\0y", b: 5}` for `{a: 1, b: -1}`. The descending field's bytes are inverted.
+	keyPattern := bson.D{{Key: "a", Value: int32(1)}, {Key: "b", Value: int32(-1)}}
+	assertEquals(tst, `{"a":"x\u0000y","b":{"$numberInt":"5"}}`,
+		canonical(DecodeKeyString(mustHex("3c 78 00 ff 79 00 d4 f5 04"), nil, keyPattern, KeyStringV1)))
+
+	// NumberLong(-300), 2.5, 0.25 and -0.0. The TypeBits tell the numbers' types apart. MongoDB
+	// appends each number's type high bit first and fills each byte from its lowest bit: 10 (long),
+	// 01 (double), 01 (double), then 11 000 (V1 negative double zero), i.e: 0xe9 0x00.
+	assertEquals(tst, `{"":{"$numberLong":"-300"},"":{"$numberDouble":"2.5"},"":{"$numberDouble":"0.25"},"":{"$numberDouble":"-0.0"}}`,
+		canonical(DecodeKeyString(mustHex("26 fd a7 2b 05 10 00 00 00 00 00 00 2a ff a0 00 00 00 00 00 00 29 04"),
+			mustHex("82 e9 00"), nil, KeyStringV1)))
+	// The first bit is the high bit: 0x01 is 10, a long, not 01, a double.
+	assertEquals(tst, `{"":{"$numberLong":"-300"}}`, canonical(DecodeKeyString(mustHex("26 fd a7 04"), mustHex("01"), nil, KeyStringV1)))
+	// NumberDecimal("0"): 11, then 011 for the top bits of the biased exponent 6176 and its 12 low
+	// bits 100000100000.
+	assertEquals(tst, `{"":{"$numberDecimal":"0"}}`, canonical(DecodeKeyString(mustHex("29 04"), mustHex("83 3b 08 00"), nil, KeyStringV1)))
+	// Without them, every whole number is an int.
+	assertEquals(tst, `{"":{"$numberInt":"-300"}}`, canonical(DecodeKeyString(mustHex("26 fd a7 04"), nil, nil, KeyStringV1)))
+
+	// NumberDecimal("1.50") keeps its trailing zero through the exponent's low bits in the TypeBits.
+	assertEquals(tst, `{"":{"$numberDecimal":"1.50"}}`,
+		canonical(DecodeKeyString(mustHex("2b 03 20 00 00 00 00 00 00 04"), mustHex("7b"), nil, KeyStringV1)))
+
+	// Values beyond the key pattern are unnamed.
+	assertEquals(tst, `{"_id":{"$oid":"6439840a5abe13336b194496"},"":true,"":{"$date":{"$numberLong":"1000"}},"":null,`+
+		`"":[{"$numberInt":"1"},"a"],"":{"b":{"$numberInt":"1"}},"":{"$binary":{"base64":"aGk=","subType":"00"}},"":{"$minKey":1}}`,
+		canonical(DecodeKeyString(mustHex("64 6439840a5abe13336b194496 6f 78 80000000000003e8 14 50 2b02 3c6100 00 46 1e 6200 2b02 00 5a 02 00 6869 0a 04"),
+			nil, bson.D{{Key: "_id", Value: int32(1)}}, KeyStringV1)))
+
+	_, err := DecodeKeyString(mustHex("3c 78"), nil, nil, KeyStringV1)
+	if err == nil {
+		tst.Fatalf("Expected an unterminated string to fail")
+	}
+
+	// Index entries carry a RecordId at the end of the key, at the start of a unique index's
+	// value or, in clustered collections, as the KeyString of the `_id`.
+	collection := &CollectionInfo{Name: "test.c"}
+	indexInfo := &IndexInfo{Name: "a_1", Definition: `{"a":1}`, Version: 2, Owner: collection}
+	indexKey, err := DecodeIndexEntry(indexInfo, mustHex("3c 61 00 04 00 08"), nil)
+	assertEquals(tst, nil, err)
+	assertEquals(tst, `{"a":"a"}`, indexKey.Describe())
+	assertEquals(tst, "1", indexKey.RecordId)
+
+	// RecordId(1000) followed by the TypeBits of a double, 01.
+	indexKey, err = DecodeIndexEntry(indexInfo, mustHex("2b 02 04"), mustHex("1f 40 02"))
+	assertEquals(tst, nil, err)
+	assertEquals(tst, `{"a":1.0}`, indexKey.Describe())
+	assertEquals(tst, "1000", indexKey.RecordId)
+
+	collection.Clustered = true
+	indexKey, err = DecodeIndexEntry(indexInfo, mustHex("3c 61 00 04 64 6439840a5abe13336b194496 0d"), nil)
+	assertEquals(tst, nil, err)
+	assertEquals(tst, `{"a":"a"}`, indexKey.Describe())
+	assertEquals(tst, `{"_id":{"$oid":"6439840a5abe13336b194496"}}`, indexKey.RecordId)
+}
+
+func TestReconstructModify(tst *testing.T) {
+	// Padding past the end and sizes past the end.
+	modified := ApplyModify([]byte("abcdef"), []ModifyEntry{
+		{Data: []byte("XY"), Offset: 1, Size: 3},
+		{Data: []byte("Z"), Offset: 7, Size: 0},
+		{Data: []byte("!"), Offset: 3, Size: 100},
+	})
+	assertEquals(tst, "aXY!", string(modified))
+
+	diff, _ := bson.MarshalExtJSON(DiffDocuments(
+		bson.D{{Key: "_id", Value: 1}, {Key: "a", Value: bson.D{{Key: "b", Value: 1}, {Key: "c", Value: 1}}}, {Key: "d", Value: "x"}},
+		bson.D{{Key: "_id", Value: 1}, {Key: "a", Value: bson.D{{Key: "b", Value: 2}, {Key: "c", Value: 1}}}, {Key: "e", Value: bson.A{1}}},
+	), false, false)
+	assertEquals(tst, `{"$set":{"a.b":2,"e":[1]},"$unset":{"d":true}}`, string(diff))
+
+	// A modify replacing the whole value, in the format of `__wt_modify_pack`.
+	packModify := func(offset, size int, data []byte) string {
+		packed := make([]byte, 32, 32+len(data))
+		binary.LittleEndian.PutUint64(packed, 1)
+		binary.LittleEndian.PutUint64(packed[8:], uint64(len(data)))
+		binary.LittleEndian.PutUint64(packed[16:], uint64(offset))
+		binary.LittleEndian.PutUint64(packed[24:], uint64(size))
+		return hex.EncodeToString(append(packed, data...))
+	}
+	entries, err := ParseModify(make([]byte, 16))
+	assertEquals(tst, 0, len(entries))
+	assertEquals(tst, nil, err)
+	if _, err := ParseModify([]byte("\x02\x00\x00\x00\x00\x00\x00\x00")); err == nil {
+		tst.Fatalf("Expected a modify too short for its entries to fail")
+	}
+
+	before, _ := bson.Marshal(bson.D{{Key: "_id", Value: 1}, {Key: "a", Value: 1}})
+	after, _ := bson.Marshal(bson.D{{Key: "_id", Value: 1}, {Key: "a", Value: 2}})
+	checkpointed, _ := bson.Marshal(bson.D{{Key: "_id", Value: 2}, {Key: "b", Value: "x"}})
+	printlogOp := func(opType, keyHex, valueHex string) string {
+		return fmt.Sprintf(`{"optype":"%s","fileid":5 0x5,"key-hex":"%s","value-hex":"%s"}`, opType, keyHex, valueHex)
+	}
+	printlog := "[" +
+		`{"lsn":[1,128],"type":"commit","txnid":1,"ops":[` + printlogOp("row_put", "81", hex.EncodeToString(before)) + `]},` +
+		`{"lsn":[1,256],"type":"commit","txnid":2,"ops":[` + printlogOp("row_modify", "81", packModify(0, len(before), after)) + `]},` +
+		`{"lsn":[1,384],"type":"commit","txnid":3,"ops":[` + printlogOp("row_modify", "82", packModify(0, 0, nil)) + `]},` +
+		`{"lsn":[1,512],"type":"commit","txnid":4,"ops":[` + printlogOp("row_modify", "83", packModify(0, 0, nil)) + `]}` +
+		"]"
+
+	catalog := &Catalog{FileToCollection: make(map[string]*CollectionInfo), FileToIndex: make(map[string]*IndexInfo)}
+	catalog.FileToCollection["collection-2-123"] = &CollectionInfo{Name: "test.coll", Ident: "collection-2-123"}
+	list := &WTList{
+		FileIdToTable: map[int64]string{5: "collection-2-123"},
+		TableConfig:   map[string]string{"collection-2-123": "checkpoint_lsn=(1,300),id=5"},
+	}
+	loads := 0
+	versions := NewDocumentVersions(list, func(table string, maxBytes int) (map[string][]byte, error) {
+		loads++
+		assertEquals(tst, "collection-2-123", table)
+		return map[string][]byte{"\x82": checkpointed}, nil
+	})
+	annotated := &bytes.Buffer{}
+	if err := AnnotatePrintlog(NewPrintlogReader(strings.NewReader(printlog)), annotated, catalog, list, nil, nil, versions); err != nil {
+		panic(err)
+	}
+	for _, expected := range []string{
+		// Modifying a document put earlier.
+		"        \"value-bson\": {\n          \"_id\": 1,\n          \"a\": 2\n        },\n        \"value-diff\": {\"$set\":{\"a\":2}}\n",
+		// Modifying a document as of the checkpoint, which the modify is not part of.
+		"        \"value-bson\": {\n          \"_id\": 2,\n          \"b\": \"x\"\n        },\n        \"value-diff\": {}\n",
+		// Neither.
+		"\"value-hex\": \"" + packModify(0, 0, nil) + "\" The earlier version is unknown\n      }\n    ]\n  }\n]",
+	} {
+		if !strings.Contains(annotated.String(), expected) {
+			tst.Fatalf("Expected annotated output to contain:\n%s\nOutput:\n%s", expected, annotated.String())
+		}
+	}
+	assertEquals(tst, 1, loads)
+
+	// Following the journal again forgets its writes and truncates, but not the checkpoint.
+	versions.Truncate(5)
+	versions.Rewind()
+	rewound := &bytes.Buffer{}
+	if err := AnnotatePrintlog(NewPrintlogReader(strings.NewReader(printlog)), rewound, catalog, list, nil, nil, versions); err != nil {
+		panic(err)
+	}
+	assertEquals(tst, annotated.String(), rewound.String())
+	assertEquals(tst, 1, loads)
+
+	// The dbpath itself was recovered, its checkpoints include the journal.
+	assertEquals(tst, true, LoadUnrecoveredCheckpoints(WTHome{DBPath: tst.TempDir()}, "list") == nil)
+}
+
+func TestCatalogTimeline(tst *testing.T) {
+	printlogOp := func(opType string, fileId int, key, value []byte) string {
+		ret := fmt.Sprintf(`{"optype":"%s","fileid":%d 0x%x,"key-hex":"%s"`, opType, fileId, fileId, hex.EncodeToString(key))
+		if value != nil {
+			ret += fmt.Sprintf(`,"value-hex":"%s"`, hex.EncodeToString(value))
+		}
+		return ret + "}"
+	}
+	printlogRecord := func(offset int, ops ...string) string {
+		return fmt.Sprintf(`{"lsn":[1,%d],"type":"commit","txnid":%d,"ops":[%s]}`, offset, offset, strings.Join(ops, ","))
+	}
+
+	created, _ := bson.Marshal(bson.M{
+		"ns":       "test.created",
+		"ident":    "collection-9-123",
+		"idxIdent": bson.M{"_id_": "index-10-123"},
+		"md":       bson.M{"indexes": bson.A{bson.M{"spec": bson.M{"key": bson.M{"_id": 1}, "name": "_id_", "v": 2}}}},
+	})
+	checkpointed, _ := bson.Marshal(bson.M{"ns": "test.old", "ident": "collection-11-123", "idxIdent": bson.M{}})
+	doc, _ := bson.Marshal(bson.M{"_id": 1})
+	printlog := "[" + strings.Join([]string{
+		printlogRecord(128,
+			printlogOp("row_put", 0, []byte("file:collection-9-123.wt\x00"), []byte("allocation_size=4KB,app_metadata=,id=9,key_format=q\x00")),
+			printlogOp("row_put", 0, []byte("file:index-10-123.wt\x00"), []byte("allocation_size=4KB,app_metadata=,id=10,key_format=u\x00")),
+			printlogOp("row_put", 1, []byte("\x83"), created)),
+		printlogRecord(256,
+			printlogOp("row_put", 9, []byte("\x81"), doc),
+			printlogOp("row_put", 10, []byte("\x2b\x02\x04"), []byte{}),
+			printlogOp("row_put", 11, []byte("\x81"), doc)),
+		printlogRecord(384, printlogOp("row_remove", 1, []byte("\x83"), nil)),
+		printlogRecord(512, printlogOp("row_remove", 1, []byte("\x82"), nil)),
+	}, ",") + "]"
+
+	list := &WTList{
+		TableToFileId: map[string]int64{"_mdb_catalog": 1, "collection-11-123": 11},
+		FileIdToTable: map[int64]string{1: "_mdb_catalog", 11: "collection-11-123"},
+		TableConfig:   map[string]string{"_mdb_catalog": "checkpoint_lsn=(1,0),id=1"},
+	}
+	versions := NewDocumentVersions(list, func(table string, maxBytes int) (map[string][]byte, error) {
+		return map[string][]byte{"\x82": checkpointed}, nil
+	})
+	timeline, err := ReadCatalogTimeline(NewPrintlogReader(strings.NewReader(printlog)), list, versions)
+	if err != nil {
+		panic(err)
+	}
+	assertEquals(tst, "index-10-123", timeline.FileIdToTable[10])
+	naming, droppedAt, found := timeline.Naming("collection-9-123", LSN{1, 1024})
+	assertEquals(tst, true, found)
+	assertEquals(tst, "test.created", naming.Describe())
+	assertEquals(tst, LSN{1, 384}, *droppedAt)
+
+	catalog := &Catalog{FileToCollection: make(map[string]*CollectionInfo), FileToIndex: make(map[string]*IndexInfo)}
+	annotated := &bytes.Buffer{}
+	if err := AnnotatePrintlog(NewPrintlogReader(strings.NewReader(printlog)), annotated, catalog, list, timeline, nil, nil); err != nil {
+		panic(err)
+	}
+	for _, expected := range []string{
+		// Created and dropped within the journal.
+		"\"fileid\": 9 0x9, collection-9-123.wt test.created (dropped at [1,384])\n",
+		"\"fileid\": 10 0xa, index-10-123.wt NS: test.created IndexName: _id_ Spec: {\"_id\":1} (dropped at [1,384])\n",
+		// Dropped within the journal, but created before it.
+		"\"fileid\": 11 0xb, collection-11-123.wt test.old (dropped at [1,512])\n",
+	} {
+		if !strings.Contains(annotated.String(), expected) {
+			tst.Fatalf("Expected annotated output to contain:\n%s\nOutput:\n%s", expected, annotated.String())
+		}
+	}
+}
+
+func TestTransactions(tst *testing.T) {
+	before, _ := bson.Marshal(bson.D{{Key: "_id", Value: 1}, {Key: "a", Value: 1}})
+	after, _ := bson.Marshal(bson.D{{Key: "_id", Value: 1}, {Key: "a", Value: 2}})
+	modify := make([]byte, 32, 32+len(after))
+	binary.LittleEndian.PutUint64(modify, 1)
+	binary.LittleEndian.PutUint64(modify[8:], uint64(len(after)))
+	binary.LittleEndian.PutUint64(modify[24:], uint64(len(before)))
+	modify = append(modify, after...)
+
+	timestamps := func(commit, prepare uint64) string {
+		return fmt.Sprintf(`{"optype":"txn_timestamp","time_sec":0,"time_nsec":0,"commit_ts":%d,"durable_ts":%d,"first_commit_ts":%d,"prepare_ts":%d,"read_ts":0}`,
+			commit, commit, commit, prepare)
+	}
+	printlog := "[" + strings.Join([]string{
+		`{"lsn":[1,128],"type":"commit","txnid":7,"ops":[` + timestamps(5<<32|1, 0) +
+			`,{"optype":"row_put","fileid":5 0x5,"key-hex":"81","value-hex":"` + hex.EncodeToString(before) + `"}` +
+			`,{"optype":"row_put","fileid":6 0x6,"key-hex":"2b0204","value-hex":""}]}`,
+		`{"lsn":[1,256],"type":"checkpoint","ckpt_lsn":[1,128]}`,
+		`{"lsn":[1,384],"type":"commit","txnid":8,"ops":[` + timestamps(5<<32|2, 5<<32|1) +
+			`,{"optype":"row_modify","fileid":5 0x5,"key-hex":"81","value-hex":"` + hex.EncodeToString(modify) + `"}` +
+			`,{"optype":"row_remove","fileid":9 0x9,"key-hex":"81"}]}`,
+	}, ",") + "]"
+
+	catalog := &Catalog{FileToCollection: make(map[string]*CollectionInfo), FileToIndex: make(map[string]*IndexInfo)}
+	catalog.AddRow(&MdbCatalogFormat{Ns: "test.coll", Ident: "collection-2-123", IdxIdent: map[string]string{"_id_": "index-3-123"}})
+	list := &WTList{
+		TableToFileId: map[string]int64{"collection-2-123": 5, "index-3-123": 6},
+		FileIdToTable: map[int64]string{5: "collection-2-123", 6: "index-3-123"},
+		TableConfig:   map[string]string{},
+	}
+
+	txns, err := ReadTransactions(context.Background(), strings.NewReader(printlog), catalog, list, nil)
+	if err != nil {
+		panic(err)
+	}
+	assertEquals(tst, 2, len(txns))
+	assertEquals(tst, uint64(7), txns[0].TxnID)
+	assertEquals(tst, LSN{1, 128}, txns[0].FirstLSN)
+	assertEquals(tst, 2, txns[0].Ops)
+	assertEquals(tst, "Timestamp(5, 1)", txns[0].CommitTs.String())
+	assertEquals(tst, false, txns[0].Prepared())
+	assertEquals(tst, fmt.Sprintf("%+v", []TransactionTable{
+		{Table: "collection-2-123", Name: "test.coll", Ops: 1},
+		{Table: "index-3-123", Name: "NS: test.coll IndexName: _id_ Spec: ", Ops: 1},
+	}), fmt.Sprintf("%+v", txns[0].Tables))
+	assertEquals(tst, true, txns[1].Prepared())
+	assertEquals(tst, fmt.Sprintf("%+v", []TransactionTable{
+		{Table: "collection-2-123", Name: "test.coll", Ops: 1},
+		{Table: "fileid 9", Name: "Unknown (dropped?) table", Ops: 1},
+	}), fmt.Sprintf("%+v", txns[1].Tables))
+
+	// The modify of the second transaction is rebuilt from the first one.
+	written := &bytes.Buffer{}
+	if err := WriteTransaction(context.Background(), strings.NewReader(printlog), written, 8, catalog, list, nil); err != nil {
+		panic(err)
+	}
+	for _, expected := range []string{
+		"\"txnid\" : 8,",
+		"        \"value-diff\": {\"$set\":{\"a\":2}}\n",
+	} {
+		if !strings.Contains(written.String(), expected) {
+			tst.Fatalf("Expected the transaction to contain:\n%s\nOutput:\n%s", expected, written.String())
+		}
+	}
+	if strings.Contains(written.String(), "\"txnid\" : 7,") {
+		tst.Fatalf("Expected only the second transaction. Output:\n%s", written.String())
+	}
+
+	// Annotating the journal gathers the same transactions, which the diagnostics save.
+	dir := tst.TempDir()
+	if err := os.WriteFile(dir+"/printlog", []byte(printlog), 0644); err != nil {
+		panic(err)
+	}
+	printlogFile, err := os.Open(dir + "/printlog")
+	if err != nil {
+		panic(err)
+	}
+	annotatedFile, err := os.Create(dir + "/annotated_printlog")
+	if err != nil {
+		panic(err)
+	}
+	annotatedTxns, err := RewritePrintlog(context.Background(), printlogFile, annotatedFile, catalog, list, nil)
+	if err != nil {
+		panic(err)
+	}
+	if err := SaveTransactions(annotatedTxns, dir+"/transactions"); err != nil {
+		panic(err)
+	}
+	savedTxns, err := LoadTransactions(dir + "/transactions")
+	if err != nil {
+		panic(err)
+	}
+	assertEquals(tst, len(txns), len(savedTxns))
+	for idx := range txns {
+		assertEquals(tst, fmt.Sprintf("%+v", *txns[idx]), fmt.Sprintf("%+v", *savedTxns[idx]))
+	}
 }
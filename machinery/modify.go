@@ -0,0 +1,334 @@
+package machinery
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ModifyEntry replaces `Size` bytes of a value at `Offset` with `Data`, which may be longer or
+// shorter.
+type ModifyEntry struct {
+	Data   []byte
+	Offset uint64
+	Size   uint64
+}
+
+// ParseModify unpacks a row_modify value. WiredTiger writes the number of entries, then each
+// entry's data size, offset and size, then the data of every entry. Each number is a little endian
+// 64 bit `size_t`.
+func ParseModify(value []byte) ([]ModifyEntry, error) {
+	if len(value) < 8 {
+		return nil, fmt.Errorf("Modify is too short. Length: %v", len(value))
+	}
+	count := binary.LittleEndian.Uint64(value)
+	if count > uint64(len(value)-8)/24 {
+		return nil, fmt.Errorf("Modify is too short for its entries. Entries: %v Length: %v", count, len(value))
+	}
+
+	ret := make([]ModifyEntry, count)
+	dataPos := 8 + 24*count
+	for idx := range ret {
+		header := value[8+24*idx:]
+		dataSize := binary.LittleEndian.Uint64(header)
+		if dataSize > uint64(len(value))-dataPos {
+			return nil, fmt.Errorf("Modify is too short for its data. Entry: %v Length: %v", idx, len(value))
+		}
+		ret[idx] = ModifyEntry{
+			Data:   value[dataPos : dataPos+dataSize],
+			Offset: binary.LittleEndian.Uint64(header[8:]),
+			Size:   binary.LittleEndian.Uint64(header[16:]),
+		}
+		dataPos += dataSize
+	}
+
+	return ret, nil
+}
+
+// ApplyModify returns the value after applying the entries in order. An offset past the end of
+// the value pads it with zeros first, as WiredTiger does for raw values.
+func ApplyModify(value []byte, entries []ModifyEntry) []byte {
+	ret := append([]byte{}, value...)
+	for _, entry := range entries {
+		if entry.Offset > uint64(len(ret)) {
+			ret = append(ret, make([]byte, entry.Offset-uint64(len(ret)))...)
+		}
+		end := entry.Offset + entry.Size
+		if end > uint64(len(ret)) {
+			end = uint64(len(ret))
+		}
+		ret = append(ret[:entry.Offset:entry.Offset], append(append([]byte{}, entry.Data...), ret[end:]...)...)
+	}
+	return ret
+}
+
+// DiffDocuments describes the changes from one version of a document to the next like an update,
+// e.g: `{"$set": {"a.b": 2}, "$unset": {"c": true}}`. Embedded documents are compared field by
+// field, arrays as a whole. No changes is an empty document.
+func DiffDocuments(before, after bson.D) bson.D {
+	set, unset := bson.D{}, bson.D{}
+	diffDocuments("", before, after, &set, &unset)
+
+	ret := bson.D{}
+	if len(set) > 0 {
+		ret = append(ret, bson.E{Key: "$set", Value: set})
+	}
+	if len(unset) > 0 {
+		ret = append(ret, bson.E{Key: "$unset", Value: unset})
+	}
+	return ret
+}
+
+func diffDocuments(prefix string, before, after bson.D, set, unset *bson.D) {
+	beforeValues := make(map[string]interface{}, len(before))
+	for _, elem := range before {
+		beforeValues[elem.Key] = elem.Value
+	}
+
+	afterKeys := make(map[string]bool, len(after))
+	for _, elem := range after {
+		afterKeys[elem.Key] = true
+		beforeValue, existed := beforeValues[elem.Key]
+		beforeDoc, beforeIsDoc := beforeValue.(bson.D)
+		afterDoc, afterIsDoc := elem.Value.(bson.D)
+		switch {
+		case existed && beforeIsDoc && afterIsDoc:
+			diffDocuments(prefix+elem.Key+".", beforeDoc, afterDoc, set, unset)
+		case !existed || !reflect.DeepEqual(beforeValue, elem.Value):
+			*set = append(*set, bson.E{Key: prefix + elem.Key, Value: elem.Value})
+		}
+	}
+	for _, elem := range before {
+		if !afterKeys[elem.Key] {
+			*unset = append(*unset, bson.E{Key: prefix + elem.Key, Value: true})
+		}
+	}
+}
+
+// The most bytes of values DocumentVersions keeps. Records written beyond that are forgotten.
+const maxDocumentVersionBytes = 256 << 20
+
+// errVersionUnknown is returned for modifies of records whose earlier value is not known.
+var errVersionUnknown = errors.New("The earlier version is unknown")
+
+type documentVersion struct {
+	// Nil for a removed record.
+	value []byte
+	// False when the value was not kept.
+	known bool
+}
+
+// DocumentVersions keeps the latest known value of each record written in the journal, such that
+// the values row_modify ops produce can be rebuilt. Values come from earlier row_puts, otherwise
+// from the table as of its last checkpoint for ops from the table's `checkpoint_lsn` on, which
+// the checkpoint does not include. Everything kept, checkpoints included, is bounded by
+// `maxDocumentVersionBytes`.
+type DocumentVersions struct {
+	// The `wt list -v` the checkpoints are read as of, for each table's `checkpoint_lsn`.
+	list *WTList
+	// `checkpointValues`, when not nil, returns the records of a table as of its last checkpoint.
+	// It fails when they are more than `maxBytes`.
+	checkpointValues func(table string, maxBytes int) (map[string][]byte, error)
+	// By file id, then by key.
+	values map[uint32]map[string]documentVersion
+	// By file id. Nil when the checkpoint could not be read.
+	checkpoints map[uint32]map[string][]byte
+	// By file id. Tables truncated in the journal are no longer as of their checkpoint.
+	truncated map[uint32]bool
+	bytes     int
+}
+
+func NewDocumentVersions(list *WTList, checkpointValues func(table string, maxBytes int) (map[string][]byte, error)) *DocumentVersions {
+	return &DocumentVersions{
+		list:             list,
+		checkpointValues: checkpointValues,
+		values:           make(map[uint32]map[string]documentVersion),
+		checkpoints:      make(map[uint32]map[string][]byte),
+		truncated:        make(map[uint32]bool),
+	}
+}
+
+// Rewind forgets the writes of the journal, such that it can be followed again from the start. The
+// tables read as of their checkpoint are kept.
+func (versions *DocumentVersions) Rewind() {
+	for _, table := range versions.values {
+		for _, version := range table {
+			versions.bytes -= len(version.value)
+		}
+	}
+	versions.values = make(map[uint32]map[string]documentVersion)
+	versions.truncated = make(map[uint32]bool)
+}
+
+func (versions *DocumentVersions) set(fileId uint32, key []byte, version documentVersion) {
+	table, exists := versions.values[fileId]
+	if !exists {
+		table = make(map[string]documentVersion)
+		versions.values[fileId] = table
+	}
+	versions.bytes -= len(table[string(key)].value)
+	if version.value != nil && versions.bytes+len(version.value) > maxDocumentVersionBytes {
+		version = documentVersion{}
+	}
+	versions.bytes += len(version.value)
+	table[string(key)] = version
+}
+
+// Put records a row_put.
+func (versions *DocumentVersions) Put(fileId uint32, key, value []byte) {
+	versions.set(fileId, key, documentVersion{value: append([]byte{}, value...), known: true})
+}
+
+// Remove records a row_remove.
+func (versions *DocumentVersions) Remove(fileId uint32, key []byte) {
+	versions.set(fileId, key, documentVersion{known: true})
+}
+
+// Truncate records a row_truncate. The records of the table are no longer known, not even from its
+// checkpoint.
+func (versions *DocumentVersions) Truncate(fileId uint32) {
+	for _, version := range versions.values[fileId] {
+		versions.bytes -= len(version.value)
+	}
+	delete(versions.values, fileId)
+	versions.truncated[fileId] = true
+}
+
+// tableCheckpointLSN reads the `checkpoint_lsn=(1,12345)` of a table's config.
+func tableCheckpointLSN(list *WTList, table string) (LSN, bool) {
+	setting, exists := parseWTConfigString(list.TableConfig[table])["checkpoint_lsn"]
+	file, offset, found := strings.Cut(strings.Trim(setting, "()"), ",")
+	if !exists || !found {
+		return LSN{}, false
+	}
+	fileNum, fileErr := strconv.ParseUint(file, 10, 32)
+	offsetNum, offsetErr := strconv.ParseUint(offset, 10, 32)
+	if fileErr != nil || offsetErr != nil {
+		return LSN{}, false
+	}
+	return LSN{uint32(fileNum), uint32(offsetNum)}, true
+}
+
+// checkpointValue returns the value of a record as of the table's checkpoint, for ops at `lsn`.
+func (versions *DocumentVersions) checkpointValue(fileId uint32, lsn LSN, key []byte) ([]byte, bool) {
+	if versions.checkpointValues == nil || versions.truncated[fileId] {
+		return nil, false
+	}
+	table, exists := versions.list.FileIdToTable[int64(fileId)]
+	if !exists {
+		return nil, false
+	}
+	if checkpointLSN, found := tableCheckpointLSN(versions.list, table); !found || lsn.Less(checkpointLSN) {
+		return nil, false
+	}
+
+	values, loaded := versions.checkpoints[fileId]
+	if !loaded {
+		var err error
+		if values, err = versions.checkpointValues(table, maxDocumentVersionBytes-versions.bytes); err != nil {
+			fmt.Printf("Failed to read the checkpoint of a modified table. Table: %v Err: %v\n", table, err)
+			values = nil
+		}
+		versions.checkpoints[fileId] = values
+		for _, value := range values {
+			versions.bytes += len(value)
+		}
+	}
+
+	value, exists := values[string(key)]
+	return value, exists
+}
+
+// Modify records a row_modify at `lsn` and returns the value before and after it.
+func (versions *DocumentVersions) Modify(fileId uint32, lsn LSN, key, modify []byte) (before []byte, after []byte, err error) {
+	entries, err := ParseModify(modify)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	version, exists := versions.values[fileId][string(key)]
+	switch {
+	case !exists:
+		if before, exists = versions.checkpointValue(fileId, lsn, key); !exists {
+			versions.set(fileId, key, documentVersion{})
+			return nil, nil, errVersionUnknown
+		}
+	case !version.known:
+		return nil, nil, errVersionUnknown
+	case version.value == nil:
+		return nil, nil, errors.New("The record was removed")
+	default:
+		before = version.value
+	}
+
+	after = ApplyModify(before, entries)
+	versions.set(fileId, key, documentVersion{value: after, known: true})
+	return before, after, nil
+}
+
+// UnrecoveredCheckpoints reads tables as of their last checkpoint from a copy of the dbpath taken
+// before anything ran recovery. The dbpath itself cannot be used, recovery replaces each table's
+// checkpoint with one that includes the journal. See `CopyUnrecovered`.
+type UnrecoveredCheckpoints struct {
+	// See `WTHome.Unrecovered`.
+	Home WTHome
+	// `wt list -v` of `Home`, for the `checkpoint_lsn` of each table.
+	List *WTList
+}
+
+// LoadUnrecoveredCheckpoints reads the `wt list -v` output of the unrecovered copy, see
+// `WTDiagnosticsResults.CheckpointListFile`. It returns nil when there is no copy.
+func LoadUnrecoveredCheckpoints(home WTHome, listFile string) *UnrecoveredCheckpoints {
+	if !home.NoRecovery || home.DBPath == "" {
+		return nil
+	}
+	file, err := os.Open(listFile)
+	if err != nil {
+		return nil
+	}
+	return &UnrecoveredCheckpoints{Home: home, List: LoadWTList(file)}
+}
+
+// newDocumentVersions keeps the versions of the documents of a journal. Without `checkpoints`
+// only documents written in the journal are known.
+func newDocumentVersions(ctx context.Context, list *WTList, checkpoints *UnrecoveredCheckpoints) *DocumentVersions {
+	if checkpoints == nil {
+		return NewDocumentVersions(list, nil)
+	}
+	return NewDocumentVersions(checkpoints.List, func(table string, maxBytes int) (map[string][]byte, error) {
+		return dumpCheckpointValues(ctx, checkpoints.Home, table, maxBytes)
+	})
+}
+
+// dumpCheckpointValues reads a table of the unrecovered copy as of its last checkpoint, up to
+// `maxBytes` of values.
+func dumpCheckpointValues(ctx context.Context, home WTHome, table string, maxBytes int) (map[string][]byte, error) {
+	reader, err := home.AtCheckpoint("WiredTigerCheckpoint").OpenDump(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	ret := make(map[string][]byte)
+	for bytes := 0; ; {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			return ret, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if bytes += len(entry.Value); bytes > maxBytes {
+			return nil, fmt.Errorf("The table is too large to keep. Table: %v", table)
+		}
+		ret[string(entry.Key)] = entry.Value
+	}
+}
@@ -15,18 +15,21 @@ type Server struct {
 	Port    int
 	DBPath  string
 	LogPath string
+	// The `mongod` and `mongo` binaries to use. Nil uses $PATH.
+	Toolchain *Toolchain
 	*exec.Cmd
 
 	Stdout *bytes.Buffer
 	Stderr *bytes.Buffer
 }
 
-func NewServer(port int, dbpath string, logpath string) *Server {
+func NewServer(toolchain *Toolchain, port int, dbpath string, logpath string) *Server {
 	return &Server{
 		port,
 		dbpath,
 		logpath,
-		exec.Command("mongod", "--dbpath", dbpath, "--port", fmt.Sprintf("%d", port), "--logpath", logpath),
+		toolchain,
+		toolchain.Command("mongod", "--dbpath", dbpath, "--port", fmt.Sprintf("%d", port), "--logpath", logpath),
 		&bytes.Buffer{},
 		&bytes.Buffer{},
 	}
@@ -50,7 +53,7 @@ func (server *Server) StartAndWaitForListening(timeout time.Duration) error {
 func (server *Server) WaitForListening(timeout time.Duration) error {
 	startTime := time.Now()
 	for time.Since(startTime) < timeout {
-		shell := exec.Command("mongo", "--port", fmt.Sprintf("%d", server.Port), "--quiet")
+		shell := server.Toolchain.Command("mongo", "--port", fmt.Sprintf("%d", server.Port), "--quiet")
 		stdin, err := shell.StdinPipe()
 		if err != nil {
 			panic(err)
@@ -94,7 +97,7 @@ func (server *Server) WaitAndPrint() {
 }
 
 func (server *Server) Execute(db string, cmd string) string {
-	shell := exec.Command("mongo", "--port", fmt.Sprintf("%d", server.Port), "--quiet", db)
+	shell := server.Toolchain.Command("mongo", "--port", fmt.Sprintf("%d", server.Port), "--quiet", db)
 	stdin, err := shell.StdinPipe()
 	if err != nil {
 		panic(err)
@@ -0,0 +1,542 @@
+package machinery
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// LogRecordIterator streams journal records in LSN order. `Next` returns io.EOF after the last
+// record. Both the JournalReader and the PrintlogReader are iterators.
+type LogRecordIterator interface {
+	Next() (*LogRecord, error)
+}
+
+// contextRecords stops iterating with the context's error once it is done.
+type contextRecords struct {
+	ctx     context.Context
+	records LogRecordIterator
+}
+
+func (iterator contextRecords) Next() (*LogRecord, error) {
+	if err := iterator.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return iterator.records.Next()
+}
+
+// printlogString escapes bytes the way `wt printlog` does: printable ASCII as is and everything
+// else as `\u00XX`.
+func printlogString(value []byte) string {
+	var ret strings.Builder
+	for _, byt := range value {
+		switch {
+		case byt == '\\' || byt == '"':
+			ret.WriteByte('\\')
+			ret.WriteByte(byt)
+		case byt == '\f':
+			ret.WriteString("\\f")
+		case byt == '\n':
+			ret.WriteString("\\n")
+		case byt == '\r':
+			ret.WriteString("\\r")
+		case byt == '\t':
+			ret.WriteString("\\t")
+		case byt >= 0x20 && byt < 0x7f:
+			ret.WriteByte(byt)
+		default:
+			ret.WriteString(fmt.Sprintf("\\u00%02x", byt))
+		}
+	}
+	return ret.String()
+}
+
+// printlogField is one `"name": value` line of an operation. The value is written as is. A
+// comment is written at the end of the line, after the separating comma.
+type printlogField struct {
+	Name    string
+	Value   string
+	Comment string
+}
+
+// printlogOpFields returns the fields `wt printlog -u -x` writes for an operation, in order.
+func printlogOpFields(op *Op) []printlogField {
+	ret := make([]printlogField, 0)
+	addField := func(name, format string, args ...interface{}) {
+		ret = append(ret, printlogField{Name: name, Value: fmt.Sprintf(format, args...)})
+	}
+	addItem := func(name string, value []byte) {
+		addField(name, "\"%s\"", printlogString(value))
+		addField(name+"-hex", "\"%s\"", hex.EncodeToString(value))
+	}
+
+	switch op.Type {
+	case OpColPut, OpColModify, OpColRemove, OpColTruncate, OpRowPut, OpRowModify, OpRowRemove, OpRowTruncate:
+		addField("fileid", "%d 0x%x", op.FileID, op.FileID)
+	}
+	switch op.Type {
+	case OpColPut, OpColModify:
+		addField("recno", "%d", op.Recno)
+		addItem("value", op.Value)
+	case OpColRemove:
+		addField("recno", "%d", op.Recno)
+	case OpColTruncate:
+		addField("start", "%d", op.StartRecno)
+		addField("stop", "%d", op.StopRecno)
+	case OpRowPut, OpRowModify:
+		addItem("key", op.Key)
+		addItem("value", op.Value)
+	case OpRowRemove:
+		addItem("key", op.Key)
+	case OpRowTruncate:
+		addItem("start", op.Start)
+		addItem("stop", op.Stop)
+		addField("mode", "%d", op.Mode)
+	case OpPrevLSN:
+		addField("prev_lsn", "[%d, %d]", op.PrevLSN.File, op.PrevLSN.Offset)
+	case OpTxnTimestamp:
+		addField("time_sec", "%d", op.TimeSec)
+		addField("time_nsec", "%d", op.TimeNsec)
+		addField("commit_ts", "%d", op.CommitTS)
+		addField("durable_ts", "%d", op.DurableTS)
+		addField("first_commit_ts", "%d", op.FirstCommitTS)
+		addField("prepare_ts", "%d", op.PrepareTS)
+		addField("read_ts", "%d", op.ReadTS)
+	case OpBackupID:
+		addField("index", "%d", op.Index)
+		addField("granularity", "%d", op.Granularity)
+		addField("id", "\"%s\"", printlogString([]byte(op.ID)))
+	}
+
+	return ret
+}
+
+// printlogRecord writes a record the way `wt printlog -u -x` does. `rewriteOp`, when not nil,
+// may change the fields written for each operation.
+func printlogRecord(output io.Writer, record *LogRecord, rewriteOp func(*Op, []printlogField) []printlogField) {
+	hdrFlags := ""
+	if record.Compressed {
+		hdrFlags = "compressed"
+	}
+	fmt.Fprintf(output, "  { \"lsn\" : [%d,%d],\n", record.LSN.File, record.LSN.Offset)
+	fmt.Fprintf(output, "    \"hdr_flags\" : \"%s\",\n", hdrFlags)
+	fmt.Fprintf(output, "    \"rec_len\" : %d,\n", record.RecLen)
+	fmt.Fprintf(output, "    \"mem_len\" : %d,\n", record.MemLen)
+	fmt.Fprintf(output, "    \"type\" : \"%s\",\n", record.Type)
+
+	switch record.Type {
+	case LogRecordCheckpoint:
+		fmt.Fprintf(output, "    \"ckpt_lsn\" : [%d,%d]\n", record.CheckpointLSN.File, record.CheckpointLSN.Offset)
+	case LogRecordFileSync:
+		fmt.Fprintf(output, "    \"fileid\" : %d,\n", record.FileID)
+		fmt.Fprintf(output, "    \"start\" : %d\n", record.Start)
+	case LogRecordMessage:
+		fmt.Fprintf(output, "    \"message\" : \"%s\"\n", printlogString([]byte(record.Message)))
+	case LogRecordCommit, LogRecordSystem:
+		if record.Type == LogRecordCommit {
+			fmt.Fprintf(output, "    \"txnid\" : %d,\n", record.TxnID)
+		}
+		fmt.Fprintf(output, "    \"ops\": [\n")
+		for idx := range record.Ops {
+			if idx > 0 {
+				fmt.Fprintf(output, ",\n")
+			}
+			op := &record.Ops[idx]
+			fields := printlogOpFields(op)
+			if rewriteOp != nil {
+				fields = rewriteOp(op, fields)
+			}
+
+			fmt.Fprintf(output, "      { \"optype\": \"%s\"", op.Type)
+			comment := ""
+			for _, field := range fields {
+				fmt.Fprintf(output, ",%s\n        \"%s\": %s", comment, field.Name, field.Value)
+				comment = ""
+				if field.Comment != "" {
+					comment = " " + field.Comment
+				}
+			}
+			fmt.Fprintf(output, "%s\n      }", comment)
+		}
+		fmt.Fprintf(output, "\n    ]\n")
+	}
+	fmt.Fprintf(output, "  }")
+}
+
+func writePrintlog(records LogRecordIterator, output io.Writer, rewriteOp func(*Op, []printlogField) []printlogField) error {
+	writer := bufio.NewWriter(output)
+	writer.WriteString("[\n")
+
+	var err error
+	for idx := 0; ; idx++ {
+		var record *LogRecord
+		if record, err = records.Next(); err != nil {
+			break
+		}
+		if idx > 0 {
+			writer.WriteString(",\n")
+		}
+		printlogRecord(writer, record, rewriteOp)
+	}
+	writer.WriteString("\n]\n")
+
+	if flushErr := writer.Flush(); flushErr != nil {
+		return flushErr
+	}
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// WritePrintlog writes records in the format of `wt printlog -u -x`. When the records cannot be
+// read to the end, the records read so far are written as a complete document and the error is
+// returned.
+func WritePrintlog(records LogRecordIterator, output io.Writer) error {
+	return writePrintlog(records, output, nil)
+}
+
+// WriteJournalPrintlog reads the journal of `home` and writes it to `outputFile` in the format of
+// `wt printlog -u -x`. It stops early when `ctx` is done.
+func WriteJournalPrintlog(ctx context.Context, home WTHome, outputFile string) error {
+	reader, err := OpenJournal(home.JournalDir())
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	if home.Config != nil {
+		reader.Compressor = home.Config.LogCompressor
+	}
+
+	output, err := os.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+
+	if err := WritePrintlog(contextRecords{ctx, reader}, output); err != nil {
+		return err
+	}
+	if reader.TornTail != nil {
+		fmt.Printf("The journal ends with a partial record. DBPath: %v Err: %v\n", home.DBPath, reader.TornTail)
+	}
+
+	return output.Close()
+}
+
+// PrintlogReader parses `wt printlog` output, with or without `-x`, back into records. Only the
+// JSON structure is relied on, not its whitespace or field order.
+type PrintlogReader struct {
+	input   *bufio.Reader
+	started bool
+	done    bool
+	// The number of records returned, for error messages.
+	count int
+}
+
+func NewPrintlogReader(input io.Reader) *PrintlogReader {
+	return &PrintlogReader{input: bufio.NewReader(input)}
+}
+
+// `wt printlog` writes file ids as `"fileid": 5 0x5`, which is not JSON.
+var printlogFileIDRe *regexp.Regexp = regexp.MustCompile("(\"fileid\"\\s*:\\s*\\d+)\\s+0x[0-9a-fA-F]+")
+
+type printlogJSONOp struct {
+	OpType   string          `json:"optype"`
+	FileID   uint32          `json:"fileid"`
+	Key      *string         `json:"key"`
+	KeyHex   *string         `json:"key-hex"`
+	Value    *string         `json:"value"`
+	ValueHex *string         `json:"value-hex"`
+	Recno    uint64          `json:"recno"`
+	Start    json.RawMessage `json:"start"`
+	StartHex *string         `json:"start-hex"`
+	Stop     json.RawMessage `json:"stop"`
+	StopHex  *string         `json:"stop-hex"`
+	Mode     uint32          `json:"mode"`
+	PrevLSN  []uint32        `json:"prev_lsn"`
+
+	TimeSec       uint64 `json:"time_sec"`
+	TimeNsec      uint64 `json:"time_nsec"`
+	CommitTS      uint64 `json:"commit_ts"`
+	DurableTS     uint64 `json:"durable_ts"`
+	FirstCommitTS uint64 `json:"first_commit_ts"`
+	PrepareTS     uint64 `json:"prepare_ts"`
+	ReadTS        uint64 `json:"read_ts"`
+
+	Index       uint32 `json:"index"`
+	Granularity uint64 `json:"granularity"`
+	ID          string `json:"id"`
+}
+
+type printlogJSONRecord struct {
+	LSN      []uint32         `json:"lsn"`
+	HdrFlags string           `json:"hdr_flags"`
+	RecLen   uint32           `json:"rec_len"`
+	MemLen   uint32           `json:"mem_len"`
+	Type     string           `json:"type"`
+	TxnID    uint64           `json:"txnid"`
+	Ops      []printlogJSONOp `json:"ops"`
+	CkptLSN  []uint32         `json:"ckpt_lsn"`
+	FileID   uint32           `json:"fileid"`
+	Start    int64            `json:"start"`
+	Message  string           `json:"message"`
+}
+
+// Next returns the next record, or io.EOF after the last one.
+func (reader *PrintlogReader) Next() (*LogRecord, error) {
+	if reader.done {
+		return nil, io.EOF
+	}
+
+	if !reader.started {
+		if _, err := reader.input.ReadBytes('['); err != nil {
+			reader.done = true
+			if err == io.EOF {
+				return nil, fmt.Errorf("Not printlog output, no `[` found.")
+			}
+			return nil, err
+		}
+		reader.started = true
+	}
+
+	object, err := reader.nextObject()
+	if err != nil {
+		reader.done = true
+		return nil, err
+	}
+	object = printlogFileIDRe.ReplaceAll(object, []byte("$1"))
+
+	var parsed printlogJSONRecord
+	if err := json.Unmarshal(object, &parsed); err != nil {
+		reader.done = true
+		return nil, errors.Wrap(err, fmt.Sprintf("Failed to parse printlog record. Record: %v", reader.count))
+	}
+	record, err := parsed.toLogRecord()
+	if err != nil {
+		reader.done = true
+		return nil, errors.Wrap(err, fmt.Sprintf("Failed to parse printlog record. Record: %v", reader.count))
+	}
+
+	reader.count++
+	return record, nil
+}
+
+// nextObject returns the bytes of the next top level `{...}` object. The closing `]` of the
+// document is io.EOF.
+func (reader *PrintlogReader) nextObject() ([]byte, error) {
+	for {
+		byt, err := reader.input.ReadByte()
+		if err == io.EOF {
+			return nil, fmt.Errorf("Printlog output ends before `]`. Records: %v", reader.count)
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch byt {
+		case '{':
+			return reader.readObject()
+		case ']':
+			return nil, io.EOF
+		case ',', ' ', '\t', '\r', '\n':
+		default:
+			return nil, fmt.Errorf("Unexpected character between printlog records. Char: %q Records: %v", byt, reader.count)
+		}
+	}
+}
+
+// readObject reads up to the `}` matching an already read `{`. Braces inside strings are not
+// counted.
+func (reader *PrintlogReader) readObject() ([]byte, error) {
+	var ret bytes.Buffer
+	ret.WriteByte('{')
+
+	depth := 1
+	inString := false
+	escaped := false
+	for depth > 0 {
+		byt, err := reader.input.ReadByte()
+		if err == io.EOF {
+			return nil, fmt.Errorf("Printlog output ends inside a record. Records: %v", reader.count)
+		} else if err != nil {
+			return nil, err
+		}
+		ret.WriteByte(byt)
+
+		switch {
+		case escaped:
+			escaped = false
+		case inString && byt == '\\':
+			escaped = true
+		case byt == '"':
+			inString = !inString
+		case !inString && byt == '{':
+			depth++
+		case !inString && byt == '}':
+			depth--
+		}
+	}
+
+	return ret.Bytes(), nil
+}
+
+// printlogItem returns the bytes of a key or value. The `-hex` form is exact. Otherwise the
+// escaped string is used, where every `\u00XX` is a single byte.
+func printlogItem(name string, escaped, hexStr *string) ([]byte, error) {
+	if hexStr != nil {
+		ret, err := hex.DecodeString(*hexStr)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("Malformed hex item. Field: %v", name))
+		}
+		return ret, nil
+	}
+	if escaped == nil {
+		return nil, nil
+	}
+
+	ret := make([]byte, 0, len(*escaped))
+	for _, char := range *escaped {
+		if char > 0xff {
+			return nil, fmt.Errorf("Item is not a byte string. Field: %v Char: %q", name, char)
+		}
+		ret = append(ret, byte(char))
+	}
+	return ret, nil
+}
+
+func printlogLSN(name string, values []uint32) (LSN, error) {
+	if len(values) != 2 {
+		return LSN{}, fmt.Errorf("Malformed LSN. Field: %v Value: %v", name, values)
+	}
+	return LSN{values[0], values[1]}, nil
+}
+
+// parseTypeName accepts the names printed by `LogRecordType.String` and `OpType.String`.
+func parseTypeName(name string, names map[uint32]string) (uint32, error) {
+	for value, valueName := range names {
+		if valueName == name {
+			return value, nil
+		}
+	}
+
+	var ret uint32
+	if _, err := fmt.Sscanf(name, "unknown(%d)", &ret); err == nil {
+		return ret, nil
+	}
+	return 0, fmt.Errorf("Unknown type. Type: %q", name)
+}
+
+var logRecordTypeValues map[uint32]string
+var opTypeValues map[uint32]string
+
+func init() {
+	logRecordTypeValues = make(map[uint32]string)
+	for recordType, name := range logRecordTypeNames {
+		logRecordTypeValues[uint32(recordType)] = name
+	}
+	opTypeValues = make(map[uint32]string)
+	for opType, name := range opTypeNames {
+		opTypeValues[uint32(opType)] = name
+	}
+}
+
+func (parsed *printlogJSONRecord) toLogRecord() (*LogRecord, error) {
+	recordType, err := parseTypeName(parsed.Type, logRecordTypeValues)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &LogRecord{
+		Compressed: parsed.HdrFlags == "compressed",
+		RecLen:     parsed.RecLen,
+		MemLen:     parsed.MemLen,
+		Type:       LogRecordType(recordType),
+		TxnID:      parsed.TxnID,
+		FileID:     parsed.FileID,
+		Start:      parsed.Start,
+		Message:    parsed.Message,
+	}
+	if ret.LSN, err = printlogLSN("lsn", parsed.LSN); err != nil {
+		return nil, err
+	}
+	if ret.Type == LogRecordCheckpoint {
+		if ret.CheckpointLSN, err = printlogLSN("ckpt_lsn", parsed.CkptLSN); err != nil {
+			return nil, err
+		}
+	}
+
+	for idx := range parsed.Ops {
+		op, err := parsed.Ops[idx].toOp()
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("Failed to parse operation. LSN: %v Op: %v", ret.LSN, idx))
+		}
+		ret.Ops = append(ret.Ops, op)
+	}
+
+	return ret, nil
+}
+
+func (parsed *printlogJSONOp) toOp() (Op, error) {
+	opType, err := parseTypeName(parsed.OpType, opTypeValues)
+	if err != nil {
+		return Op{}, err
+	}
+
+	ret := Op{
+		Type:          OpType(opType),
+		FileID:        parsed.FileID,
+		Recno:         parsed.Recno,
+		Mode:          parsed.Mode,
+		TimeSec:       parsed.TimeSec,
+		TimeNsec:      parsed.TimeNsec,
+		CommitTS:      parsed.CommitTS,
+		DurableTS:     parsed.DurableTS,
+		FirstCommitTS: parsed.FirstCommitTS,
+		PrepareTS:     parsed.PrepareTS,
+		ReadTS:        parsed.ReadTS,
+		Index:         parsed.Index,
+		Granularity:   parsed.Granularity,
+		ID:            parsed.ID,
+	}
+	if ret.Key, err = printlogItem("key", parsed.Key, parsed.KeyHex); err != nil {
+		return ret, err
+	}
+	if ret.Value, err = printlogItem("value", parsed.Value, parsed.ValueHex); err != nil {
+		return ret, err
+	}
+	if ret.Type == OpPrevLSN {
+		if ret.PrevLSN, err = printlogLSN("prev_lsn", parsed.PrevLSN); err != nil {
+			return ret, err
+		}
+	}
+
+	// `start` and `stop` are record numbers for col_truncate and keys for row_truncate.
+	switch ret.Type {
+	case OpColTruncate:
+		if err = json.Unmarshal(parsed.Start, &ret.StartRecno); err == nil {
+			err = json.Unmarshal(parsed.Stop, &ret.StopRecno)
+		}
+	case OpRowTruncate:
+		var start, stop *string
+		if err = json.Unmarshal(parsed.Start, &start); err == nil {
+			err = json.Unmarshal(parsed.Stop, &stop)
+		}
+		if err == nil {
+			ret.Start, err = printlogItem("start", start, parsed.StartHex)
+		}
+		if err == nil {
+			ret.Stop, err = printlogItem("stop", stop, parsed.StopHex)
+		}
+	}
+
+	return ret, err
+}
@@ -0,0 +1,528 @@
+package machinery
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ArtifactSource knows where the data file archives for a task live.
+type ArtifactSource interface {
+	// FetchDataArchives makes every `mongo-data-*` archive for the task available on the local
+	// filesystem. `target` is a directory the source may download into. The returned paths are
+	// absolute or relative to the CWD and need not be inside `target`. Sources report the bytes
+	// they download to `progress`.
+	FetchDataArchives(task TaskRef, target string, progress FetchProgress) ([]string, error)
+}
+
+// ParseArtifactSource turns a command line description of a source into an ArtifactSource:
+//   - `evergreen` uses the `evergreen` cli.
+//   - `dir:<path>` reads archives from `<path>/<task id>/<execution>/`.
+//   - `http://...` or `https://...` is a url template. See `HTTPSource`.
+func ParseArtifactSource(spec string) (ArtifactSource, error) {
+	switch {
+	case spec == "evergreen":
+		return EvergreenSource{}, nil
+	case strings.HasPrefix(spec, "dir:"):
+		return LocalDirSource{Dir: strings.TrimPrefix(spec, "dir:")}, nil
+	case strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://"):
+		return HTTPSource{URLTemplate: spec}, nil
+	}
+
+	return nil, fmt.Errorf("Unknown artifact source. Source: %q", spec)
+}
+
+var taskIdRe = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// checkTaskId rejects task ids that could name a path outside of a source's directory, e.g: `..`
+// or `a/b`. Evergreen task ids only use these characters.
+func checkTaskId(taskId string) error {
+	if !taskIdRe.MatchString(taskId) || taskId == "." || taskId == ".." {
+		return fmt.Errorf("Invalid task id. Task: %q", taskId)
+	}
+	return nil
+}
+
+// LatestExecutionSource is implemented by sources that know which execution of a task is the
+// latest.
+type LatestExecutionSource interface {
+	LatestExecution(taskId string) (int, error)
+}
+
+// LogSource knows where the test and server logs of a task live.
+type LogSource interface {
+	// FetchLogs copies the task's log files into the `target` directory and returns their paths.
+	FetchLogs(task TaskRef, target string) ([]string, error)
+}
+
+// ParseLogSource accepts the same descriptions as `ParseArtifactSource`. For `dir:<path>`, logs
+// are read from `<path>/<task id>/<execution>/logs/`. An http(s) url template names the log file
+// to download. `none` returns a nil source.
+func ParseLogSource(spec string) (LogSource, error) {
+	if spec == "none" {
+		return nil, nil
+	}
+
+	// A url template for logs differs from the one for data archives.
+	if strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://") {
+		return HTTPSource{LogURLTemplate: spec}, nil
+	}
+
+	source, err := ParseArtifactSource(spec)
+	if err != nil {
+		return nil, err
+	}
+	return LogSourceOf(source), nil
+}
+
+// LogSourceOf returns the artifact source as a log source, or nil when it cannot fetch logs, e.g:
+// an `HTTPSource` without a `LogURLTemplate`.
+func LogSourceOf(source ArtifactSource) LogSource {
+	if httpSource, ok := source.(HTTPSource); ok && httpSource.LogURLTemplate == "" {
+		return nil
+	}
+	if logSource, ok := source.(LogSource); ok {
+		return logSource
+	}
+	return nil
+}
+
+// EvergreenSource downloads a task's artifacts with `evergreen fetch`.
+type EvergreenSource struct{}
+
+func (source EvergreenSource) FetchDataArchives(task TaskRef, target string, progress FetchProgress) ([]string, error) {
+	// The `evergreen` cli does not report progress. Watch the download directory grow instead.
+	// The final size is not known up front.
+	fetchDone := make(chan struct{})
+	defer close(fetchDone)
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-fetchDone:
+				return
+			case <-ticker.C:
+				progress.Update(FetchDownloading, DirSize(target), 0)
+			}
+		}
+	}()
+
+	if err := fetchFromEvergreen(task, target); err != nil {
+		return nil, errors.Wrap(err, "Failed to run `evergreen fetch`")
+	}
+
+	matches, err := fs.Glob(os.DirFS(target), "artifacts-*/mongo-data-*")
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]string, len(matches))
+	for idx, match := range matches {
+		ret[idx] = filepath.Join(target, match)
+	}
+
+	return ret, nil
+}
+
+// DirSize sums the sizes of the regular files under `dir`.
+func DirSize(dir string) int64 {
+	var ret int64
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// Files may disappear while the cli moves them into place.
+			return nil
+		}
+		if info, err := entry.Info(); err == nil && info.Mode().IsRegular() {
+			ret += info.Size()
+		}
+		return nil
+	})
+
+	return ret
+}
+
+// Evergreen archives the prior executions of a restarted task under `<id>_<execution>`. The
+// latest execution is only addressable by the plain task id. Fetching the plain task id is only
+// correct when the REST API confirms the requested execution is the latest one.
+func fetchFromEvergreen(task TaskRef, target string) error {
+	archivedId := fmt.Sprintf("%s_%d", task.ID, task.Execution)
+	evg := exec.Command("evergreen", "fetch", "--task", archivedId, "--artifacts", "--shallow", "--dir", target)
+	archivedErr := evg.Run()
+	if archivedErr == nil {
+		return nil
+	}
+
+	latest, err := EvergreenSource{}.LatestExecution(task.ID)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("Failed to fetch the archived task. Task: %v Err: %v", archivedId, archivedErr))
+	}
+	if latest != task.Execution {
+		return fmt.Errorf("Failed to fetch the archived task. Task: %v Latest execution: %v Err: %v", archivedId, latest, archivedErr)
+	}
+
+	evg = exec.Command("evergreen", "fetch", "--task", task.ID, "--artifacts", "--shallow", "--dir", target)
+	return evg.Run()
+}
+
+type evergreenConfig struct {
+	APIServerHost string
+	User          string
+	APIKey        string
+}
+
+// loadEvergreenConfig reads the credentials the `evergreen` cli uses from `~/.evergreen.yml`. Only
+// flat `key: value` lines are understood, which is all the cli writes. The `EVG_USER` and
+// `EVG_API_KEY` environment variables take precedence.
+func loadEvergreenConfig() (evergreenConfig, error) {
+	ret := evergreenConfig{
+		APIServerHost: "https://evergreen.mongodb.com/api",
+		User:          os.Getenv("EVG_USER"),
+		APIKey:        os.Getenv("EVG_API_KEY"),
+	}
+	if ret.User != "" && ret.APIKey != "" {
+		return ret, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ret, err
+	}
+
+	contents, err := os.ReadFile(filepath.Join(home, ".evergreen.yml"))
+	if err != nil {
+		return ret, err
+	}
+	for _, line := range strings.Split(string(contents), "\n") {
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		value = strings.Trim(strings.TrimSpace(value), `"'`)
+		switch strings.TrimSpace(key) {
+		case "api_server_host":
+			ret.APIServerHost = strings.TrimSuffix(value, "/")
+		case "user":
+			ret.User = value
+		case "api_key":
+			ret.APIKey = value
+		}
+	}
+
+	return ret, nil
+}
+
+// LatestExecution asks the evergreen REST API for the task's current execution.
+func (source EvergreenSource) LatestExecution(taskId string) (int, error) {
+	config, err := loadEvergreenConfig()
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to read the evergreen credentials")
+	}
+
+	taskUrl := fmt.Sprintf("%s/rest/v2/tasks/%s", config.APIServerHost, url.PathEscape(taskId))
+	req, err := http.NewRequest(http.MethodGet, taskUrl, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Api-User", config.User)
+	req.Header.Set("Api-Key", config.APIKey)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("Failed to look up the task. Url: %v Status: %v", taskUrl, resp.Status)
+	}
+
+	var task struct {
+		Execution int `json:"execution"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&task); err != nil {
+		return 0, errors.Wrap(err, fmt.Sprintf("Failed to parse the task. Url: %v", taskUrl))
+	}
+	return task.Execution, nil
+}
+
+// FetchLogs downloads the task log through the evergreen REST API. Resmoke writes the output of
+// the tests and of the servers it starts to the task log.
+func (source EvergreenSource) FetchLogs(task TaskRef, target string) ([]string, error) {
+	config, err := loadEvergreenConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read the evergreen credentials")
+	}
+
+	logUrl := fmt.Sprintf("%s/rest/v2/tasks/%s/build/TaskLogs?execution=%d&type=task_log&print_time=true",
+		config.APIServerHost, url.PathEscape(task.ID), task.Execution)
+	req, err := http.NewRequest(http.MethodGet, logUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Api-User", config.User)
+	req.Header.Set("Api-Key", config.APIKey)
+
+	downloaded, err := download(http.DefaultClient, req, target, noProgress{})
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Failed to download the task log. Url: %v", logUrl))
+	}
+
+	logPath := filepath.Join(target, "task.log")
+	if err := os.Rename(downloaded, logPath); err != nil {
+		return nil, err
+	}
+	return []string{logPath}, nil
+}
+
+// LocalDirSource reads archives that are already on disk. Archives for a task are expected in
+// `<Dir>/<task id>/<execution>/`. Archives for the first execution may also be placed directly in
+// `<Dir>/<task id>/`.
+type LocalDirSource struct {
+	Dir string
+}
+
+func (source LocalDirSource) FetchDataArchives(task TaskRef, target string, progress FetchProgress) ([]string, error) {
+	if err := checkTaskId(task.ID); err != nil {
+		return nil, err
+	}
+	taskDirs := []string{filepath.Join(source.Dir, task.ID, fmt.Sprint(task.Execution))}
+	if task.Execution == 0 {
+		taskDirs = append(taskDirs, filepath.Join(source.Dir, task.ID))
+	}
+
+	for _, taskDir := range taskDirs {
+		matches, err := filepath.Glob(filepath.Join(taskDir, "mongo-data-*"))
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) > 0 {
+			// Nothing to download.
+			progress.Update(FetchDownloading, 0, 0)
+			return matches, nil
+		}
+	}
+
+	return nil, fmt.Errorf("No data archives found. Task: %v Dir: %v", task, source.Dir)
+}
+
+// LatestExecution is the highest numbered execution directory of the task. A task with only
+// archives placed directly in `<Dir>/<task id>/` was executed once.
+func (source LocalDirSource) LatestExecution(taskId string) (int, error) {
+	if err := checkTaskId(taskId); err != nil {
+		return 0, err
+	}
+	entries, err := os.ReadDir(filepath.Join(source.Dir, taskId))
+	if err != nil {
+		return 0, err
+	}
+
+	ret := 0
+	for _, entry := range entries {
+		if execution, err := strconv.Atoi(entry.Name()); err == nil && entry.IsDir() && execution > ret {
+			ret = execution
+		}
+	}
+	return ret, nil
+}
+
+func (source LocalDirSource) FetchLogs(task TaskRef, target string) ([]string, error) {
+	if err := checkTaskId(task.ID); err != nil {
+		return nil, err
+	}
+	logDirs := []string{filepath.Join(source.Dir, task.ID, fmt.Sprint(task.Execution), "logs")}
+	if task.Execution == 0 {
+		logDirs = append(logDirs, filepath.Join(source.Dir, task.ID, "logs"))
+	}
+
+	for _, logDir := range logDirs {
+		entries, err := os.ReadDir(logDir)
+		if err != nil {
+			continue
+		}
+
+		ret := make([]string, 0)
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() {
+				continue
+			}
+			// Copy the logs such that the task directory is self-contained.
+			logPath := filepath.Join(target, entry.Name())
+			if err := copyFile(filepath.Join(logDir, entry.Name()), logPath); err != nil {
+				return nil, err
+			}
+			ret = append(ret, logPath)
+		}
+		return ret, nil
+	}
+
+	return nil, fmt.Errorf("No logs found. Task: %v Dir: %v", task, source.Dir)
+}
+
+func copyFile(source, dest string) error {
+	reader, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	writer, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(writer, reader)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// HTTPSource downloads a single archive from a plain http(s) server. The `{task}` and
+// `{execution}` placeholders in the template are replaced with the requested task, escaped as a
+// path element, e.g:
+// `http://files.internal/bf/{task}/{execution}/mongo-data.tgz`. The source only fetches logs
+// when `LogURLTemplate` is set, e.g: `http://files.internal/bf/{task}/{execution}/task.log`.
+type HTTPSource struct {
+	URLTemplate    string
+	LogURLTemplate string
+	// Defaults to `http.DefaultClient` when nil.
+	Client *http.Client
+}
+
+func expandURLTemplate(template string, task TaskRef) string {
+	return strings.NewReplacer(
+		"{task}", url.PathEscape(task.ID),
+		"{execution}", fmt.Sprint(task.Execution),
+	).Replace(template)
+}
+
+func (source HTTPSource) URL(task TaskRef) string {
+	return expandURLTemplate(source.URLTemplate, task)
+}
+
+func (source HTTPSource) LogURL(task TaskRef) string {
+	return expandURLTemplate(source.LogURLTemplate, task)
+}
+
+func (source HTTPSource) client() *http.Client {
+	if source.Client == nil {
+		return http.DefaultClient
+	}
+	return source.Client
+}
+
+func (source HTTPSource) FetchDataArchives(task TaskRef, target string, progress FetchProgress) ([]string, error) {
+	if err := checkTaskId(task.ID); err != nil {
+		return nil, err
+	}
+	archiveUrl := source.URL(task)
+	req, err := http.NewRequest(http.MethodGet, archiveUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	archivePath, err := download(source.client(), req, target, progress)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Failed to download archive. Url: %v", archiveUrl))
+	}
+
+	// Keep the `mongo-data-` prefix so the archive is recognizable next to other task files.
+	if archiveName := filepath.Base(archivePath); !strings.HasPrefix(archiveName, "mongo-data-") {
+		renamed := filepath.Join(target, "mongo-data-"+archiveName)
+		if err := os.Rename(archivePath, renamed); err != nil {
+			return nil, err
+		}
+		archivePath = renamed
+	}
+
+	return []string{archivePath}, nil
+}
+
+// FetchLogs downloads a single log file from the log url template.
+func (source HTTPSource) FetchLogs(task TaskRef, target string) ([]string, error) {
+	if source.LogURLTemplate == "" {
+		return nil, fmt.Errorf("No log url template is configured")
+	}
+	if err := checkTaskId(task.ID); err != nil {
+		return nil, err
+	}
+	logUrl := source.LogURL(task)
+	req, err := http.NewRequest(http.MethodGet, logUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	logPath, err := download(source.client(), req, target, noProgress{})
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Failed to download log. Url: %v", logUrl))
+	}
+	return []string{logPath}, nil
+}
+
+// MaxDownloadSize caps the bytes `download` saves, like `DefaultExtractor.MaxTotalSize` caps what
+// is extracted.
+var MaxDownloadSize int64 = 20 << 30
+
+// download saves the response to `req` into the `target` directory. The file is named after the
+// last element of the url path. Responses larger than `MaxDownloadSize` fail.
+func download(client *http.Client, req *http.Request, target string, progress FetchProgress) (string, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Unexpected status: %v", resp.Status)
+	}
+	if resp.ContentLength > MaxDownloadSize {
+		return "", fmt.Errorf("Download exceeds the limit of %d bytes. Size: %v", MaxDownloadSize, resp.ContentLength)
+	}
+
+	fileName := path.Base(resp.Request.URL.Path)
+	if fileName == "/" || fileName == "." {
+		fileName = "download"
+	}
+	filePath := filepath.Join(target, fileName)
+
+	file, err := os.Create(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	// Read one byte past the limit to tell a response of exactly the limit from a larger one.
+	body := &progressReader{
+		Reader:   io.LimitReader(resp.Body, MaxDownloadSize+1),
+		progress: progress,
+		phase:    FetchDownloading,
+		total:    resp.ContentLength,
+	}
+	// `ContentLength` is -1 when the server does not say.
+	if body.total < 0 {
+		body.total = 0
+	}
+	written, err := io.Copy(file, body)
+	if err != nil {
+		return "", err
+	}
+	if written > MaxDownloadSize {
+		os.Remove(filePath)
+		return "", fmt.Errorf("Download exceeds the limit of %d bytes", MaxDownloadSize)
+	}
+
+	return filePath, nil
+}
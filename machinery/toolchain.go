@@ -0,0 +1,286 @@
+package machinery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The name recorded for the toolchain of binaries found on $PATH.
+const SystemToolchainName = "system"
+
+// A toolchain directory may describe itself with this file, e.g:
+// `{"revision": "f98b3361fbab4e02683325cc0e6ebaa69d6af1df", "wtVersion": "11.2.0"}`. Otherwise the
+// `wt` and `mongod` binaries are asked for their versions.
+const toolchainMetadataFile = "toolchain.json"
+
+type WTVersion struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+var wtVersionRe *regexp.Regexp = regexp.MustCompile("(\\d+)\\.(\\d+)\\.(\\d+)")
+
+// ParseWTVersion accepts `11.2.0` as well as `wt -V` output, e.g: `WiredTiger 11.2.0: (December  1, 2022)`.
+func ParseWTVersion(version string) (WTVersion, error) {
+	match := wtVersionRe.FindStringSubmatch(version)
+	if match == nil {
+		return WTVersion{}, fmt.Errorf("Not a WiredTiger version. Version: %q", version)
+	}
+
+	major, _ := strconv.Atoi(match[1])
+	minor, _ := strconv.Atoi(match[2])
+	patch, _ := strconv.Atoi(match[3])
+	return WTVersion{major, minor, patch}, nil
+}
+
+func (version WTVersion) IsZero() bool {
+	return version == WTVersion{}
+}
+
+func (version WTVersion) Less(other WTVersion) bool {
+	if version.Major != other.Major {
+		return version.Major < other.Major
+	}
+	if version.Minor != other.Minor {
+		return version.Minor < other.Minor
+	}
+	return version.Patch < other.Patch
+}
+
+func (version WTVersion) String() string {
+	if version.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf("%d.%d.%d", version.Major, version.Minor, version.Patch)
+}
+
+var turtleVersionRe *regexp.Regexp = regexp.MustCompile("^major=(\\d+),minor=(\\d+),patch=(\\d+)$")
+
+// ReadTurtleVersion returns the WiredTiger version that last wrote the dbpath. It is found in the
+// `WiredTiger.turtle` file as e.g: `major=11,minor=2,patch=0`.
+func ReadTurtleVersion(dbpath string) (WTVersion, error) {
+	contents, err := os.ReadFile(filepath.Join(dbpath, "WiredTiger.turtle"))
+	if err != nil {
+		return WTVersion{}, err
+	}
+
+	for _, line := range strings.Split(string(contents), "\n") {
+		if match := turtleVersionRe.FindStringSubmatch(strings.TrimSpace(line)); match != nil {
+			return ParseWTVersion(fmt.Sprintf("%s.%s.%s", match[1], match[2], match[3]))
+		}
+	}
+
+	return WTVersion{}, fmt.Errorf("No version found in the turtle file. DBPath: %v", dbpath)
+}
+
+// Evergreen task ids embed the revision they tested, e.g:
+// `..._patch_9c65140283c3f72330a94e58bd9ac2c5bd090ced_63e54b7e9ccd4e19c98bf4c6_23_02_10_19_28_57`. For
+// patches the revision is the patch's base commit.
+var taskRevisionRe *regexp.Regexp = regexp.MustCompile("(?:^|_)([0-9a-f]{40})(?:_|$)")
+
+// TaskRevision returns the mongo git revision of the task, or an empty string.
+func TaskRevision(task TaskRef) string {
+	if match := taskRevisionRe.FindStringSubmatch(task.ID); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
+// Toolchain is a set of `mongod`, `wt` and `ksdecode` binaries built together. A nil toolchain,
+// like the system toolchain, runs whatever is first on $PATH.
+type Toolchain struct {
+	// The directory name, e.g: `v7.0`. Recorded in MANIFEST files.
+	Name string
+	// Empty for the system toolchain.
+	Dir string
+	// The mongo git revision the binaries were built from, if known.
+	Revision  string
+	WTVersion WTVersion
+}
+
+// Binary returns the path of a program in the toolchain, e.g: `wt`. The toolchain's `bin/`
+// directory is searched first, then the toolchain directory itself. Programs the toolchain does
+// not have are looked up on $PATH.
+func (toolchain *Toolchain) Binary(name string) string {
+	if toolchain == nil || toolchain.Dir == "" {
+		return name
+	}
+
+	for _, candidate := range []string{filepath.Join(toolchain.Dir, "bin", name), filepath.Join(toolchain.Dir, name)} {
+		if info, err := os.Stat(candidate); err == nil && info.Mode().IsRegular() && info.Mode()&0111 != 0 {
+			return candidate
+		}
+	}
+
+	return name
+}
+
+func (toolchain *Toolchain) Command(name string, args ...string) *exec.Cmd {
+	return exec.Command(toolchain.Binary(name), args...)
+}
+
+// CommandContext is like Command. The process is killed when `ctx` is done.
+func (toolchain *Toolchain) CommandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, toolchain.Binary(name), args...)
+}
+
+func (toolchain *Toolchain) String() string {
+	if toolchain == nil {
+		return SystemToolchainName
+	}
+	return toolchain.Name
+}
+
+// ToolchainRegistry is a directory of versioned toolchains, one per subdirectory, e.g:
+// `<dir>/v7.0/bin/{mongod,wt,ksdecode}`.
+type ToolchainRegistry struct {
+	Dir string
+	// Ordered by WiredTiger version. Toolchains of an unknown version come first.
+	Toolchains []*Toolchain
+	System     *Toolchain
+}
+
+// LoadToolchains indexes the toolchains of `dir`. A nil registry, or one without toolchains,
+// resolves everything to the system toolchain.
+func LoadToolchains(dir string) (*ToolchainRegistry, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(absDir)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Failed to read the toolchain directory. Dir: %v", dir))
+	}
+
+	ret := &ToolchainRegistry{Dir: absDir, System: &Toolchain{Name: SystemToolchainName}}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		// Names end up in MANIFEST files, which are space delimited.
+		if strings.ContainsAny(entry.Name(), " \t") || entry.Name() == SystemToolchainName {
+			fmt.Printf("Skipping toolchain with an unusable name. Name: %q\n", entry.Name())
+			continue
+		}
+
+		toolchain, err := loadToolchain(entry.Name(), filepath.Join(absDir, entry.Name()))
+		if err != nil {
+			fmt.Printf("Skipping toolchain. Name: %v Err: %v\n", entry.Name(), err)
+			continue
+		}
+		fmt.Printf("Loaded toolchain. Name: %v Revision: %v WiredTiger: %v\n",
+			toolchain.Name, toolchain.Revision, toolchain.WTVersion)
+		ret.Toolchains = append(ret.Toolchains, toolchain)
+	}
+
+	sort.SliceStable(ret.Toolchains, func(left, right int) bool {
+		return ret.Toolchains[left].WTVersion.Less(ret.Toolchains[right].WTVersion)
+	})
+
+	return ret, nil
+}
+
+var mongodGitVersionRe *regexp.Regexp = regexp.MustCompile("\"gitVersion\": \"([0-9a-f]+)\"|git version: ([0-9a-f]+)")
+
+func loadToolchain(name, dir string) (*Toolchain, error) {
+	ret := &Toolchain{Name: name, Dir: dir}
+
+	if contents, err := os.ReadFile(filepath.Join(dir, toolchainMetadataFile)); err == nil {
+		var metadata struct {
+			Revision  string `json:"revision"`
+			WTVersion string `json:"wtVersion"`
+		}
+		if err := json.Unmarshal(contents, &metadata); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("Malformed %v", toolchainMetadataFile))
+		}
+		ret.Revision = strings.ToLower(metadata.Revision)
+		if metadata.WTVersion != "" {
+			if ret.WTVersion, err = ParseWTVersion(metadata.WTVersion); err != nil {
+				return nil, err
+			}
+		}
+		return ret, nil
+	}
+
+	hasBinary := false
+	for _, binary := range []string{"wt", "mongod", "ksdecode"} {
+		hasBinary = hasBinary || ret.Binary(binary) != binary
+	}
+	if !hasBinary {
+		return nil, fmt.Errorf("No `wt`, `mongod` or `ksdecode` binary found")
+	}
+
+	// The binaries may not run on this host. The toolchain can still be picked by name.
+	if wtPath := ret.Binary("wt"); wtPath != "wt" {
+		if output, err := exec.Command(wtPath, "-V").Output(); err == nil {
+			ret.WTVersion, _ = ParseWTVersion(string(output))
+		}
+	}
+	if mongodPath := ret.Binary("mongod"); mongodPath != "mongod" {
+		if output, err := exec.Command(mongodPath, "--version").Output(); err == nil {
+			if match := mongodGitVersionRe.FindStringSubmatch(string(output)); match != nil {
+				ret.Revision = match[1] + match[2]
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+// Find returns the toolchain recorded as `name`, or nil when it no longer exists.
+func (registry *ToolchainRegistry) Find(name string) *Toolchain {
+	if registry == nil {
+		return nil
+	}
+	if name == SystemToolchainName {
+		return registry.System
+	}
+	for _, toolchain := range registry.Toolchains {
+		if toolchain.Name == name {
+			return toolchain
+		}
+	}
+
+	return nil
+}
+
+// Resolve picks the toolchain for a dbpath. The toolchain built from the task's `revision` is
+// preferred. Otherwise the toolchain with the oldest WiredTiger version that is at least
+// `wtVersion`, the version that last wrote the data files. Older WiredTiger versions may not be
+// able to open newer files. When nothing matches, the system toolchain is used.
+func (registry *ToolchainRegistry) Resolve(revision string, wtVersion WTVersion) *Toolchain {
+	if registry == nil {
+		return &Toolchain{Name: SystemToolchainName}
+	}
+
+	// Allow either side to be an abbreviated revision.
+	if len(revision) >= 7 {
+		for _, toolchain := range registry.Toolchains {
+			if len(toolchain.Revision) >= 7 &&
+				(strings.HasPrefix(revision, toolchain.Revision) || strings.HasPrefix(toolchain.Revision, revision)) {
+				return toolchain
+			}
+		}
+	}
+
+	if !wtVersion.IsZero() {
+		for _, toolchain := range registry.Toolchains {
+			if !toolchain.WTVersion.IsZero() && !toolchain.WTVersion.Less(wtVersion) {
+				return toolchain
+			}
+		}
+	}
+
+	return registry.System
+}
@@ -0,0 +1,346 @@
+package machinery
+
+import (
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Resmoke lays out dbpaths as `<prefix>/job<N>/resmoke/[shard<N>|config/]node<N>`. A replica set
+// fixture has no shard directory and a standalone has no node directory.
+var jobDirRe *regexp.Regexp = regexp.MustCompile("^job\\d+$")
+var nodeDirRe *regexp.Regexp = regexp.MustCompile("^node(\\d+)$")
+var shardDirRe *regexp.Regexp = regexp.MustCompile("^shard\\d+$")
+
+type NodeState string
+
+const (
+	NodePrimary    NodeState = "primary"
+	NodeSecondary  NodeState = "secondary"
+	NodeArbiter    NodeState = "arbiter"
+	NodeStandalone NodeState = "standalone"
+	NodeUnknown    NodeState = "unknown"
+)
+
+// DBPathLayout is what the directory names of a dbpath say about the node.
+type DBPathLayout struct {
+	// The path up to and including the `job<N>` directory. Every node of a cluster shares it.
+	Cluster string
+	// e.g: `shard0`, `config` or `rs0`. Empty for the replica set of a replica set fixture.
+	ReplicaSet   string
+	Shard        string
+	ConfigServer bool
+	// e.g: `node0`. A standalone is named after its own directory.
+	Node string
+}
+
+// ParseDBPathLayout interprets a dbpath such as `dbpath/mongo-data-job0/data/db/job0/resmoke/shard1/node2`.
+func ParseDBPathLayout(dbpath string) DBPathLayout {
+	components := strings.Split(strings.Trim(dbpath, "/"), "/")
+
+	jobIdx := -1
+	for idx, component := range components {
+		if jobDirRe.MatchString(component) {
+			jobIdx = idx
+		}
+	}
+
+	var ret DBPathLayout
+	ret.Node = components[len(components)-1]
+	var setComponents []string
+	if jobIdx == -1 || jobIdx == len(components)-1 {
+		// Not a resmoke layout. Treat the parent directory as the replica set.
+		if len(components) > 1 {
+			ret.Cluster = strings.Join(components[:len(components)-1], "/")
+		}
+	} else {
+		ret.Cluster = strings.Join(components[:jobIdx+1], "/")
+		for _, component := range components[jobIdx+1 : len(components)-1] {
+			if component != "resmoke" {
+				setComponents = append(setComponents, component)
+			}
+		}
+	}
+
+	for _, component := range setComponents {
+		switch {
+		case component == "config" || component == "configsvr":
+			ret.ConfigServer = true
+		case shardDirRe.MatchString(component):
+			ret.Shard = component
+		}
+	}
+	ret.ReplicaSet = strings.Join(setComponents, "/")
+
+	return ret
+}
+
+type ReplSetMember struct {
+	ID          int    `bson:"_id"`
+	Host        string `bson:"host"`
+	ArbiterOnly bool   `bson:"arbiterOnly"`
+}
+
+// ReplSetConfig is the document stored in `local.system.replset`.
+type ReplSetConfig struct {
+	ID        string          `bson:"_id"`
+	ConfigSvr bool            `bson:"configsvr"`
+	Members   []ReplSetMember `bson:"members"`
+}
+
+// NodeMetadata is what a node's own collections say about its place in the topology. Every field
+// is optional.
+type NodeMetadata struct {
+	ReplSetConfig *ReplSetConfig
+	// From the `shardIdentity` document in `admin.system.version`.
+	ShardName string
+	// The port of the last startup, from `local.startup_log`.
+	Port int
+	// The node's last vote, from `local.replset.election`. `CandidateIndex` is an index into the
+	// config's members.
+	LastVoteTerm   int64
+	CandidateIndex int
+	HasLastVote    bool
+}
+
+// ReadNodeMetadata reads the topology related collections of a dbpath with `wt`. Collections
+// that do not exist are skipped.
+func ReadNodeMetadata(home WTHome) (NodeMetadata, error) {
+	var ret NodeMetadata
+	catalog, err := home.ReadCatalog()
+	if err != nil {
+		return ret, err
+	}
+
+	readDocs := func(ns string) ([]bson.Raw, error) {
+		collection := catalog.FindCollection(ns)
+		if collection == nil {
+			return nil, nil
+		}
+		entries, err := home.DumpTable(collection.Ident)
+		if err != nil {
+			return nil, err
+		}
+
+		docs := make([]bson.Raw, len(entries))
+		for idx, entry := range entries {
+			docs[idx] = bson.Raw(entry.Value)
+		}
+		return docs, nil
+	}
+
+	docs, err := readDocs("local.system.replset")
+	if err != nil {
+		return ret, err
+	}
+	if len(docs) > 0 {
+		ret.ReplSetConfig = &ReplSetConfig{}
+		if err := bson.Unmarshal(docs[0], ret.ReplSetConfig); err != nil {
+			return ret, errors.Wrap(err, "Failed to parse the replica set config")
+		}
+	}
+
+	if docs, err = readDocs("admin.system.version"); err != nil {
+		return ret, err
+	}
+	for _, doc := range docs {
+		var version struct {
+			ID        interface{} `bson:"_id"`
+			ShardName string      `bson:"shardName"`
+		}
+		if err := bson.Unmarshal(doc, &version); err == nil && version.ID == "shardIdentity" {
+			ret.ShardName = version.ShardName
+		}
+	}
+
+	if docs, err = readDocs("local.startup_log"); err != nil {
+		return ret, err
+	}
+	// Records are in insertion order. The last one is the most recent startup.
+	if len(docs) > 0 {
+		var startup struct {
+			CmdLine struct {
+				Net struct {
+					Port int `bson:"port"`
+				} `bson:"net"`
+			} `bson:"cmdLine"`
+		}
+		if err := bson.Unmarshal(docs[len(docs)-1], &startup); err == nil {
+			ret.Port = startup.CmdLine.Net.Port
+		}
+	}
+
+	if docs, err = readDocs("local.replset.election"); err != nil {
+		return ret, err
+	}
+	if len(docs) > 0 {
+		var lastVote struct {
+			Term           int64 `bson:"term"`
+			CandidateIndex int   `bson:"candidateIndex"`
+		}
+		if err := bson.Unmarshal(docs[0], &lastVote); err == nil {
+			ret.LastVoteTerm, ret.CandidateIndex, ret.HasLastVote = lastVote.Term, lastVote.CandidateIndex, true
+		}
+	}
+
+	return ret, nil
+}
+
+type TopologyNode struct {
+	DBPath string
+	Name   string
+	Port   int
+	// The host in the replica set config, e.g: `localhost:20001`.
+	Host  string
+	State NodeState
+	// Set when the node's collections could not be read. The node is then only described by its
+	// dbpath.
+	Err string
+}
+
+type TopologyReplicaSet struct {
+	// The replica set name from the config, or the directory name.
+	Name         string
+	Shard        string
+	ConfigServer bool
+	Nodes        []*TopologyNode
+}
+
+type TopologyCluster struct {
+	Name        string
+	Sharded     bool
+	ReplicaSets []*TopologyReplicaSet
+}
+
+// Topology groups the dbpaths of a task as job -> shard/replica set -> node.
+type Topology struct {
+	Clusters []*TopologyCluster
+}
+
+// BuildTopology groups `dbpaths` by their layout. `readMetadata`, when not nil, is called with
+// each dbpath to refine the grouping with the node's own collections.
+func BuildTopology(dbpaths []string, readMetadata func(dbpath string) (NodeMetadata, error)) *Topology {
+	type setMember struct {
+		node     *TopologyNode
+		metadata *NodeMetadata
+	}
+
+	ret := &Topology{}
+	clusters := make(map[string]*TopologyCluster)
+	sets := make(map[string]*TopologyReplicaSet)
+	members := make(map[*TopologyReplicaSet][]setMember)
+	for _, dbpath := range dbpaths {
+		layout := ParseDBPathLayout(dbpath)
+		node := &TopologyNode{DBPath: dbpath, Name: layout.Node, State: NodeUnknown}
+
+		var metadata *NodeMetadata
+		if readMetadata != nil {
+			if read, err := readMetadata(dbpath); err != nil {
+				node.Err = err.Error()
+			} else {
+				metadata = &read
+				node.Port = read.Port
+			}
+		}
+
+		cluster, exists := clusters[layout.Cluster]
+		if !exists {
+			cluster = &TopologyCluster{Name: layout.Cluster}
+			clusters[layout.Cluster] = cluster
+			ret.Clusters = append(ret.Clusters, cluster)
+		}
+
+		setKey := layout.Cluster + "\x00" + layout.ReplicaSet
+		set, exists := sets[setKey]
+		if !exists {
+			set = &TopologyReplicaSet{Name: layout.ReplicaSet, Shard: layout.Shard, ConfigServer: layout.ConfigServer}
+			sets[setKey] = set
+			cluster.ReplicaSets = append(cluster.ReplicaSets, set)
+		}
+		if metadata != nil {
+			if metadata.ReplSetConfig != nil {
+				set.Name = metadata.ReplSetConfig.ID
+				set.ConfigServer = set.ConfigServer || metadata.ReplSetConfig.ConfigSvr
+			}
+			if metadata.ShardName != "" {
+				set.Shard = metadata.ShardName
+			}
+		}
+		cluster.Sharded = cluster.Sharded || set.Shard != "" || set.ConfigServer
+
+		set.Nodes = append(set.Nodes, node)
+		members[set] = append(members[set], setMember{node, metadata})
+	}
+
+	for set, setMembers := range members {
+		var config *ReplSetConfig
+		// The vote of the highest term names the most recent primary.
+		var lastVote *NodeMetadata
+		for _, member := range setMembers {
+			if member.metadata == nil {
+				continue
+			}
+			if member.metadata.ReplSetConfig != nil && config == nil {
+				config = member.metadata.ReplSetConfig
+			}
+			if member.metadata.HasLastVote && (lastVote == nil || member.metadata.LastVoteTerm > lastVote.LastVoteTerm) {
+				lastVote = member.metadata
+			}
+		}
+
+		for _, member := range setMembers {
+			if member.metadata == nil {
+				continue
+			}
+			if config == nil {
+				member.node.State = NodeStandalone
+				continue
+			}
+
+			configIdx := findConfigMember(config, member.node)
+			if configIdx == -1 {
+				continue
+			}
+			member.node.Host = config.Members[configIdx].Host
+			switch {
+			case config.Members[configIdx].ArbiterOnly:
+				member.node.State = NodeArbiter
+			case lastVote != nil && lastVote.CandidateIndex == configIdx:
+				member.node.State = NodePrimary
+			case lastVote != nil:
+				member.node.State = NodeSecondary
+			}
+		}
+
+		sort.Slice(set.Nodes, func(left, right int) bool {
+			return set.Nodes[left].DBPath < set.Nodes[right].DBPath
+		})
+	}
+
+	return ret
+}
+
+// findConfigMember returns the index of the node in the replica set config, or -1. Nodes are
+// matched by the port they last started with. Otherwise resmoke's `node<N>` is the Nth member.
+func findConfigMember(config *ReplSetConfig, node *TopologyNode) int {
+	if node.Port != 0 {
+		for idx, member := range config.Members {
+			if _, port, err := net.SplitHostPort(member.Host); err == nil && port == strconv.Itoa(node.Port) {
+				return idx
+			}
+		}
+	}
+
+	if match := nodeDirRe.FindStringSubmatch(node.Name); match != nil {
+		if idx, _ := strconv.Atoi(match[1]); idx < len(config.Members) {
+			return idx
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,201 @@
+package machinery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// TransactionTable is a table a transaction wrote to.
+type TransactionTable struct {
+	// e.g: `collection-7-123`.
+	Table string
+	// What the catalog makes of the table, e.g: `test.coll`.
+	Name string
+	Ops  int
+}
+
+// Transaction is the commit records of the journal with the same txnid.
+type Transaction struct {
+	TxnID    uint64
+	FirstLSN LSN
+	LastLSN  LSN
+	Records  int
+	// The writes to tables.
+	Ops int
+	// From the txn_timestamp op. Zero when the transaction did not set them.
+	CommitTs      Timestamp
+	DurableTs     Timestamp
+	FirstCommitTs Timestamp
+	PrepareTs     Timestamp
+	ReadTs        Timestamp
+	// In the order they were first written to.
+	Tables []TransactionTable
+}
+
+func (txn *Transaction) Prepared() bool {
+	return txn.PrepareTs != 0
+}
+
+func (txn *Transaction) add(record *LogRecord, annotator *PrintlogAnnotator) {
+	if txn.Records == 0 {
+		txn.FirstLSN = record.LSN
+	}
+	txn.LastLSN = record.LSN
+	txn.Records++
+
+	annotator.lsn = record.LSN
+	for idx := range record.Ops {
+		op := &record.Ops[idx]
+		switch op.Type {
+		case OpTxnTimestamp:
+			txn.CommitTs, txn.DurableTs = Timestamp(op.CommitTS), Timestamp(op.DurableTS)
+			txn.FirstCommitTs, txn.PrepareTs, txn.ReadTs = Timestamp(op.FirstCommitTS), Timestamp(op.PrepareTS), Timestamp(op.ReadTS)
+			continue
+		case OpCheckpointStart, OpPrevLSN, OpBackupID:
+			continue
+		}
+		txn.Ops++
+
+		tableName, exists, mdbDisplayName, _ := annotator.TableOf(op)
+		if !exists {
+			tableName = fmt.Sprintf("fileid %d", op.TableFileID())
+		}
+		found := false
+		for tableIdx := range txn.Tables {
+			if table := &txn.Tables[tableIdx]; table.Table == tableName {
+				table.Ops++
+				found = true
+				break
+			}
+		}
+		if !found {
+			txn.Tables = append(txn.Tables, TransactionTable{Table: tableName, Name: mdbDisplayName, Ops: 1})
+		}
+	}
+}
+
+// transactionIndex groups the commit records by txnid, in the order of their first record.
+type transactionIndex struct {
+	transactions       []*Transaction
+	txnIdToTransaction map[uint64]*Transaction
+}
+
+func newTransactionIndex() *transactionIndex {
+	return &transactionIndex{
+		transactions:       make([]*Transaction, 0),
+		txnIdToTransaction: make(map[uint64]*Transaction),
+	}
+}
+
+func (index *transactionIndex) add(record *LogRecord, annotator *PrintlogAnnotator) {
+	if record.Type != LogRecordCommit {
+		return
+	}
+
+	txn, exists := index.txnIdToTransaction[record.TxnID]
+	if !exists {
+		txn = &Transaction{TxnID: record.TxnID}
+		index.txnIdToTransaction[record.TxnID] = txn
+		index.transactions = append(index.transactions, txn)
+	}
+	txn.add(record, annotator)
+}
+
+// indexedRecords adds every record to the index as it is read, such that the transactions are
+// known after annotating the journal without reading it again.
+type indexedRecords struct {
+	records   LogRecordIterator
+	annotator *PrintlogAnnotator
+	index     *transactionIndex
+}
+
+func (iterator indexedRecords) Next() (*LogRecord, error) {
+	record, err := iterator.records.Next()
+	if err == nil {
+		iterator.index.add(record, iterator.annotator)
+	}
+	return record, err
+}
+
+func readTransactions(records LogRecordIterator, annotator *PrintlogAnnotator) ([]*Transaction, error) {
+	index := newTransactionIndex()
+	for {
+		record, err := records.Next()
+		if err == io.EOF {
+			return index.transactions, nil
+		} else if err != nil {
+			return index.transactions, err
+		}
+		index.add(record, annotator)
+	}
+}
+
+// ReadTransactions groups the records of `wt printlog` output by txnid and names the tables each
+// transaction wrote to. It stops early when `ctx` is done.
+func ReadTransactions(ctx context.Context, input io.ReadSeeker, catalog *Catalog, list *WTList, checkpoints *UnrecoveredCheckpoints) ([]*Transaction, error) {
+	annotator, err := NewJournalAnnotator(ctx, input, catalog, list, checkpoints)
+	if err != nil {
+		return nil, err
+	}
+	return readTransactions(contextRecords{ctx, NewPrintlogReader(input)}, annotator)
+}
+
+// transactionRecords returns the commit records of one transaction. The records before and in
+// between are followed, such that row_modify ops are annotated as in the whole journal.
+type transactionRecords struct {
+	records   LogRecordIterator
+	annotator *PrintlogAnnotator
+	txnId     uint64
+}
+
+func (iterator transactionRecords) Next() (*LogRecord, error) {
+	for {
+		record, err := iterator.records.Next()
+		if err != nil {
+			return nil, err
+		}
+		if record.Type == LogRecordCommit && record.TxnID == iterator.txnId {
+			iterator.annotator.lsn = record.LSN
+			return record, nil
+		}
+		iterator.annotator.Follow(record)
+	}
+}
+
+// SaveTransactions writes the transactions as JSON, such that the journal is only read once.
+func SaveTransactions(txns []*Transaction, transactionsFile string) error {
+	contents, err := json.Marshal(txns)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(transactionsFile, contents, 0644)
+}
+
+// LoadTransactions reads transactions saved by SaveTransactions.
+func LoadTransactions(transactionsFile string) ([]*Transaction, error) {
+	contents, err := os.ReadFile(transactionsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []*Transaction
+	if err := json.Unmarshal(contents, &ret); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Malformed transactions. File: %v", transactionsFile))
+	}
+	return ret, nil
+}
+
+// WriteTransaction writes the commit records of one transaction of `wt printlog` output, annotated
+// as `RewritePrintlog` does. It stops early when `ctx` is done.
+func WriteTransaction(ctx context.Context, input io.ReadSeeker, output io.Writer, txnId uint64, catalog *Catalog, list *WTList, checkpoints *UnrecoveredCheckpoints) error {
+	annotator, err := NewJournalAnnotator(ctx, input, catalog, list, checkpoints)
+	if err != nil {
+		return err
+	}
+	return writePrintlog(transactionRecords{contextRecords{ctx, NewPrintlogReader(input)}, annotator, txnId}, output, annotator.rewriteOp)
+}
@@ -0,0 +1,106 @@
+package machinery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// VerifyResult is the outcome of `wt verify` on one table.
+type VerifyResult struct {
+	Table  string
+	FileId int64
+	// The namespace owning the table, if it is a collection or an index.
+	Namespace string
+	// The index name, if the table is an index.
+	Index  string
+	Passed bool
+	// What `wt verify` printed. Empty for tables that passed.
+	Output string
+}
+
+// Describe names the table by what MongoDB stores in it, e.g: `test.foo index a_1`.
+func (result VerifyResult) Describe() string {
+	switch {
+	case result.Index != "":
+		return fmt.Sprintf("%v index %v", result.Namespace, result.Index)
+	case result.Namespace != "":
+		return result.Namespace
+	default:
+		return result.Table
+	}
+}
+
+// VerifyTable runs `wt verify` on a single table. A table that fails to verify is not an error,
+// the error is only for `ctx` being done.
+func (home WTHome) VerifyTable(ctx context.Context, table string) (passed bool, output string, err error) {
+	cmd := home.CommandContext(ctx, "verify", "file:"+table+".wt")
+	combined, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return false, "", ctx.Err()
+	}
+	if err != nil {
+		return false, fmt.Sprintf("%s\n%v", strings.TrimSpace(string(combined)), err), nil
+	}
+	return true, "", nil
+}
+
+// VerifyTables verifies every table in `list`, one at a time. Tables are named through the
+// catalog. The WiredTiger metadata is skipped, it is not a table.
+func VerifyTables(ctx context.Context, home WTHome, catalog *Catalog, list *WTList) ([]VerifyResult, error) {
+	if err := home.Check(); err != nil {
+		return nil, err
+	}
+	ret := make([]VerifyResult, 0, len(list.TableToFileId))
+	for table, fileId := range list.TableToFileId {
+		if table == "WiredTiger" {
+			continue
+		}
+
+		result := VerifyResult{Table: table, FileId: fileId}
+		result.Namespace, result.Index = catalog.TableOwner(table)
+
+		var err error
+		if result.Passed, result.Output, err = home.VerifyTable(ctx, table); err != nil {
+			return nil, errors.Wrap(err, "Verifying was cancelled")
+		}
+		ret = append(ret, result)
+	}
+
+	// Failures first, then in file id order.
+	sort.Slice(ret, func(left, right int) bool {
+		if ret[left].Passed != ret[right].Passed {
+			return !ret[left].Passed
+		}
+		return ret[left].FileId < ret[right].FileId
+	})
+	return ret, nil
+}
+
+// SaveVerifyResults writes results for LoadVerifyResults.
+func SaveVerifyResults(results []VerifyResult, verifyFile string) error {
+	contents, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(verifyFile, contents, 0644)
+}
+
+// LoadVerifyResults reads results saved by SaveVerifyResults.
+func LoadVerifyResults(verifyFile string) ([]VerifyResult, error) {
+	contents, err := os.ReadFile(verifyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []VerifyResult
+	if err := json.Unmarshal(contents, &ret); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Malformed verify results. File: %v", verifyFile))
+	}
+	return ret, nil
+}
@@ -1,25 +1,38 @@
 package machinery
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 
 	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 type WTDiagnostics struct {
 	DBPath    string
 	OutputDir string
+	// The `wt` binary to use. Nil uses $PATH.
+	Toolchain *Toolchain
+	// A copy of the dbpath taken before anything ran recovery, see `CopyUnrecovered`. Documents
+	// changed by row_modify ops are rebuilt from its checkpoint. Empty rebuilds them only from
+	// earlier writes in the journal.
+	UnrecoveredDBPath string
 }
 
 func NewWTDiagnostics(dbpath string, outputDir string) *WTDiagnostics {
 	if !strings.HasSuffix(outputDir, "/") {
 		outputDir = outputDir + "/"
 	}
-	return &WTDiagnostics{dbpath, outputDir}
+	return &WTDiagnostics{DBPath: dbpath, OutputDir: outputDir}
 }
 
 type WTDiagnosticsResults struct {
@@ -30,6 +43,15 @@ type WTDiagnosticsResults struct {
 	CatalogFile           string
 	AnnotatedCatalogFile  string
 	AnnotatedPrintlogFile string
+	TransactionsFile      string
+	ConfigFile            string
+	VerifyFile            string
+	HistoryStoreFile      string
+	// `wt list -v` of the unrecovered copy. Missing without one. See `LoadUnrecoveredCheckpoints`.
+	CheckpointListFile string
+
+	// The config every `wt` command was run with.
+	Config WTConfig
 }
 
 func ReadStderr(stderr io.ReadCloser) string {
@@ -95,7 +117,479 @@ func RunCommand(cmd *exec.Cmd, outputFile string) error {
 	return nil
 }
 
-func (wtDiag *WTDiagnostics) Run() (WTDiagnosticsResults, error) {
+// WTHome is a dbpath along with the toolchain whose `wt` opens it.
+type WTHome struct {
+	DBPath string
+	// Nil uses the `wt` on $PATH.
+	Toolchain *Toolchain
+	// Nil uses MongoDB's defaults. See `NewWTHome`.
+	Config *WTConfig
+	// Dumps read this checkpoint, e.g: `WiredTigerCheckpoint`, rather than the latest data. See
+	// `AtCheckpoint`.
+	Checkpoint string
+	// Opens the dbpath read-only without running recovery. See `Unrecovered`.
+	NoRecovery bool
+}
+
+// NewWTHome detects the config for opening the dbpath. When detection fails MongoDB's defaults
+// are used.
+func NewWTHome(dbpath string, toolchain *Toolchain) WTHome {
+	config, err := DetectWTConfig(dbpath)
+	if err != nil {
+		fmt.Printf("Failed to detect the WiredTiger config, using defaults. DBPath: %v Err: %v\n", dbpath, err)
+		config = DefaultWTConfig()
+	}
+	return WTHome{DBPath: dbpath, Toolchain: toolchain, Config: &config}
+}
+
+func (home WTHome) config() WTConfig {
+	if home.Config == nil {
+		return DefaultWTConfig()
+	}
+	return *home.Config
+}
+
+// JournalDir returns the directory of the dbpath's `WiredTigerLog.*` files.
+func (home WTHome) JournalDir() string {
+	return home.config().JournalDir(home.DBPath)
+}
+
+// Check fails when `wt` cannot open the dbpath. See `WTConfig.Check`.
+func (home WTHome) Check() error {
+	return home.config().Check()
+}
+
+// Command builds a `wt` invocation against the dbpath, e.g: `home.Command("list", "-v")`.
+func (home WTHome) Command(args ...string) *exec.Cmd {
+	return home.CommandContext(context.Background(), args...)
+}
+
+// CommandContext is like Command. `wt` is killed when `ctx` is done.
+func (home WTHome) CommandContext(ctx context.Context, args ...string) *exec.Cmd {
+	if home.NoRecovery {
+		config := home.config()
+		config.LogEnabled = false
+		return home.Toolchain.CommandContext(ctx, "wt", append([]string{
+			"-C", config.String() + ",readonly=true", "-h", home.DBPath}, args...)...)
+	}
+	return home.Toolchain.CommandContext(ctx, "wt", append([]string{
+		"-C", home.config().String(), "-h", home.DBPath, "-r"}, args...)...)
+}
+
+// Unrecovered returns a home for `copyDir`, a copy of the dbpath made by `CopyUnrecovered`. It is
+// opened read-only with the journal disabled, i.e: its checkpoints are as the node left them.
+// Recovery, which every other `wt` run does, replaces `WiredTigerCheckpoint` with one that
+// includes the journal.
+func (home WTHome) Unrecovered(copyDir string) WTHome {
+	home.DBPath = copyDir
+	home.NoRecovery = true
+	return home
+}
+
+// CopyUnrecovered copies the dbpath into `target` before anything runs recovery on it. The
+// journal, `mongod.lock` and `diagnostic.data` are left out, `Unrecovered` does not read them.
+// It stops between files once `ctx` is done.
+func CopyUnrecovered(ctx context.Context, dbpath, target string) error {
+	return filepath.WalkDir(dbpath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name := entry.Name()
+		switch {
+		case entry.IsDir() && name == "diagnostic.data":
+			return filepath.SkipDir
+		case strings.HasPrefix(name, "WiredTigerLog.") || strings.HasPrefix(name, "WiredTigerPreplog.") ||
+			strings.HasPrefix(name, "WiredTigerTmplog.") || name == "mongod.lock":
+			return nil
+		}
+
+		relative, err := filepath.Rel(dbpath, path)
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return os.MkdirAll(filepath.Join(target, relative), 0755)
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		return copyFile(path, filepath.Join(target, relative))
+	})
+}
+
+// DumpEntry is one key/value pair of a `wt dump -x` output.
+type DumpEntry struct {
+	Key   []byte
+	Value []byte
+}
+
+// ParseDump reads the output of `wt dump -x`. The header is skipped, everything after the `Data`
+// line is alternating hex encoded key and value lines.
+func ParseDump(dump io.Reader) ([]DumpEntry, error) {
+	scanner := bufio.NewScanner(dump)
+	// Documents may be up to 16MB, i.e: 32MB of hex.
+	scanner.Buffer(make([]byte, 64*1024), 34*1024*1024)
+	for scanner.Scan() {
+		if scanner.Text() == "Data" {
+			break
+		}
+	}
+
+	ret := make([]DumpEntry, 0)
+	for scanner.Scan() {
+		key, err := hex.DecodeString(scanner.Text())
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to decode a dump key")
+		}
+		if !scanner.Scan() {
+			return nil, fmt.Errorf("Dump ends with a key and no value")
+		}
+		value, err := hex.DecodeString(scanner.Text())
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to decode a dump value")
+		}
+
+		ret = append(ret, DumpEntry{key, value})
+	}
+
+	return ret, scanner.Err()
+}
+
+// AtCheckpoint returns a home whose dumps read the named checkpoint. `WiredTigerCheckpoint` is the
+// most recent checkpoint. An empty name reads the latest data.
+func (home WTHome) AtCheckpoint(checkpoint string) WTHome {
+	home.Checkpoint = checkpoint
+	return home
+}
+
+// dumpArgs dumps `table`, or a uri such as `file:WiredTigerHS.wt` for tables WiredTiger only knows
+// as files.
+func (home WTHome) dumpArgs(table string) []string {
+	uri := table
+	if !strings.Contains(uri, ":") {
+		uri = "table:" + table
+	}
+	if home.Checkpoint != "" {
+		return []string{"dump", "-x", "-c", home.Checkpoint, uri}
+	}
+	return []string{"dump", "-x", uri}
+}
+
+// DumpTable returns every record of `table`, e.g: `_mdb_catalog` or `collection-7-123`. The whole
+// table is held in memory; only use this for small tables.
+func (home WTHome) DumpTable(table string) ([]DumpEntry, error) {
+	if err := home.Check(); err != nil {
+		return nil, err
+	}
+	cmd := home.Command(home.dumpArgs(table)...)
+	stdout, err := cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return nil, errors.Wrap(err, fmt.Sprintf("Failed to dump table. Table: %v Stderr: %s", table, exitErr.Stderr))
+	} else if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Failed to dump table. Table: %v", table))
+	}
+
+	return ParseDump(bytes.NewReader(stdout))
+}
+
+// DumpReader streams the records of `wt dump -x`, for tables too large to hold in memory.
+type DumpReader struct {
+	// Either the running `wt`, or the file it dumped into. See `dumpToFile`.
+	cmd     *exec.Cmd
+	cancel  context.CancelFunc
+	file    *os.File
+	scanner *bufio.Scanner
+	stderr  bytes.Buffer
+	waited  bool
+	waitErr error
+}
+
+// OpenDump starts dumping `table`. The reader must be closed.
+func (home WTHome) OpenDump(ctx context.Context, table string) (*DumpReader, error) {
+	if err := home.Check(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	ret := &DumpReader{cmd: home.CommandContext(ctx, home.dumpArgs(table)...), cancel: cancel}
+	ret.cmd.Stderr = &ret.stderr
+	stdout, err := ret.cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := ret.cmd.Start(); err != nil {
+		cancel()
+		return nil, errors.Wrap(err, fmt.Sprintf("Failed to dump table. Table: %v", table))
+	}
+
+	ret.scan(stdout)
+
+	return ret, nil
+}
+
+// scan reads the records of `dump`, skipping its header.
+func (reader *DumpReader) scan(dump io.Reader) {
+	reader.scanner = bufio.NewScanner(dump)
+	// Documents may be up to 16MB, i.e: 32MB of hex.
+	reader.scanner.Buffer(make([]byte, 64*1024), 34*1024*1024)
+	for reader.scanner.Scan() {
+		if reader.scanner.Text() == "Data" {
+			break
+		}
+	}
+}
+
+// dumpToFile dumps `table` into a temporary file and returns a reader of it. The file is removed
+// when the reader is closed.
+func (home WTHome) dumpToFile(ctx context.Context, table string) (*DumpReader, error) {
+	if err := home.Check(); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp("", "wtdump_")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create a dump file")
+	}
+	ret := &DumpReader{file: file}
+	cmd := home.CommandContext(ctx, home.dumpArgs(table)...)
+	cmd.Stdout = file
+	cmd.Stderr = &ret.stderr
+	if err := cmd.Run(); err != nil {
+		ret.Close()
+		return nil, errors.Wrap(err, fmt.Sprintf("`wt dump` failed. Table: %v Stderr: %s", table, ret.stderr.String()))
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		ret.Close()
+		return nil, err
+	}
+	ret.scan(file)
+
+	return ret, nil
+}
+
+func (reader *DumpReader) wait() error {
+	if reader.cmd == nil {
+		return nil
+	}
+	if !reader.waited {
+		reader.waited = true
+		if err := reader.cmd.Wait(); err != nil {
+			reader.waitErr = errors.Wrap(err, fmt.Sprintf("`wt dump` failed. Stderr: %s", reader.stderr.String()))
+		}
+	}
+	return reader.waitErr
+}
+
+// Next returns the next record, or io.EOF after the last one. A `wt` that fails part way through
+// is an error rather than a short table.
+func (reader *DumpReader) Next() (DumpEntry, error) {
+	if !reader.scanner.Scan() {
+		if err := reader.scanner.Err(); err != nil {
+			return DumpEntry{}, err
+		}
+		if err := reader.wait(); err != nil {
+			return DumpEntry{}, err
+		}
+		return DumpEntry{}, io.EOF
+	}
+
+	key, err := hex.DecodeString(reader.scanner.Text())
+	if err != nil {
+		return DumpEntry{}, errors.Wrap(err, "Failed to decode a dump key")
+	}
+	if !reader.scanner.Scan() {
+		return DumpEntry{}, fmt.Errorf("Dump ends with a key and no value")
+	}
+	value, err := hex.DecodeString(reader.scanner.Text())
+	if err != nil {
+		return DumpEntry{}, errors.Wrap(err, "Failed to decode a dump value")
+	}
+
+	return DumpEntry{key, value}, nil
+}
+
+// Close stops `wt` if the table was not read to the end.
+func (reader *DumpReader) Close() {
+	if reader.file != nil {
+		reader.file.Close()
+		os.Remove(reader.file.Name())
+		return
+	}
+	reader.cancel()
+	reader.wait()
+}
+
+// DumpPage returns up to `limit` records of `table` after skipping the first `skip`. `more` is
+// true when the table has records after the page. `wt dump` always starts at the beginning of
+// the table, later pages take longer.
+func (home WTHome) DumpPage(ctx context.Context, table string, skip, limit int) (entries []DumpEntry, more bool, err error) {
+	reader, err := home.OpenDump(ctx, table)
+	if err != nil {
+		return nil, false, err
+	}
+	defer reader.Close()
+
+	entries = make([]DumpEntry, 0, limit)
+	for idx := 0; idx <= skip+limit; idx++ {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			return entries, false, nil
+		} else if err != nil {
+			return nil, false, err
+		}
+
+		if idx == skip+limit {
+			return entries, true, nil
+		}
+		if idx >= skip {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, false, nil
+}
+
+// DumpDiff is a record that differs between two dumps of a table. `Before` is nil for records
+// that were inserted and `After` is nil for records that were removed.
+type DumpDiff struct {
+	Key    []byte
+	Before []byte
+	After  []byte
+}
+
+// DiffTable compares `table` as dumped by `before` and `after`, e.g: as of a checkpoint and the
+// latest data. Both dumps are in key order, which for WiredTiger's packed keys is byte order. At
+// most `limit` differences are returned, `more` is true when there are others.
+//
+// `before` is dumped into a temporary file first, such that only one `wt` runs at a time.
+// WiredTiger allows one process per home and both sides may be the same dbpath.
+func DiffTable(ctx context.Context, before, after WTHome, table string, limit int) (diffs []DumpDiff, more bool, err error) {
+	beforeReader, err := before.dumpToFile(ctx, table)
+	if err != nil {
+		return nil, false, err
+	}
+	defer beforeReader.Close()
+	afterReader, err := after.OpenDump(ctx, table)
+	if err != nil {
+		return nil, false, err
+	}
+	defer afterReader.Close()
+
+	// Returns nil after the last record.
+	next := func(reader *DumpReader) (*DumpEntry, error) {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		return &entry, nil
+	}
+
+	beforeEntry, err := next(beforeReader)
+	if err != nil {
+		return nil, false, err
+	}
+	afterEntry, err := next(afterReader)
+	if err != nil {
+		return nil, false, err
+	}
+	for beforeEntry != nil || afterEntry != nil {
+		var diff *DumpDiff
+		var compare int
+		switch {
+		case beforeEntry == nil:
+			compare = 1
+		case afterEntry == nil:
+			compare = -1
+		default:
+			compare = bytes.Compare(beforeEntry.Key, afterEntry.Key)
+		}
+
+		switch {
+		case compare < 0:
+			diff = &DumpDiff{Key: beforeEntry.Key, Before: beforeEntry.Value}
+			beforeEntry, err = next(beforeReader)
+		case compare > 0:
+			diff = &DumpDiff{Key: afterEntry.Key, After: afterEntry.Value}
+			afterEntry, err = next(afterReader)
+		default:
+			if !bytes.Equal(beforeEntry.Value, afterEntry.Value) {
+				diff = &DumpDiff{Key: beforeEntry.Key, Before: beforeEntry.Value, After: afterEntry.Value}
+			}
+			if beforeEntry, err = next(beforeReader); err == nil {
+				afterEntry, err = next(afterReader)
+			}
+		}
+		if err != nil {
+			return nil, false, err
+		}
+
+		if diff != nil {
+			if len(diffs) == limit {
+				return diffs, true, nil
+			}
+			diffs = append(diffs, *diff)
+		}
+	}
+
+	return diffs, false, nil
+}
+
+// ReadCatalog loads the `_mdb_catalog` of the dbpath.
+func (home WTHome) ReadCatalog() (*Catalog, error) {
+	entries, err := home.DumpTable("_mdb_catalog")
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &Catalog{
+		FileToCollection: make(map[string]*CollectionInfo),
+		FileToIndex:      make(map[string]*IndexInfo),
+		Collections:      make([]*CollectionInfo, 0),
+		Indexes:          make([]*IndexInfo, 0),
+	}
+	for _, entry := range entries {
+		var parsedFormat MdbCatalogFormat
+		if err := bson.Unmarshal(entry.Value, &parsedFormat); err != nil {
+			return nil, errors.Wrap(err, "Failed to parse a catalog entry")
+		}
+		ret.AddRow(&parsedFormat)
+	}
+
+	return ret, nil
+}
+
+// FindCollection returns the collection named `ns`, e.g: `local.system.replset`, or nil.
+func (catalog *Catalog) FindCollection(ns string) *CollectionInfo {
+	for _, collection := range catalog.Collections {
+		if collection.Name == ns {
+			return collection
+		}
+	}
+
+	return nil
+}
+
+// TableOwner names what MongoDB stores in a table: the namespace of a collection, or the namespace
+// and index name of an index. Both are empty for WiredTiger's own tables.
+func (catalog *Catalog) TableOwner(table string) (ns string, index string) {
+	if collInfo, found := catalog.FileToCollection[table]; found {
+		return collInfo.Name, ""
+	}
+	if indexInfo, found := catalog.FileToIndex[table]; found {
+		return indexInfo.Owner.Name, indexInfo.Name
+	}
+	return "", ""
+}
+
+// Run writes the diagnostics files. The journal, `wt list` and the `_mdb_catalog` are read one
+// after the other, then the journal is annotated, every table is verified and the history store is
+// decoded. Every subprocess is killed when `ctx` is done. The caller must not run other `wt`
+// processes against the dbpath meanwhile.
+func (wtDiag *WTDiagnostics) Run(ctx context.Context) (WTDiagnosticsResults, error) {
 	err := os.MkdirAll(wtDiag.OutputDir, 0750)
 	if err != nil {
 		return WTDiagnosticsResults{}, err
@@ -108,56 +602,112 @@ func (wtDiag *WTDiagnostics) Run() (WTDiagnosticsResults, error) {
 		CatalogFile:           wtDiag.OutputDir + "catalog",
 		AnnotatedCatalogFile:  wtDiag.OutputDir + "annotated_catalog",
 		AnnotatedPrintlogFile: wtDiag.OutputDir + "annotated_printlog",
+		TransactionsFile:      wtDiag.OutputDir + "transactions",
+		ConfigFile:            wtDiag.OutputDir + "config",
+		VerifyFile:            wtDiag.OutputDir + "verify",
+		HistoryStoreFile:      wtDiag.OutputDir + "history_store",
+		CheckpointListFile:    wtDiag.OutputDir + "checkpoint_list",
 	}
 
 	fmt.Printf("Writing diagnostic data. Dir: %s\n", ret.OutputDir)
 
-	printlogCmd := exec.Command(
-		"wt", "-C", "log=(compressor=snappy,path=journal),verbose=()", "-h", wtDiag.DBPath, "-r",
-		"printlog", "-u", "-x")
-	if err := RunCommand(printlogCmd, ret.PrintlogFile); err != nil {
-		return ret, errors.Wrap(err, "Failed to get the WT journal output")
+	home := NewWTHome(wtDiag.DBPath, wtDiag.Toolchain)
+	ret.Config = *home.Config
+	fmt.Printf("WiredTiger config. DBPath: %v Config: %v Sources: %v\n", wtDiag.DBPath, ret.Config, ret.Config.Sources)
+	if err := SaveWTConfig(ret.Config, ret.ConfigFile); err != nil {
+		return ret, errors.Wrap(err, "Failed to save the WT config")
 	}
-
-	listCmd := exec.Command(
-		"wt", "-C", "log=(compressor=snappy,path=journal),verbose=()", "-h", wtDiag.DBPath, "-r",
-		"list", "-v")
-	if err := RunCommand(listCmd, ret.ListFile); err != nil {
-		return ret, errors.Wrap(err, "Failed to get the WT list output")
+	if err := home.Check(); err != nil {
+		return ret, err
 	}
 
-	catalogCmd := exec.Command(
-		"wt", "-C", "log=(compressor=snappy,path=journal),verbose=()", "-h", wtDiag.DBPath, "-r",
-		"dump", "-x", "table:_mdb_catalog")
-	if err := RunCommand(catalogCmd, ret.CatalogFile); err != nil {
-		return ret, errors.Wrap(err, "Failed to get the MDB catalog output")
+	// WiredTiger allows one process per home, and `wt -r` runs recovery, which may remove journal
+	// files. The journal is read first, then each `wt` command runs on its own.
+	runWT := func(output string, failure string, args ...string) error {
+		err := RunCommand(home.CommandContext(ctx, args...), output)
+		if ctx.Err() != nil {
+			return errors.Wrap(ctx.Err(), "Diagnostics were cancelled")
+		}
+		return errors.Wrap(err, failure)
+	}
+	if err := WriteJournalPrintlog(ctx, home, ret.PrintlogFile); ctx.Err() != nil {
+		return ret, errors.Wrap(ctx.Err(), "Diagnostics were cancelled")
+	} else if err != nil {
+		// Reading the journal natively does not depend on a `wt` built for the data files'
+		// version. Compressors without a Go implementation still need `wt`.
+		fmt.Printf("Failed to read the journal, falling back to `wt printlog`. DBPath: %v Err: %v\n", wtDiag.DBPath, err)
+		if err := runWT(ret.PrintlogFile, "Failed to get the WT journal output", "printlog", "-u", "-x"); err != nil {
+			return ret, err
+		}
+	}
+	if err := runWT(ret.ListFile, "Failed to get the WT list output", "list", "-v"); err != nil {
+		return ret, err
+	}
+	if err := runWT(ret.CatalogFile, "Failed to get the MDB catalog output", "dump", "-x", "table:_mdb_catalog"); err != nil {
+		return ret, err
+	}
+	var checkpoints *UnrecoveredCheckpoints
+	if wtDiag.UnrecoveredDBPath != "" {
+		// Without the checkpoints fewer documents are rebuilt, the diagnostics are still useful.
+		checkpointHome := home.Unrecovered(wtDiag.UnrecoveredDBPath)
+		if err := RunCommand(checkpointHome.CommandContext(ctx, "list", "-v"), ret.CheckpointListFile); ctx.Err() != nil {
+			return ret, errors.Wrap(ctx.Err(), "Diagnostics were cancelled")
+		} else if err != nil {
+			fmt.Printf("Failed to list the unrecovered copy. DBPath: %v Err: %v\n", wtDiag.UnrecoveredDBPath, err)
+			os.Remove(ret.CheckpointListFile)
+		}
+		checkpoints = LoadUnrecoveredCheckpoints(checkpointHome, ret.CheckpointListFile)
 	}
 
 	catalogFile, err := os.Open(ret.CatalogFile)
 	if err != nil {
-		panic(err)
+		return ret, err
 	}
 	annotatedCatalogFile, err := os.Create(ret.AnnotatedCatalogFile)
 	if err != nil {
-		panic(err)
+		catalogFile.Close()
+		return ret, err
 	}
 	catalog := LoadCatalog(catalogFile, annotatedCatalogFile)
 
 	wtListFile, err := os.Open(ret.ListFile)
 	if err != nil {
-		panic(err)
+		return ret, err
 	}
 	wtList := LoadWTList(wtListFile)
 
 	printlogFile, err := os.Open(ret.PrintlogFile)
 	if err != nil {
-		panic(err)
+		return ret, err
 	}
 	annotatedPrintlogFile, err := os.Create(ret.AnnotatedPrintlogFile)
 	if err != nil {
-		panic(err)
+		printlogFile.Close()
+		return ret, err
+	}
+	txns, err := RewritePrintlog(ctx, printlogFile, annotatedPrintlogFile, catalog, wtList, checkpoints)
+	if err != nil {
+		return ret, errors.Wrap(err, "Failed to annotate the WT journal output")
+	}
+	if err := SaveTransactions(txns, ret.TransactionsFile); err != nil {
+		return ret, errors.Wrap(err, "Failed to save the transactions")
+	}
+
+	verifyResults, err := VerifyTables(ctx, home, catalog, wtList)
+	if err != nil {
+		return ret, err
+	}
+	if err := SaveVerifyResults(verifyResults, ret.VerifyFile); err != nil {
+		return ret, errors.Wrap(err, "Failed to save the verify results")
+	}
+
+	// A damaged history store is what the verify results are for. Its file is left out, the
+	// history store page will try again and show the error.
+	if err := WriteHistoryStore(ctx, home, catalog, wtList, ret.HistoryStoreFile); ctx.Err() != nil {
+		return ret, errors.Wrap(ctx.Err(), "Diagnostics were cancelled")
+	} else if err != nil {
+		fmt.Printf("Failed to decode the history store. DBPath: %v Err: %v\n", wtDiag.DBPath, err)
 	}
-	RewritePrintlog(printlogFile, annotatedPrintlogFile, catalog, wtList)
 
 	return ret, nil
 }
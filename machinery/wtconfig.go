@@ -0,0 +1,304 @@
+package machinery
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// WTConfig is the `wiredtiger_open` configuration `wt` needs for a dbpath. WiredTiger does not
+// record which compressor wrote the journal, opening with the wrong one fails recovery.
+type WTConfig struct {
+	LogEnabled bool
+	// Relative to the dbpath. MongoDB uses `journal`.
+	LogPath string
+	// `snappy`, `zstd` or `zlib`. Empty when the journal is not compressed.
+	LogCompressor string
+	// The encryptor, e.g: `AES256-CBC`. See `Check`.
+	EncryptionName  string
+	EncryptionKeyID string
+	// From `storage.bson`. Collections and indexes are in subdirectories of the dbpath.
+	DirectoryPerDB      bool
+	DirectoryForIndexes bool
+	// Where each setting came from, e.g: `log compressor zstd: journal records`.
+	Sources []string
+}
+
+// DefaultWTConfig is how `mongod` opens WiredTiger unless told otherwise.
+func DefaultWTConfig() WTConfig {
+	return WTConfig{LogEnabled: true, LogPath: "journal", LogCompressor: "snappy"}
+}
+
+// Check fails for dbpaths `wt` cannot open. MongoDB's encryptors are built into `mongod`, not
+// WiredTiger extensions `wt` could load, so `wt` cannot read encrypted data files.
+func (config WTConfig) Check() error {
+	if config.EncryptionName != "" && config.EncryptionName != "none" {
+		return fmt.Errorf("The dbpath is encrypted, `wt` cannot open it. Encryption: %v KeyID: %v. "+
+			"Start a mongod with the same key, e.g: `--enableEncryption --encryptionKeyFile`, and "+
+			"upload a copy synced without encryption instead", config.EncryptionName, config.EncryptionKeyID)
+	}
+	return nil
+}
+
+// String returns the config for `wt -C`, e.g: `log=(enabled=true,path=journal,compressor=snappy),verbose=()`.
+// Encryption is left out, see `Check`.
+func (config WTConfig) String() string {
+	var log string
+	switch {
+	case !config.LogEnabled:
+		log = "log=(enabled=false)"
+	case config.LogCompressor == "":
+		log = fmt.Sprintf("log=(enabled=true,path=%s)", config.LogPath)
+	default:
+		log = fmt.Sprintf("log=(enabled=true,path=%s,compressor=%s)", config.LogPath, config.LogCompressor)
+	}
+
+	return log + ",verbose=()"
+}
+
+// JournalDir returns the directory of the dbpath's `WiredTigerLog.*` files.
+func (config WTConfig) JournalDir(dbpath string) string {
+	return filepath.Join(dbpath, config.LogPath)
+}
+
+func (config *WTConfig) addSource(format string, args ...interface{}) {
+	config.Sources = append(config.Sources, fmt.Sprintf(format, args...))
+}
+
+// parseWTConfigString splits a WiredTiger config string, e.g: `log=(enabled=true,path=journal),
+// verbose=()`, into its top level keys. Nested values keep their parentheses.
+func parseWTConfigString(config string) map[string]string {
+	ret := make(map[string]string)
+	depth := 0
+	inString := false
+	start := 0
+	addPair := func(pair string) {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+		if key != "" {
+			ret[strings.TrimSpace(key)] = strings.Trim(strings.TrimSpace(value), "\"")
+		}
+	}
+	for idx, char := range config {
+		switch {
+		case char == '"':
+			inString = !inString
+		case inString:
+		case char == '(' || char == '[':
+			depth++
+		case char == ')' || char == ']':
+			depth--
+		case char == ',' && depth == 0:
+			addPair(config[start:idx])
+			start = idx + 1
+		}
+	}
+	addPair(config[start:])
+
+	return ret
+}
+
+// wtConfigGroup returns the settings of a nested value, e.g: `(enabled=true,path=journal)`.
+func wtConfigGroup(value string) map[string]string {
+	return parseWTConfigString(strings.TrimSuffix(strings.TrimPrefix(value, "("), ")"))
+}
+
+// applyBaseConfig reads the settings `wiredtiger_open` was first called with. Older WiredTiger
+// versions record all of them in `WiredTiger.basecfg`, newer versions only the version.
+func (config *WTConfig) applyBaseConfig(dbpath string) {
+	contents, err := os.ReadFile(filepath.Join(dbpath, "WiredTiger.basecfg"))
+	if err != nil {
+		return
+	}
+
+	for _, line := range strings.Split(string(contents), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		settings := parseWTConfigString(line)
+		if log, exists := settings["log"]; exists {
+			logSettings := wtConfigGroup(log)
+			if enabled, exists := logSettings["enabled"]; exists {
+				config.LogEnabled = enabled == "true" || enabled == "1"
+				config.addSource("log enabled %v: WiredTiger.basecfg", config.LogEnabled)
+			}
+			if path, exists := logSettings["path"]; exists {
+				config.LogPath = path
+				config.addSource("log path %q: WiredTiger.basecfg", path)
+			}
+			if compressor, exists := logSettings["compressor"]; exists {
+				config.LogCompressor = strings.TrimPrefix(compressor, "none")
+				config.addSource("log compressor %q: WiredTiger.basecfg", config.LogCompressor)
+			}
+		}
+		if encryption, exists := settings["encryption"]; exists {
+			config.applyEncryption(wtConfigGroup(encryption), "WiredTiger.basecfg")
+		}
+	}
+}
+
+func (config *WTConfig) applyEncryption(settings map[string]string, source string) {
+	if name := settings["name"]; name != "" && name != "none" {
+		config.EncryptionName = name
+		config.EncryptionKeyID = settings["keyid"]
+		config.addSource("encryption %v: %v", name, source)
+	}
+}
+
+// applyTurtle reads the encryption of the metadata table, which is the connection's encryption.
+// The turtle file alternates key and value lines.
+func (config *WTConfig) applyTurtle(dbpath string) {
+	contents, err := os.ReadFile(filepath.Join(dbpath, "WiredTiger.turtle"))
+	if err != nil {
+		return
+	}
+
+	lines := strings.Split(string(contents), "\n")
+	for idx := 0; idx+1 < len(lines); idx++ {
+		if lines[idx] != "file:WiredTiger.wt" {
+			continue
+		}
+		if encryption, exists := parseWTConfigString(lines[idx+1])["encryption"]; exists {
+			config.applyEncryption(wtConfigGroup(encryption), "WiredTiger.turtle")
+		}
+	}
+}
+
+// applyStorageBSON reads the `storage.bson` MongoDB writes into every dbpath, e.g:
+// `{storage: {engine: "wiredTiger", options: {directoryPerDB: true, directoryForIndexes: false}}}`.
+func (config *WTConfig) applyStorageBSON(dbpath string) error {
+	contents, err := os.ReadFile(filepath.Join(dbpath, "storage.bson"))
+	if err != nil {
+		return nil
+	}
+
+	var storage struct {
+		Storage struct {
+			Engine  string
+			Options struct {
+				DirectoryPerDB      bool `bson:"directoryPerDB"`
+				DirectoryForIndexes bool `bson:"directoryForIndexes"`
+			}
+		}
+	}
+	if err := bson.Unmarshal(contents, &storage); err != nil {
+		fmt.Printf("Ignoring a malformed storage.bson. DBPath: %v Err: %v\n", dbpath, err)
+		return nil
+	}
+	if storage.Storage.Engine != "" && storage.Storage.Engine != "wiredTiger" {
+		return fmt.Errorf("Not a WiredTiger dbpath. Engine: %v", storage.Storage.Engine)
+	}
+
+	config.DirectoryPerDB = storage.Storage.Options.DirectoryPerDB
+	config.DirectoryForIndexes = storage.Storage.Options.DirectoryForIndexes
+	if config.DirectoryPerDB || config.DirectoryForIndexes {
+		config.addSource("directoryPerDB %v directoryForIndexes %v: storage.bson", config.DirectoryPerDB, config.DirectoryForIndexes)
+	}
+	return nil
+}
+
+// The most journal records read looking for a compressed one.
+const configDetectRecords = 1000
+
+// applyJournalFiles finds where the journal is and how it is compressed from the log files
+// themselves. They override any configuration, the files are what `wt` has to read.
+func (config *WTConfig) applyJournalFiles(dbpath string) {
+	logPath := ""
+	for _, candidate := range []string{config.LogPath, "journal", "."} {
+		if files, _ := JournalFiles(filepath.Join(dbpath, candidate)); len(files) > 0 {
+			logPath = candidate
+			break
+		}
+	}
+	if logPath == "" {
+		// Without log files there is nothing to recover, so any log config opens the dbpath.
+		if config.LogEnabled {
+			config.addSource("no journal files found")
+		}
+		return
+	}
+	if logPath != config.LogPath {
+		config.LogPath = logPath
+		config.addSource("log path %q: journal files", logPath)
+	}
+	if !config.LogEnabled {
+		config.LogEnabled = true
+		config.addSource("log enabled true: journal files")
+	}
+
+	reader, err := OpenJournal(config.JournalDir(dbpath))
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+
+	// Small records are never compressed, so an uncompressed record says nothing about the
+	// compressor.
+	for idx := 0; idx < configDetectRecords && reader.fileIdx < len(reader.files); idx++ {
+		if reader.file == nil {
+			if err := reader.openFile(reader.files[reader.fileIdx]); err != nil {
+				return
+			}
+		}
+		raw, err := reader.readRaw()
+		if err != nil {
+			reader.closeFile()
+			reader.fileIdx++
+			continue
+		}
+		reader.offset += int64(len(raw))
+
+		flags := raw[8]
+		if flags&logRecordEncrypted != 0 && config.EncryptionName == "" {
+			config.addSource("encrypted journal records, but no encryptor is configured")
+			return
+		}
+		if flags&logRecordCompressed != 0 && flags&logRecordEncrypted == 0 {
+			config.LogCompressor = detectLogCompressor(raw[logRecordHeaderSize:])
+			config.addSource("log compressor %v: journal records", config.LogCompressor)
+			return
+		}
+	}
+}
+
+// DetectWTConfig works out the configuration for opening a dbpath with `wt`. Starting from
+// MongoDB's defaults, it applies `WiredTiger.basecfg`, `WiredTiger.turtle`, `storage.bson` and
+// the journal files present, in that order.
+func DetectWTConfig(dbpath string) (WTConfig, error) {
+	ret := DefaultWTConfig()
+	ret.applyBaseConfig(dbpath)
+	ret.applyTurtle(dbpath)
+	if err := ret.applyStorageBSON(dbpath); err != nil {
+		return ret, err
+	}
+	ret.applyJournalFiles(dbpath)
+
+	return ret, nil
+}
+
+// SaveWTConfig records a detected config next to the diagnostics output that was made with it.
+func SaveWTConfig(config WTConfig, configFile string) error {
+	contents, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(configFile, contents, 0644)
+}
+
+// LoadWTConfig reads a config saved by SaveWTConfig.
+func LoadWTConfig(configFile string) (WTConfig, error) {
+	contents, err := os.ReadFile(configFile)
+	if err != nil {
+		return WTConfig{}, err
+	}
+
+	var ret WTConfig
+	if err := json.Unmarshal(contents, &ret); err != nil {
+		return WTConfig{}, errors.Wrap(err, fmt.Sprintf("Malformed WiredTiger config. File: %v", configFile))
+	}
+	return ret, nil
+}
@@ -0,0 +1,160 @@
+package machinery
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// WiredTiger packs integers such that their byte order matches their numeric order. The first
+// byte says how the value is encoded:
+//
+//	[00 01llll] llll bytes follow, a large negative value
+//	[00 1xxxxx] 1 byte follows, a 13 bit negative value
+//	[01 xxxxxx] a 6 bit negative value
+//	[10 xxxxxx] a 6 bit positive value
+//	[11 0xxxxx] 1 byte follows, a 13 bit positive value
+//	[11 10llll] llll bytes follow, a large positive value
+const (
+	wtNegMultiMarker = 0x10
+	wtNeg2ByteMarker = 0x20
+	wtNeg1ByteMarker = 0x40
+	wtPos1ByteMarker = 0x80
+	wtPos2ByteMarker = 0xc0
+	wtPosMultiMarker = 0xe0
+
+	wtNeg1ByteMin = -(1 << 6)
+	wtNeg2ByteMin = -(1 << 13) + wtNeg1ByteMin
+	wtPos1ByteMax = (1 << 6) - 1
+	wtPos2ByteMax = (1 << 13) + wtPos1ByteMax
+)
+
+// wtUnpacker reads values packed with a WiredTiger format string, e.g: `IIIuu`. The first error
+// is kept and every later read returns a zero value.
+type wtUnpacker struct {
+	buf []byte
+	pos int
+	err error
+}
+
+func (unpacker *wtUnpacker) fail(format string, args ...interface{}) {
+	if unpacker.err == nil {
+		unpacker.err = fmt.Errorf(format+" Offset: %v", append(args, unpacker.pos)...)
+	}
+}
+
+func (unpacker *wtUnpacker) done() bool {
+	return unpacker.err != nil || unpacker.pos >= len(unpacker.buf)
+}
+
+// bigEndian reads `length` bytes as a big endian number.
+func (unpacker *wtUnpacker) bigEndian(length int) uint64 {
+	if length > 8 || unpacker.pos+length > len(unpacker.buf) {
+		unpacker.fail("Packed integer is too long. Length: %v", length)
+		return 0
+	}
+
+	var ret uint64
+	for _, byt := range unpacker.buf[unpacker.pos : unpacker.pos+length] {
+		ret = ret<<8 | uint64(byt)
+	}
+	unpacker.pos += length
+	return ret
+}
+
+// Uint reads an `I`, `Q` or `r` value.
+func (unpacker *wtUnpacker) Uint() uint64 {
+	if unpacker.done() {
+		unpacker.fail("Expected a packed integer.")
+		return 0
+	}
+
+	marker := unpacker.buf[unpacker.pos]
+	switch marker & 0xf0 {
+	case wtPos1ByteMarker, wtPos1ByteMarker | 0x10, wtPos1ByteMarker | 0x20, wtPos1ByteMarker | 0x30:
+		unpacker.pos++
+		return uint64(marker & 0x3f)
+	case wtPos2ByteMarker, wtPos2ByteMarker | 0x10:
+		unpacker.pos++
+		return (uint64(marker&0x1f)<<8 | unpacker.bigEndian(1)) + wtPos1ByteMax + 1
+	case wtPosMultiMarker:
+		unpacker.pos++
+		return unpacker.bigEndian(int(marker&0x0f)) + wtPos2ByteMax + 1
+	}
+
+	unpacker.fail("Not a packed unsigned integer. Marker: %#x", marker)
+	return 0
+}
+
+// Int reads an `i` or `q` value.
+func (unpacker *wtUnpacker) Int() int64 {
+	if unpacker.done() {
+		unpacker.fail("Expected a packed integer.")
+		return 0
+	}
+
+	marker := unpacker.buf[unpacker.pos]
+	switch marker & 0xf0 {
+	case wtNegMultiMarker:
+		unpacker.pos++
+		length := 8 - int(marker&0x0f)
+		// The leading 0xff bytes are not stored.
+		ret := ^uint64(0)
+		for idx := 0; idx < length; idx++ {
+			ret = ret<<8 | unpacker.bigEndian(1)
+		}
+		return int64(ret)
+	case wtNeg2ByteMarker, wtNeg2ByteMarker | 0x10:
+		unpacker.pos++
+		return int64(uint64(marker&0x1f)<<8|unpacker.bigEndian(1)) + wtNeg2ByteMin
+	case wtNeg1ByteMarker, wtNeg1ByteMarker | 0x10, wtNeg1ByteMarker | 0x20, wtNeg1ByteMarker | 0x30:
+		unpacker.pos++
+		return int64(marker&0x3f) + wtNeg1ByteMin
+	}
+
+	return int64(unpacker.Uint())
+}
+
+// Item reads a `U` value, or a `u` that is not the last in its format: a packed length followed
+// by that many bytes.
+func (unpacker *wtUnpacker) Item() []byte {
+	length := unpacker.Uint()
+	if unpacker.err != nil {
+		return nil
+	}
+	if length > uint64(len(unpacker.buf)-unpacker.pos) {
+		unpacker.fail("Packed item is too long. Length: %v", length)
+		return nil
+	}
+
+	ret := unpacker.buf[unpacker.pos : unpacker.pos+int(length)]
+	unpacker.pos += int(length)
+	return ret
+}
+
+// Rest reads a `u` that is last in its format. It has no length and takes the remaining bytes.
+func (unpacker *wtUnpacker) Rest() []byte {
+	if unpacker.err != nil {
+		return nil
+	}
+
+	ret := unpacker.buf[unpacker.pos:]
+	unpacker.pos = len(unpacker.buf)
+	return ret
+}
+
+// String reads an `S` value, a NUL terminated string.
+func (unpacker *wtUnpacker) String() string {
+	if unpacker.err != nil {
+		return ""
+	}
+
+	length := bytes.IndexByte(unpacker.buf[unpacker.pos:], 0)
+	if length == -1 {
+		unpacker.fail("Packed string is not terminated.")
+		return ""
+	}
+
+	ret := string(unpacker.buf[unpacker.pos : unpacker.pos+length])
+	unpacker.pos += length + 1
+	return ret
+}
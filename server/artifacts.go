@@ -2,15 +2,19 @@ package server
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"html/template"
 	"io"
 	"io/fs"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -25,6 +29,14 @@ func loadTemplates() {
 		"server/templates/task_download.html",
 		"server/templates/404.html",
 		"server/templates/task_view.html",
+		"server/templates/task_download_status.html",
+		"server/templates/cache.html",
+		"server/templates/task_upload.html",
+		"server/templates/logs.html",
+		"server/templates/table.html",
+		"server/templates/checkpoints.html",
+		"server/templates/history.html",
+		"server/templates/transactions.html",
 		// "server/templates/printlog.html",
 	); err != nil {
 		panic(err)
@@ -108,27 +120,74 @@ func (artifacts *Artifacts) FromLogicalPath(logicalPath string) ArtifactPath {
 type DBInfo struct {
 	DBPath     ArtifactPath
 	WtDiagPath ArtifactPath
+	// The file name of the data archive the dbpath was extracted from.
+	Archive string
+	// The name of the toolchain whose binaries open the dbpath and the WiredTiger version that
+	// last wrote it. See toolchain.go.
+	Toolchain string
+	WTVersion string
 }
 
 type TaskState struct {
-	Name   string
+	Task   machinery.TaskRef
 	DBInfo []DBInfo
 	// DownloadDir ArtifactPath
 	DownloadDir string
+
+	// Guarded by the `Artifacts` mutex. `LastAccess` is persisted as the MANIFEST's mtime.
+	LastAccess time.Time
+	// The number of requests currently reading the task's files. Pinned tasks are never evicted.
+	pins int
+	// Guarded by the `Artifacts` mutex. The WiredTiger config of each dbpath, by logical path.
+	wtConfigs map[string]machinery.WTConfig
+	// The archive entries that were not extracted, e.g: symlinks out of the archive. Persisted in
+	// the SKIPPED file next to the MANIFEST.
+	Skipped []string
+
+	topologyMutex sync.Mutex
+	// Guarded by `topologyMutex`. The last topology that could not be read completely, and when.
+	incompleteTopology   *machinery.Topology
+	incompleteTopologyAt time.Time
+}
+
+// The first line of a MANIFEST file is formatted as `taskId execution`.
+func writeManifestTask(manifestFile *os.File, task machinery.TaskRef) {
+	manifestFile.WriteString(fmt.Sprintf("%s %d\n", task.ID, task.Execution))
+}
+
+// A MANIFEST written before executions were tracked only contains the task id. Those tasks are
+// treated as the first execution.
+func parseManifestTask(line string) (machinery.TaskRef, error) {
+	taskId, execution, _ := strings.Cut(line, " ")
+	if execution == "" {
+		return machinery.TaskRef{ID: taskId}, nil
+	}
+	return machinery.ParseTaskRef(taskId, execution)
 }
 
-func CreateNewManifestFile(downloadDir, taskName string, dbpaths []string) error {
+// Every following line describes one dbpath and is formatted as `dbpath key=value...`. The
+// values must not contain spaces.
+func writeManifestDBPath(manifestFile *os.File, dbpath string, attributes ...string) {
+	manifestFile.WriteString(dbpath)
+	for idx := 0; idx < len(attributes); idx += 2 {
+		if len(attributes[idx+1]) == 0 {
+			continue
+		}
+		manifestFile.WriteString(fmt.Sprintf(" %s=%s", attributes[idx], attributes[idx+1]))
+	}
+	manifestFile.WriteString("\n")
+}
+
+func CreateNewManifestFile(downloadDir string, task machinery.TaskRef, dbpaths []machinery.ArchivedDBPath) error {
 	manifestFile, err := os.Create(downloadDir + "MANIFEST")
 	if err != nil {
 		return err
 	}
 	defer manifestFile.Close()
 
-	manifestFile.WriteString(taskName)
-	manifestFile.WriteString("\n")
+	writeManifestTask(manifestFile, task)
 	for _, dbpath := range dbpaths {
-		manifestFile.WriteString(dbpath)
-		manifestFile.WriteString("\n")
+		writeManifestDBPath(manifestFile, dbpath.DBPath, "archive", dbpath.Archive)
 	}
 
 	return nil
@@ -141,20 +200,41 @@ func CreateManifestFile(taskState *TaskState) error {
 	}
 	defer manifestFile.Close()
 
-	manifestFile.WriteString(taskState.Name)
-	manifestFile.WriteString("\n")
+	writeManifestTask(manifestFile, taskState.Task)
 	for _, dbinfo := range taskState.DBInfo {
-		manifestFile.WriteString(dbinfo.DBPath.LogicalPath)
-		if len(dbinfo.WtDiagPath.LogicalPath) > 0 {
-			manifestFile.WriteString(" ")
-			manifestFile.WriteString(dbinfo.WtDiagPath.LogicalPath)
-		}
-		manifestFile.WriteString("\n")
+		writeManifestDBPath(manifestFile, dbinfo.DBPath.LogicalPath,
+			"archive", dbinfo.Archive,
+			"wtDiag", dbinfo.WtDiagPath.LogicalPath,
+			"toolchain", dbinfo.Toolchain,
+			"wtVersion", dbinfo.WTVersion)
 	}
 
 	return nil
 }
 
+// The SKIPPED file lists one skipped archive entry per line. Tasks without skipped entries have
+// none.
+func writeSkippedFile(taskState *TaskState) error {
+	if len(taskState.Skipped) == 0 {
+		return nil
+	}
+
+	contents := &strings.Builder{}
+	for _, skipped := range taskState.Skipped {
+		contents.WriteString(strings.ReplaceAll(skipped, "\n", " "))
+		contents.WriteString("\n")
+	}
+	return os.WriteFile(taskState.DownloadDir+"SKIPPED", []byte(contents.String()), 0644)
+}
+
+func readSkippedFile(taskState *TaskState) {
+	contents, err := os.ReadFile(taskState.DownloadDir + "SKIPPED")
+	if err != nil {
+		return
+	}
+	taskState.Skipped = strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+}
+
 func (artifacts *Artifacts) LoadManifestFile(manifestPath string) (*TaskState, error) {
 	absManifestPath, err := filepath.Abs(manifestPath)
 	if err != nil {
@@ -172,24 +252,48 @@ func (artifacts *Artifacts) LoadManifestFile(manifestPath string) (*TaskState, e
 	}
 	defer manifestFile.Close()
 
+	if info, err := manifestFile.Stat(); err == nil {
+		taskState.LastAccess = info.ModTime()
+	}
+
 	scanner := bufio.NewScanner(manifestFile)
 	scanner.Split(bufio.ScanLines)
 
 	scanner.Scan()
-	taskState.Name = scanner.Text()
+	if taskState.Task, err = parseManifestTask(scanner.Text()); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Malformed manifest file. Path: %v", manifestPath))
+	}
 	for scanner.Scan() {
-		// The input string here may be formatted as `dbpath` or `dbpath wtDiagPath`:
-		//   A string formatted as only `dbpath` should return `("dbpath", "")`.
-		//   A string formatted as `dbpath wtDiagPath` should return `("dbpath", "wtDiagPath")`.
-		dbpath, wtDiagPath, _ := strings.Cut(scanner.Text(), " ")
+		// The input string here is formatted as `dbpath key=value...`. Older MANIFEST files
+		// may instead be formatted as `dbpath wtDiagPath`.
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
 		toAdd := DBInfo{
-			DBPath: taskState.GetArtifactPath(dbpath),
+			DBPath: taskState.GetArtifactPath(fields[0]),
 		}
-		if len(wtDiagPath) > 0 {
-			toAdd.WtDiagPath = taskState.GetArtifactPath(wtDiagPath)
+		for _, field := range fields[1:] {
+			key, value, found := strings.Cut(field, "=")
+			if !found {
+				key, value = "wtDiag", field
+			}
+
+			switch key {
+			case "wtDiag":
+				toAdd.WtDiagPath = taskState.GetArtifactPath(value)
+			case "archive":
+				toAdd.Archive = value
+			case "toolchain":
+				toAdd.Toolchain = value
+			case "wtVersion":
+				toAdd.WTVersion = value
+			}
 		}
 		taskState.DBInfo = append(taskState.DBInfo, toAdd)
 	}
+	readSkippedFile(taskState)
 
 	return taskState, nil
 }
@@ -228,13 +332,38 @@ func (taskState *TaskState) FullDBPath(dbpath string) string {
 	return taskState.DownloadDir + dbpath
 }
 
+func (taskState *TaskState) FindDBInfo(logicalDBPath string) *DBInfo {
+	for idx := range taskState.DBInfo {
+		if taskState.DBInfo[idx].DBPath.LogicalPath == logicalDBPath {
+			return &taskState.DBInfo[idx]
+		}
+	}
+
+	return nil
+}
+
 type Artifacts struct {
 	absolutePath string
-	tasksCache   map[string]*TaskState
+	source       machinery.ArtifactSource
+	logSource    machinery.LogSource
+	toolchains   *machinery.ToolchainRegistry
+	tasksCache   map[machinery.TaskRef]*TaskState
+	// Guarded by the same mutex as `tasksCache` such that checking the cache and starting a
+	// download happen atomically.
+	downloads *DownloadJobs
+	// Also guarded by the mutex, such that checking for diagnostics and starting them happen
+	// atomically.
+	diagnostics *DiagnosticsJobs
+	// Eviction bookkeeping. See eviction.go.
+	cachePolicy      CachePolicy
+	evictions        []EvictedTask
+	pendingEvictions sync.WaitGroup
 	sync.Mutex
 }
 
-func LoadArtifacts(artifactsDir string) (*Artifacts, error) {
+// LoadArtifacts indexes the tasks already downloaded into `artifactsDir`. New tasks are
+// downloaded from `source`.
+func LoadArtifacts(artifactsDir string, source machinery.ArtifactSource) (*Artifacts, error) {
 	if err := os.MkdirAll(artifactsDir, 0755); err != nil {
 		return nil, errors.Wrap(err, "Failed to create artifacts repository directory")
 	}
@@ -246,8 +375,12 @@ func LoadArtifacts(artifactsDir string) (*Artifacts, error) {
 
 	ret := &Artifacts{
 		absolutePath: absolutePath,
-		tasksCache:   make(map[string]*TaskState),
+		source:       source,
+		tasksCache:   make(map[machinery.TaskRef]*TaskState),
+		downloads:    NewDownloadJobs(maxConcurrentDownloads),
+		diagnostics:  NewDiagnosticsJobs(maxConcurrentDiagnostics),
 	}
+	ret.logSource = machinery.LogSourceOf(source)
 
 	filepath.WalkDir(artifactsDir, func(path string, dir fs.DirEntry, err error) error {
 		if dir.Name() != "MANIFEST" {
@@ -260,7 +393,7 @@ func LoadArtifacts(artifactsDir string) (*Artifacts, error) {
 		}
 
 		// fmt.Printf("TaskState: %+v\n", taskState)
-		ret.tasksCache[taskState.Name] = taskState
+		ret.tasksCache[taskState.Task] = taskState
 		return nil
 	})
 
@@ -269,10 +402,44 @@ func LoadArtifacts(artifactsDir string) (*Artifacts, error) {
 }
 
 func (artifacts *Artifacts) DownloadFromURL(taskUrl string) (*TaskState, error) {
-	return artifacts.DownloadTask(machinery.GetTaskFromUrl(taskUrl))
+	task, err := machinery.GetTaskFromUrl(taskUrl)
+	if err != nil {
+		return nil, err
+	}
+	if task, err = artifacts.ResolveExecution(task); err != nil {
+		return nil, err
+	}
+
+	return artifacts.EnsureEvgArtifacts(task)
 }
 
-func (artifacts *Artifacts) DownloadTask(taskName string) (*TaskState, error) {
+// ResolveExecution replaces `machinery.LatestExecution` with the number of the task's latest
+// execution. Sources that cannot tell fall back to the latest cached execution, and otherwise to
+// the first one.
+func (artifacts *Artifacts) ResolveExecution(task machinery.TaskRef) (machinery.TaskRef, error) {
+	if task.Execution != machinery.LatestExecution {
+		return task, nil
+	}
+
+	if source, ok := artifacts.source.(machinery.LatestExecutionSource); ok {
+		latest, err := source.LatestExecution(task.ID)
+		if err != nil {
+			return task, errors.Wrap(err, fmt.Sprintf("Failed to find the latest execution. Task: %v", task.ID))
+		}
+		task.Execution = latest
+		return task, nil
+	}
+
+	task.Execution = 0
+	if cached := artifacts.CachedExecutions(task.ID); len(cached) > 0 {
+		task.Execution = cached[len(cached)-1]
+	}
+	return task, nil
+}
+
+// DownloadTask fetches the task into a new `taskid_*` directory. The caller is responsible for
+// adding the result to the `tasksCache`. Use `StartDownload` or `EnsureEvgArtifacts` instead.
+func (artifacts *Artifacts) DownloadTask(task machinery.TaskRef, progress machinery.FetchProgress) (_ *TaskState, err error) {
 	downloadDir, err := os.MkdirTemp(artifacts.absolutePath, "taskid_")
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to create directory for task artifacts")
@@ -281,77 +448,180 @@ func (artifacts *Artifacts) DownloadTask(taskName string) (*TaskState, error) {
 		downloadDir = downloadDir + "/"
 	}
 
-	dbpaths := machinery.FetchArtifactsForTask(taskName, downloadDir)
-	if err = CreateNewManifestFile(downloadDir, taskName, dbpaths); err != nil {
+	// The fetch machinery panics on errors. A failed download must neither take down the server
+	// nor leave a partial task directory behind.
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			os.RemoveAll(downloadDir)
+			err = fmt.Errorf("Failed to download task. Task: %v Err: %v", task, recovered)
+		}
+	}()
+
+	dbpaths, skipped := machinery.FetchArtifactsForTask(artifacts.source, task, downloadDir, progress)
+	// Logs help, but the data files are what matter. A task without logs is still usable.
+	if artifacts.logSource != nil {
+		if err := artifacts.FetchLogs(task, downloadDir); err != nil {
+			fmt.Printf("Failed to fetch logs. Task: %v Err: %v\n", task, err)
+		}
+	}
+	taskState := NewTaskState(task, downloadDir, dbpaths, skipped)
+	artifacts.resolveToolchains(taskState)
+	markUnrecovered(taskState)
+	if err = writeSkippedFile(taskState); err != nil {
+		panic(err)
+	}
+	// The MANIFEST marks the task as complete. Write it last.
+	if err = CreateManifestFile(taskState); err != nil {
 		panic(err)
 	}
 
+	return taskState, nil
+}
+
+// The checkpoints of each dbpath are read from a copy in this directory of the task, taken before
+// any `wt` ran recovery. See `machinery.CopyUnrecovered`.
+const unrecoveredDir = "unrecovered/"
+
+// A `.pending` file next to where the copy goes marks a dbpath no `wt` has run against yet.
+const unrecoveredPendingSuffix = ".pending"
+
+// markUnrecovered marks every dbpath of a freshly extracted task as not yet recovered. The copies
+// are taken by `saveUnrecoveredCopy`, before the first `wt` runs against each dbpath, such that
+// fetching a task does not wait on copying every dbpath.
+func markUnrecovered(taskState *TaskState) {
+	for _, dbinfo := range taskState.DBInfo {
+		marker := taskState.DownloadDir + unrecoveredDir + dbinfo.DBPath.LogicalPath + unrecoveredPendingSuffix
+		err := os.MkdirAll(filepath.Dir(marker), 0755)
+		if err == nil {
+			err = os.WriteFile(marker, nil, 0644)
+		}
+		if err != nil {
+			fmt.Printf("Failed to mark the dbpath as not recovered. DBPath: %v Err: %v\n", dbinfo.DBPath.LogicalPath, err)
+		}
+	}
+}
+
+// saveUnrecoveredCopy copies a dbpath marked by `markUnrecovered`. Must be called holding the
+// dbpath's lock before running `wt`, see `runWT`. A cancelled copy is taken again by the next run.
+// A dbpath that could not be copied is still browsed, only not as of its checkpoints.
+func saveUnrecoveredCopy(ctx context.Context, taskState *TaskState, dbpath ArtifactPath) error {
+	target := taskState.DownloadDir + unrecoveredDir + dbpath.LogicalPath
+	marker := target + unrecoveredPendingSuffix
+	if _, err := os.Stat(marker); err != nil {
+		return nil
+	}
+
+	// A copy the server was stopped in the middle of is taken again.
+	os.RemoveAll(target)
+	if err := machinery.CopyUnrecovered(ctx, dbpath.PhysicalPath, target); err != nil {
+		os.RemoveAll(target)
+		if ctx.Err() != nil {
+			return errors.Wrap(ctx.Err(), fmt.Sprintf("Cancelled while copying the dbpath. DBPath: %v", dbpath.LogicalPath))
+		}
+		fmt.Printf("Failed to copy the dbpath before recovery. DBPath: %v Err: %v\n", dbpath.LogicalPath, err)
+	}
+	return os.Remove(marker)
+}
+
+// UnrecoveredPath returns the copy of the dbpath taken before recovery, or an empty string for
+// tasks fetched before copies were taken and dbpaths that could not be copied. A dbpath still
+// marked by `markUnrecovered` is copied by `runWT` before any `wt` reads the copy.
+func (taskState *TaskState) UnrecoveredPath(dbpath ArtifactPath) string {
+	path := taskState.DownloadDir + unrecoveredDir + dbpath.LogicalPath
+	if _, err := os.Stat(path + unrecoveredPendingSuffix); err == nil {
+		return path
+	}
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// NewTaskState describes a freshly extracted task. The caller is responsible for writing its
+// MANIFEST.
+func NewTaskState(task machinery.TaskRef, downloadDir string, dbpaths []machinery.ArchivedDBPath, skipped []machinery.SkippedEntry) *TaskState {
 	ret := &TaskState{
-		Name:        taskName,
+		Task:        task,
 		DownloadDir: downloadDir,
+		LastAccess:  time.Now(),
+	}
+	for _, entry := range skipped {
+		ret.Skipped = append(ret.Skipped, entry.Describe())
 	}
 	dbinfos := make([]DBInfo, len(dbpaths))
 	for idx, path := range dbpaths {
 		// fmt.Println("\tHaveDBPath:", path)
 		dbinfos[idx] = DBInfo{
-			DBPath:     ret.GetArtifactPath(path),
+			DBPath:     ret.GetArtifactPath(path.DBPath),
 			WtDiagPath: ArtifactPath{},
+			Archive:    path.Archive,
 		}
 	}
 	ret.DBInfo = dbinfos
 	// fmt.Printf("Downloaded.\n\tDownloadPath: %v\n\tDBPaths: %v\n\tDBInfos: %v\n", downloadDir, dbpaths, dbinfos)
-	artifacts.Lock()
-	artifacts.tasksCache[taskName] = ret
-	artifacts.Unlock()
-	return ret, nil
+	return ret
 }
 
-func (artifacts *Artifacts) EnsureEvgArtifacts(taskName string) (*TaskState, error) {
-	artifacts.Lock()
-	taskState, exists := artifacts.tasksCache[taskName]
-	artifacts.Unlock()
-	if exists {
+// EnsureEvgArtifacts returns the cached task, downloading it first if necessary. Concurrent
+// callers for the same task share one download.
+func (artifacts *Artifacts) EnsureEvgArtifacts(task machinery.TaskRef) (*TaskState, error) {
+	taskState, job := artifacts.StartDownload(task)
+	if taskState != nil {
 		return taskState, nil
 	}
 
-	return artifacts.DownloadTask(taskName)
+	return job.Wait()
 }
 
-func (artifacts *Artifacts) EnsureWTDiag(taskState *TaskState, dbpath ArtifactPath) (machinery.WTDiagnosticsResults, error) {
-	if outputDir := GetWtDiagPath(taskState, dbpath); outputDir != "" {
-		// Returns the `wtDiagPath/printlog` file.
-		ret := machinery.WTDiagnosticsResults{
-			OutputDir:             outputDir,
-			PrintlogFile:          outputDir + "printlog",
-			ListFile:              outputDir + "list",
-			CatalogFile:           outputDir + "catalog",
-			AnnotatedCatalogFile:  outputDir + "annotated_catalog",
-			AnnotatedPrintlogFile: outputDir + "annotated_printlog",
+// CachedExecutions returns the executions of a task id that have already been downloaded, in
+// ascending order.
+func (artifacts *Artifacts) CachedExecutions(taskId string) []int {
+	artifacts.Lock()
+	defer artifacts.Unlock()
+
+	ret := make([]int, 0)
+	for task := range artifacts.tasksCache {
+		if task.ID == taskId {
+			ret = append(ret, task.Execution)
 		}
-		return ret, nil
 	}
+	sort.Ints(ret)
 
-	systemWtDiagPath, err := os.MkdirTemp(taskState.DownloadDir, "wtDiag_")
-	if err != nil {
-		return machinery.WTDiagnosticsResults{}, errors.Wrap(err, "Failed to create a WT diagnostics directory")
-	}
-	if !strings.HasSuffix(systemWtDiagPath, "/") {
-		systemWtDiagPath = systemWtDiagPath + "/"
-	}
+	return ret
+}
 
-	wtDiagCmd := machinery.NewWTDiagnostics(dbpath.PhysicalPath, systemWtDiagPath)
-	diagResults, err := wtDiagCmd.Run()
-	if err != nil {
-		panic(err)
+// EnsureWTDiag returns the dbpath's diagnostics, making them if needed. It gives up when `ctx` is
+// done. Diagnostics nobody is waiting for anymore are cancelled.
+func (artifacts *Artifacts) EnsureWTDiag(ctx context.Context, taskState *TaskState, dbpath ArtifactPath) (machinery.WTDiagnosticsResults, error) {
+	artifacts.Lock()
+	outputDir := GetWtDiagPath(taskState, dbpath)
+	if outputDir == "" {
+		job := artifacts.startDiagnostics(taskState, dbpath)
+		artifacts.Unlock()
+		return artifacts.waitDiagnostics(ctx, job)
 	}
+	artifacts.Unlock()
 
-	// Also modifies TaskState to reflect `wtDiagDir`.
-	if err := AddWtDiagToManifestFile(
-		taskState, dbpath, taskState.GetArtifactPathFromSystemPath(systemWtDiagPath)); err != nil {
-		panic(err)
+	// Returns the `wtDiagPath/printlog` file.
+	ret := machinery.WTDiagnosticsResults{
+		OutputDir:             outputDir,
+		PrintlogFile:          outputDir + "printlog",
+		ListFile:              outputDir + "list",
+		CatalogFile:           outputDir + "catalog",
+		AnnotatedCatalogFile:  outputDir + "annotated_catalog",
+		AnnotatedPrintlogFile: outputDir + "annotated_printlog",
+		TransactionsFile:      outputDir + "transactions",
+		ConfigFile:            outputDir + "config",
+		VerifyFile:            outputDir + "verify",
+		HistoryStoreFile:      outputDir + "history_store",
+		CheckpointListFile:    outputDir + "checkpoint_list",
 	}
-
-	return diagResults, nil
+	// Diagnostics made before the config was recorded used MongoDB's defaults.
+	var err error
+	if ret.Config, err = machinery.LoadWTConfig(ret.ConfigFile); err != nil {
+		ret.Config = machinery.DefaultWTConfig()
+	}
+	return ret, nil
 }
 
 func (artifacts *Artifacts) AddHandlers(handlers *http.ServeMux) {
@@ -362,6 +632,14 @@ func (artifacts *Artifacts) AddHandlers(handlers *http.ServeMux) {
 	handlers.HandleFunc("/fancy_printlog", artifacts.HandleFancyPrintlog)
 	handlers.HandleFunc("/catalog", artifacts.HandleCatalog)
 	handlers.HandleFunc("/list", artifacts.HandleList)
+	handlers.HandleFunc("/table", artifacts.HandleTable)
+	handlers.HandleFunc("/verify", artifacts.HandleVerify)
+	handlers.HandleFunc("/checkpoints", artifacts.HandleCheckpoints)
+	handlers.HandleFunc("/history", artifacts.HandleHistory)
+	handlers.HandleFunc("/transactions", artifacts.HandleTransactions)
+	handlers.HandleFunc("/cache", artifacts.HandleCache)
+	handlers.HandleFunc("/upload", artifacts.HandleUpload)
+	handlers.HandleFunc("/logs", artifacts.HandleLogs)
 }
 
 func handle404(resp http.ResponseWriter, req *http.Request) {
@@ -388,18 +666,94 @@ func (artifacts *Artifacts) HandleTaskDownload(resp http.ResponseWriter, req *ht
 	}
 }
 
+type TaskViewDBPath struct {
+	DBPath    string
+	Archive   string
+	Toolchain string
+	WTVersion string
+	Node      *machinery.TopologyNode
+	// Whether the dbpath's diagnostics include `wt verify` results.
+	Verified       bool
+	VerifyPassed   int
+	VerifyFailures []machinery.VerifyResult
+}
+
+// loadVerifyResults summarizes the dbpath's `wt verify` results, if its diagnostics were made.
+// Diagnostics made before verifying was added have no results.
+func (viewDBPath *TaskViewDBPath) loadVerifyResults(taskState *TaskState, dbpath ArtifactPath) {
+	outputDir := GetWtDiagPath(taskState, dbpath)
+	if outputDir == "" {
+		return
+	}
+	results, err := machinery.LoadVerifyResults(outputDir + "verify")
+	if err != nil {
+		return
+	}
+
+	viewDBPath.Verified = true
+	for _, result := range results {
+		if result.Passed {
+			viewDBPath.VerifyPassed++
+		} else {
+			viewDBPath.VerifyFailures = append(viewDBPath.VerifyFailures, result)
+		}
+	}
+}
+
+type TaskViewReplicaSet struct {
+	*machinery.TopologyReplicaSet
+	DBPaths []TaskViewDBPath
+}
+
+type TaskViewCluster struct {
+	Name        string
+	Sharded     bool
+	ReplicaSets []TaskViewReplicaSet
+}
+
 type TaskViewArgs struct {
-	Name    string
-	DBPaths []string
+	Task machinery.TaskRef
+	// The mongo git revision the task tested, if known.
+	Revision string
+	DBPaths  []TaskViewDBPath
+	// The same dbpaths grouped by cluster and replica set.
+	Clusters []TaskViewCluster
+	// Executions of the same task id that are already downloaded.
+	CachedExecutions []int
+	// The archive entries that were not extracted.
+	Skipped []string
 }
 
-func NewTaskViewArgs(taskState *TaskState) *TaskViewArgs {
+func NewTaskViewArgs(taskState *TaskState, topology *machinery.Topology, cachedExecutions []int) *TaskViewArgs {
 	ret := &TaskViewArgs{
-		Name: taskState.Name,
+		Task:             taskState.Task,
+		Revision:         machinery.TaskRevision(taskState.Task),
+		CachedExecutions: cachedExecutions,
+		Skipped:          taskState.Skipped,
 	}
 
+	newViewDBPath := func(logicalDBPath string, node *machinery.TopologyNode) TaskViewDBPath {
+		ret := TaskViewDBPath{DBPath: logicalDBPath, Node: node}
+		if dbinfo := taskState.FindDBInfo(logicalDBPath); dbinfo != nil {
+			ret.Archive, ret.Toolchain, ret.WTVersion = dbinfo.Archive, dbinfo.Toolchain, dbinfo.WTVersion
+			ret.loadVerifyResults(taskState, dbinfo.DBPath)
+		}
+		return ret
+	}
 	for _, dbinfo := range taskState.DBInfo {
-		ret.DBPaths = append(ret.DBPaths, dbinfo.DBPath.LogicalPath)
+		ret.DBPaths = append(ret.DBPaths, newViewDBPath(dbinfo.DBPath.LogicalPath, nil))
+	}
+
+	for _, cluster := range topology.Clusters {
+		viewCluster := TaskViewCluster{Name: cluster.Name, Sharded: cluster.Sharded}
+		for _, set := range cluster.ReplicaSets {
+			viewSet := TaskViewReplicaSet{TopologyReplicaSet: set}
+			for _, node := range set.Nodes {
+				viewSet.DBPaths = append(viewSet.DBPaths, newViewDBPath(node.DBPath, node))
+			}
+			viewCluster.ReplicaSets = append(viewCluster.ReplicaSets, viewSet)
+		}
+		ret.Clusters = append(ret.Clusters, viewCluster)
 	}
 
 	return ret
@@ -413,19 +767,51 @@ func (artifacts *Artifacts) HandleTaskView(resp http.ResponseWriter, req *http.R
 		handle404(resp, req)
 		return
 	}
-	taskName := taskNameForm[0]
+	taskName := strings.TrimSpace(taskNameForm[0])
 
+	// Without an execution, either in the url or the form, the task view shows the latest one.
+	var task machinery.TaskRef
+	var err error
 	if strings.HasPrefix(taskName, "http://") || strings.HasPrefix(taskName, "https://") {
-		taskName = machinery.GetTaskFromUrl(taskName)
+		task, err = machinery.GetTaskFromUrl(taskName)
+		// An explicitly requested execution takes precedence over the one in the url.
+		if err == nil && req.Form.Get("execution") != "" {
+			task, err = machinery.ParseTaskRef(task.ID, req.Form.Get("execution"))
+		}
+	} else {
+		task, err = machinery.ParseTaskRef(taskName, req.Form.Get("execution"))
+	}
+	if err == nil {
+		task, err = artifacts.ResolveExecution(task)
 	}
-
-	taskState, err := artifacts.EnsureEvgArtifacts(taskName)
-	_ = taskState
 	if err != nil {
-		panic(err)
+		fmt.Println("Task view arg parsing error:", err)
+		handle404(resp, req)
+		return
+	}
+
+	// Uploaded tasks cannot be downloaded again once evicted.
+	if IsUploadedTask(task) && len(artifacts.CachedExecutions(task.ID)) == 0 {
+		handle404(resp, req)
+		return
 	}
 
-	if err := artifactTemplates.ExecuteTemplate(resp, "task_view.html", NewTaskViewArgs(taskState)); err != nil {
+	// Downloads take minutes. Show the progress of the download until the task is cached. The
+	// status page refreshes itself.
+	taskState, job := artifacts.StartDownload(task)
+	if taskState == nil {
+		if err := artifactTemplates.ExecuteTemplate(resp, "task_download_status.html", job.Status()); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	artifacts.Pin(taskState)
+	defer artifacts.Unpin(taskState)
+
+	topology := artifacts.EnsureTopology(req.Context(), taskState)
+	viewArgs := NewTaskViewArgs(taskState, topology, artifacts.CachedExecutions(task.ID))
+	if err := artifactTemplates.ExecuteTemplate(resp, "task_view.html", viewArgs); err != nil {
 		panic(err)
 	}
 }
@@ -446,6 +832,42 @@ func GetFormValues(resp http.ResponseWriter, req *http.Request, keys ...string)
 	return ret, nil
 }
 
+// GetTaskState looks up the task named by the `task` and `execution` form values. Without an
+// `execution` it is the latest one. When the task has not been downloaded, the response is
+// redirected to the task view and `nil` is returned.
+//
+// The returned task is pinned such that it cannot be evicted. The caller must `Unpin` it.
+func (artifacts *Artifacts) GetTaskState(resp http.ResponseWriter, req *http.Request, taskId string) *TaskState {
+	task, err := machinery.ParseTaskRef(taskId, req.Form.Get("execution"))
+	if err == nil {
+		task, err = artifacts.ResolveExecution(task)
+	}
+	if err != nil {
+		fmt.Println("Task arg parsing error:", err)
+		handle404(resp, req)
+		return nil
+	}
+
+	artifacts.Lock()
+	taskState, exists := artifacts.tasksCache[task]
+	if exists {
+		taskState.pins++
+		artifacts.touch(taskState)
+	}
+	artifacts.Unlock()
+	if !exists {
+		resp.Header().Add("Location", TaskViewUrl(task))
+		resp.WriteHeader(302)
+		return nil
+	}
+
+	return taskState
+}
+
+func TaskViewUrl(task machinery.TaskRef) string {
+	return fmt.Sprintf("/task_view?task=%s&execution=%d", url.QueryEscape(task.ID), task.Execution)
+}
+
 func (artifacts *Artifacts) HandlePrintlog(resp http.ResponseWriter, req *http.Request) {
 	loadTemplates()
 	args, err := GetFormValues(resp, req, "task", "dbpath")
@@ -455,14 +877,11 @@ func (artifacts *Artifacts) HandlePrintlog(resp http.ResponseWriter, req *http.R
 	}
 
 	taskName, logicalDBPath := args["task"], args["dbpath"]
-	artifacts.Lock()
-	taskState, exists := artifacts.tasksCache[taskName]
-	artifacts.Unlock()
-	if !exists {
-		resp.Header().Add("Location", fmt.Sprintf("/task_view?task=%s", taskName))
-		resp.WriteHeader(302)
+	taskState := artifacts.GetTaskState(resp, req, taskName)
+	if taskState == nil {
 		return
 	}
+	defer artifacts.Unpin(taskState)
 
 	dbpath, err := taskState.FindArtifactPath(logicalDBPath)
 	if err != nil {
@@ -470,9 +889,10 @@ func (artifacts *Artifacts) HandlePrintlog(resp http.ResponseWriter, req *http.R
 	}
 	// fmt.Println("Found DBPath:", dbpath)
 
-	wtDiagRes, err := artifacts.EnsureWTDiag(taskState, dbpath)
+	wtDiagRes, err := artifacts.EnsureWTDiag(req.Context(), taskState, dbpath)
 	if err != nil {
-		panic(err)
+		handleWTDiagError(resp, req, err)
+		return
 	}
 	// fmt.Println("Found PrintlogFileName:", printlogFilename)
 
@@ -494,14 +914,11 @@ func (artifacts *Artifacts) HandleCatalog(resp http.ResponseWriter, req *http.Re
 	}
 
 	taskName, logicalDBPath := args["task"], args["dbpath"]
-	artifacts.Lock()
-	taskState, exists := artifacts.tasksCache[taskName]
-	artifacts.Unlock()
-	if !exists {
-		resp.Header().Add("Location", fmt.Sprintf("/task_view?task=%s", taskName))
-		resp.WriteHeader(302)
+	taskState := artifacts.GetTaskState(resp, req, taskName)
+	if taskState == nil {
 		return
 	}
+	defer artifacts.Unpin(taskState)
 
 	dbpath, err := taskState.FindArtifactPath(logicalDBPath)
 	if err != nil {
@@ -509,9 +926,10 @@ func (artifacts *Artifacts) HandleCatalog(resp http.ResponseWriter, req *http.Re
 	}
 	// fmt.Println("Found DBPath:", dbpath)
 
-	wtDiagRes, err := artifacts.EnsureWTDiag(taskState, dbpath)
+	wtDiagRes, err := artifacts.EnsureWTDiag(req.Context(), taskState, dbpath)
 	if err != nil {
-		panic(err)
+		handleWTDiagError(resp, req, err)
+		return
 	}
 
 	fmt.Println(wtDiagRes.CatalogFile)
@@ -534,14 +952,11 @@ func (artifacts *Artifacts) HandleList(resp http.ResponseWriter, req *http.Reque
 	}
 
 	taskName, logicalDBPath := args["task"], args["dbpath"]
-	artifacts.Lock()
-	taskState, exists := artifacts.tasksCache[taskName]
-	artifacts.Unlock()
-	if !exists {
-		resp.Header().Add("Location", fmt.Sprintf("/task_view?task=%s", taskName))
-		resp.WriteHeader(302)
+	taskState := artifacts.GetTaskState(resp, req, taskName)
+	if taskState == nil {
 		return
 	}
+	defer artifacts.Unpin(taskState)
 
 	dbpath, err := taskState.FindArtifactPath(logicalDBPath)
 	if err != nil {
@@ -549,9 +964,10 @@ func (artifacts *Artifacts) HandleList(resp http.ResponseWriter, req *http.Reque
 	}
 	// fmt.Println("Found DBPath:", dbpath)
 
-	wtDiagRes, err := artifacts.EnsureWTDiag(taskState, dbpath)
+	wtDiagRes, err := artifacts.EnsureWTDiag(req.Context(), taskState, dbpath)
 	if err != nil {
-		panic(err)
+		handleWTDiagError(resp, req, err)
+		return
 	}
 
 	listFile, err := os.Open(wtDiagRes.ListFile)
@@ -563,6 +979,76 @@ func (artifacts *Artifacts) HandleList(resp http.ResponseWriter, req *http.Reque
 	io.Copy(resp, listFile)
 }
 
+// ensureVerified runs `wt verify` on the tables of existing diagnostics made before verifying was
+// added. It runs as a diagnostics job, such that it holds the dbpath's lock and is cancelled once
+// nobody waits for it.
+func (artifacts *Artifacts) ensureVerified(ctx context.Context, taskState *TaskState, dbpath ArtifactPath, wtDiagRes machinery.WTDiagnosticsResults) error {
+	if _, err := os.Stat(wtDiagRes.VerifyFile); err == nil {
+		return nil
+	}
+
+	artifacts.Lock()
+	job := artifacts.startDiagnosticsJob(taskState, dbpath, "verify", func(ctx context.Context) (machinery.WTDiagnosticsResults, error) {
+		return wtDiagRes, artifacts.verifyDBPath(ctx, taskState, dbpath.LogicalPath, wtDiagRes)
+	})
+	artifacts.Unlock()
+	_, err := artifacts.waitDiagnostics(ctx, job)
+	return err
+}
+
+// verifyDBPath runs `wt verify` on the tables of existing diagnostics.
+func (artifacts *Artifacts) verifyDBPath(ctx context.Context, taskState *TaskState, logicalDBPath string, wtDiagRes machinery.WTDiagnosticsResults) error {
+	catalog, err := machinery.LoadCatalogFile(wtDiagRes.CatalogFile)
+	if err != nil {
+		return err
+	}
+	listFile, err := os.Open(wtDiagRes.ListFile)
+	if err != nil {
+		return err
+	}
+	results, err := machinery.VerifyTables(ctx, artifacts.WTHome(taskState, logicalDBPath), catalog, machinery.LoadWTList(listFile))
+	if err != nil {
+		return err
+	}
+	return machinery.SaveVerifyResults(results, wtDiagRes.VerifyFile)
+}
+
+// HandleVerify makes the dbpath's diagnostics, which verify every table, then returns to the task
+// page where the results are shown.
+func (artifacts *Artifacts) HandleVerify(resp http.ResponseWriter, req *http.Request) {
+	loadTemplates()
+	args, err := GetFormValues(resp, req, "task", "dbpath")
+	if err != nil {
+		fmt.Println("Verify arg parsing error:", err)
+		return
+	}
+
+	taskName, logicalDBPath := args["task"], args["dbpath"]
+	taskState := artifacts.GetTaskState(resp, req, taskName)
+	if taskState == nil {
+		return
+	}
+	defer artifacts.Unpin(taskState)
+
+	dbpath, err := taskState.FindArtifactPath(logicalDBPath)
+	if err != nil {
+		panic(err)
+	}
+
+	wtDiagRes, err := artifacts.EnsureWTDiag(req.Context(), taskState, dbpath)
+	if err != nil {
+		handleWTDiagError(resp, req, err)
+		return
+	}
+	// Diagnostics made before verifying was added are verified now.
+	if err := artifacts.ensureVerified(req.Context(), taskState, dbpath, wtDiagRes); err != nil {
+		handleWTDiagError(resp, req, err)
+		return
+	}
+
+	http.Redirect(resp, req, TaskViewUrl(taskState.Task), http.StatusSeeOther)
+}
+
 func (artifacts *Artifacts) HandleFancyPrintlog(resp http.ResponseWriter, req *http.Request) {
 	loadTemplates()
 	args, err := GetFormValues(resp, req, "task", "dbpath")
@@ -572,14 +1058,11 @@ func (artifacts *Artifacts) HandleFancyPrintlog(resp http.ResponseWriter, req *h
 	}
 
 	taskName, logicalDBPath := args["task"], args["dbpath"]
-	artifacts.Lock()
-	taskState, exists := artifacts.tasksCache[taskName]
-	artifacts.Unlock()
-	if !exists {
-		resp.Header().Add("Location", fmt.Sprintf("/task_view?task=%s", taskName))
-		resp.WriteHeader(302)
+	taskState := artifacts.GetTaskState(resp, req, taskName)
+	if taskState == nil {
 		return
 	}
+	defer artifacts.Unpin(taskState)
 
 	dbpath, err := taskState.FindArtifactPath(logicalDBPath)
 	if err != nil {
@@ -587,9 +1070,10 @@ func (artifacts *Artifacts) HandleFancyPrintlog(resp http.ResponseWriter, req *h
 	}
 	// fmt.Println("Found DBPath:", dbpath)
 
-	wtDiagRes, err := artifacts.EnsureWTDiag(taskState, dbpath)
+	wtDiagRes, err := artifacts.EnsureWTDiag(req.Context(), taskState, dbpath)
 	if err != nil {
-		panic(err)
+		handleWTDiagError(resp, req, err)
+		return
 	}
 	// fmt.Println("Found PrintlogFileName:", printlogFilename)
 
@@ -1,8 +1,18 @@
 package server
 
 import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
+
+	"bfserver/machinery"
 )
 
 func assertEquals(tst *testing.T, expected, actual interface{}) {
@@ -25,7 +35,7 @@ func TestManifestRoundtrip(tst *testing.T) {
 
 	// `testfiles` is the repository root. MANIFEST files should not be aware of the physical
 	// `testfiles` location.
-	artifacts, err := LoadArtifacts("./testfiles/")
+	artifacts, err := LoadArtifacts("./testfiles/", nil)
 	if err != nil {
 		panic(err)
 	}
@@ -37,7 +47,11 @@ func TestManifestRoundtrip(tst *testing.T) {
 	//     - evg/
 	//       - dbpath1/<db files>
 	//       - dbpath2/<db files>
-	if err := CreateNewManifestFile("./testfiles/task_123/", "taskName", []string{"evg/dbpath1", "evg/dbpath2"}); err != nil {
+	task := machinery.TaskRef{ID: "taskName", Execution: 1}
+	if err := CreateNewManifestFile("./testfiles/task_123/", task, []machinery.ArchivedDBPath{
+		{DBPath: "evg/dbpath1", Archive: "mongo-data-1.tgz"},
+		{DBPath: "evg/dbpath2", Archive: "mongo-data-2.tgz"},
+	}); err != nil {
 		panic(err)
 	}
 
@@ -46,10 +60,11 @@ func TestManifestRoundtrip(tst *testing.T) {
 		panic(err)
 	}
 
-	assertEquals(tst, "taskName", state.Name)
+	assertEquals(tst, task, state.Task)
 	assertEquals(tst, 2, len(state.DBInfo))
 	assertEquals(tst, "evg/dbpath1", state.DBInfo[0].DBPath.LogicalPath)
 	assertEquals(tst, "evg/dbpath2", state.DBInfo[1].DBPath.LogicalPath)
+	assertEquals(tst, "mongo-data-2.tgz", state.DBInfo[1].Archive)
 
 	// This call represents the following directory structure rooted at `testfiles`:
 	// - testfiles/
@@ -73,4 +88,474 @@ func TestManifestRoundtrip(tst *testing.T) {
 	// Loading fresh sees a set `WtDiagPath`.
 	assertEquals(tst, ArtifactPath{}, state.DBInfo[0].WtDiagPath)
 	assertEquals(tst, "wtDiag_456", state.DBInfo[1].WtDiagPath.LogicalPath)
+	assertEquals(tst, "mongo-data-1.tgz", state.DBInfo[0].Archive)
+	assertEquals(tst, "mongo-data-2.tgz", state.DBInfo[1].Archive)
+}
+
+func TestLegacyManifest(tst *testing.T) {
+	if err := os.RemoveAll("./testfiles/"); err != nil {
+		panic(err)
+	}
+	if err := os.MkdirAll("./testfiles/task_123", 0755); err != nil {
+		panic(err)
+	}
+
+	artifacts, err := LoadArtifacts("./testfiles/", nil)
+	if err != nil {
+		panic(err)
+	}
+
+	// MANIFEST files written before executions were tracked only name the task id. They also
+	// list the WT diagnostics directory without a key.
+	if err := os.WriteFile("./testfiles/task_123/MANIFEST", []byte("taskName\nevg/dbpath1 wtDiag_456\n"), 0644); err != nil {
+		panic(err)
+	}
+
+	state, err := artifacts.LoadManifestFile("./testfiles/task_123/MANIFEST")
+	if err != nil {
+		panic(err)
+	}
+
+	assertEquals(tst, machinery.TaskRef{ID: "taskName", Execution: 0}, state.Task)
+	assertEquals(tst, 1, len(state.DBInfo))
+	assertEquals(tst, "evg/dbpath1", state.DBInfo[0].DBPath.LogicalPath)
+	assertEquals(tst, "wtDiag_456", state.DBInfo[0].WtDiagPath.LogicalPath)
+}
+
+// writeDataArchive creates a `.tgz` at `archivePath` holding a file for each entry of `files`.
+func writeDataArchive(archivePath string, files map[string]string) {
+	archiveFile, err := os.Create(archivePath)
+	if err != nil {
+		panic(err)
+	}
+	defer archiveFile.Close()
+
+	gzWriter := gzip.NewWriter(archiveFile)
+	defer gzWriter.Close()
+	tarWriter := tar.NewWriter(gzWriter)
+	defer tarWriter.Close()
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Like `tar` itself, write an entry for each directory before the files it contains.
+	writtenDirs := make(map[string]bool)
+	for _, name := range names {
+		contents := files[name]
+		dirs := make([]string, 0)
+		for dir := filepath.Dir(name); dir != "."; dir = filepath.Dir(dir) {
+			dirs = append([]string{dir}, dirs...)
+		}
+		for _, dir := range dirs {
+			if writtenDirs[dir] {
+				continue
+			}
+			writtenDirs[dir] = true
+			if err := tarWriter.WriteHeader(&tar.Header{Name: dir + "/", Mode: 0755, Typeflag: tar.TypeDir}); err != nil {
+				panic(err)
+			}
+		}
+
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(contents)), Typeflag: tar.TypeReg}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			panic(err)
+		}
+		if _, err := tarWriter.Write([]byte(contents)); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// fakeSource serves a synthetic data archive instead of running the `evergreen` cli.
+type fakeSource struct {
+	// Archive file name -> archive contents.
+	archives  map[string]map[string]string
+	requested []machinery.TaskRef
+	// When non-nil, fetching blocks until the channel is closed.
+	gate chan struct{}
+}
+
+func (source *fakeSource) FetchDataArchives(
+	task machinery.TaskRef, target string, progress machinery.FetchProgress) ([]string, error) {
+	source.requested = append(source.requested, task)
+	if source.gate != nil {
+		<-source.gate
+	}
+
+	ret := make([]string, 0)
+	for name, files := range source.archives {
+		archivePath := filepath.Join(target, name)
+		writeDataArchive(archivePath, files)
+		ret = append(ret, archivePath)
+	}
+	sort.Strings(ret)
+
+	return ret, nil
+}
+
+func TestDownloadTaskFromSource(tst *testing.T) {
+	if err := os.RemoveAll("./testfiles/"); err != nil {
+		panic(err)
+	}
+
+	// Both archives contain the same relative paths. Each must be extracted into its own
+	// directory.
+	source := &fakeSource{archives: map[string]map[string]string{
+		"mongo-data-job0.tgz": {
+			"data/db/job0/resmoke/node0/WiredTiger":    "WiredTiger\n",
+			"data/db/job0/resmoke/node0/WiredTiger.wt": "",
+			// Skipped, and listed on the task page.
+			"../outside": "",
+		},
+		"mongo-data-job0-retry.tgz": {
+			"data/db/job0/resmoke/node0/WiredTiger":    "WiredTiger\n",
+			"data/db/job0/resmoke/node0/WiredTiger.wt": "",
+		},
+	}}
+	artifacts, err := LoadArtifacts("./testfiles/", source)
+	if err != nil {
+		panic(err)
+	}
+
+	task := machinery.TaskRef{ID: "fakeTask", Execution: 1}
+	state, err := artifacts.EnsureEvgArtifacts(task)
+	if err != nil {
+		panic(err)
+	}
+	assertEquals(tst, 2, len(state.DBInfo))
+	assertEquals(tst, "dbpath/mongo-data-job0-retry/data/db/job0/resmoke/node0", state.DBInfo[0].DBPath.LogicalPath)
+	assertEquals(tst, "mongo-data-job0-retry.tgz", state.DBInfo[0].Archive)
+	assertEquals(tst, "dbpath/mongo-data-job0/data/db/job0/resmoke/node0", state.DBInfo[1].DBPath.LogicalPath)
+	assertEquals(tst, "mongo-data-job0.tgz", state.DBInfo[1].Archive)
+	// The archive also has an entry for the `../` directory.
+	assertEquals(tst, 2, len(state.Skipped))
+	if !strings.HasPrefix(state.Skipped[1], "mongo-data-job0.tgz: ../outside: ") {
+		tst.Fatalf("Unexpected skipped entry. Skipped: %v", state.Skipped[1])
+	}
+	// Checkpoints are read from a copy taken before the first `wt` runs recovery.
+	unrecovered := state.UnrecoveredPath(state.DBInfo[1].DBPath)
+	if _, err := os.Stat(unrecovered + "/WiredTiger.wt"); err == nil {
+		tst.Fatalf("Expected the dbpath to be copied by the first `wt` run, not the download")
+	}
+	if err := artifacts.runWT(context.Background(), state, state.DBInfo[1].DBPath, func() error { return nil }); err != nil {
+		panic(err)
+	}
+	assertEquals(tst, unrecovered, state.UnrecoveredPath(state.DBInfo[1].DBPath))
+	if _, err := os.Stat(unrecovered + "/WiredTiger.wt"); err != nil {
+		tst.Fatalf("Expected a copy of the dbpath. Err: %v", err)
+	}
+
+	// A second request is served from the cache.
+	if _, err = artifacts.EnsureEvgArtifacts(task); err != nil {
+		panic(err)
+	}
+	assertEquals(tst, 1, len(source.requested))
+	assertEquals(tst, task, source.requested[0])
+
+	// Reloading the repository finds the task through its MANIFEST.
+	artifacts, err = LoadArtifacts("./testfiles/", source)
+	if err != nil {
+		panic(err)
+	}
+	assertEquals(tst, 1, len(artifacts.CachedExecutions("fakeTask")))
+	assertEquals(tst, "mongo-data-job0-retry.tgz", artifacts.tasksCache[task].DBInfo[0].Archive)
+	assertEquals(tst, fmt.Sprintf("%q", state.Skipped), fmt.Sprintf("%q", artifacts.tasksCache[task].Skipped))
+}
+
+func TestResolveLatestExecution(tst *testing.T) {
+	if err := os.RemoveAll("./testfiles/"); err != nil {
+		panic(err)
+	}
+
+	for _, dir := range []string{"./testfiles/src/fakeTask/0", "./testfiles/src/fakeTask/2"} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			panic(err)
+		}
+	}
+	artifacts, err := LoadArtifacts("./testfiles/cache/", machinery.LocalDirSource{Dir: "./testfiles/src"})
+	if err != nil {
+		panic(err)
+	}
+
+	task, err := artifacts.ResolveExecution(machinery.TaskRef{ID: "fakeTask", Execution: machinery.LatestExecution})
+	if err != nil {
+		panic(err)
+	}
+	assertEquals(tst, machinery.TaskRef{ID: "fakeTask", Execution: 2}, task)
+
+	// An explicit execution is kept.
+	task, err = artifacts.ResolveExecution(machinery.TaskRef{ID: "fakeTask", Execution: 0})
+	if err != nil {
+		panic(err)
+	}
+	assertEquals(tst, machinery.TaskRef{ID: "fakeTask", Execution: 0}, task)
+
+	// A source that cannot tell falls back to the first execution.
+	artifacts.source = &fakeSource{}
+	task, err = artifacts.ResolveExecution(machinery.TaskRef{ID: "fakeTask", Execution: machinery.LatestExecution})
+	if err != nil {
+		panic(err)
+	}
+	assertEquals(tst, machinery.TaskRef{ID: "fakeTask", Execution: 0}, task)
+}
+
+func TestConcurrentDownloadsAreDeduplicated(tst *testing.T) {
+	if err := os.RemoveAll("./testfiles/"); err != nil {
+		panic(err)
+	}
+
+	source := &fakeSource{
+		archives: map[string]map[string]string{
+			"mongo-data-job0.tgz": {"data/db/job0/resmoke/node0/WiredTiger": "WiredTiger\n"},
+		},
+		gate: make(chan struct{}),
+	}
+	artifacts, err := LoadArtifacts("./testfiles/", source)
+	if err != nil {
+		panic(err)
+	}
+
+	task := machinery.TaskRef{ID: "fakeTask", Execution: 0}
+	state, firstJob := artifacts.StartDownload(task)
+	if state != nil {
+		tst.Fatalf("Expected the task to not be cached")
+	}
+	_, secondJob := artifacts.StartDownload(task)
+	assertEquals(tst, firstJob, secondJob)
+
+	close(source.gate)
+	state, err = firstJob.Wait()
+	if err != nil {
+		panic(err)
+	}
+	assertEquals(tst, DownloadDone, firstJob.Status().State)
+	assertEquals(tst, 1, len(source.requested))
+
+	// The finished download is now served from the cache.
+	cachedState, job := artifacts.StartDownload(task)
+	assertEquals(tst, state, cachedState)
+	if job != nil {
+		tst.Fatalf("Expected no download job for a cached task")
+	}
+}
+
+// `wt` runs against the same dbpath wait for each other. Different dbpaths do not.
+func TestRunWTLocksDBPath(tst *testing.T) {
+	artifacts := &Artifacts{diagnostics: NewDiagnosticsJobs(2)}
+	taskState := &TaskState{DownloadDir: tst.TempDir() + "/"}
+	first, second := ArtifactPath{PhysicalPath: "/first"}, ArtifactPath{PhysicalPath: "/second"}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- artifacts.runWT(context.Background(), taskState, first, func() error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+
+	if err := artifacts.runWT(context.Background(), taskState, second, func() error { return nil }); err != nil {
+		tst.Fatalf("Expected another dbpath to run. Err: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	ran := false
+	if err := artifacts.runWT(ctx, taskState, first, func() error { ran = true; return nil }); err == nil || ran {
+		tst.Fatalf("Expected the busy dbpath to be waited on. Err: %v", err)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		panic(err)
+	}
+	if err := artifacts.runWT(context.Background(), taskState, first, func() error { ran = true; return nil }); err != nil || !ran {
+		tst.Fatalf("Expected the dbpath to be free again. Err: %v", err)
+	}
+}
+
+func TestAbandonedDiagnosticsAreCancelled(tst *testing.T) {
+	if err := os.RemoveAll("./testfiles/"); err != nil {
+		panic(err)
+	}
+
+	source := &fakeSource{archives: map[string]map[string]string{
+		"mongo-data-job0.tgz": {"data/db/job0/resmoke/node0/WiredTiger": "WiredTiger\n"},
+	}}
+	artifacts, err := LoadArtifacts("./testfiles/", source)
+	if err != nil {
+		panic(err)
+	}
+	state, err := artifacts.EnsureEvgArtifacts(machinery.TaskRef{ID: "fakeTask", Execution: 0})
+	if err != nil {
+		panic(err)
+	}
+
+	// A `wt` that never finishes.
+	toolchainDir, err := filepath.Abs("./testfiles/toolchains/sleeping")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.MkdirAll(toolchainDir+"/bin", 0755); err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(toolchainDir+"/bin/wt", []byte("#!/bin/sh\nexec sleep 60\n"), 0755); err != nil {
+		panic(err)
+	}
+	artifacts.toolchains = &machinery.ToolchainRegistry{Toolchains: []*machinery.Toolchain{{Name: "sleeping", Dir: toolchainDir}}}
+	state.DBInfo[0].Toolchain = "sleeping"
+
+	// Both requests wait on the same run. It is only cancelled once both give up.
+	dbpath := state.DBInfo[0].DBPath
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	secondCtx, cancelSecond := context.WithCancel(context.Background())
+	errs := make(chan error, 2)
+	for _, ctx := range []context.Context{firstCtx, secondCtx} {
+		go func(ctx context.Context) {
+			_, err := artifacts.EnsureWTDiag(ctx, state, dbpath)
+			errs <- err
+		}(ctx)
+	}
+
+	var job *DiagnosticsJob
+	for job == nil || job.waiters < 2 {
+		time.Sleep(10 * time.Millisecond)
+		artifacts.Lock()
+		job = artifacts.diagnostics.jobs[(&DiagnosticsJob{DBPath: dbpath, Kind: "diagnostics"}).key()]
+		artifacts.Unlock()
+	}
+	cancelFirst()
+	assertEquals(tst, context.Canceled, <-errs)
+	select {
+	case <-job.finished:
+		tst.Fatalf("Expected the run to continue while a request waits for it")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	cancelSecond()
+	assertEquals(tst, context.Canceled, <-errs)
+	select {
+	case <-job.finished:
+	case <-time.After(10 * time.Second):
+		tst.Fatalf("Expected the abandoned run to be killed")
+	}
+	if job.err == nil {
+		tst.Fatalf("Expected the abandoned run to fail")
+	}
+
+	// Nothing of the cancelled run is kept.
+	assertEquals(tst, "", GetWtDiagPath(state, dbpath))
+	if leftover, _ := filepath.Glob(state.DownloadDir + "wtDiag_*"); len(leftover) != 0 {
+		tst.Fatalf("Expected the diagnostics directory to be removed. Found: %v", leftover)
+	}
+	artifacts.Lock()
+	assertEquals(tst, 0, state.pins)
+	artifacts.Unlock()
+}
+
+func TestEvictLeastRecentlyUsed(tst *testing.T) {
+	if err := os.RemoveAll("./testfiles/"); err != nil {
+		panic(err)
+	}
+
+	source := &fakeSource{archives: map[string]map[string]string{
+		"mongo-data-job0.tgz": {"data/db/job0/resmoke/node0/WiredTiger": strings.Repeat("x", 1000)},
+	}}
+	artifacts, err := LoadArtifacts("./testfiles/", source)
+	if err != nil {
+		panic(err)
+	}
+
+	states := make([]*TaskState, 4)
+	for execution := range states {
+		if states[execution], err = artifacts.EnsureEvgArtifacts(machinery.TaskRef{ID: "fakeTask", Execution: execution}); err != nil {
+			panic(err)
+		}
+	}
+	// Let the evictions that follow each download finish before changing the policy.
+	artifacts.pendingEvictions.Wait()
+
+	// Execution 0 is the least recently used but is in use. Execution 3 was just accessed.
+	now := time.Now()
+	states[0].LastAccess = now.Add(-4 * time.Hour)
+	states[1].LastAccess = now.Add(-3 * time.Hour)
+	states[2].LastAccess = now.Add(-2 * time.Hour)
+	states[3].LastAccess = now
+	artifacts.Pin(states[0])
+
+	// Every task is slightly over 1KB. Only two tasks fit.
+	artifacts.cachePolicy = CachePolicy{MaxBytes: 2500}
+	evicted := artifacts.Evict()
+	assertEquals(tst, 2, len(evicted))
+	assertEquals(tst, states[1].Task, evicted[0].Task)
+	assertEquals(tst, states[2].Task, evicted[1].Task)
+	assertEquals(tst, "[0 3]", fmt.Sprint(artifacts.CachedExecutions("fakeTask")))
+	if _, err := os.Stat(states[1].DownloadDir); !os.IsNotExist(err) {
+		tst.Fatalf("Expected the evicted task directory to be removed. Err: %v", err)
+	}
+
+	// Once unpinned, the old task is evicted by age. The recently used task is kept.
+	artifacts.Unpin(states[0])
+	artifacts.cachePolicy = CachePolicy{MaxAge: time.Hour}
+	evicted = artifacts.Evict()
+	assertEquals(tst, 1, len(evicted))
+	assertEquals(tst, states[0].Task, evicted[0].Task)
+	assertEquals(tst, "[3]", fmt.Sprint(artifacts.CachedExecutions("fakeTask")))
+}
+
+func TestImportArchive(tst *testing.T) {
+	if err := os.RemoveAll("./testfiles/"); err != nil {
+		panic(err)
+	}
+
+	artifacts, err := LoadArtifacts("./testfiles/", nil)
+	if err != nil {
+		panic(err)
+	}
+
+	archivePath := "./testfiles/staged"
+	writeDataArchive(archivePath, map[string]string{
+		"db/rs0/node0/WiredTiger":        "WiredTiger\n",
+		"db/rs0/node0/WiredTiger.turtle": "WiredTiger version\nmajor=11,minor=2,patch=0\n",
+		"db/rs0/node1/WiredTiger":        "WiredTiger\n",
+	})
+	state, err := artifacts.ImportArchive("", "customer repro.tar.gz", archivePath)
+	if err != nil {
+		panic(err)
+	}
+	if !IsUploadedTask(state.Task) || !strings.HasPrefix(state.Task.ID, "upload_customer-repro_") {
+		tst.Fatalf("Unexpected task id for an upload. Task: %v", state.Task)
+	}
+	assertEquals(tst, 2, len(state.DBInfo))
+	assertEquals(tst, "dbpath/customer-repro/db/rs0/node0", state.DBInfo[0].DBPath.LogicalPath)
+	assertEquals(tst, "customer-repro.tar.gz", state.DBInfo[0].Archive)
+
+	// The upload is served like a downloaded task, also after a restart.
+	artifacts, err = LoadArtifacts("./testfiles/", nil)
+	if err != nil {
+		panic(err)
+	}
+	cached, exists := artifacts.tasksCache[state.Task]
+	if !exists {
+		tst.Fatalf("Expected the upload to be found through its MANIFEST")
+	}
+	assertEquals(tst, 2, len(cached.DBInfo))
+	assertEquals(tst, state.DBInfo[1].DBPath, cached.DBInfo[1].DBPath)
+	// Without a toolchain registry, dbpaths are opened with the binaries on $PATH.
+	assertEquals(tst, "11.2.0", cached.DBInfo[0].WTVersion)
+	assertEquals(tst, machinery.SystemToolchainName, cached.DBInfo[0].Toolchain)
+	assertEquals(tst, "", cached.DBInfo[1].WTVersion)
+
+	// An archive without a dbpath is rejected and leaves nothing behind.
+	writeDataArchive(archivePath, map[string]string{"logs/mongod.log": "{}\n"})
+	if _, err := artifacts.ImportArchive("logs", "logs.tgz", archivePath); err == nil {
+		tst.Fatalf("Expected an archive without a dbpath to fail")
+	}
+	matches, _ := filepath.Glob("./testfiles/taskid_*")
+	assertEquals(tst, 1, len(matches))
 }
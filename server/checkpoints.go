@@ -0,0 +1,99 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"bfserver/machinery"
+)
+
+// CheckpointsTable is a table's checkpoints along with what MongoDB stores in it.
+type CheckpointsTable struct {
+	machinery.TableCheckpoints
+	Namespace string
+	Index     string
+}
+
+type CheckpointsViewArgs struct {
+	Task   machinery.TaskRef
+	DBPath string
+	Info   *machinery.CheckpointInfo
+	Tables []CheckpointsTable
+	// The checkpoints tables can be browsed as of.
+	Names []string
+	// Set when the task has no copy of the dbpath taken before recovery. The checkpoints are then
+	// the ones recovery wrote, not the ones the node left.
+	Recovered bool
+	Err       string
+}
+
+// readNodeCheckpoints reads the checkpoints the node left: the `wt list -v` of the copy taken
+// before recovery and its `WiredTiger.turtle`, see `saveUnrecoveredCopy`. Without a copy they
+// are read from the dbpath after recovery and `recovered` is true.
+func readNodeCheckpoints(taskState *TaskState, dbpath ArtifactPath, listFile, checkpointListFile string) (info *machinery.CheckpointInfo, recovered bool, err error) {
+	listPath, turtleDir := checkpointListFile, taskState.UnrecoveredPath(dbpath)
+	if _, statErr := os.Stat(listPath); turtleDir == "" || statErr != nil {
+		listPath, turtleDir, recovered = listFile, dbpath.PhysicalPath, true
+	}
+	list, err := os.Open(listPath)
+	if err != nil {
+		return nil, recovered, err
+	}
+	return machinery.ReadCheckpoints(machinery.LoadWTList(list), turtleDir), recovered, nil
+}
+
+// HandleCheckpoints shows the global checkpoint and oldest timestamps of a dbpath and the
+// checkpoints of each of its tables, as the node left them. See `readNodeCheckpoints`.
+func (artifacts *Artifacts) HandleCheckpoints(resp http.ResponseWriter, req *http.Request) {
+	loadTemplates()
+	args, err := GetFormValues(resp, req, "task", "dbpath")
+	if err != nil {
+		fmt.Println("Checkpoints arg parsing error:", err)
+		return
+	}
+
+	taskName, logicalDBPath := args["task"], args["dbpath"]
+	taskState := artifacts.GetTaskState(resp, req, taskName)
+	if taskState == nil {
+		return
+	}
+	defer artifacts.Unpin(taskState)
+
+	dbpath, err := taskState.FindArtifactPath(logicalDBPath)
+	if err != nil {
+		panic(err)
+	}
+
+	wtDiagRes, err := artifacts.EnsureWTDiag(req.Context(), taskState, dbpath)
+	if err != nil {
+		handleWTDiagError(resp, req, err)
+		return
+	}
+
+	viewArgs := &CheckpointsViewArgs{
+		Task:   taskState.Task,
+		DBPath: logicalDBPath,
+	}
+	if viewArgs.Info, viewArgs.Recovered, err = readNodeCheckpoints(taskState, dbpath, wtDiagRes.ListFile, wtDiagRes.CheckpointListFile); err != nil {
+		panic(err)
+	}
+	viewArgs.Names = viewArgs.Info.Names()
+
+	// Tables are still shown by name without the catalog.
+	catalog, err := machinery.LoadCatalogFile(wtDiagRes.CatalogFile)
+	if err != nil {
+		viewArgs.Err = fmt.Sprintf("Failed to read the catalog. Err: %v", err)
+	}
+	for _, table := range viewArgs.Info.Tables {
+		viewTable := CheckpointsTable{TableCheckpoints: table}
+		if catalog != nil {
+			viewTable.Namespace, viewTable.Index = catalog.TableOwner(table.Table)
+		}
+		viewArgs.Tables = append(viewArgs.Tables, viewTable)
+	}
+
+	if err := artifactTemplates.ExecuteTemplate(resp, "checkpoints.html", viewArgs); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"bfserver/machinery"
+)
+
+// The most `wt` runs, diagnostics or otherwise, going at once. The server has 2 CPUs and 3GB of
+// memory.
+const maxConcurrentDiagnostics = 2
+
+// A run taking longer than this is killed, whether or not anyone is still waiting for it.
+const diagnosticsTimeout = 15 * time.Minute
+
+// DiagnosticsJob is one run of `WTDiagnostics`, or of a later addition to the diagnostics such as
+// verifying the tables, for a dbpath. Requests for the same dbpath and kind wait on the same job.
+type DiagnosticsJob struct {
+	DBPath ArtifactPath
+	// e.g: `diagnostics` or `verify`.
+	Kind string
+
+	cancel context.CancelFunc
+	// Guarded by the `Artifacts` mutex. The run is cancelled when the last waiter gives up.
+	waiters int
+	results machinery.WTDiagnosticsResults
+	err     error
+	// Closed when the run is done or failed.
+	finished chan struct{}
+}
+
+// DiagnosticsJobs de-duplicates diagnostics runs per dbpath and caps how many `wt` runs happen at
+// once. It is guarded by the `Artifacts` mutex.
+type DiagnosticsJobs struct {
+	jobs  map[string]*DiagnosticsJob
+	slots chan struct{}
+	// By dbpath. See `runWT`.
+	locks map[string]chan struct{}
+}
+
+func NewDiagnosticsJobs(maxConcurrent int) *DiagnosticsJobs {
+	return &DiagnosticsJobs{
+		jobs:  make(map[string]*DiagnosticsJob),
+		slots: make(chan struct{}, maxConcurrent),
+		locks: make(map[string]chan struct{}),
+	}
+}
+
+// runWT calls `run`, which runs `wt` against the dbpath, holding the dbpath's lock and one of the
+// diagnostics slots. WiredTiger allows one process per home, and `wt -r` runs recovery, which
+// writes a checkpoint and may remove journal files. Different dbpaths run in parallel up to the
+// slots. It gives up when `ctx` is done before `run` starts.
+//
+// The lock is taken before the slot, such that runs waiting on a busy dbpath do not hold a slot
+// others could use. `run` must not wait on diagnostics, they take the same lock.
+//
+// The first run against a dbpath of the task first copies it, see `saveUnrecoveredCopy`.
+func (artifacts *Artifacts) runWT(ctx context.Context, taskState *TaskState, dbpath ArtifactPath, run func() error) error {
+	artifacts.Lock()
+	lock, exists := artifacts.diagnostics.locks[dbpath.PhysicalPath]
+	if !exists {
+		lock = make(chan struct{}, 1)
+		artifacts.diagnostics.locks[dbpath.PhysicalPath] = lock
+	}
+	artifacts.Unlock()
+
+	select {
+	case lock <- struct{}{}:
+		defer func() { <-lock }()
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), fmt.Sprintf("Cancelled while waiting for the dbpath. DBPath: %v", dbpath.LogicalPath))
+	}
+	select {
+	case artifacts.diagnostics.slots <- struct{}{}:
+		defer func() { <-artifacts.diagnostics.slots }()
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "Cancelled while waiting to run `wt`")
+	}
+
+	if err := saveUnrecoveredCopy(ctx, taskState, dbpath); err != nil {
+		return err
+	}
+	return run()
+}
+
+func (job *DiagnosticsJob) key() string {
+	return job.Kind + ":" + job.DBPath.PhysicalPath
+}
+
+// startDiagnostics returns the job making the dbpath's diagnostics, starting one if none is in
+// flight. The caller is counted as a waiter and must call `waitDiagnostics`. Must be called with
+// the `Artifacts` mutex held.
+func (artifacts *Artifacts) startDiagnostics(taskState *TaskState, dbpath ArtifactPath) *DiagnosticsJob {
+	return artifacts.startDiagnosticsJob(taskState, dbpath, "diagnostics", func(ctx context.Context) (machinery.WTDiagnosticsResults, error) {
+		return artifacts.runWTDiag(ctx, taskState, dbpath)
+	})
+}
+
+// startDiagnosticsJob is like `startDiagnostics` for any `run` against the dbpath. `run` holds the
+// dbpath's lock, see `runWT`.
+func (artifacts *Artifacts) startDiagnosticsJob(taskState *TaskState, dbpath ArtifactPath, kind string, run func(ctx context.Context) (machinery.WTDiagnosticsResults, error)) *DiagnosticsJob {
+	job, exists := artifacts.diagnostics.jobs[(&DiagnosticsJob{DBPath: dbpath, Kind: kind}).key()]
+	if !exists {
+		ctx, cancel := context.WithTimeout(context.Background(), diagnosticsTimeout)
+		job = &DiagnosticsJob{
+			DBPath:   dbpath,
+			Kind:     kind,
+			cancel:   cancel,
+			finished: make(chan struct{}),
+		}
+		artifacts.diagnostics.jobs[job.key()] = job
+		// The task must outlive the requests that asked for it.
+		taskState.pins++
+		go artifacts.runDiagnostics(ctx, job, taskState, run)
+	}
+	job.waiters++
+
+	return job
+}
+
+// waitDiagnostics waits for the job or for `ctx` to be done. When every waiter has given up the
+// job is cancelled, which kills its subprocesses.
+func (artifacts *Artifacts) waitDiagnostics(ctx context.Context, job *DiagnosticsJob) (machinery.WTDiagnosticsResults, error) {
+	select {
+	case <-job.finished:
+		artifacts.Lock()
+		job.waiters--
+		artifacts.Unlock()
+		return job.results, job.err
+	case <-ctx.Done():
+	}
+
+	artifacts.Lock()
+	defer artifacts.Unlock()
+	job.waiters--
+	if job.waiters == 0 {
+		job.cancel()
+		// Later requests start over rather than wait on a job that is going away.
+		if artifacts.diagnostics.jobs[job.key()] == job {
+			delete(artifacts.diagnostics.jobs, job.key())
+		}
+	}
+	return machinery.WTDiagnosticsResults{}, ctx.Err()
+}
+
+func (artifacts *Artifacts) runDiagnostics(ctx context.Context, job *DiagnosticsJob, taskState *TaskState, run func(ctx context.Context) (machinery.WTDiagnosticsResults, error)) {
+	defer artifacts.Unpin(taskState)
+	defer job.cancel()
+
+	var results machinery.WTDiagnosticsResults
+	err := artifacts.runWT(ctx, taskState, job.DBPath, func() (err error) {
+		results, err = run(ctx)
+		return err
+	})
+
+	artifacts.Lock()
+	defer artifacts.Unlock()
+
+	job.results, job.err = results, err
+	if err != nil {
+		fmt.Printf("Diagnostics failed. DBPath: %v Kind: %v Err: %v\n", job.DBPath.LogicalPath, job.Kind, err)
+	}
+	if artifacts.diagnostics.jobs[job.key()] == job {
+		delete(artifacts.diagnostics.jobs, job.key())
+	}
+	close(job.finished)
+}
+
+// runWTDiag writes the dbpath's diagnostics into a new directory of the task and records it in
+// the MANIFEST. A failed run leaves nothing behind.
+func (artifacts *Artifacts) runWTDiag(ctx context.Context, taskState *TaskState, dbpath ArtifactPath) (ret machinery.WTDiagnosticsResults, err error) {
+	systemWtDiagPath, err := os.MkdirTemp(taskState.DownloadDir, "wtDiag_")
+	if err != nil {
+		return ret, errors.Wrap(err, "Failed to create a WT diagnostics directory")
+	}
+	if !strings.HasSuffix(systemWtDiagPath, "/") {
+		systemWtDiagPath = systemWtDiagPath + "/"
+	}
+	defer func() {
+		// The machinery panics on malformed `wt` output. This is not an http handler, a panic
+		// would take down the server.
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("Diagnostics panicked. Err: %v", recovered)
+		}
+		if err != nil {
+			os.RemoveAll(systemWtDiagPath)
+		}
+	}()
+
+	wtDiagCmd := machinery.NewWTDiagnostics(dbpath.PhysicalPath, systemWtDiagPath)
+	wtDiagCmd.UnrecoveredDBPath = taskState.UnrecoveredPath(dbpath)
+	if dbinfo := taskState.FindDBInfo(dbpath.LogicalPath); dbinfo != nil {
+		wtDiagCmd.Toolchain = artifacts.Toolchain(*dbinfo)
+	}
+	if ret, err = wtDiagCmd.Run(ctx); err != nil {
+		return ret, err
+	}
+
+	// Also modifies TaskState to reflect `wtDiagDir`.
+	artifacts.Lock()
+	defer artifacts.Unlock()
+	err = AddWtDiagToManifestFile(taskState, dbpath, taskState.GetArtifactPathFromSystemPath(systemWtDiagPath))
+	return ret, err
+}
+
+// handleWTDiagError reports diagnostics that could not be made. Nothing is written when the client
+// has gone away.
+func handleWTDiagError(resp http.ResponseWriter, req *http.Request, err error) {
+	if req.Context().Err() != nil {
+		return
+	}
+	http.Error(resp, fmt.Sprintf("Failed to make WiredTiger diagnostics. Err: %v", err), http.StatusInternalServerError)
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+
+	"bfserver/machinery"
+)
+
+// Downloads are mostly bound by network and disk, but extraction is CPU heavy and the server only
+// has 2 CPUs.
+const maxConcurrentDownloads = 2
+
+type DownloadState string
+
+const (
+	DownloadQueued      DownloadState = "queued"
+	DownloadDownloading DownloadState = "downloading"
+	DownloadExtracting  DownloadState = "extracting"
+	DownloadDone        DownloadState = "done"
+	DownloadFailed      DownloadState = "failed"
+)
+
+// DownloadJob tracks one in-flight download of a task. It implements `machinery.FetchProgress`.
+type DownloadJob struct {
+	Task machinery.TaskRef
+
+	mutex      sync.Mutex
+	state      DownloadState
+	bytesDone  int64
+	bytesTotal int64
+	taskState  *TaskState
+	err        error
+	// Closed when the job is done or failed.
+	finished chan struct{}
+}
+
+func (job *DownloadJob) Update(phase machinery.FetchPhase, done, total int64) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	switch phase {
+	case machinery.FetchDownloading:
+		job.state = DownloadDownloading
+	case machinery.FetchExtracting:
+		job.state = DownloadExtracting
+	}
+	job.bytesDone, job.bytesTotal = done, total
+}
+
+func (job *DownloadJob) setState(state DownloadState) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	job.state = state
+	job.bytesDone, job.bytesTotal = 0, 0
+}
+
+// Wait blocks until the job finishes.
+func (job *DownloadJob) Wait() (*TaskState, error) {
+	<-job.finished
+	return job.taskState, job.err
+}
+
+type DownloadStatus struct {
+	Task       machinery.TaskRef
+	State      DownloadState
+	BytesDone  int64
+	BytesTotal int64
+	// -1 when the total size is not known.
+	Percent int
+	Err     string
+}
+
+func (status DownloadStatus) Finished() bool {
+	return status.State == DownloadDone || status.State == DownloadFailed
+}
+
+func (status DownloadStatus) DoneSize() string {
+	return formatBytes(status.BytesDone)
+}
+
+func (status DownloadStatus) TotalSize() string {
+	return formatBytes(status.BytesTotal)
+}
+
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	div, exp := int64(unit), 0
+	for remaining := bytes / unit; remaining >= unit; remaining /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+func (job *DownloadJob) Status() DownloadStatus {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	ret := DownloadStatus{
+		Task:       job.Task,
+		State:      job.state,
+		BytesDone:  job.bytesDone,
+		BytesTotal: job.bytesTotal,
+		Percent:    -1,
+	}
+	if job.bytesTotal > 0 {
+		ret.Percent = int(job.bytesDone * 100 / job.bytesTotal)
+	}
+	if job.err != nil {
+		ret.Err = job.err.Error()
+	}
+
+	return ret
+}
+
+// DownloadJobs de-duplicates downloads per task and caps how many run at once. It is guarded by
+// the `Artifacts` mutex.
+type DownloadJobs struct {
+	jobs  map[machinery.TaskRef]*DownloadJob
+	slots chan struct{}
+}
+
+func NewDownloadJobs(maxConcurrent int) *DownloadJobs {
+	return &DownloadJobs{
+		jobs:  make(map[machinery.TaskRef]*DownloadJob),
+		slots: make(chan struct{}, maxConcurrent),
+	}
+}
+
+// StartDownload returns the task if it is already cached. Otherwise it returns the job
+// downloading the task, starting one if none is in flight.
+//
+// A failed job is handed out once and then forgotten, so asking for the task again retries the
+// download.
+func (artifacts *Artifacts) StartDownload(task machinery.TaskRef) (*TaskState, *DownloadJob) {
+	artifacts.Lock()
+	defer artifacts.Unlock()
+
+	if taskState, exists := artifacts.tasksCache[task]; exists {
+		artifacts.touch(taskState)
+		return taskState, nil
+	}
+
+	if job, exists := artifacts.downloads.jobs[task]; exists {
+		if job.Status().State == DownloadFailed {
+			delete(artifacts.downloads.jobs, task)
+		}
+		return nil, job
+	}
+
+	job := &DownloadJob{
+		Task:     task,
+		state:    DownloadQueued,
+		finished: make(chan struct{}),
+	}
+	artifacts.downloads.jobs[task] = job
+	go artifacts.runDownload(job)
+
+	return nil, job
+}
+
+func (artifacts *Artifacts) runDownload(job *DownloadJob) {
+	artifacts.downloads.slots <- struct{}{}
+	defer func() { <-artifacts.downloads.slots }()
+	job.setState(DownloadDownloading)
+
+	taskState, err := artifacts.DownloadTask(job.Task, job)
+
+	artifacts.Lock()
+	defer artifacts.Unlock()
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	job.taskState, job.err = taskState, err
+	if err != nil {
+		job.state = DownloadFailed
+		fmt.Printf("Download failed. Task: %v Err: %v\n", job.Task, err)
+	} else {
+		job.state = DownloadDone
+		artifacts.tasksCache[job.Task] = taskState
+		delete(artifacts.downloads.jobs, job.Task)
+		// Make room for the new task.
+		artifacts.evictInBackground()
+	}
+	close(job.finished)
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"bfserver/machinery"
+)
+
+// CachePolicy bounds the disk used by downloaded tasks. A zero value disables a limit.
+type CachePolicy struct {
+	// The most bytes the cache directory may use. Least recently used tasks are evicted first.
+	MaxBytes int64
+	// Tasks not accessed for this long are evicted regardless of size.
+	MaxAge time.Duration
+}
+
+// Recently accessed tasks are not evicted for size. Otherwise a task larger than the quota would be
+// deleted as soon as it finished downloading.
+const minResidency = 5 * time.Minute
+
+// The number of evictions remembered for the `/cache` page.
+const maxEvictionHistory = 100
+
+type EvictedTask struct {
+	Task        machinery.TaskRef
+	DownloadDir string
+	Bytes       int64
+	LastAccess  time.Time
+	EvictedAt   time.Time
+	Reason      string
+}
+
+// touch records an access to the task. Must be called with the `Artifacts` mutex held.
+func (artifacts *Artifacts) touch(taskState *TaskState) {
+	taskState.LastAccess = time.Now()
+	// Persist the access time such that a restart does not forget it.
+	os.Chtimes(taskState.DownloadDir+"MANIFEST", taskState.LastAccess, taskState.LastAccess)
+}
+
+// Pin prevents the task from being evicted until a matching `Unpin`.
+func (artifacts *Artifacts) Pin(taskState *TaskState) {
+	artifacts.Lock()
+	defer artifacts.Unlock()
+
+	taskState.pins++
+}
+
+func (artifacts *Artifacts) Unpin(taskState *TaskState) {
+	artifacts.Lock()
+	defer artifacts.Unlock()
+
+	taskState.pins--
+}
+
+// EnforceCachePolicy applies the policy now and then every `interval`.
+func (artifacts *Artifacts) EnforceCachePolicy(policy CachePolicy, interval time.Duration) {
+	artifacts.Lock()
+	artifacts.cachePolicy = policy
+	artifacts.Unlock()
+
+	artifacts.Evict()
+	go func() {
+		for range time.Tick(interval) {
+			artifacts.Evict()
+		}
+	}()
+}
+
+// evictInBackground runs `Evict` without waiting for it. Used after a task is added to the cache.
+func (artifacts *Artifacts) evictInBackground() {
+	artifacts.pendingEvictions.Add(1)
+	go func() {
+		defer artifacts.pendingEvictions.Done()
+		artifacts.Evict()
+	}()
+}
+
+// Evict deletes the tasks that violate the cache policy. Tasks being downloaded are not in the
+// cache yet and pinned tasks are skipped, so neither is ever evicted.
+func (artifacts *Artifacts) Evict() []EvictedTask {
+	type candidate struct {
+		taskState  *TaskState
+		lastAccess time.Time
+		bytes      int64
+	}
+
+	artifacts.Lock()
+	policy := artifacts.cachePolicy
+	candidates := make([]candidate, 0, len(artifacts.tasksCache))
+	for _, taskState := range artifacts.tasksCache {
+		candidates = append(candidates, candidate{taskState: taskState, lastAccess: taskState.LastAccess})
+	}
+	artifacts.Unlock()
+
+	if policy.MaxBytes == 0 && policy.MaxAge == 0 {
+		return nil
+	}
+
+	// Walking the filesystem is slow. Do it without holding the mutex. The total includes tasks
+	// that are still downloading.
+	for idx := range candidates {
+		candidates[idx].bytes = machinery.DirSize(candidates[idx].taskState.DownloadDir)
+	}
+	totalBytes := machinery.DirSize(artifacts.absolutePath)
+	sort.Slice(candidates, func(left, right int) bool {
+		return candidates[left].lastAccess.Before(candidates[right].lastAccess)
+	})
+
+	now := time.Now()
+	evicted := make([]EvictedTask, 0)
+	artifacts.Lock()
+	for _, candidate := range candidates {
+		taskState := candidate.taskState
+		// The task may have been accessed or pinned since the snapshot.
+		if artifacts.tasksCache[taskState.Task] != taskState || taskState.pins > 0 {
+			continue
+		}
+
+		idle := now.Sub(taskState.LastAccess)
+		var reason string
+		switch {
+		case policy.MaxAge > 0 && idle > policy.MaxAge:
+			reason = fmt.Sprintf("not accessed for %v", idle.Round(time.Minute))
+		case policy.MaxBytes > 0 && totalBytes > policy.MaxBytes && idle > minResidency:
+			reason = fmt.Sprintf("cache size %v exceeds quota %v", formatBytes(totalBytes), formatBytes(policy.MaxBytes))
+		default:
+			continue
+		}
+
+		delete(artifacts.tasksCache, taskState.Task)
+		totalBytes -= candidate.bytes
+		evicted = append(evicted, EvictedTask{
+			Task:        taskState.Task,
+			DownloadDir: taskState.DownloadDir,
+			Bytes:       candidate.bytes,
+			LastAccess:  taskState.LastAccess,
+			EvictedAt:   now,
+			Reason:      reason,
+		})
+	}
+	artifacts.evictions = append(artifacts.evictions, evicted...)
+	if len(artifacts.evictions) > maxEvictionHistory {
+		artifacts.evictions = artifacts.evictions[len(artifacts.evictions)-maxEvictionHistory:]
+	}
+	artifacts.Unlock()
+
+	for _, task := range evicted {
+		fmt.Printf("Evicted task. Task: %v Dir: %v Size: %v Reason: %v\n",
+			task.Task, task.DownloadDir, formatBytes(task.Bytes), task.Reason)
+		if err := os.RemoveAll(task.DownloadDir); err != nil {
+			fmt.Printf("Failed to remove evicted task. Dir: %v Err: %v\n", task.DownloadDir, err)
+		}
+	}
+
+	return evicted
+}
+
+type CachedTask struct {
+	Task       machinery.TaskRef
+	Bytes      int64
+	LastAccess time.Time
+	Pinned     bool
+}
+
+func (task CachedTask) Size() string {
+	return formatBytes(task.Bytes)
+}
+
+func (task EvictedTask) Size() string {
+	return formatBytes(task.Bytes)
+}
+
+type CacheViewArgs struct {
+	Policy    CachePolicy
+	Tasks     []CachedTask
+	Evictions []EvictedTask
+	Total     string
+}
+
+func (artifacts *Artifacts) HandleCache(resp http.ResponseWriter, req *http.Request) {
+	loadTemplates()
+
+	args := CacheViewArgs{}
+	downloadDirs := make([]string, 0)
+	artifacts.Lock()
+	args.Policy = artifacts.cachePolicy
+	for _, taskState := range artifacts.tasksCache {
+		args.Tasks = append(args.Tasks, CachedTask{
+			Task:       taskState.Task,
+			LastAccess: taskState.LastAccess,
+			Pinned:     taskState.pins > 0,
+		})
+		downloadDirs = append(downloadDirs, taskState.DownloadDir)
+	}
+	// Most recent first.
+	for idx := len(artifacts.evictions) - 1; idx >= 0; idx-- {
+		args.Evictions = append(args.Evictions, artifacts.evictions[idx])
+	}
+	artifacts.Unlock()
+
+	for idx, downloadDir := range downloadDirs {
+		args.Tasks[idx].Bytes = machinery.DirSize(downloadDir)
+	}
+	sort.Slice(args.Tasks, func(left, right int) bool {
+		return args.Tasks[left].LastAccess.After(args.Tasks[right].LastAccess)
+	})
+	args.Total = formatBytes(machinery.DirSize(artifacts.absolutePath))
+
+	if err := artifactTemplates.ExecuteTemplate(resp, "cache.html", args); err != nil {
+		panic(err)
+	}
+}
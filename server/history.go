@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+
+	"bfserver/machinery"
+)
+
+// The most history store versions shown at once.
+const historyPageVersions = 500
+
+// HistoryTable is how many versions of a table's records the history store has.
+type HistoryTable struct {
+	Table     string
+	Namespace string
+	Index     string
+	Versions  int
+}
+
+type HistoryViewArgs struct {
+	Task   machinery.TaskRef
+	DBPath string
+	// Set when no table is selected.
+	Tables []HistoryTable
+	// The selected table and, optionally, a single record of it.
+	Table    string
+	RecordId string
+	Versions []machinery.HSVersion
+	More     bool
+	Err      string
+}
+
+// ensureHistoryStore decodes the history store when the diagnostics did not, either because they
+// predate decoding it or because decoding failed. It runs as a diagnostics job, such that it holds
+// the dbpath's lock and is cancelled once nobody waits for it.
+func (artifacts *Artifacts) ensureHistoryStore(ctx context.Context, taskState *TaskState, dbpath ArtifactPath, wtDiagRes machinery.WTDiagnosticsResults) error {
+	if _, err := os.Stat(wtDiagRes.HistoryStoreFile); err == nil {
+		return nil
+	}
+
+	artifacts.Lock()
+	job := artifacts.startDiagnosticsJob(taskState, dbpath, "history", func(ctx context.Context) (machinery.WTDiagnosticsResults, error) {
+		return wtDiagRes, artifacts.writeHistoryStore(ctx, taskState, dbpath.LogicalPath, wtDiagRes)
+	})
+	artifacts.Unlock()
+	_, err := artifacts.waitDiagnostics(ctx, job)
+	return err
+}
+
+// writeHistoryStore decodes the history store of existing diagnostics.
+func (artifacts *Artifacts) writeHistoryStore(ctx context.Context, taskState *TaskState, logicalDBPath string, wtDiagRes machinery.WTDiagnosticsResults) error {
+	catalog, err := machinery.LoadCatalogFile(wtDiagRes.CatalogFile)
+	if err != nil {
+		return err
+	}
+	listFile, err := os.Open(wtDiagRes.ListFile)
+	if err != nil {
+		return err
+	}
+	defer listFile.Close()
+	return machinery.WriteHistoryStore(ctx, artifacts.WTHome(taskState, logicalDBPath), catalog, machinery.LoadWTList(listFile), wtDiagRes.HistoryStoreFile)
+}
+
+// HandleHistory shows the versions the history store keeps. Without a `table` it counts the
+// versions of each table. With a `table`, and optionally a `recordId`, it lists the versions in
+// key order, i.e: each record's versions from oldest to newest.
+func (artifacts *Artifacts) HandleHistory(resp http.ResponseWriter, req *http.Request) {
+	loadTemplates()
+	args, err := GetFormValues(resp, req, "task", "dbpath")
+	if err != nil {
+		fmt.Println("History arg parsing error:", err)
+		return
+	}
+
+	taskName, logicalDBPath := args["task"], args["dbpath"]
+	taskState := artifacts.GetTaskState(resp, req, taskName)
+	if taskState == nil {
+		return
+	}
+	defer artifacts.Unpin(taskState)
+
+	dbpath, err := taskState.FindArtifactPath(logicalDBPath)
+	if err != nil {
+		panic(err)
+	}
+
+	wtDiagRes, err := artifacts.EnsureWTDiag(req.Context(), taskState, dbpath)
+	if err != nil {
+		handleWTDiagError(resp, req, err)
+		return
+	}
+
+	viewArgs := &HistoryViewArgs{
+		Task:     taskState.Task,
+		DBPath:   logicalDBPath,
+		Table:    req.Form.Get("table"),
+		RecordId: req.Form.Get("recordId"),
+	}
+	if err := artifacts.ensureHistoryStore(req.Context(), taskState, dbpath, wtDiagRes); err != nil {
+		viewArgs.Err = fmt.Sprintf("Failed to decode the history store. Err: %v", err)
+	} else if viewArgs.Table == "" {
+		tables := make(map[string]*HistoryTable)
+		_, _, err = machinery.ReadHistoryStore(wtDiagRes.HistoryStoreFile, func(version *machinery.HSVersion) bool {
+			if _, exists := tables[version.Table]; !exists {
+				tables[version.Table] = &HistoryTable{Table: version.Table, Namespace: version.Namespace, Index: version.Index}
+			}
+			tables[version.Table].Versions++
+			return false
+		}, 0)
+		for _, table := range tables {
+			viewArgs.Tables = append(viewArgs.Tables, *table)
+		}
+		sort.Slice(viewArgs.Tables, func(left, right int) bool {
+			return viewArgs.Tables[left].Versions > viewArgs.Tables[right].Versions
+		})
+	} else {
+		viewArgs.Versions, viewArgs.More, err = machinery.ReadHistoryStore(wtDiagRes.HistoryStoreFile, func(version *machinery.HSVersion) bool {
+			return version.Table == viewArgs.Table && (viewArgs.RecordId == "" || version.RecordId == viewArgs.RecordId)
+		}, historyPageVersions)
+	}
+	if err != nil && viewArgs.Err == "" {
+		viewArgs.Err = err.Error()
+	}
+
+	if req.Context().Err() != nil {
+		return
+	}
+	if err := artifactTemplates.ExecuteTemplate(resp, "history.html", viewArgs); err != nil {
+		panic(err)
+	}
+}
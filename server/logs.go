@@ -0,0 +1,215 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"bfserver/machinery"
+)
+
+// The most log lines shown on one page.
+const logPageLines = 2000
+
+func (taskState *TaskState) LogDir() string {
+	return taskState.DownloadDir + "logs/"
+}
+
+// LogFiles returns the names of the task's log files. Each has an index next to it.
+func (taskState *TaskState) LogFiles() []string {
+	entries, err := os.ReadDir(taskState.LogDir())
+	if err != nil {
+		return nil
+	}
+
+	ret := make([]string, 0)
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && !strings.Contains(entry.Name(), ".index.json") {
+			ret = append(ret, entry.Name())
+		}
+	}
+	sort.Strings(ret)
+
+	return ret
+}
+
+// SetLogSource changes where task logs are fetched from. By default the artifact source is used
+// when it can fetch logs. See `machinery.LogSourceOf`. A nil source disables fetching logs.
+func (artifacts *Artifacts) SetLogSource(logSource machinery.LogSource) {
+	artifacts.logSource = logSource
+}
+
+// FetchLogs downloads the task's logs into its `logs/` directory and indexes them.
+func (artifacts *Artifacts) FetchLogs(task machinery.TaskRef, downloadDir string) error {
+	if artifacts.logSource == nil {
+		return fmt.Errorf("No log source is configured")
+	}
+
+	logDir := downloadDir + "logs/"
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return err
+	}
+
+	logPaths, err := artifacts.logSource.FetchLogs(task, logDir)
+	if err != nil {
+		return err
+	}
+	for _, logPath := range logPaths {
+		index, err := machinery.IndexLog(logPath)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("Failed to index log. Log: %v", logPath))
+		}
+		if err := machinery.SaveLogIndex(logPath, index); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadOrIndexLog indexes a log that was fetched but never indexed.
+func loadOrIndexLog(logPath string) (*machinery.LogIndex, error) {
+	index, err := machinery.LoadLogIndex(logPath)
+	if !os.IsNotExist(errors.Cause(err)) {
+		return index, err
+	}
+
+	if index, err = machinery.IndexLog(logPath); err != nil {
+		return nil, err
+	}
+	return index, machinery.SaveLogIndex(logPath, index)
+}
+
+type LogsViewArgs struct {
+	Task  machinery.TaskRef
+	Files []string
+	// The selected file and its index. Empty when no file is selected.
+	File   string
+	Index  *machinery.LogIndex
+	Filter machinery.LogFilter
+	Lines  []machinery.LogLine
+	// The url of the next page of lines, if any.
+	NextUrl string
+	Err     string
+}
+
+// FilterUrl returns the url of the current view with one filter changed, e.g:
+// `{{ $.FilterUrl "test" .Name }}`.
+func (args *LogsViewArgs) FilterUrl(key, value string) string {
+	values := url.Values{}
+	values.Set("task", args.Task.ID)
+	values.Set("execution", strconv.Itoa(args.Task.Execution))
+	values.Set("file", args.File)
+	setIfNotEmpty := func(key, value string) {
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+	setIfNotEmpty("test", args.Filter.Test)
+	setIfNotEmpty("component", args.Filter.Component)
+	setIfNotEmpty("node", args.Filter.Node)
+	if !args.Filter.From.IsZero() {
+		values.Set("from", args.Filter.From.Format(time.RFC3339Nano))
+	}
+	if !args.Filter.To.IsZero() {
+		values.Set("to", args.Filter.To.Format(time.RFC3339Nano))
+	}
+
+	if value == "" {
+		values.Del(key)
+	} else {
+		values.Set(key, value)
+	}
+	return "/logs?" + values.Encode()
+}
+
+// parseLogTime accepts RFC3339 or a UTC time without a zone, e.g: `2023-02-10T19:35:12`.
+func parseLogTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if ret, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return ret, nil
+	}
+	return time.Parse("2006-01-02T15:04:05", value)
+}
+
+// HandleLogs lists the task's logs. With a `file`, it shows the lines of that log matching the
+// `test`, `component`, `node`, `from` and `to` filters. `fetch=1` downloads the logs of a task
+// that was fetched without them.
+func (artifacts *Artifacts) HandleLogs(resp http.ResponseWriter, req *http.Request) {
+	loadTemplates()
+	args, err := GetFormValues(resp, req, "task")
+	if err != nil {
+		fmt.Println("Logs arg parsing error:", err)
+		return
+	}
+
+	taskState := artifacts.GetTaskState(resp, req, args["task"])
+	if taskState == nil {
+		return
+	}
+	defer artifacts.Unpin(taskState)
+
+	viewArgs := &LogsViewArgs{Task: taskState.Task}
+	if req.Form.Get("fetch") != "" && len(taskState.LogFiles()) == 0 && !IsUploadedTask(taskState.Task) {
+		if err := artifacts.FetchLogs(taskState.Task, taskState.DownloadDir); err != nil {
+			viewArgs.Err = err.Error()
+		}
+	}
+	viewArgs.Files = taskState.LogFiles()
+
+	viewArgs.File = req.Form.Get("file")
+	if viewArgs.File == "" && len(viewArgs.Files) == 1 {
+		viewArgs.File = viewArgs.Files[0]
+	}
+	if viewArgs.File != "" {
+		known := false
+		for _, file := range viewArgs.Files {
+			known = known || file == viewArgs.File
+		}
+		if !known {
+			handle404(resp, req)
+			return
+		}
+
+		logPath := taskState.LogDir() + viewArgs.File
+		filter := machinery.LogFilter{
+			Test:      req.Form.Get("test"),
+			Component: req.Form.Get("component"),
+			Node:      req.Form.Get("node"),
+		}
+		if filter.From, err = parseLogTime(req.Form.Get("from")); err == nil {
+			filter.To, err = parseLogTime(req.Form.Get("to"))
+		}
+		if err == nil && req.Form.Get("after") != "" {
+			filter.After, err = strconv.ParseInt(req.Form.Get("after"), 10, 64)
+		}
+		viewArgs.Filter = filter
+		if err != nil {
+			viewArgs.Err = fmt.Sprintf("Invalid filter. Err: %v", err)
+		} else if viewArgs.Index, err = loadOrIndexLog(logPath); err != nil {
+			viewArgs.Err = fmt.Sprintf("Failed to load the log index. Err: %v", err)
+		} else {
+			var next int64
+			viewArgs.Lines, next, err = machinery.ScanLog(logPath, viewArgs.Index, filter, logPageLines)
+			if err != nil {
+				viewArgs.Err = err.Error()
+			}
+			if next != -1 {
+				viewArgs.NextUrl = viewArgs.FilterUrl("after", strconv.FormatInt(next, 10))
+			}
+		}
+	}
+
+	if err := artifactTemplates.ExecuteTemplate(resp, "logs.html", viewArgs); err != nil {
+		panic(err)
+	}
+}
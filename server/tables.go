@@ -0,0 +1,308 @@
+package server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"bfserver/machinery"
+)
+
+// The most records shown on one page of a table.
+const tablePageRecords = 100
+
+// The most differences shown between a checkpoint and the latest data.
+const tableDiffRecords = 1000
+
+// TableRecord is one record of a collection or index, decoded as far as possible.
+type TableRecord struct {
+	// Empty when the key is not a RecordId. The `_id` of clustered collections.
+	RecordId string
+	// Collections. Extended JSON, or empty when the value is not BSON.
+	Document string
+	// Indexes. Empty when the key could not be decoded, see `KeyErr`.
+	Key      string
+	KeyErr   string
+	TypeBits string
+	KeyHex   string
+	ValueHex string
+}
+
+// TableDiff is a record that differs between a checkpoint and the latest data. `Before` is nil
+// for records inserted since the checkpoint and `After` is nil for records removed since.
+type TableDiff struct {
+	Before *TableRecord
+	After  *TableRecord
+}
+
+func (diff TableDiff) Change() string {
+	switch {
+	case diff.Before == nil:
+		return "inserted"
+	case diff.After == nil:
+		return "removed"
+	default:
+		return "updated"
+	}
+}
+
+type TableViewArgs struct {
+	Task   machinery.TaskRef
+	DBPath string
+	// The checkpoint the tables are read as of. Empty for the latest data.
+	Checkpoint  string
+	Checkpoints []string
+	// Every collection of the dbpath. Set when no collection is selected.
+	Collections []*machinery.CollectionInfo
+	Collection  *machinery.CollectionInfo
+	// Set when browsing one of the collection's indexes.
+	Index   *machinery.IndexInfo
+	Ident   string
+	Records []TableRecord
+	Skip    int
+	// The url of the next page of records, if any.
+	NextUrl string
+	// Set when comparing the checkpoint with the latest data.
+	Diff      bool
+	Diffs     []TableDiff
+	DiffsMore bool
+	Err       string
+}
+
+// The `_mdb_catalog` is browsed like a collection. It is not in the catalog itself.
+var mdbCatalogCollection = &machinery.CollectionInfo{
+	Name:            "_mdb_catalog",
+	Ident:           "_mdb_catalog",
+	IndexNameToInfo: map[string]*machinery.IndexInfo{},
+}
+
+// TableUrl links to a collection, or to one of its indexes when `index` is not empty, as of the
+// same checkpoint.
+func (args *TableViewArgs) TableUrl(ns, index string) string {
+	values := url.Values{}
+	values.Set("task", args.Task.ID)
+	values.Set("execution", strconv.Itoa(args.Task.Execution))
+	values.Set("dbpath", args.DBPath)
+	values.Set("ns", ns)
+	if index != "" {
+		values.Set("index", index)
+	}
+	if args.Checkpoint != "" {
+		values.Set("checkpoint", args.Checkpoint)
+	}
+	return "table?" + values.Encode()
+}
+
+// DiffUrl links to the differences between the checkpoint and the latest data of the table being
+// browsed.
+func (args *TableViewArgs) DiffUrl() string {
+	index := ""
+	if args.Index != nil {
+		index = args.Index.Name
+	}
+	return args.TableUrl(args.Collection.Name, index) + "&diff=1"
+}
+
+func collectionRecords(collection *machinery.CollectionInfo, entries []machinery.DumpEntry) []TableRecord {
+	ret := make([]TableRecord, len(entries))
+	for idx, entry := range entries {
+		record := &ret[idx]
+		if recordId, ok := machinery.CollectionRecordId(entry.Key); ok {
+			record.RecordId = strconv.FormatInt(recordId, 10)
+		} else if recordId, err := machinery.DecodeClusteredRecordId(entry.Key); collection.Clustered && err == nil {
+			record.RecordId = recordId
+		} else {
+			record.KeyHex = hex.EncodeToString(entry.Key)
+		}
+		if document, err := machinery.MayMarshal(entry.Value, ""); err == nil {
+			record.Document = string(document)
+		} else {
+			record.ValueHex = hex.EncodeToString(entry.Value)
+		}
+	}
+
+	return ret
+}
+
+// indexRecords splits each index entry into its KeyString, RecordId and TypeBits and decodes the
+// KeyStrings.
+func indexRecords(indexInfo *machinery.IndexInfo, entries []machinery.DumpEntry) []TableRecord {
+	ret := make([]TableRecord, len(entries))
+	for idx, entry := range entries {
+		record := &ret[idx]
+		record.KeyHex, record.ValueHex = hex.EncodeToString(entry.Key), hex.EncodeToString(entry.Value)
+
+		indexKey, err := machinery.DecodeIndexEntry(indexInfo, entry.Key, entry.Value)
+		record.RecordId, record.TypeBits = indexKey.RecordId, hex.EncodeToString(indexKey.TypeBits)
+		if err != nil {
+			record.KeyErr = err.Error()
+		} else {
+			record.Key = indexKey.Describe()
+		}
+	}
+
+	return ret
+}
+
+// tableRecords decodes the entries of the collection or index being browsed.
+func tableRecords(viewArgs *TableViewArgs, entries []machinery.DumpEntry) []TableRecord {
+	if viewArgs.Index == nil {
+		return collectionRecords(viewArgs.Collection, entries)
+	}
+	return indexRecords(viewArgs.Index, entries)
+}
+
+// tableDiffs decodes both sides of the differences.
+func tableDiffs(viewArgs *TableViewArgs, diffs []machinery.DumpDiff) []TableDiff {
+	ret := make([]TableDiff, len(diffs))
+	for idx, diff := range diffs {
+		if diff.Before != nil {
+			ret[idx].Before = &tableRecords(viewArgs, []machinery.DumpEntry{{Key: diff.Key, Value: diff.Before}})[0]
+		}
+		if diff.After != nil {
+			ret[idx].After = &tableRecords(viewArgs, []machinery.DumpEntry{{Key: diff.Key, Value: diff.After}})[0]
+		}
+	}
+	return ret
+}
+
+// HandleTable browses the collections and indexes of a dbpath without starting a `mongod`. Without
+// an `ns` it lists the collections. With an `ns`, and optionally an `index` name, it pages through
+// the table's records with `skip`. A `checkpoint` reads the tables, and the catalog naming them,
+// as of that checkpoint. `diff` compares the checkpoint with the latest data instead, i.e: what
+// recovery replayed from the journal. Checkpoints are read from the copy of the dbpath taken before
+// recovery, see `saveUnrecoveredCopy`. `wt` runs one at a time per dbpath, see `runWT`, and the
+// catalog and config the diagnostics saved are reused.
+func (artifacts *Artifacts) HandleTable(resp http.ResponseWriter, req *http.Request) {
+	loadTemplates()
+	args, err := GetFormValues(resp, req, "task", "dbpath")
+	if err != nil {
+		fmt.Println("Table arg parsing error:", err)
+		return
+	}
+
+	taskName, logicalDBPath := args["task"], args["dbpath"]
+	taskState := artifacts.GetTaskState(resp, req, taskName)
+	if taskState == nil {
+		return
+	}
+	defer artifacts.Unpin(taskState)
+
+	dbpath, err := taskState.FindArtifactPath(logicalDBPath)
+	if err != nil {
+		handle404(resp, req)
+		return
+	}
+
+	viewArgs := &TableViewArgs{
+		Task:        taskState.Task,
+		DBPath:      logicalDBPath,
+		Checkpoint:  req.Form.Get("checkpoint"),
+		Checkpoints: []string{"WiredTigerCheckpoint"},
+		Diff:        req.Form.Get("diff") != "",
+	}
+	if viewArgs.Diff && viewArgs.Checkpoint == "" {
+		viewArgs.Checkpoint = "WiredTigerCheckpoint"
+	}
+	latest := artifacts.WTHome(taskState, logicalDBPath)
+	home := latest
+	// Tasks fetched before copies were taken have no checkpoints to read.
+	unrecoveredPath := taskState.UnrecoveredPath(dbpath)
+	noCheckpoints := viewArgs.Checkpoint != "" && unrecoveredPath == ""
+	if viewArgs.Checkpoint != "" {
+		home = latest.Unrecovered(unrecoveredPath).AtCheckpoint(viewArgs.Checkpoint)
+	}
+	// Named checkpoints are only known once the diagnostics have listed the unrecovered copy.
+	artifacts.Lock()
+	wtDiagPath := GetWtDiagPath(taskState, dbpath)
+	artifacts.Unlock()
+	if wtDiagPath != "" {
+		info, recovered, err := readNodeCheckpoints(taskState, dbpath, wtDiagPath+"list", wtDiagPath+"checkpoint_list")
+		if err == nil && !recovered {
+			viewArgs.Checkpoints = info.Names()
+		}
+	}
+
+	// The catalog as of the latest data is the one the diagnostics saved.
+	var catalog *machinery.Catalog
+	if wtDiagPath != "" && viewArgs.Checkpoint == "" {
+		catalog, err = machinery.LoadCatalogFile(wtDiagPath + "catalog")
+	} else if !noCheckpoints {
+		err = artifacts.runWT(req.Context(), taskState, dbpath, func() (err error) {
+			catalog, err = home.ReadCatalog()
+			return err
+		})
+	}
+	if noCheckpoints {
+		viewArgs.Err = "The checkpoints are not available. The task was fetched before dbpaths were copied ahead of recovery, download it again to browse its checkpoints."
+	} else if err != nil {
+		viewArgs.Err = fmt.Sprintf("Failed to read the catalog. Err: %v", err)
+	} else if ns := req.Form.Get("ns"); ns == "" {
+		viewArgs.Collections = append(viewArgs.Collections, catalog.Collections...)
+		sort.Slice(viewArgs.Collections, func(left, right int) bool {
+			return viewArgs.Collections[left].Name < viewArgs.Collections[right].Name
+		})
+		viewArgs.Collections = append([]*machinery.CollectionInfo{mdbCatalogCollection}, viewArgs.Collections...)
+	} else {
+		if ns == mdbCatalogCollection.Name {
+			viewArgs.Collection = mdbCatalogCollection
+		} else if viewArgs.Collection = catalog.FindCollection(ns); viewArgs.Collection == nil {
+			handle404(resp, req)
+			return
+		}
+		viewArgs.Ident = viewArgs.Collection.Ident
+		if indexName := req.Form.Get("index"); indexName != "" {
+			if viewArgs.Index = viewArgs.Collection.IndexNameToInfo[indexName]; viewArgs.Index == nil {
+				handle404(resp, req)
+				return
+			}
+			viewArgs.Ident = viewArgs.Index.Ident
+		}
+
+		if skip := req.Form.Get("skip"); skip != "" {
+			if viewArgs.Skip, err = strconv.Atoi(skip); err != nil || viewArgs.Skip < 0 {
+				viewArgs.Skip = 0
+			}
+		}
+
+		if viewArgs.Diff {
+			var diffs []machinery.DumpDiff
+			var more bool
+			err := artifacts.runWT(req.Context(), taskState, dbpath, func() (err error) {
+				diffs, more, err = machinery.DiffTable(req.Context(), home, latest, viewArgs.Ident, tableDiffRecords)
+				return err
+			})
+			if err != nil {
+				viewArgs.Err = fmt.Sprintf("Failed to compare the table. Ident: %v Err: %v", viewArgs.Ident, err)
+			} else {
+				viewArgs.Diffs = tableDiffs(viewArgs, diffs)
+			}
+			viewArgs.DiffsMore = more
+		} else {
+			var entries []machinery.DumpEntry
+			var more bool
+			err := artifacts.runWT(req.Context(), taskState, dbpath, func() (err error) {
+				entries, more, err = home.DumpPage(req.Context(), viewArgs.Ident, viewArgs.Skip, tablePageRecords)
+				return err
+			})
+			if err != nil {
+				viewArgs.Err = fmt.Sprintf("Failed to dump the table. Ident: %v Err: %v", viewArgs.Ident, err)
+			} else {
+				viewArgs.Records = tableRecords(viewArgs, entries)
+			}
+			if more {
+				viewArgs.NextUrl = fmt.Sprintf("%s&skip=%d", viewArgs.TableUrl(ns, req.Form.Get("index")), viewArgs.Skip+tablePageRecords)
+			}
+		}
+	}
+
+	if req.Context().Err() != nil {
+		return
+	}
+	if err := artifactTemplates.ExecuteTemplate(resp, "table.html", viewArgs); err != nil {
+		panic(err)
+	}
+}
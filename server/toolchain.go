@@ -0,0 +1,101 @@
+package server
+
+import (
+	"fmt"
+	"os"
+
+	"bfserver/machinery"
+)
+
+// SetToolchains makes `wt`, `mongod` and `ksdecode` come from the registry's toolchains rather
+// than $PATH. Cached dbpaths that were assigned the system toolchain are matched again and their
+// MANIFEST files rewritten. Must be called before serving requests.
+func (artifacts *Artifacts) SetToolchains(registry *machinery.ToolchainRegistry) {
+	artifacts.Lock()
+	defer artifacts.Unlock()
+
+	artifacts.toolchains = registry
+	for _, taskState := range artifacts.tasksCache {
+		resolve := false
+		for _, dbinfo := range taskState.DBInfo {
+			resolve = resolve || dbinfo.Toolchain == "" || dbinfo.Toolchain == machinery.SystemToolchainName
+		}
+		if !resolve {
+			continue
+		}
+
+		artifacts.resolveToolchains(taskState)
+		if err := CreateManifestFile(taskState); err != nil {
+			fmt.Printf("Failed to record toolchains. Task: %v Err: %v\n", taskState.Task, err)
+		}
+	}
+}
+
+// resolveToolchains assigns a toolchain to each dbpath of a task that is not yet visible to other
+// requests. The task's revision is preferred over the WiredTiger version of the dbpath.
+func (artifacts *Artifacts) resolveToolchains(taskState *TaskState) {
+	revision := machinery.TaskRevision(taskState.Task)
+	for idx := range taskState.DBInfo {
+		dbinfo := &taskState.DBInfo[idx]
+		if dbinfo.Toolchain != "" && dbinfo.Toolchain != machinery.SystemToolchainName {
+			continue
+		}
+
+		wtVersion, err := machinery.ReadTurtleVersion(dbinfo.DBPath.PhysicalPath)
+		if err != nil {
+			fmt.Printf("Failed to read the WiredTiger version. DBPath: %v Err: %v\n", dbinfo.DBPath.LogicalPath, err)
+		}
+		dbinfo.WTVersion = wtVersion.String()
+		dbinfo.Toolchain = artifacts.toolchains.Resolve(revision, wtVersion).Name
+	}
+}
+
+// Toolchain returns the toolchain recorded for the dbpath. A toolchain that has since been
+// removed from the registry falls back to $PATH.
+func (artifacts *Artifacts) Toolchain(dbinfo DBInfo) *machinery.Toolchain {
+	toolchain := artifacts.toolchains.Find(dbinfo.Toolchain)
+	if toolchain == nil && dbinfo.Toolchain != "" && dbinfo.Toolchain != machinery.SystemToolchainName {
+		fmt.Printf("Unknown toolchain, using $PATH. DBPath: %v Toolchain: %v\n", dbinfo.DBPath.LogicalPath, dbinfo.Toolchain)
+	}
+
+	return toolchain
+}
+
+// WTHome returns how to run `wt` against one of the task's dbpaths: its toolchain and the
+// WiredTiger config. The config saved with the dbpath's diagnostics is used when there is one.
+// Otherwise it is detected once and kept with the task.
+func (artifacts *Artifacts) WTHome(taskState *TaskState, logicalDBPath string) machinery.WTHome {
+	artifacts.Lock()
+	var toolchain *machinery.Toolchain
+	var wtDiagPath string
+	if dbinfo := taskState.FindDBInfo(logicalDBPath); dbinfo != nil {
+		toolchain = artifacts.Toolchain(*dbinfo)
+		wtDiagPath = GetWtDiagPath(taskState, dbinfo.DBPath)
+	}
+	config, cached := taskState.wtConfigs[logicalDBPath]
+	artifacts.Unlock()
+
+	dbpath := taskState.FullDBPath(logicalDBPath)
+	if cached {
+		return machinery.WTHome{DBPath: dbpath, Toolchain: toolchain, Config: &config}
+	}
+
+	var err error
+	if wtDiagPath == "" {
+		err = os.ErrNotExist
+	} else {
+		config, err = machinery.LoadWTConfig(wtDiagPath + "config")
+	}
+	if err != nil {
+		home := machinery.NewWTHome(dbpath, toolchain)
+		config = *home.Config
+	}
+
+	artifacts.Lock()
+	if taskState.wtConfigs == nil {
+		taskState.wtConfigs = make(map[string]machinery.WTConfig)
+	}
+	taskState.wtConfigs[logicalDBPath] = config
+	artifacts.Unlock()
+	return machinery.WTHome{DBPath: dbpath, Toolchain: toolchain, Config: &config}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"bfserver/machinery"
+)
+
+// The topology of a task is saved next to its MANIFEST. Reading it requires running `wt` against
+// every dbpath, which is too slow to repeat on every page view.
+const topologyFile = "topology.json"
+
+// How long an incomplete topology is shown before reading the dbpaths again.
+const topologyRetryInterval = time.Minute
+
+// How long a view waits for the dbpaths to be free of other `wt` runs.
+const topologyWaitTimeout = 5 * time.Second
+
+// EnsureTopology returns how the task's dbpaths form replica sets and clusters. When a dbpath's
+// collections cannot be read, the topology only reflects the directory layout. It is not saved,
+// and views within `topologyRetryInterval` are shown the same before it is tried again.
+func (artifacts *Artifacts) EnsureTopology(ctx context.Context, taskState *TaskState) *machinery.Topology {
+	// Concurrent views of the same task read the topology once.
+	taskState.topologyMutex.Lock()
+	defer taskState.topologyMutex.Unlock()
+
+	if contents, err := os.ReadFile(taskState.DownloadDir + topologyFile); err == nil {
+		ret := &machinery.Topology{}
+		if err = json.Unmarshal(contents, ret); err == nil {
+			return ret
+		}
+		fmt.Printf("Ignoring a malformed topology file. Dir: %v Err: %v\n", taskState.DownloadDir, err)
+	}
+	if taskState.incompleteTopology != nil && time.Since(taskState.incompleteTopologyAt) < topologyRetryInterval {
+		return taskState.incompleteTopology
+	}
+
+	dbpaths := make([]string, len(taskState.DBInfo))
+	for idx, dbinfo := range taskState.DBInfo {
+		dbpaths[idx] = dbinfo.DBPath.LogicalPath
+	}
+
+	// Dbpaths busy with diagnostics are not waited on for long.
+	ctx, cancel := context.WithTimeout(ctx, topologyWaitTimeout)
+	defer cancel()
+	complete := true
+	ret := machinery.BuildTopology(dbpaths, func(logicalDBPath string) (metadata machinery.NodeMetadata, err error) {
+		dbpath, err := taskState.FindArtifactPath(logicalDBPath)
+		if err == nil {
+			err = artifacts.runWT(ctx, taskState, dbpath, func() (err error) {
+				metadata, err = machinery.ReadNodeMetadata(artifacts.WTHome(taskState, logicalDBPath))
+				return err
+			})
+		}
+		if err != nil {
+			fmt.Printf("Failed to read node metadata. DBPath: %v Err: %v\n", logicalDBPath, err)
+			complete = false
+		}
+		return metadata, err
+	})
+
+	if !complete {
+		taskState.incompleteTopology, taskState.incompleteTopologyAt = ret, time.Now()
+		return ret
+	}
+	taskState.incompleteTopology = nil
+
+	contents, err := json.Marshal(ret)
+	if err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(taskState.DownloadDir+topologyFile, contents, 0644); err != nil {
+		fmt.Printf("Failed to save the topology. Dir: %v Err: %v\n", taskState.DownloadDir, err)
+	}
+
+	return ret
+}
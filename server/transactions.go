@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"bfserver/machinery"
+)
+
+// The most transactions shown on one page.
+const transactionPageSize = 500
+
+type TransactionsViewArgs struct {
+	Task   machinery.TaskRef
+	DBPath string
+	// Set when no transaction is selected.
+	Transactions []*machinery.Transaction
+	Skip         int
+	// The url of the next page of transactions, if any.
+	NextUrl string
+	// The selected transaction and its records, annotated like the printlog.
+	Transaction *machinery.Transaction
+	Printlog    string
+	Err         string
+}
+
+// ensureTransactions returns the transactions of the journal. Diagnostics made before they were
+// saved read them in a diagnostics job, once.
+func (artifacts *Artifacts) ensureTransactions(ctx context.Context, taskState *TaskState, dbpath ArtifactPath, wtDiagRes machinery.WTDiagnosticsResults) ([]*machinery.Transaction, error) {
+	if txns, err := machinery.LoadTransactions(wtDiagRes.TransactionsFile); err == nil {
+		return txns, nil
+	}
+
+	artifacts.Lock()
+	job := artifacts.startDiagnosticsJob(taskState, dbpath, "transactions", func(ctx context.Context) (machinery.WTDiagnosticsResults, error) {
+		return wtDiagRes, writeTransactions(ctx, wtDiagRes)
+	})
+	artifacts.Unlock()
+	if _, err := artifacts.waitDiagnostics(ctx, job); err != nil {
+		return nil, err
+	}
+	return machinery.LoadTransactions(wtDiagRes.TransactionsFile)
+}
+
+// writeTransactions saves the transactions of existing diagnostics.
+func writeTransactions(ctx context.Context, wtDiagRes machinery.WTDiagnosticsResults) error {
+	catalog, err := machinery.LoadCatalogFile(wtDiagRes.CatalogFile)
+	if err != nil {
+		return err
+	}
+	listFile, err := os.Open(wtDiagRes.ListFile)
+	if err != nil {
+		return err
+	}
+	printlogFile, err := os.Open(wtDiagRes.PrintlogFile)
+	if err != nil {
+		return err
+	}
+	defer printlogFile.Close()
+
+	// Naming the tables does not need the documents, nor their checkpoint.
+	txns, err := machinery.ReadTransactions(ctx, printlogFile, catalog, machinery.LoadWTList(listFile), nil)
+	if err != nil {
+		return err
+	}
+	return machinery.SaveTransactions(txns, wtDiagRes.TransactionsFile)
+}
+
+// writeTransactionRecords writes the records of one transaction, annotated like the printlog.
+// Documents changed by row_modify ops are rebuilt from the checkpoint of `unrecovered`, see
+// `saveUnrecoveredCopy`.
+func writeTransactionRecords(ctx context.Context, output io.Writer, txnId uint64, unrecovered machinery.WTHome, wtDiagRes machinery.WTDiagnosticsResults) error {
+	catalog, err := machinery.LoadCatalogFile(wtDiagRes.CatalogFile)
+	if err != nil {
+		return err
+	}
+	listFile, err := os.Open(wtDiagRes.ListFile)
+	if err != nil {
+		return err
+	}
+	printlogFile, err := os.Open(wtDiagRes.PrintlogFile)
+	if err != nil {
+		return err
+	}
+	defer printlogFile.Close()
+
+	checkpoints := machinery.LoadUnrecoveredCheckpoints(unrecovered, wtDiagRes.CheckpointListFile)
+	return machinery.WriteTransaction(ctx, printlogFile, output, txnId, catalog, machinery.LoadWTList(listFile), checkpoints)
+}
+
+// HandleTransactions groups the journal records of a dbpath by txnid. Without a `txnid` it pages
+// through the transactions with `skip`, listing the LSNs, timestamps and tables of each. With a
+// `txnid` it also shows the transaction's records. `format=json` returns the same as JSON. The
+// transactions are the ones the diagnostics saved, see `ensureTransactions`.
+func (artifacts *Artifacts) HandleTransactions(resp http.ResponseWriter, req *http.Request) {
+	loadTemplates()
+	args, err := GetFormValues(resp, req, "task", "dbpath")
+	if err != nil {
+		fmt.Println("Transactions arg parsing error:", err)
+		return
+	}
+
+	taskName, logicalDBPath := args["task"], args["dbpath"]
+	taskState := artifacts.GetTaskState(resp, req, taskName)
+	if taskState == nil {
+		return
+	}
+	defer artifacts.Unpin(taskState)
+
+	dbpath, err := taskState.FindArtifactPath(logicalDBPath)
+	if err != nil {
+		panic(err)
+	}
+
+	wtDiagRes, err := artifacts.EnsureWTDiag(req.Context(), taskState, dbpath)
+	if err != nil {
+		handleWTDiagError(resp, req, err)
+		return
+	}
+
+	viewArgs := &TransactionsViewArgs{
+		Task:   taskState.Task,
+		DBPath: logicalDBPath,
+	}
+	if skip := req.Form.Get("skip"); skip != "" {
+		if viewArgs.Skip, err = strconv.Atoi(skip); err != nil || viewArgs.Skip < 0 {
+			viewArgs.Skip = 0
+		}
+	}
+	txnId, txnIdErr := strconv.ParseUint(req.Form.Get("txnid"), 10, 64)
+	if req.Form.Get("txnid") != "" && txnIdErr != nil {
+		handle404(resp, req)
+		return
+	}
+
+	txns, err := artifacts.ensureTransactions(req.Context(), taskState, dbpath, wtDiagRes)
+	switch {
+	case err != nil:
+		viewArgs.Err = fmt.Sprintf("Failed to read the journal. Err: %v", err)
+	case txnIdErr != nil:
+		if viewArgs.Skip < len(txns) {
+			viewArgs.Transactions = txns[viewArgs.Skip:]
+		}
+		if len(viewArgs.Transactions) > transactionPageSize {
+			viewArgs.Transactions = viewArgs.Transactions[:transactionPageSize]
+			values := url.Values{}
+			values.Set("task", viewArgs.Task.ID)
+			values.Set("execution", strconv.Itoa(viewArgs.Task.Execution))
+			values.Set("dbpath", viewArgs.DBPath)
+			values.Set("skip", strconv.Itoa(viewArgs.Skip+transactionPageSize))
+			viewArgs.NextUrl = "transactions?" + values.Encode()
+		}
+	default:
+		for _, txn := range txns {
+			if txn.TxnID == txnId {
+				viewArgs.Transaction = txn
+				break
+			}
+		}
+		if viewArgs.Transaction == nil {
+			break
+		}
+		// Rebuilding documents dumps tables of the unrecovered copy, which takes the dbpath's lock.
+		unrecovered := artifacts.WTHome(taskState, logicalDBPath).Unrecovered(taskState.UnrecoveredPath(dbpath))
+		printlog := &bytes.Buffer{}
+		err := artifacts.runWT(req.Context(), taskState, dbpath, func() error {
+			return writeTransactionRecords(req.Context(), printlog, txnId, unrecovered, wtDiagRes)
+		})
+		viewArgs.Printlog = printlog.String()
+		if err != nil {
+			viewArgs.Err = fmt.Sprintf("Failed to read the journal. Err: %v", err)
+		}
+	}
+	if txnIdErr == nil && viewArgs.Transaction == nil && viewArgs.Err == "" {
+		handle404(resp, req)
+		return
+	}
+
+	if req.Context().Err() != nil {
+		return
+	}
+	if req.Form.Get("format") == "json" {
+		resp.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(resp).Encode(viewArgs); err != nil {
+			fmt.Println("Failed to write transactions. Err:", err)
+		}
+		return
+	}
+	if err := artifactTemplates.ExecuteTemplate(resp, "transactions.html", viewArgs); err != nil {
+		panic(err)
+	}
+}
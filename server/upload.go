@@ -0,0 +1,185 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"bfserver/machinery"
+)
+
+// Uploaded archives are not evergreen tasks. Their task ids are made up and start with this
+// prefix such that they are never looked up in evergreen.
+const uploadTaskPrefix = "upload_"
+
+func IsUploadedTask(task machinery.TaskRef) bool {
+	return strings.HasPrefix(task.ID, uploadTaskPrefix)
+}
+
+var unsafeTaskIdCharsRe *regexp.Regexp = regexp.MustCompile("[^A-Za-z0-9._-]+")
+
+// uploadLabel names an upload after `name`, or the archive file name when `name` is empty, e.g:
+// `repro.tar.gz` -> `repro`. MANIFEST files and urls need the result to be free of spaces.
+func uploadLabel(name, filename string) string {
+	if name == "" {
+		name, _, _ = strings.Cut(filepath.Base(filename), ".")
+	}
+
+	return strings.Trim(unsafeTaskIdCharsRe.ReplaceAllString(name, "-"), "-")
+}
+
+// ImportArchive adds a task for a data archive that did not come from evergreen. The archive at
+// `archivePath` is moved into a new `taskid_*` directory and extracted like a downloaded data
+// archive. `filename` is the name the archive was uploaded as.
+func (artifacts *Artifacts) ImportArchive(name, filename, archivePath string) (_ *TaskState, err error) {
+	downloadDir, err := os.MkdirTemp(artifacts.absolutePath, "taskid_")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create directory for task artifacts")
+	}
+	if !strings.HasSuffix(downloadDir, "/") {
+		downloadDir = downloadDir + "/"
+	}
+
+	// The extraction machinery panics on errors.
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			os.RemoveAll(downloadDir)
+			err = fmt.Errorf("Failed to import archive. Archive: %v Err: %v", filename, recovered)
+		}
+	}()
+
+	// The directory suffix makes the task id unique.
+	task := machinery.TaskRef{ID: strings.TrimPrefix(filepath.Base(downloadDir), "taskid_")}
+	if label := uploadLabel(name, filename); label != "" {
+		task.ID = label + "_" + task.ID
+	}
+	task.ID = uploadTaskPrefix + task.ID
+
+	// Keep the extension, the archive's subdirectory is named after it. The name ends up in the
+	// MANIFEST and must not contain spaces.
+	archiveName := unsafeTaskIdCharsRe.ReplaceAllString(filepath.Base(filename), "-")
+	if strings.Trim(archiveName, ".-") == "" {
+		archiveName = "upload"
+	}
+	if err := os.Rename(archivePath, downloadDir+archiveName); err != nil {
+		panic(err)
+	}
+
+	dbpaths, skipped := machinery.ExtractDataArchives([]string{downloadDir + archiveName}, downloadDir, nil)
+	if len(dbpaths) == 0 {
+		panic("No dbpath found. A dbpath is a directory containing a `WiredTiger` file.")
+	}
+	taskState := NewTaskState(task, downloadDir, dbpaths, skipped)
+	artifacts.resolveToolchains(taskState)
+	markUnrecovered(taskState)
+	if err := writeSkippedFile(taskState); err != nil {
+		panic(err)
+	}
+	if err := CreateManifestFile(taskState); err != nil {
+		panic(err)
+	}
+
+	artifacts.Lock()
+	artifacts.tasksCache[task] = taskState
+	artifacts.Unlock()
+	artifacts.evictInBackground()
+
+	return taskState, nil
+}
+
+// HandleUpload accepts a multipart form with an `archive` file and an optional `name`. On success
+// the response redirects to the task view of the new task. API clients can read the task from the
+// `Location` header, e.g:
+//
+//	curl -i -F name=repro -F archive=@dbpath.tgz http://host:8080/upload
+func (artifacts *Artifacts) HandleUpload(resp http.ResponseWriter, req *http.Request) {
+	loadTemplates()
+	if req.Method != http.MethodPost {
+		if err := artifactTemplates.ExecuteTemplate(resp, "task_upload.html", nil); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if maxSize := machinery.DefaultExtractor.MaxTotalSize; maxSize > 0 {
+		req.Body = http.MaxBytesReader(resp, req.Body, maxSize)
+	}
+	// Stream the archive to disk rather than let `ParseMultipartForm` buffer it.
+	reader, err := req.MultipartReader()
+	if err != nil {
+		http.Error(resp, fmt.Sprintf("Expected a multipart form. Err: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var name, filename, archivePath string
+	defer func() {
+		if archivePath != "" {
+			os.Remove(archivePath)
+		}
+	}()
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			http.Error(resp, fmt.Sprintf("Failed to read the upload. Err: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		switch part.FormName() {
+		case "name":
+			value, _ := io.ReadAll(io.LimitReader(part, 256))
+			name = strings.TrimSpace(string(value))
+		case "archive":
+			if archivePath != "" {
+				http.Error(resp, "Only one archive may be uploaded at a time", http.StatusBadRequest)
+				return
+			}
+			filename = part.FileName()
+			// Stage the upload in the cache directory such that importing it is a rename.
+			if archivePath, err = saveUpload(artifacts.absolutePath, part); err != nil {
+				http.Error(resp, fmt.Sprintf("Failed to receive the archive. Err: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if archivePath == "" {
+		http.Error(resp, "Missing the `archive` file", http.StatusBadRequest)
+		return
+	}
+
+	taskState, err := artifacts.ImportArchive(name, filename, archivePath)
+	if err != nil {
+		fmt.Println("Upload error:", err)
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fmt.Printf("Imported archive. Task: %v Dir: %v\n", taskState.Task, taskState.DownloadDir)
+	resp.Header().Add("Location", TaskViewUrl(taskState.Task))
+	resp.WriteHeader(http.StatusSeeOther)
+}
+
+func saveUpload(dir string, contents io.Reader) (string, error) {
+	file, err := os.CreateTemp(dir, "upload_*")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(file, contents)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	return file.Name(), nil
+}